@@ -1,16 +1,36 @@
 package main
 
 import (
+	"context"
+	"log"
+	"os"
+
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 
-	"github.com/UKHomeOffice/snowsync/pkg/out"
+	"github.com/UKHomeOffice/snowsync/pkg/app"
+	"github.com/UKHomeOffice/snowsync/pkg/config"
+	"github.com/UKHomeOffice/snowsync/pkg/tracing"
 )
 
-func handler(req *events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	return out.Handle(req)
-}
-
 func main() {
-	lambda.Start(handler)
+	conf, err := config.Load(config.Out)
+	if err != nil {
+		log.Fatalf("could not start: %v", err)
+	}
+	_, err = app.Setup(context.Background(), conf, "snowsync-out", os.Stdout)
+	if err != nil {
+		log.Fatalf("could not start: %v", err)
+	}
+
+	h, err := app.OutHandler(conf)
+	if err != nil {
+		log.Fatalf("could not start: %v", err)
+	}
+
+	// the function may be frozen as soon as it returns, so spans are exported first
+	lambda.Start(func(ctx context.Context, req *events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		defer tracing.Flush(ctx)
+		return h.Handle(ctx, req)
+	})
 }
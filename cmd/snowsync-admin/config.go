@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/UKHomeOffice/snowsync/pkg/config"
+	"github.com/UKHomeOffice/snowsync/pkg/explain"
+	"github.com/UKHomeOffice/snowsync/pkg/in"
+	"github.com/UKHomeOffice/snowsync/pkg/logging"
+	"github.com/UKHomeOffice/snowsync/pkg/out"
+)
+
+// readConfig reads the configuration from file, or the one CONFIG_FILE names when it is blank, then the environment
+// diagnostics are logged at the level it sets, an invalid level is left for Validate to report
+func readConfig(file string) (*config.Config, error) {
+	if file == "" {
+		file = os.Getenv("CONFIG_FILE")
+	}
+	c, err := config.Read(file)
+	if err != nil {
+		return nil, err
+	}
+	if level, err := c.LogLevel(); err == nil {
+		logging.Setup(os.Stderr, level)
+	}
+	return c, nil
+}
+
+// directions turns a -direction flag into the directions to validate
+func directions(d string) ([]string, error) {
+	switch d {
+	case "both":
+		return []string{config.In, config.Out}, nil
+	case config.In, config.Out:
+		return []string{d}, nil
+	}
+	return nil, fmt.Errorf("unknown direction: %v", d)
+}
+
+func validateConfig(args []string) error {
+
+	fs := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	file := fs.String("config", "", "configuration file, read before the environment as CONFIG_FILE would be")
+	direction := fs.String("direction", "both", "direction to validate: in, out or both")
+	fs.Parse(args)
+
+	dirs, err := directions(*direction)
+	if err != nil {
+		return err
+	}
+	c, err := readConfig(*file)
+	if err != nil {
+		return err
+	}
+
+	err = c.Validate(dirs...)
+	var invalid *config.Error
+	if errors.As(err, &invalid) {
+		for _, p := range invalid.Problems {
+			fmt.Println(p)
+		}
+		return fmt.Errorf("%v problems found", len(invalid.Problems))
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("configuration is valid")
+	return nil
+}
+
+func explainWebhook(args []string) error {
+
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	file := fs.String("config", "", "configuration file, read before the environment as CONFIG_FILE would be")
+	resource := fs.String("resource", "/v2/in", "resource the webhook is sent to: /v2/in, /v2/add, /v2/out or /v2/reverse")
+	body := fs.String("body", "-", "file holding the webhook body, - for stdin")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Parse(args)
+
+	var explainer func(*config.Config, string, string) *explain.Report
+	var direction string
+	switch *resource {
+	case "/v2/in", "/v2/add":
+		explainer, direction = in.Explain, config.In
+	case "/v2/out", "/v2/reverse":
+		explainer, direction = out.Explain, config.Out
+	default:
+		return fmt.Errorf("unexpected resource: %v", *resource)
+	}
+
+	c, err := readConfig(*file)
+	if err != nil {
+		return err
+	}
+	// a configuration problem does not stop the explanation, it may well be what is being debugged
+	err = c.Validate(direction)
+	var invalid *config.Error
+	if errors.As(err, &invalid) {
+		for _, p := range invalid.Problems {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", p)
+		}
+	} else if err != nil {
+		return err
+	}
+	if c.Mappings == nil {
+		return fmt.Errorf("mappings could not be loaded")
+	}
+
+	var b []byte
+	if *body == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(*body)
+	}
+	if err != nil {
+		return fmt.Errorf("could not read webhook body: %w", err)
+	}
+
+	r := explainer(c, *resource, string(b))
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+	return r.Write(os.Stdout)
+}
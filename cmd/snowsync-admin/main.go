@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/UKHomeOffice/snowsync/pkg/logging"
+)
+
+const usage = `usage: snowsync-admin <command> [flags]
+
+commands:
+  replay           re-drive dead-lettered or recorded webhooks
+  validate-config  check the configuration offline and list every problem
+  explain          show how a sample webhook body would be parsed and routed
+
+run snowsync-admin <command> -h for the flags of a command
+`
+
+func main() {
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	// handler diagnostics go to stderr, leaving stdout for the command's own report
+	// the level is raised or lowered by readConfig once LOG_LEVEL is known
+	logging.Setup(os.Stderr, slog.LevelInfo)
+
+	var err error
+	switch os.Args[1] {
+	case "replay":
+		err = replay(os.Args[2:])
+	case "validate-config":
+		err = validateConfig(os.Args[2:])
+	case "explain":
+		err = explainWebhook(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %v\n\n%v", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
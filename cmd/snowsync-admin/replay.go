@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/UKHomeOffice/snowsync/pkg/app"
+	"github.com/UKHomeOffice/snowsync/pkg/config"
+	"github.com/UKHomeOffice/snowsync/pkg/outbox"
+)
+
+// handler is implemented by both the inbound and outbound handlers
+type handler interface {
+	Replay(context.Context, *outbox.Entry) (events.APIGatewayProxyResponse, error)
+	Identify(*events.APIGatewayProxyRequest) (string, error)
+}
+
+// router builds the handler for a resource on first use, so one direction can be replayed without the other's configuration
+type router struct {
+	conf    *config.Config
+	in, out handler
+}
+
+func (r *router) handler(resource string) (handler, error) {
+
+	switch resource {
+	case "/v2/in", "/v2/add":
+		if r.in == nil {
+			err := r.conf.Validate(config.In)
+			if err != nil {
+				return nil, err
+			}
+			h, err := app.InHandler(r.conf)
+			if err != nil {
+				return nil, err
+			}
+			r.in = h
+		}
+		return r.in, nil
+	case "/v2/out", "/v2/reverse":
+		if r.out == nil {
+			err := r.conf.Validate(config.Out)
+			if err != nil {
+				return nil, err
+			}
+			h, err := app.OutHandler(r.conf)
+			if err != nil {
+				return nil, err
+			}
+			r.out = h
+		}
+		return r.out, nil
+	}
+	return nil, fmt.Errorf("unexpected resource: %v", resource)
+}
+
+// event is a line of a replay file, either an outbox entry or an API Gateway request
+type event struct {
+	outbox.Entry
+	RequestContext struct {
+		RequestTimeEpoch int64 `json:"requestTimeEpoch"`
+	} `json:"requestContext"`
+}
+
+func replay(args []string) error {
+
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	source := fs.String("source", "dlq", "where to read events from: dlq or file")
+	file := fs.String("file", "", "JSONL file of raw webhooks, one outbox entry or API Gateway request per line")
+	ticket := fs.String("ticket", "", "only replay events for this ticket identifier")
+	since := fs.String("since", "", "only replay events received at or after this RFC 3339 time")
+	until := fs.String("until", "", "only replay events received before this RFC 3339 time")
+	stale := fs.Duration("stale", 15*time.Minute, "treat pending dead-letter store entries older than this as failed")
+	rate := fs.Float64("rate", 1, "maximum events replayed per second")
+	dryRun := fs.Bool("dry-run", false, "list the events that would be replayed without sending them")
+	fs.Parse(args)
+
+	var from, to time.Time
+	var err error
+	if *since != "" {
+		from, err = time.Parse(time.RFC3339, *since)
+		if err != nil {
+			return fmt.Errorf("invalid -since: %w", err)
+		}
+	}
+	if *until != "" {
+		to, err = time.Parse(time.RFC3339, *until)
+		if err != nil {
+			return fmt.Errorf("invalid -until: %w", err)
+		}
+	}
+	if *rate <= 0 {
+		return fmt.Errorf("-rate must be positive")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	conf, err := readConfig("")
+	if err != nil {
+		return err
+	}
+
+	var entries []*outbox.Entry
+	switch *source {
+	case "dlq":
+		ob, err := outbox.Open(conf.OutboxOptions())
+		if err != nil {
+			return fmt.Errorf("could not open outbox: %w", err)
+		}
+		if ob == nil {
+			return fmt.Errorf("no outbox configured, set OUTBOX_TYPE")
+		}
+		entries, err = ob.DeadLetters(ctx, *stale)
+		if err != nil {
+			return err
+		}
+	case "file":
+		if *file == "" {
+			return fmt.Errorf("-file is required with -source file")
+		}
+		entries, err = readEvents(*file)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown source: %v", *source)
+	}
+
+	r := &router{conf: conf}
+	tick := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	defer tick.Stop()
+
+	var replayed, failed, skipped int
+	for _, e := range entries {
+
+		if !from.IsZero() && e.Received.Before(from) || !to.IsZero() && !e.Received.Before(to) {
+			skipped++
+			continue
+		}
+
+		h, err := r.handler(e.Resource)
+		if err != nil {
+			fmt.Printf("skipping %v: %v\n", describe(e), err)
+			failed++
+			continue
+		}
+
+		// entries read from a file carry no identifier, so work it out the way the handler would
+		if e.Identifier == "" {
+			e.Identifier, err = h.Identify(&events.APIGatewayProxyRequest{Resource: e.Resource, Body: e.Body})
+			if err != nil {
+				fmt.Printf("skipping %v: %v\n", describe(e), err)
+				failed++
+				continue
+			}
+		}
+		if *ticket != "" && e.Identifier != *ticket {
+			skipped++
+			continue
+		}
+
+		if *dryRun {
+			fmt.Printf("would replay %v\n", describe(e))
+			replayed++
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("interrupted after %v replayed, %v failed", replayed, failed)
+		case <-tick.C:
+		}
+
+		res, err := h.Replay(ctx, e)
+		if err != nil || res.StatusCode >= 300 {
+			fmt.Printf("failed %v: %v %v\n", describe(e), res.StatusCode, res.Body)
+			failed++
+			continue
+		}
+		fmt.Printf("replayed %v\n", describe(e))
+		replayed++
+	}
+
+	fmt.Printf("%v replayed, %v failed, %v skipped\n", replayed, failed, skipped)
+	if failed != 0 {
+		return fmt.Errorf("%v events failed", failed)
+	}
+	return nil
+}
+
+// readEvents decodes a JSONL file of webhooks
+func readEvents(path string) ([]*outbox.Entry, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open events file: %w", err)
+	}
+	defer f.Close()
+
+	var entries []*outbox.Entry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var ev event
+		err = json.Unmarshal(sc.Bytes(), &ev)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode line %v: %w", line, err)
+		}
+		if ev.Received.IsZero() && ev.RequestContext.RequestTimeEpoch != 0 {
+			ev.Received = time.Unix(0, ev.RequestContext.RequestTimeEpoch*int64(time.Millisecond)).UTC()
+		}
+		e := ev.Entry
+		entries = append(entries, &e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("could not read events file: %w", err)
+	}
+	return entries, nil
+}
+
+func describe(e *outbox.Entry) string {
+	s := e.Resource
+	if e.Identifier != "" {
+		s += " " + e.Identifier
+	}
+	if e.ID != "" {
+		s += " (" + e.ID + ")"
+	}
+	if !e.Received.IsZero() {
+		s += " received " + e.Received.Format(time.RFC3339)
+	}
+	return s
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/UKHomeOffice/snowsync/pkg/app"
+	"github.com/UKHomeOffice/snowsync/pkg/config"
+	"github.com/UKHomeOffice/snowsync/pkg/logging"
+	"github.com/UKHomeOffice/snowsync/pkg/metrics"
+	"github.com/UKHomeOffice/snowsync/pkg/server"
+)
+
+func main() {
+
+	// both directions run in this process, so the configuration is validated for both
+	conf, err := config.Load(config.In, config.Out)
+	if err != nil {
+		fatal("could not start", err)
+	}
+	stopTracing, err := app.Setup(context.Background(), conf, "snowsync-server", os.Stdout)
+	if err != nil {
+		fatal("could not start", err)
+	}
+
+	addr := conf.Server.ListenAddr
+	grace, err := conf.ShutdownTimeout()
+	if err != nil {
+		fatal("could not start", err)
+	}
+
+	in, err := app.InHandler(conf)
+	if err != nil {
+		fatal("could not start inbound handler", err)
+	}
+	out, err := app.OutHandler(conf)
+	if err != nil {
+		fatal("could not start outbound handler", err)
+	}
+
+	s := server.New(in, out)
+	s.Handle("/metrics", metrics.Handler())
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      60 * time.Second,
+		IdleTimeout:       120 * time.Second,
+	}
+
+	if conf.Server.TLSCert != "" {
+		srv.TLSConfig, err = tlsConfig(conf.Server.TLSCert, conf.Server.TLSKey, conf.Server.TLSClientCA)
+		if err != nil {
+			fatal("invalid TLS configuration", err)
+		}
+	}
+
+	// readiness is only reported once the address is bound, so traffic is not sent to a server that cannot listen
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		fatal("could not listen", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errs <- srv.ServeTLS(ln, "", "")
+			return
+		}
+		errs <- srv.Serve(ln)
+	}()
+	slog.Info("listening", "addr", ln.Addr().String())
+	s.SetReady(true)
+
+	select {
+	case err := <-errs:
+		fatal("server failed", err)
+	case <-ctx.Done():
+	}
+
+	// stop taking new traffic and let requests in flight finish
+	slog.Info("shutting down")
+	s.SetReady(false)
+
+	sctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	err = srv.Shutdown(sctx)
+	if err != nil {
+		fatal("could not shut down cleanly", err)
+	}
+	err = stopTracing(sctx)
+	if err != nil {
+		slog.Warn("could not export remaining spans", logging.Err(err))
+	}
+	if err := <-errs; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal("server failed", err)
+	}
+}
+
+// fatal logs err and exits, failures before app.Setup go to the default logger on stderr
+func fatal(msg string, err error) {
+	slog.Error(msg, logging.Err(err))
+	os.Exit(1)
+}
+
+// tlsConfig serves the certificate in certFile, loaded up front so a bad pair fails before readiness is reported,
+// and requires client certificates signed by the CA in caFile when it is set
+func tlsConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	c := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+	if caFile == "" {
+		return c, nil
+	}
+
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in client CA file")
+	}
+	c.ClientCAs = pool
+	c.ClientAuth = tls.RequireAndVerifyClientCert
+	return c, nil
+}
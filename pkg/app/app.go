@@ -0,0 +1,209 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+
+	"github.com/UKHomeOffice/snowsync/pkg/caller"
+	"github.com/UKHomeOffice/snowsync/pkg/config"
+	"github.com/UKHomeOffice/snowsync/pkg/in"
+	"github.com/UKHomeOffice/snowsync/pkg/logging"
+	"github.com/UKHomeOffice/snowsync/pkg/metrics"
+	"github.com/UKHomeOffice/snowsync/pkg/out"
+	"github.com/UKHomeOffice/snowsync/pkg/outbox"
+	"github.com/UKHomeOffice/snowsync/pkg/secrets"
+	"github.com/UKHomeOffice/snowsync/pkg/store"
+	"github.com/UKHomeOffice/snowsync/pkg/tracing"
+)
+
+// Setup writes logs, metrics and traces to w as conf selects, the returned function flushes and stops tracing
+func Setup(ctx context.Context, conf *config.Config, service string, w io.Writer) (func(context.Context) error, error) {
+
+	level, err := conf.LogLevel()
+	if err != nil {
+		return nil, err
+	}
+	logging.Setup(w, level)
+
+	err = metrics.Setup(w, conf.MetricsFormat(), conf.Observability.MetricsNamespace)
+	if err != nil {
+		return nil, err
+	}
+	return tracing.Setup(ctx, service, conf.Observability.TracesExporter, w)
+}
+
+// InHandler wires the inbound handler from a configuration validated for config.In
+func InHandler(conf *config.Config) (*in.Handler, error) {
+
+	sec, err := conf.OpenSecrets()
+	if err != nil {
+		return nil, fmt.Errorf("could not open secrets backend: %w", err)
+	}
+
+	s, err := openStore(conf.StoreOptions())
+	if err != nil {
+		return nil, fmt.Errorf("could not open mapping store: %w", err)
+	}
+
+	jsd, err := newClient(conf, secrets.JSD, conf.JSDURL, sec)
+	if err != nil {
+		return nil, fmt.Errorf("could not create JSD client: %w", err)
+	}
+
+	ob, err := outbox.Open(conf.OutboxOptions())
+	if err != nil {
+		return nil, fmt.Errorf("could not open outbox: %w", err)
+	}
+
+	// nonces are kept alongside the mapping records, so every instance refuses a replayed webhook
+	v, err := conf.Verifier(secrets.SNOW, s)
+	if err != nil {
+		return nil, fmt.Errorf("could not configure webhook verification: %w", err)
+	}
+	if v == nil {
+		slog.Warn("SNOW webhooks are not authenticated, as WEBHOOK_AUTH is none")
+	}
+
+	p := in.NewProcessor(s, jsd, conf)
+
+	links, err := linkStore(conf)
+	if err != nil {
+		return nil, fmt.Errorf("could not open link store: %w", err)
+	}
+	p.ShareLinks(links)
+
+	// attachments are downloaded from SNOW, so copying them needs its address
+	if conf.In.Attachments != "" {
+		snow, err := newClient(conf, secrets.SNOW, conf.SNOWURL, sec)
+		if err != nil {
+			return nil, fmt.Errorf("could not create SNOW client: %w", err)
+		}
+		err = p.EnableAttachments(snow)
+		if err != nil {
+			return nil, fmt.Errorf("could not read attachment policy: %w", err)
+		}
+	}
+
+	h := in.NewHandler(p)
+	h.Outbox = ob
+	h.Verifier = v
+	return h, nil
+}
+
+// OutHandler wires the outbound handler from a configuration validated for config.Out
+func OutHandler(conf *config.Config) (*out.Handler, error) {
+
+	sec, err := conf.OpenSecrets()
+	if err != nil {
+		return nil, fmt.Errorf("could not open secrets backend: %w", err)
+	}
+
+	s, err := openStore(conf.StoreOptions())
+	if err != nil {
+		return nil, fmt.Errorf("could not open mapping store: %w", err)
+	}
+
+	snow, err := newClient(conf, secrets.SNOW, conf.SNOWURL, sec)
+	if err != nil {
+		return nil, fmt.Errorf("could not create SNOW client: %w", err)
+	}
+
+	ob, err := outbox.Open(conf.OutboxOptions())
+	if err != nil {
+		return nil, fmt.Errorf("could not open outbox: %w", err)
+	}
+
+	// nonces are kept alongside the mapping records, so every instance refuses a replayed webhook
+	v, err := conf.Verifier(secrets.JSD, s)
+	if err != nil {
+		return nil, fmt.Errorf("could not configure webhook verification: %w", err)
+	}
+	if v == nil {
+		slog.Warn("JSD webhooks are not authenticated, as WEBHOOK_AUTH is none")
+	}
+
+	p := out.NewProcessor(s, snow, conf)
+
+	links, err := linkStore(conf)
+	if err != nil {
+		return nil, fmt.Errorf("could not open link store: %w", err)
+	}
+	p.ShareLinks(links)
+
+	// attachments are downloaded from JSD, so copying them needs its address
+	if conf.Out.Attachments != "" {
+		jsd, err := newClient(conf, secrets.JSD, conf.JSDURL, sec)
+		if err != nil {
+			return nil, fmt.Errorf("could not create JSD client: %w", err)
+		}
+		err = p.EnableAttachments(jsd)
+		if err != nil {
+			return nil, fmt.Errorf("could not read attachment policy: %w", err)
+		}
+	}
+
+	h := out.NewHandler(p)
+	h.Outbox = ob
+	h.Verifier = v
+	return h, nil
+}
+
+var (
+	storesMu sync.Mutex
+	stores   = make(map[store.Options]store.MappingStore)
+)
+
+// openStore opens a store once per process, so both directions of the standalone server share an in-memory store
+func openStore(o store.Options) (store.MappingStore, error) {
+
+	storesMu.Lock()
+	defer storesMu.Unlock()
+
+	if s, ok := stores[o]; ok {
+		return s, nil
+	}
+
+	s, err := store.New(o)
+	if err != nil {
+		return nil, err
+	}
+	stores[o] = s
+	return s, nil
+}
+
+// linkStore opens the store of comment links shared by both directions
+func linkStore(conf *config.Config) (store.MappingStore, error) {
+	return openStore(conf.LinkStoreOptions())
+}
+
+// newClient creates the client of a system, authenticated with the credential set of the same name
+// the credentials are loaded up front, so a missing secret fails the cold start rather than the first event
+func newClient(conf *config.Config, name, base string, sec secrets.Provider) (*caller.Client, error) {
+
+	c, err := caller.NewClient(base)
+	if err != nil {
+		return nil, err
+	}
+	c.Name = name
+
+	c.Retry, err = conf.RetryPolicy()
+	if err != nil {
+		return nil, fmt.Errorf("could not read retry policy: %w", err)
+	}
+
+	auth, err := conf.Authenticator(name, sec)
+	if err != nil {
+		return nil, fmt.Errorf("could not configure authentication: %w", err)
+	}
+	if ch, ok := auth.(caller.Checker); ok {
+		err = ch.Check(context.Background())
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.SetAuthenticator(auth)
+	return c, nil
+}
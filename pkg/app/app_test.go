@@ -0,0 +1,104 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/UKHomeOffice/snowsync/pkg/config"
+	"github.com/UKHomeOffice/snowsync/pkg/store"
+)
+
+// newConfig returns a configuration both directions accept, with an in-memory store
+func newConfig(t *testing.T) *config.Config {
+	t.Helper()
+
+	t.Setenv("ADMIN_USER", "admin")
+	t.Setenv("ADMIN_PASS", "secret")
+	c := &config.Config{
+		JSDURL:  "https://jsd.example.com",
+		SNOWURL: "https://snow.example.com",
+		Store:   config.Store{Type: store.TypeMemory},
+		Webhooks: config.Webhooks{
+			JSD:  config.Webhook{Secret: "jsd-secret"},
+			SNOW: config.Webhook{Token: "snow-token"},
+		},
+		In: config.InFields{
+			IntID:       "number",
+			Description: "description",
+			Priority:    "priority",
+			Reporter:    "reporter",
+			Status:      "state",
+			Summary:     "summary",
+		},
+		Out: config.OutFields{
+			IssueID:     "issue.key",
+			Description: "issue.fields.description",
+			Priority:    "issue.fields.priority.name",
+			Status:      "issue.fields.status.name",
+			Summary:     "issue.fields.summary",
+		},
+	}
+	err := c.Validate(config.In, config.Out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestHandlers(t *testing.T) {
+
+	conf := newConfig(t)
+
+	in, err := InHandler(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Verifier == nil {
+		t.Error("SNOW webhooks are not verified")
+	}
+	out, err := OutHandler(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Verifier == nil {
+		t.Error("JSD webhooks are not verified")
+	}
+}
+
+func TestHandlersWithoutAuth(t *testing.T) {
+
+	conf := newConfig(t)
+	conf.Webhooks = config.Webhooks{Auth: "none"}
+
+	in, err := InHandler(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Verifier != nil {
+		t.Error("SNOW webhooks verified with WEBHOOK_AUTH none")
+	}
+}
+
+func TestOpenStoreShared(t *testing.T) {
+
+	// both directions of the standalone server must see each other's records
+	conf := newConfig(t)
+	a, err := openStore(conf.StoreOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := openStore(conf.StoreOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Error("store opened twice")
+	}
+
+	links, err := linkStore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if links == a {
+		t.Error("links share the namespace of the mapping records")
+	}
+}
@@ -0,0 +1,180 @@
+// Package attachment describes files attached to tickets and decides which of them may be copied
+package attachment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"strings"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/UKHomeOffice/snowsync/pkg/caller"
+)
+
+// ErrRejected is returned for attachments the policy does not allow
+var ErrRejected = errors.New("attachment rejected")
+
+// Attachment is a file attached to a ticket on one side
+type Attachment struct {
+	ID          string
+	Name        string
+	ContentType string
+	Size        int64
+	// URL is where the file can be downloaded from, absolute or relative to the source system
+	URL string
+}
+
+// Key is the comment id a copied attachment is recorded under in the mapping store
+func (a *Attachment) Key() string {
+	return Key(a.ID)
+}
+
+// Key is the comment id the file with an id is recorded under in the mapping store, on whichever system it is held
+func Key(id string) string {
+	return "attachment:" + id
+}
+
+// FromJSD reads the attachments of a JSD issue webhook, the array at path holds JSD attachment objects
+func FromJSD(input, path string) []Attachment {
+
+	if path == "" {
+		return nil
+	}
+
+	var as []Attachment
+	gjson.Get(input, path).ForEach(func(_, v gjson.Result) bool {
+		as = append(as, Attachment{
+			ID:          v.Get("id").String(),
+			Name:        v.Get("filename").String(),
+			ContentType: v.Get("mimeType").String(),
+			Size:        v.Get("size").Int(),
+			URL:         v.Get("content").String(),
+		})
+		return true
+	})
+	return as
+}
+
+// FromSNOW reads the attachments of a SNOW payload, the array at path holds sys_attachment records
+// files without a download link are fetched through the attachment API
+func FromSNOW(input, path string) []Attachment {
+
+	if path == "" {
+		return nil
+	}
+
+	var as []Attachment
+	gjson.Get(input, path).ForEach(func(_, v gjson.Result) bool {
+		a := Attachment{
+			ID:          v.Get("sys_id").String(),
+			Name:        v.Get("file_name").String(),
+			ContentType: v.Get("content_type").String(),
+			Size:        v.Get("size_bytes").Int(),
+			URL:         v.Get("download_link").String(),
+		}
+		if a.URL == "" {
+			a.URL = "/api/now/attachment/" + url.PathEscape(a.ID) + "/file"
+		}
+		as = append(as, a)
+		return true
+	})
+	return as
+}
+
+// Policy limits the attachments that are copied
+type Policy struct {
+	// MaxSize is the largest file copied in bytes
+	MaxSize int64
+	// Types lists the allowed content types, a type may end in /* to allow a whole family
+	Types []string
+}
+
+// DefaultPolicy allows images, text, PDFs and archives up to 10MB
+func DefaultPolicy() *Policy {
+	return &Policy{
+		MaxSize: 10 << 20,
+		Types: []string{
+			"image/*",
+			"text/plain",
+			"text/csv",
+			"application/pdf",
+			"application/json",
+			"application/zip",
+		},
+	}
+}
+
+// Check reports whether an attachment may be copied
+func (p *Policy) Check(a *Attachment) error {
+
+	if a.ID == "" {
+		return fmt.Errorf("%w: no id", ErrRejected)
+	}
+	if a.Size > p.MaxSize {
+		return fmt.Errorf("%w: %v is %v bytes, over the %v byte limit", ErrRejected, a.Name, a.Size, p.MaxSize)
+	}
+	if !p.allowed(a.ContentType) {
+		return fmt.Errorf("%w: %v has content type %q", ErrRejected, a.Name, a.ContentType)
+	}
+	return nil
+}
+
+// allowed matches a content type, ignoring parameters, against the allowlist
+func (p *Policy) allowed(ct string) bool {
+
+	t, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+
+	for _, a := range p.Types {
+		switch {
+		case a == "*/*", a == t:
+			return true
+		case strings.HasSuffix(a, "/*") && strings.HasPrefix(t, strings.TrimSuffix(a, "*")):
+			return true
+		}
+	}
+	return false
+}
+
+// Download fetches an attachment from the system it was added to, refusing files over MaxSize
+// a URL naming a host, absolute or scheme relative, is only followed on the client's own host, so credentials are never
+// sent elsewhere
+func (p *Policy) Download(ctx context.Context, c *caller.Client, a *Attachment) ([]byte, error) {
+
+	u, err := url.Parse(a.URL)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse attachment URL: %w", err)
+	}
+	if u.Host != "" && u.Host != c.BaseURL.Host {
+		return nil, fmt.Errorf("%w: %v is not hosted on %v", ErrRejected, a.Name, c.BaseURL.Host)
+	}
+
+	req, err := c.NewRequest(ctx, a.URL, "GET", nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not make request: %w", err)
+	}
+	req.Header.Set("Accept", "*/*")
+
+	res, err := c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not download attachment: %w", err)
+	}
+	defer res.Body.Close()
+
+	// the declared size cannot be trusted, so stop reading one byte past the limit
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, p.MaxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not read attachment: %w", err)
+	}
+	if int64(len(b)) > p.MaxSize {
+		return nil, fmt.Errorf("%w: %v is over the %v byte limit", ErrRejected, a.Name, p.MaxSize)
+	}
+	return b, nil
+}
@@ -0,0 +1,112 @@
+package attachment
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/UKHomeOffice/snowsync/pkg/caller"
+)
+
+func TestAllowed(t *testing.T) {
+
+	p := &Policy{Types: []string{"image/*", "text/plain"}}
+	for ct, want := range map[string]bool{
+		"image/png":                 true,
+		"image/svg+xml":             true,
+		"text/plain":                true,
+		"text/plain; charset=utf-8": true,
+		"TEXT/PLAIN":                true,
+		"text/csv":                  false,
+		// a family only covers its own subtypes
+		"imagery/png":      false,
+		"application/zip":  false,
+		"":                 false,
+		"not a media type": false,
+	} {
+		if got := p.allowed(ct); got != want {
+			t.Errorf("%q allowed is %v, want %v", ct, got, want)
+		}
+	}
+
+	if !(&Policy{Types: []string{"*/*"}}).allowed("application/octet-stream") {
+		t.Error("*/* does not allow every type")
+	}
+}
+
+func TestCheck(t *testing.T) {
+
+	p := &Policy{MaxSize: 10, Types: []string{"text/plain"}}
+	for name, a := range map[string]Attachment{
+		"no id":    {Name: "a.txt", ContentType: "text/plain", Size: 1},
+		"too big":  {ID: "1", Name: "a.txt", ContentType: "text/plain", Size: 11},
+		"bad type": {ID: "1", Name: "a.exe", ContentType: "application/x-msdownload", Size: 1},
+	} {
+		if err := p.Check(&a); !errors.Is(err, ErrRejected) {
+			t.Errorf("%v: got %v", name, err)
+		}
+	}
+	if err := p.Check(&Attachment{ID: "1", Name: "a.txt", ContentType: "text/plain", Size: 10}); err != nil {
+		t.Errorf("file at the limit rejected: %v", err)
+	}
+}
+
+// newFileServer serves a body for every path and counts the requests
+func newFileServer(t *testing.T, body string, requests *int) *caller.Client {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(s.Close)
+	c, err := caller.NewClient(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestDownload(t *testing.T) {
+
+	var requests int
+	c := newFileServer(t, "0123456789", &requests)
+	ctx := context.Background()
+
+	b, err := (&Policy{MaxSize: 10}).Download(ctx, c, &Attachment{Name: "a.txt", URL: "/file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "0123456789" {
+		t.Errorf("downloaded %q", b)
+	}
+	// an absolute URL on the client's own host is followed
+	_, err = (&Policy{MaxSize: 10}).Download(ctx, c, &Attachment{Name: "a.txt", URL: c.BaseURL.String() + "/file"})
+	if err != nil {
+		t.Errorf("own host refused: %v", err)
+	}
+
+	// the declared size is not trusted, the file is measured as it is read
+	_, err = (&Policy{MaxSize: 9}).Download(ctx, c, &Attachment{Name: "a.txt", Size: 1, URL: "/file"})
+	if !errors.Is(err, ErrRejected) || !strings.Contains(err.Error(), "limit") {
+		t.Errorf("oversized file got %v", err)
+	}
+}
+
+func TestDownloadForeignHost(t *testing.T) {
+
+	var requests int
+	c := newFileServer(t, "secret", &requests)
+
+	for _, u := range []string{"https://attacker.example.com/file", "//attacker.example.com/file"} {
+		_, err := (&Policy{MaxSize: 10}).Download(context.Background(), c, &Attachment{Name: "a.txt", URL: u})
+		if !errors.Is(err, ErrRejected) {
+			t.Errorf("%v got %v", u, err)
+		}
+	}
+	if requests != 0 {
+		t.Errorf("%v requests sent", requests)
+	}
+}
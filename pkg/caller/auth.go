@@ -0,0 +1,275 @@
+package caller
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/UKHomeOffice/snowsync/pkg/secrets"
+)
+
+// authentication modes, chosen per system with <SYSTEM>_AUTH
+const (
+	AuthBasic  = "basic"
+	AuthBearer = "bearer"
+	AuthOAuth2 = "oauth2"
+	AuthMTLS   = "mtls"
+)
+
+// tokenMargin renews an OAuth token this long before it expires, so it does not lapse in flight
+const tokenMargin = 30 * time.Second
+
+// Authenticator adds credentials to a request before it is sent
+type Authenticator interface {
+	Authenticate(req *http.Request) error
+}
+
+// Checker is implemented by authenticators that load credentials, so a missing set is found before the first request
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// Refresher is implemented by authenticators whose credentials can go stale
+// Refresh is called when a request is rejected with 401, and the request is then sent once more
+type Refresher interface {
+	Refresh(ctx context.Context)
+}
+
+// tlsAuthenticator is implemented by authenticators working at the TLS layer rather than on each request
+type tlsAuthenticator interface {
+	TLSConfig() *tls.Config
+}
+
+// invalidator is implemented by providers that cache credentials, such as secrets.Cache
+type invalidator interface {
+	Invalidate(name string)
+}
+
+// load reads a credential set, which must hold a username when user is true
+func load(ctx context.Context, p secrets.Provider, set string, user bool) (*secrets.Credentials, error) {
+	c, err := p.Get(ctx, set)
+	if err != nil {
+		return nil, fmt.Errorf("could not load %v credentials: %w", set, err)
+	}
+	if user && c.User == "" {
+		return nil, fmt.Errorf("could not load %v credentials: missing username", set)
+	}
+	return c, nil
+}
+
+// invalidate makes a caching provider load a credential set again
+func invalidate(p secrets.Provider, name string) {
+	if i, ok := p.(invalidator); ok {
+		i.Invalidate(name)
+	}
+}
+
+// Basic sends the username and password of a credential set, such as an Atlassian email and API token
+type Basic struct {
+	Secrets secrets.Provider
+	Set     string
+}
+
+// Authenticate sets basic credentials on a request
+func (b *Basic) Authenticate(req *http.Request) error {
+	c, err := load(req.Context(), b.Secrets, b.Set, true)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.User, c.Pass)
+	return nil
+}
+
+// Check loads the username and password
+func (b *Basic) Check(ctx context.Context) error {
+	_, err := load(ctx, b.Secrets, b.Set, true)
+	return err
+}
+
+// Refresh reloads the credential set, which may have been rotated
+func (b *Basic) Refresh(ctx context.Context) {
+	invalidate(b.Secrets, b.Set)
+}
+
+// Bearer sends the password of a credential set as a bearer token, such as a JSD personal access token
+// the set needs no username, one naming the token's owner is not sent
+type Bearer struct {
+	Secrets secrets.Provider
+	Set     string
+}
+
+// Authenticate sets a bearer token on a request
+func (b *Bearer) Authenticate(req *http.Request) error {
+	c, err := load(req.Context(), b.Secrets, b.Set, false)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Pass)
+	return nil
+}
+
+// Check loads the token
+func (b *Bearer) Check(ctx context.Context) error {
+	_, err := load(ctx, b.Secrets, b.Set, false)
+	return err
+}
+
+// Refresh reloads the credential set, which may have been rotated
+func (b *Bearer) Refresh(ctx context.Context) {
+	invalidate(b.Secrets, b.Set)
+}
+
+// ClientCredentials fetches OAuth 2.0 access tokens with the client credentials grant
+// the username and password of the credential set are the client id and secret
+// a token is kept until shortly before it expires or until a request is rejected with it
+type ClientCredentials struct {
+	Secrets  secrets.Provider
+	Set      string
+	TokenURL string
+	Scopes   []string
+	// HTTPClient requests tokens, a client with a 5 second timeout when nil
+	HTTPClient *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// Authenticate sets an access token on a request, fetching a new one when there is none
+func (o *ClientCredentials) Authenticate(req *http.Request) error {
+	token, err := o.Token(req.Context())
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// Check loads the client id and secret, without fetching a token
+func (o *ClientCredentials) Check(ctx context.Context) error {
+	_, err := load(ctx, o.Secrets, o.Set, true)
+	return err
+}
+
+// Refresh drops the access token, and reloads the client secret in case it was rotated
+func (o *ClientCredentials) Refresh(ctx context.Context) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.token = ""
+	invalidate(o.Secrets, o.Set)
+}
+
+// Token returns the current access token, fetching a new one when there is none or it is about to expire
+func (o *ClientCredentials) Token(ctx context.Context) (string, error) {
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.token != "" && (o.expiry.IsZero() || time.Now().Before(o.expiry)) {
+		return o.token, nil
+	}
+
+	c, err := load(ctx, o.Secrets, o.Set, true)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {c.User},
+		"client_secret": {c.Pass},
+	}
+	if len(o.Scopes) != 0 {
+		form.Set("scope", strings.Join(o.Scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", o.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("could not make token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	hc := o.HTTPClient
+	if hc == nil {
+		hc = &http.Client{Timeout: 5 * time.Second}
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not request token: %w", err)
+	}
+	err = checkResponse(resp)
+	if err != nil {
+		return "", fmt.Errorf("could not request token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("could not read token response: %w", err)
+	}
+	err = json.Unmarshal(b, &t)
+	if err != nil {
+		return "", fmt.Errorf("could not decode token response: %w", err)
+	}
+	if t.AccessToken == "" {
+		return "", fmt.Errorf("token response holds no access token")
+	}
+
+	o.token = t.AccessToken
+	o.expiry = time.Time{}
+	if t.ExpiresIn > 0 {
+		o.expiry = time.Now().Add(time.Duration(t.ExpiresIn)*time.Second - tokenMargin)
+	}
+	return o.token, nil
+}
+
+// MutualTLS authenticates with a client certificate presented during the TLS handshake
+type MutualTLS struct {
+	Config *tls.Config
+}
+
+// NewMutualTLS loads a client certificate and key, and optionally the CA bundle the server is checked against
+func NewMutualTLS(certFile, keyFile, caFile string) (*MutualTLS, error) {
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load client certificate: %w", err)
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA bundle: %w", err)
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", caFile)
+		}
+	}
+	return &MutualTLS{Config: conf}, nil
+}
+
+// Authenticate leaves the request as it is, the certificate is sent by the transport
+func (m *MutualTLS) Authenticate(req *http.Request) error {
+	return nil
+}
+
+// TLSConfig returns the configuration holding the client certificate
+func (m *MutualTLS) TLSConfig() *tls.Config {
+	return m.Config
+}
@@ -0,0 +1,168 @@
+package caller
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/UKHomeOffice/snowsync/pkg/secrets"
+)
+
+func TestBasic(t *testing.T) {
+
+	sec := secrets.NewFake()
+	sec.Set(secrets.JSD, "alice@example.com", "api-token")
+	b := &Basic{Secrets: sec, Set: secrets.JSD}
+
+	req, _ := http.NewRequest("GET", "https://jsd.example.com", nil)
+	err := b.Authenticate(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, p, ok := req.BasicAuth(); !ok || u != "alice@example.com" || p != "api-token" {
+		t.Errorf("sent %q, %q", u, p)
+	}
+
+	// basic credentials cannot do without a username
+	sec.Set(secrets.JSD, "", "api-token")
+	if err := b.Check(context.Background()); err == nil {
+		t.Error("set without a username accepted")
+	}
+}
+
+func TestBearer(t *testing.T) {
+
+	sec := secrets.NewFake()
+	sec.Set(secrets.JSD, "", "personal-access-token")
+	b := &Bearer{Secrets: sec, Set: secrets.JSD}
+
+	if err := b.Check(context.Background()); err != nil {
+		t.Fatalf("token without a username rejected: %v", err)
+	}
+	req, _ := http.NewRequest("GET", "https://jsd.example.com", nil)
+	err := b.Authenticate(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer personal-access-token" {
+		t.Errorf("sent %q", got)
+	}
+}
+
+// tokenServer issues numbered access tokens with the client credentials grant
+func tokenServer(t *testing.T, issued *int32) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("client_id") != "snowsync" || r.Form.Get("client_secret") != "s3cret" {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		if r.Form.Get("scope") != "useraccount incident" {
+			t.Errorf("requested scope %q", r.Form.Get("scope"))
+		}
+		n := atomic.AddInt32(issued, 1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"token%v","expires_in":3600}`, n)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestClientCredentials(t *testing.T) {
+
+	var issued int32
+	ts := tokenServer(t, &issued)
+	sec := secrets.NewFake()
+	sec.Set(secrets.SNOW, "snowsync", "s3cret")
+	o := &ClientCredentials{Secrets: sec, Set: secrets.SNOW, TokenURL: ts.URL, Scopes: []string{"useraccount", "incident"}}
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		token, err := o.Token(ctx)
+		if err != nil || token != "token1" {
+			t.Fatalf("got %q, %v", token, err)
+		}
+	}
+	if n := atomic.LoadInt32(&issued); n != 1 {
+		t.Errorf("%v tokens fetched, want the first reused", n)
+	}
+
+	o.Refresh(ctx)
+	if token, err := o.Token(ctx); err != nil || token != "token2" {
+		t.Errorf("got %q, %v after a refresh", token, err)
+	}
+
+	sec.Set(secrets.SNOW, "snowsync", "wrong")
+	o.Refresh(ctx)
+	if _, err := o.Token(ctx); err == nil {
+		t.Error("token fetched with a wrong secret")
+	}
+}
+
+func TestReauthenticate(t *testing.T) {
+
+	var issued, calls int32
+	ts := tokenServer(t, &issued)
+
+	// the API revokes the first token
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.Header.Get("Authorization") != "Bearer token2" {
+			http.Error(w, "revoked", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer api.Close()
+
+	sec := secrets.NewFake()
+	sec.Set(secrets.SNOW, "snowsync", "s3cret")
+	c, err := NewClient(api.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetAuthenticator(&ClientCredentials{Secrets: sec, Set: secrets.SNOW, TokenURL: ts.URL, Scopes: []string{"useraccount", "incident"}})
+
+	req, _ := c.NewRequest(context.Background(), "/", "POST", []byte(`{}`))
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("request not sent again with a new token: %v", err)
+	}
+	resp.Body.Close()
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("%v calls, want the rejected one and one more", n)
+	}
+
+	// a token rejected again fails the request rather than looping
+	sec.Set(secrets.SNOW, "snowsync", "s3cret")
+	c.SetAuthenticator(&Bearer{Secrets: sec, Set: secrets.SNOW})
+	req, _ = c.NewRequest(context.Background(), "/", "GET", nil)
+	if _, err := c.Do(req); err == nil {
+		t.Error("rejected credentials reported as a success")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+
+	_, err := NewMutualTLS("missing.crt", "missing.key", "")
+	if err == nil {
+		t.Error("missing certificate accepted")
+	}
+
+	// the certificate is sent by the transport, requests are left as they are
+	m := &MutualTLS{}
+	c, err := NewClient("https://snow.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetAuthenticator(m)
+	if c.HTTPClient.Transport == nil {
+		t.Error("client certificate not installed on the transport")
+	}
+	if _, ok := Authenticator(m).(Checker); ok {
+		t.Error("mutual TLS loads no credential set to check")
+	}
+}
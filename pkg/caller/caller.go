@@ -2,18 +2,63 @@ package caller
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/UKHomeOffice/snowsync/pkg/logging"
+	"github.com/UKHomeOffice/snowsync/pkg/metrics"
+	"github.com/UKHomeOffice/snowsync/pkg/tracing"
 )
 
 // Client is a HTTP client
 type Client struct {
+	// Name labels the metrics of calls made by this client, e.g. jsd or snow
+	Name       string
 	BaseURL    *url.URL
 	HTTPClient *http.Client
+	// Retry is applied to idempotent requests, nil means a single attempt
+	Retry *RetryPolicy
+	// Auth adds credentials to each request, nil sends requests without any
+	Auth Authenticator
+}
+
+// NewClient creates a client for a base URL
+func NewClient(base string) (*Client, error) {
+
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse base URL: %w", err)
+	}
+
+	return &Client{
+		BaseURL:    u,
+		HTTPClient: &http.Client{Timeout: 5 * time.Second},
+		Retry:      DefaultRetryPolicy(),
+	}, nil
+}
+
+// SetAuthenticator authenticates the client's requests with a, installing its certificate for mutual TLS
+func (c *Client) SetAuthenticator(a Authenticator) {
+	c.Auth = a
+	if t, ok := a.(tlsAuthenticator); ok {
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.TLSClientConfig = t.TLSConfig()
+		c.HTTPClient.Transport = tr
+	}
 }
 
-// NewRequest creates a HTTP request
-func (c *Client) NewRequest(path, method, user, pass string, body []byte) (*http.Request, error) {
+// NewRequest creates a HTTP request, credentials are added when it is sent
+func (c *Client) NewRequest(ctx context.Context, path, method string, body []byte) (*http.Request, error) {
 
 	p, err := url.Parse(path)
 	if err != nil {
@@ -21,7 +66,7 @@ func (c *Client) NewRequest(path, method, user, pass string, body []byte) (*http
 	}
 	u := c.BaseURL.ResolveReference(p)
 
-	req, err := http.NewRequest(method, u.String(), bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewBuffer(body))
 	if err != nil {
 		return nil, err
 	}
@@ -30,18 +75,141 @@ func (c *Client) NewRequest(path, method, user, pass string, body []byte) (*http
 	}
 	req.Header.Set("Accept", "application/json")
 
-	req.SetBasicAuth(user, pass)
-
 	return req, nil
 }
 
-// Do makes a HTTP request
-func (c *Client) Do(req *http.Request) (*http.Response, error) {
+// Do makes a HTTP request, retrying transient failures of idempotent requests
+// a response with a non-2xx status is returned as a *HTTPError
+func (c *Client) Do(req *http.Request) (_ *http.Response, err error) {
+
+	ctx, span := tracing.Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.full", req.URL.Redacted()),
+			attribute.String("server.address", req.URL.Hostname()),
+			attribute.String("peer.service", c.Name),
+		),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	// pass the trace on so the remote system can join it
+	req = req.WithContext(ctx)
+	tracing.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	err = c.authenticate(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp, err = c.reauthenticate(req, resp)
+		if err != nil {
+			return nil, err
+		}
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+
+	err = checkResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) authenticate(req *http.Request) error {
+	if c.Auth == nil {
+		return nil
+	}
+	err := c.Auth.Authenticate(req)
+	if err != nil {
+		return fmt.Errorf("could not authenticate: %w", err)
+	}
+	return nil
+}
+
+// reauthenticate sends a request rejected with 401 once more with refreshed credentials
+// the rejected response is returned when the authenticator cannot refresh or the body cannot be sent again
+func (c *Client) reauthenticate(req *http.Request, resp *http.Response) (*http.Response, error) {
+
+	r, ok := c.Auth.(Refresher)
+	if !ok || req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		req.Body = body
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	logging.From(req.Context()).Info("credentials rejected, refreshing", "method", req.Method, "path", req.URL.Path)
+	r.Refresh(req.Context())
 
-	resp, err := c.HTTPClient.Do(req)
+	err := c.authenticate(req)
 	if err != nil {
 		return nil, err
 	}
+	return c.do(req)
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+
+	attempts := 1
+	if c.Retry != nil && c.Retry.MaxAttempts > 1 && idempotent(req) {
+		attempts = c.Retry.MaxAttempts
+	}
+
+	log := logging.From(req.Context())
 
-	return resp, err
+	for attempt := 1; ; attempt++ {
+
+		start := time.Now()
+		resp, err := c.HTTPClient.Do(req)
+		status := "error"
+		if resp != nil {
+			status = strconv.Itoa(resp.StatusCode)
+		}
+		metrics.Since(metrics.RemoteCalls, start, "system", c.Name, "method", req.Method, "status", status)
+		if err != nil {
+			log.Warn("remote call failed", "method", req.Method, "path", req.URL.Path, "attempt", attempt, logging.Since(start), logging.Err(err))
+		} else {
+			log.Info("remote call", "method", req.Method, "path", req.URL.Path, "attempt", attempt, "status", resp.StatusCode, logging.Since(start))
+		}
+		if attempt == attempts || req.Context().Err() != nil || !c.Retry.retryable(req, resp, err) {
+			return resp, err
+		}
+
+		wait := c.Retry.delay(attempt, resp)
+
+		// rewind the body for the next attempt
+		if req.GetBody != nil {
+			body, gerr := req.GetBody()
+			if gerr != nil {
+				return resp, err
+			}
+			req.Body = body
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		trace.SpanFromContext(req.Context()).AddEvent("retry", trace.WithAttributes(attribute.Int("attempt", attempt)))
+		log.Info("retrying", "method", req.Method, "path", req.URL.Path, "attempt", attempt, "wait", wait.String())
+
+		t := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			t.Stop()
+			return nil, req.Context().Err()
+		case <-t.C:
+		}
+	}
 }
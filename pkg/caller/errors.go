@@ -0,0 +1,110 @@
+package caller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Sentinel errors matched by HTTPError, test with errors.Is
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrNotFound     = errors.New("not found")
+	ErrConflict     = errors.New("conflict")
+	ErrRateLimited  = errors.New("rate limited")
+)
+
+// bodyExcerpt limits how much of a failed response is kept
+const bodyExcerpt = 512
+
+// requestIDHeaders carry the remote system's identifier for a request, JSD sends the first
+var requestIDHeaders = []string{"X-Arequestid", "X-Request-Id", "X-Transaction-Id"}
+
+// HTTPError is returned when a remote system responds with a non-2xx status
+type HTTPError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+	RequestID  string
+}
+
+func (e *HTTPError) Error() string {
+	msg := fmt.Sprintf("%v %v returned %v", e.Method, e.URL, e.StatusCode)
+	if e.RequestID != "" {
+		msg += fmt.Sprintf(" (request id %v)", e.RequestID)
+	}
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+// Unwrap exposes the sentinel error for the status code
+func (e *HTTPError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrUnauthorized
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusConflict:
+		return ErrConflict
+	case http.StatusTooManyRequests:
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// checkResponse turns a failure status into a HTTPError, consuming and closing the body
+func checkResponse(resp *http.Response) error {
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	defer resp.Body.Close()
+
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, bodyExcerpt))
+
+	e := &HTTPError{
+		StatusCode: resp.StatusCode,
+		Body:       strings.TrimSpace(string(b)),
+	}
+	if resp.Request != nil {
+		e.Method = resp.Request.Method
+		e.URL = resp.Request.URL.Redacted()
+	}
+	for _, h := range requestIDHeaders {
+		if id := resp.Header.Get(h); id != "" {
+			e.RequestID = id
+			break
+		}
+	}
+	return e
+}
+
+// GatewayStatus maps an error to the status code returned to the webhook sender
+// failures of the remote system are reported as gateway errors so the sender can tell them from bad input
+func GatewayStatus(err error) int {
+
+	var he *HTTPError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.As(err, &he):
+		if he.StatusCode >= 500 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,137 @@
+package caller
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// IdempotencyHeader marks a request that is safe to repeat whatever its method
+const IdempotencyHeader = "Idempotency-Key"
+
+// RetryPolicy controls how failed requests are retried
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first
+	MaxAttempts int
+	// BaseDelay is the wait before the first retry, doubled on every further retry
+	BaseDelay time.Duration
+	// MaxDelay caps the wait between attempts
+	MaxDelay time.Duration
+	// Jitter randomises each wait between zero and the computed delay
+	Jitter bool
+	// RetryStatus lists the response codes worth retrying
+	RetryStatus []int
+}
+
+// DefaultRetryPolicy returns the policy used by new clients
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   200 * time.Millisecond,
+		MaxDelay:    2 * time.Second,
+		Jitter:      true,
+		RetryStatus: []int{
+			http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
+	}
+}
+
+// SetIdempotencyKey marks a request as safe to retry, the key is also sent to the remote system
+func SetIdempotencyKey(req *http.Request, key string) {
+	req.Header.Set(IdempotencyHeader, key)
+}
+
+// idempotent reports whether repeating a request cannot cause a duplicate side effect
+func idempotent(req *http.Request) bool {
+	return safeMethod(req) || req.Header.Get(IdempotencyHeader) != ""
+}
+
+// safeMethod reports whether the method alone makes a request safe to repeat
+func safeMethod(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryable reports whether an attempt of req failed in a way worth repeating
+// a request only marked safe by its idempotency key is not repeated when the remote system may already have
+// acted on it, after a timeout or a connection dropped once the request was sent, as the key may be ignored
+func (p *RetryPolicy) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		return safeMethod(req) || unsent(err)
+	}
+	if !safeMethod(req) && resp.StatusCode == http.StatusGatewayTimeout {
+		return false
+	}
+	for _, code := range p.RetryStatus {
+		if resp.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// unsent reports whether a transport error happened before the request reached the remote system
+func unsent(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
+
+var (
+	jitterMu sync.Mutex
+	jitter   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// delay works out the wait before the next attempt
+func (p *RetryPolicy) delay(attempt int, resp *http.Response) time.Duration {
+
+	// the remote system knows best, but the wait never exceeds the policy
+	if resp != nil {
+		if d, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+			if d > p.MaxDelay {
+				d = p.MaxDelay
+			}
+			return d
+		}
+	}
+
+	d := p.BaseDelay << uint(attempt-1)
+	if d > p.MaxDelay || d <= 0 {
+		d = p.MaxDelay
+	}
+
+	if p.Jitter && d > 0 {
+		jitterMu.Lock()
+		d = time.Duration(jitter.Int63n(int64(d) + 1))
+		jitterMu.Unlock()
+	}
+	return d
+}
+
+// retryAfter parses a Retry-After header given in seconds or as a HTTP date
+func retryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(v); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
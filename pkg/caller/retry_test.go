@@ -0,0 +1,188 @@
+package caller
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDelayBackoff(t *testing.T) {
+
+	p := &RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempt, want := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 400 * time.Millisecond,
+		4: 800 * time.Millisecond,
+		5: time.Second,
+		// a shift past the width of the duration is capped rather than wrapped
+		80: time.Second,
+	} {
+		if got := p.delay(attempt, nil); got != want {
+			t.Errorf("attempt %v waits %v, want %v", attempt, got, want)
+		}
+	}
+}
+
+func TestDelayJitter(t *testing.T) {
+
+	p := &RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second, Jitter: true}
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		d := p.delay(3, nil)
+		if d < 0 || d > 400*time.Millisecond {
+			t.Fatalf("jittered wait %v outside [0, 400ms]", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Error("jitter did not vary the wait")
+	}
+}
+
+func TestDelayRetryAfter(t *testing.T) {
+
+	p := &RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: 5 * time.Second, Jitter: true}
+	resp := func(v string) *http.Response {
+		return &http.Response{Header: http.Header{"Retry-After": []string{v}}}
+	}
+
+	if got := p.delay(1, resp("2")); got != 2*time.Second {
+		t.Errorf("Retry-After in seconds waits %v", got)
+	}
+	date := time.Now().Add(3 * time.Second).UTC().Format(http.TimeFormat)
+	if got := p.delay(1, resp(date)); got < time.Second || got > 3*time.Second {
+		t.Errorf("Retry-After as a date waits %v", got)
+	}
+	if got := p.delay(1, resp(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))); got != 0 {
+		t.Errorf("Retry-After in the past waits %v", got)
+	}
+	// a longer wait than the policy allows is cut short, not given up on
+	if got := p.delay(1, resp("120")); got != 5*time.Second {
+		t.Errorf("Retry-After over the maximum waits %v", got)
+	}
+	// an unreadable header falls back to the backoff
+	if got := p.delay(1, resp("soon")); got > 100*time.Millisecond {
+		t.Errorf("unreadable Retry-After waits %v", got)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+
+	p := DefaultRetryPolicy()
+	get, _ := http.NewRequest("GET", "https://snow.example.com/api", nil)
+	post, _ := http.NewRequest("POST", "https://snow.example.com/api", nil)
+	SetIdempotencyKey(post, "INC1-c1")
+
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	timeout := context.DeadlineExceeded
+
+	for _, c := range []struct {
+		req    *http.Request
+		status int
+		err    error
+		want   bool
+	}{
+		{req: get, err: refused, want: true},
+		{req: get, err: reset, want: true},
+		{req: get, err: timeout, want: true},
+		{req: get, status: http.StatusGatewayTimeout, want: true},
+		{req: get, status: http.StatusNotFound, want: false},
+		{req: post, err: refused, want: true},
+		{req: post, err: reset, want: false},
+		{req: post, err: timeout, want: false},
+		{req: post, status: http.StatusServiceUnavailable, want: true},
+		{req: post, status: http.StatusGatewayTimeout, want: false},
+	} {
+		var resp *http.Response
+		if c.err == nil {
+			resp = &http.Response{StatusCode: c.status}
+		}
+		if got := p.retryable(c.req, resp, c.err); got != c.want {
+			t.Errorf("%v after %v %v: retryable is %v", c.req.Method, c.status, c.err, got)
+		}
+	}
+}
+
+// dropping is a server that reads each request and closes the connection without answering
+func dropping(t *testing.T, calls *int32) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestDoDroppedConnection(t *testing.T) {
+
+	var calls int32
+	s := dropping(t, &calls)
+	c, err := NewClient(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Retry.BaseDelay, c.Retry.MaxDelay = time.Millisecond, time.Millisecond
+
+	// the update may have been applied, so it is sent once
+	req, _ := c.NewRequest(context.Background(), "/", "POST", []byte(`{}`))
+	SetIdempotencyKey(req, "INC1-c1")
+	if _, err := c.Do(req); err == nil {
+		t.Fatal("dropped connection reported as a success")
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("update sent %v times", n)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	req, _ = c.NewRequest(context.Background(), "/", "GET", nil)
+	c.Do(req)
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("read sent %v times, want 3", n)
+	}
+}
+
+func TestDoRetryAfter(t *testing.T) {
+
+	var calls int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer s.Close()
+
+	c, err := NewClient(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Retry.MaxDelay = 10 * time.Millisecond
+
+	req, _ := c.NewRequest(context.Background(), "/", "GET", nil)
+	start := time.Now()
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("throttled read not retried: %v", err)
+	}
+	resp.Body.Close()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("waited %v despite the maximum delay", d)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("read sent %v times, want 2", n)
+	}
+}
@@ -0,0 +1,434 @@
+// Package config reads the settings of both directions once at cold start
+// settings come from the JSON file named by CONFIG_FILE and the environment, which takes precedence,
+// and every problem found is reported together so a deployment can be fixed in one go
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/UKHomeOffice/snowsync/pkg/loop"
+	"github.com/UKHomeOffice/snowsync/pkg/mapping"
+	"github.com/UKHomeOffice/snowsync/pkg/store"
+)
+
+// directions a configuration is validated for
+const (
+	In  = "in"
+	Out = "out"
+)
+
+// InFields are the gjson paths of the values read from ServiceNow webhooks
+type InFields struct {
+	ExtID             string `json:"extid,omitempty"`
+	IntID             string `json:"intid,omitempty"`
+	Description       string `json:"description,omitempty"`
+	Comment           string `json:"comment,omitempty"`
+	CommentID         string `json:"comment_id,omitempty"`
+	InternalComment   string `json:"internal_comment,omitempty"`
+	InternalCommentID string `json:"internal_comment_id,omitempty"`
+	Priority          string `json:"priority,omitempty"`
+	Reporter          string `json:"reporter,omitempty"`
+	Resolution        string `json:"resolution,omitempty"`
+	Service           string `json:"service,omitempty"`
+	Status            string `json:"status,omitempty"`
+	Summary           string `json:"summary,omitempty"`
+	Attachments       string `json:"attachments,omitempty"`
+	Event             string `json:"event,omitempty"`
+	Updated           string `json:"updated,omitempty"`
+}
+
+// OutFields are the gjson paths of the values read from JSD webhooks
+type OutFields struct {
+	IssueID       string `json:"issue_id,omitempty"`
+	SNOWID        string `json:"snow_id,omitempty"`
+	Description   string `json:"description,omitempty"`
+	Comment       string `json:"comment,omitempty"`
+	CommentID     string `json:"comment_id,omitempty"`
+	CommentAuthor string `json:"comment_author,omitempty"`
+	CommentBody   string `json:"comment_body,omitempty"`
+	Priority      string `json:"priority,omitempty"`
+	Service       string `json:"service,omitempty"`
+	Status        string `json:"status,omitempty"`
+	Summary       string `json:"summary,omitempty"`
+	Attachments   string `json:"attachments,omitempty"`
+	Event         string `json:"event,omitempty"`
+	Updated       string `json:"updated,omitempty"`
+}
+
+// Store selects the mapping store, as described by store.Options
+type Store struct {
+	Type  string `json:"type,omitempty"`
+	Table string `json:"table,omitempty"`
+	// LinkTable holds the comment links both directions share
+	LinkTable string `json:"link_table,omitempty"`
+	Region    string `json:"region,omitempty"`
+	Path      string `json:"path,omitempty"`
+}
+
+// Outbox selects the outbox, as described by outbox.Options
+type Outbox struct {
+	Type  string `json:"type,omitempty"`
+	Table string `json:"table,omitempty"`
+	Path  string `json:"path,omitempty"`
+}
+
+// Retry tunes caller.DefaultRetryPolicy, a blank setting keeps the default
+type Retry struct {
+	MaxAttempts string `json:"max_attempts,omitempty"`
+	BaseDelay   string `json:"base_delay,omitempty"`
+	MaxDelay    string `json:"max_delay,omitempty"`
+	Jitter      string `json:"jitter,omitempty"`
+	StatusCodes string `json:"status_codes,omitempty"`
+}
+
+// Auth selects how a system is called, as described by caller.Authenticator
+type Auth struct {
+	Mode     string `json:"mode,omitempty"`
+	TokenURL string `json:"token_url,omitempty"`
+	// Scopes is a space separated list of OAuth scopes
+	Scopes  string `json:"scopes,omitempty"`
+	TLSCert string `json:"tls_cert,omitempty"`
+	TLSKey  string `json:"tls_key,omitempty"`
+	TLSCA   string `json:"tls_ca,omitempty"`
+}
+
+// Secrets selects the backend credential sets are loaded from
+type Secrets struct {
+	Backend string `json:"backend,omitempty"`
+	TTL     string `json:"ttl,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Prefix  string `json:"prefix,omitempty"`
+}
+
+// Webhook holds how the webhooks of one system are authenticated
+// JSD signs its webhooks with Secret, SNOW sends Token or User and Pass
+type Webhook struct {
+	Secret          string `json:"secret,omitempty"`
+	SignatureHeader string `json:"signature_header,omitempty"`
+	SignatureScheme string `json:"signature_scheme,omitempty"`
+	Token           string `json:"token,omitempty"`
+	TokenHeader     string `json:"token_header,omitempty"`
+	User            string `json:"user,omitempty"`
+	Pass            string `json:"pass,omitempty"`
+	TimestampHeader string `json:"timestamp_header,omitempty"`
+	NonceHeader     string `json:"nonce_header,omitempty"`
+}
+
+// Webhooks holds the authentication of the webhooks of both systems
+// Auth is required unless set to none
+type Webhooks struct {
+	JSD    Webhook `json:"jsd"`
+	SNOW   Webhook `json:"snow"`
+	Auth   string  `json:"auth,omitempty"`
+	MaxAge string  `json:"max_age,omitempty"`
+}
+
+// Attachments tunes attachment.DefaultPolicy and names the SNOW table files are attached to
+type Attachments struct {
+	MaxSize   string `json:"max_size,omitempty"`
+	Types     string `json:"types,omitempty"`
+	SNOWTable string `json:"snow_table,omitempty"`
+}
+
+// Observability selects how logs, metrics and traces are written
+type Observability struct {
+	LogLevel         string `json:"log_level,omitempty"`
+	MetricsFormat    string `json:"metrics_format,omitempty"`
+	MetricsNamespace string `json:"metrics_namespace,omitempty"`
+	TracesExporter   string `json:"traces_exporter,omitempty"`
+}
+
+// Server holds how snowsync-server listens, it serves HTTPS when TLSCert and TLSKey are set
+type Server struct {
+	ListenAddr      string `json:"listen_addr,omitempty"`
+	ShutdownTimeout string `json:"shutdown_timeout,omitempty"`
+	TLSCert         string `json:"tls_cert_file,omitempty"`
+	TLSKey          string `json:"tls_key_file,omitempty"`
+	TLSClientCA     string `json:"tls_client_ca_file,omitempty"`
+}
+
+// Config holds the settings the processors read at cold start
+type Config struct {
+	JSDURL      string `json:"jsd_url,omitempty"`
+	SNOWURL     string `json:"snow_url,omitempty"`
+	MappingFile string `json:"mapping_file,omitempty"`
+	// Marker tags the comments snowsync writes, blank leaves them untagged
+	Marker      string      `json:"loop_marker,omitempty"`
+	Store       Store       `json:"store"`
+	Outbox      Outbox      `json:"outbox"`
+	Retry       Retry       `json:"retry"`
+	JSDAuth     Auth        `json:"jsd_auth"`
+	SNOWAuth    Auth        `json:"snow_auth"`
+	Secrets     Secrets     `json:"secrets"`
+	Webhooks    Webhooks    `json:"webhooks"`
+	Attachments Attachments `json:"attachments"`
+	// Observability and Server are read by the commands before the handlers are wired
+	Observability Observability `json:"observability"`
+	Server        Server        `json:"server"`
+	In            InFields      `json:"in"`
+	Out           OutFields     `json:"out"`
+	// Mappings are loaded from MappingFile, or the embedded document when it is blank
+	Mappings *mapping.Mappings `json:"-"`
+}
+
+// variable ties an environment variable to the setting it fills
+type variable struct {
+	name  string
+	value *string
+	// direction is the one a setting belongs to, blank for settings both use
+	direction string
+	// required marks a setting the direction cannot run without, or both when the direction is blank
+	required bool
+	// path marks a gjson path
+	path bool
+}
+
+// variables lists every setting
+func (c *Config) variables() []variable {
+	return []variable{
+		{name: "JSD_URL", value: &c.JSDURL, direction: In, required: true},
+		{name: "SNOW_URL", value: &c.SNOWURL, direction: Out, required: true},
+		{name: "MAPPING_FILE", value: &c.MappingFile},
+		{name: "LOOP_MARKER", value: &c.Marker},
+		{name: "STORE_TYPE", value: &c.Store.Type},
+		{name: "TABLE_NAME", value: &c.Store.Table},
+		{name: "AWS_REGION", value: &c.Store.Region},
+		{name: "STORE_PATH", value: &c.Store.Path},
+		{name: "LINK_TABLE_NAME", value: &c.Store.LinkTable},
+
+		{name: "OUTBOX_TYPE", value: &c.Outbox.Type},
+		{name: "OUTBOX_TABLE", value: &c.Outbox.Table},
+		{name: "OUTBOX_PATH", value: &c.Outbox.Path},
+
+		{name: "RETRY_MAX_ATTEMPTS", value: &c.Retry.MaxAttempts},
+		{name: "RETRY_BASE_DELAY", value: &c.Retry.BaseDelay},
+		{name: "RETRY_MAX_DELAY", value: &c.Retry.MaxDelay},
+		{name: "RETRY_JITTER", value: &c.Retry.Jitter},
+		{name: "RETRY_STATUS_CODES", value: &c.Retry.StatusCodes},
+
+		{name: "JSD_AUTH", value: &c.JSDAuth.Mode},
+		{name: "JSD_TOKEN_URL", value: &c.JSDAuth.TokenURL},
+		{name: "JSD_OAUTH_SCOPES", value: &c.JSDAuth.Scopes},
+		{name: "JSD_TLS_CERT", value: &c.JSDAuth.TLSCert},
+		{name: "JSD_TLS_KEY", value: &c.JSDAuth.TLSKey},
+		{name: "JSD_TLS_CA", value: &c.JSDAuth.TLSCA},
+		{name: "SNOW_AUTH", value: &c.SNOWAuth.Mode},
+		{name: "SNOW_TOKEN_URL", value: &c.SNOWAuth.TokenURL},
+		{name: "SNOW_OAUTH_SCOPES", value: &c.SNOWAuth.Scopes},
+		{name: "SNOW_TLS_CERT", value: &c.SNOWAuth.TLSCert},
+		{name: "SNOW_TLS_KEY", value: &c.SNOWAuth.TLSKey},
+		{name: "SNOW_TLS_CA", value: &c.SNOWAuth.TLSCA},
+
+		{name: "SECRETS_BACKEND", value: &c.Secrets.Backend},
+		{name: "SECRETS_TTL", value: &c.Secrets.TTL},
+		{name: "SECRETS_PATH", value: &c.Secrets.Path},
+		{name: "SECRETS_PREFIX", value: &c.Secrets.Prefix},
+
+		{name: "JSD_WEBHOOK_SECRET", value: &c.Webhooks.JSD.Secret, direction: Out},
+		{name: "JSD_SIGNATURE_HEADER", value: &c.Webhooks.JSD.SignatureHeader, direction: Out},
+		{name: "JSD_SIGNATURE_SCHEME", value: &c.Webhooks.JSD.SignatureScheme, direction: Out},
+		{name: "JSD_TIMESTAMP_HEADER", value: &c.Webhooks.JSD.TimestampHeader, direction: Out},
+		{name: "JSD_NONCE_HEADER", value: &c.Webhooks.JSD.NonceHeader, direction: Out},
+		{name: "SNOW_WEBHOOK_TOKEN", value: &c.Webhooks.SNOW.Token, direction: In},
+		{name: "SNOW_TOKEN_HEADER", value: &c.Webhooks.SNOW.TokenHeader, direction: In},
+		{name: "SNOW_WEBHOOK_USER", value: &c.Webhooks.SNOW.User, direction: In},
+		{name: "SNOW_WEBHOOK_PASS", value: &c.Webhooks.SNOW.Pass, direction: In},
+		{name: "SNOW_TIMESTAMP_HEADER", value: &c.Webhooks.SNOW.TimestampHeader, direction: In},
+		{name: "SNOW_NONCE_HEADER", value: &c.Webhooks.SNOW.NonceHeader, direction: In},
+		{name: "WEBHOOK_AUTH", value: &c.Webhooks.Auth},
+		{name: "WEBHOOK_MAX_AGE", value: &c.Webhooks.MaxAge},
+
+		{name: "ATTACHMENT_MAX_SIZE", value: &c.Attachments.MaxSize},
+		{name: "ATTACHMENT_TYPES", value: &c.Attachments.Types},
+		{name: "SNOW_ATTACHMENT_TABLE", value: &c.Attachments.SNOWTable, direction: Out},
+
+		{name: "LOG_LEVEL", value: &c.Observability.LogLevel},
+		{name: "METRICS_FORMAT", value: &c.Observability.MetricsFormat},
+		{name: "METRICS_NAMESPACE", value: &c.Observability.MetricsNamespace},
+		{name: "OTEL_TRACES_EXPORTER", value: &c.Observability.TracesExporter},
+
+		{name: "LISTEN_ADDR", value: &c.Server.ListenAddr},
+		{name: "SHUTDOWN_TIMEOUT", value: &c.Server.ShutdownTimeout},
+		{name: "TLS_CERT_FILE", value: &c.Server.TLSCert},
+		{name: "TLS_KEY_FILE", value: &c.Server.TLSKey},
+		{name: "TLS_CLIENT_CA_FILE", value: &c.Server.TLSClientCA},
+
+		{name: "EXTID_FIELD", value: &c.In.ExtID, direction: In, path: true},
+		{name: "INTID_FIELD", value: &c.In.IntID, direction: In, required: true, path: true},
+		{name: "DESCRIPTION_FIELD", value: &c.In.Description, direction: In, required: true, path: true},
+		{name: "COMMENT_FIELD", value: &c.In.Comment, direction: In, path: true},
+		{name: "COMMENT_ID_FIELD", value: &c.In.CommentID, direction: In, path: true},
+		{name: "INTERNAL_COMMENT_FIELD", value: &c.In.InternalComment, direction: In, path: true},
+		{name: "INTERNAL_COMMENT_ID_FIELD", value: &c.In.InternalCommentID, direction: In, path: true},
+		{name: "PRIORITY_FIELD", value: &c.In.Priority, direction: In, required: true, path: true},
+		{name: "REPORTER_FIELD", value: &c.In.Reporter, direction: In, required: true, path: true},
+		{name: "RESOLUTION_FIELD", value: &c.In.Resolution, direction: In, path: true},
+		{name: "SERVICE_FIELD", value: &c.In.Service, direction: In, path: true},
+		{name: "STATUS_FIELD", value: &c.In.Status, direction: In, required: true, path: true},
+		{name: "SUMMARY_FIELD", value: &c.In.Summary, direction: In, required: true, path: true},
+		{name: "ATTACHMENTS_FIELD", value: &c.In.Attachments, direction: In, path: true},
+		{name: "EVENT_FIELD", value: &c.In.Event, direction: In, path: true},
+		{name: "UPDATED_FIELD", value: &c.In.Updated, direction: In, path: true},
+
+		{name: "ISSUE_ID_FIELD", value: &c.Out.IssueID, direction: Out, required: true, path: true},
+		{name: "SNOW_ID_FIELD", value: &c.Out.SNOWID, direction: Out, path: true},
+		{name: "DESCRIPTION_FIELD", value: &c.Out.Description, direction: Out, required: true, path: true},
+		{name: "COMMENT_FIELD", value: &c.Out.Comment, direction: Out, path: true},
+		{name: "COMMENT_ID_FIELD", value: &c.Out.CommentID, direction: Out, path: true},
+		{name: "COMMENT_AUTHOR_FIELD", value: &c.Out.CommentAuthor, direction: Out, path: true},
+		{name: "COMMENT_BODY_FIELD", value: &c.Out.CommentBody, direction: Out, path: true},
+		{name: "PRIORITY_FIELD", value: &c.Out.Priority, direction: Out, required: true, path: true},
+		{name: "SERVICE_FIELD", value: &c.Out.Service, direction: Out, path: true},
+		{name: "STATUS_FIELD", value: &c.Out.Status, direction: Out, required: true, path: true},
+		{name: "SUMMARY_FIELD", value: &c.Out.Summary, direction: Out, required: true, path: true},
+		{name: "ATTACHMENTS_FIELD", value: &c.Out.Attachments, direction: Out, path: true},
+		{name: "EVENT_FIELD", value: &c.Out.Event, direction: Out, path: true},
+		{name: "UPDATED_FIELD", value: &c.Out.Updated, direction: Out, path: true},
+	}
+}
+
+// lookup reads a variable from the environment
+// a field path prefixed IN_ or OUT_ takes precedence, so directions sharing a process can read different payloads
+func (v variable) lookup() (string, bool) {
+	if v.path {
+		if val, ok := os.LookupEnv(strings.ToUpper(v.direction) + "_" + v.name); ok {
+			return val, true
+		}
+	}
+	return os.LookupEnv(v.name)
+}
+
+// Load reads and validates the configuration of the directions given, from the file named by CONFIG_FILE, if any, and
+// the environment
+func Load(directions ...string) (*Config, error) {
+
+	c, err := Read(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		return nil, err
+	}
+	err = c.Validate(directions...)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Read reads the configuration file at path, unless it is blank, then the environment, without validating either
+func Read(path string) (*Config, error) {
+
+	c := &Config{Marker: loop.DefaultMarker}
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read config file: %w", err)
+		}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse config file: %w", err)
+		}
+	}
+
+	for _, v := range c.variables() {
+		if val, ok := v.lookup(); ok {
+			*v.value = val
+		}
+	}
+	if c.Marker == "" {
+		c.Marker = loop.DefaultMarker
+	}
+	if c.Store.Type == "" {
+		c.Store.Type = store.TypeDynamoDB
+	}
+	if c.Server.ListenAddr == "" {
+		c.Server.ListenAddr = ":8080"
+	}
+	return c, nil
+}
+
+// Validate checks the settings the directions given need and loads the mappings, reporting all problems found
+func (c *Config) Validate(directions ...string) error {
+
+	var problems []string
+
+	for _, v := range c.variables() {
+		// the paths of the other direction are not read, so they need not make sense
+		if v.path && !validating(v.direction, directions) {
+			continue
+		}
+		if *v.value == "" {
+			if v.required && validating(v.direction, directions) {
+				problems = append(problems, fmt.Sprintf("%v: missing", v.name))
+			}
+			continue
+		}
+		if v.path {
+			if err := checkPath(*v.value); err != nil {
+				problems = append(problems, fmt.Sprintf("%v: %v", v.name, err))
+			}
+		}
+	}
+
+	// attachments are downloaded from the other system, so copying them needs its address
+	if validating(In, directions) && c.In.Attachments != "" && c.SNOWURL == "" {
+		problems = append(problems, "SNOW_URL: missing, needed to copy attachments")
+	}
+	if validating(Out, directions) && c.Out.Attachments != "" && c.JSDURL == "" {
+		problems = append(problems, "JSD_URL: missing, needed to copy attachments")
+	}
+
+	switch c.Store.Type {
+	case store.TypeDynamoDB:
+		if c.Store.Table == "" {
+			problems = append(problems, "TABLE_NAME: missing, needed by the dynamodb store")
+		}
+	case store.TypeBolt:
+		if c.Store.Path == "" {
+			problems = append(problems, "STORE_PATH: missing, needed by the bolt store")
+		}
+	case store.TypeMemory:
+	default:
+		problems = append(problems, fmt.Sprintf("STORE_TYPE: unknown store %q", c.Store.Type))
+	}
+
+	problems = append(problems, c.settingsProblems(directions)...)
+
+	m, err := mapping.Load(c.MappingFile)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("MAPPING_FILE: %v", err))
+	}
+	c.Mappings = m
+
+	if len(problems) != 0 {
+		return &Error{Problems: problems}
+	}
+	return nil
+}
+
+// Error lists every problem found in a configuration
+type Error struct {
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// validating reports whether the settings of a direction are being validated, shared settings always are
+func validating(direction string, directions []string) bool {
+	if direction == "" {
+		return true
+	}
+	for _, d := range directions {
+		if d == direction {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,420 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/UKHomeOffice/snowsync/pkg/metrics"
+	"github.com/UKHomeOffice/snowsync/pkg/secrets"
+	"github.com/UKHomeOffice/snowsync/pkg/store"
+	"github.com/UKHomeOffice/snowsync/pkg/webhook"
+)
+
+// valid returns a configuration both directions accept
+func valid() *Config {
+	return &Config{
+		JSDURL:  "https://jsd.example.com",
+		SNOWURL: "https://snow.example.com",
+		Store:   Store{Type: store.TypeDynamoDB, Table: "snowsync"},
+		Webhooks: Webhooks{
+			JSD:  Webhook{Secret: "jsd-secret"},
+			SNOW: Webhook{Token: "snow-token"},
+		},
+		In: InFields{
+			IntID:       "number",
+			Description: "description",
+			Priority:    "priority",
+			Reporter:    "reporter",
+			Status:      "state",
+			Summary:     "summary",
+		},
+		Out: OutFields{
+			IssueID:     "issue.key",
+			Description: "issue.fields.description",
+			Priority:    "issue.fields.priority.name",
+			Status:      "issue.fields.status.name",
+			Summary:     "issue.fields.summary",
+		},
+	}
+}
+
+// problems returns the problems a validation found
+func problems(t *testing.T, err error) []string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	var invalid *Error
+	if !errors.As(err, &invalid) {
+		t.Fatalf("got %v, want a config.Error", err)
+	}
+	return invalid.Problems
+}
+
+// hasProblem reports whether a problem names a setting
+func hasProblem(problems []string, name string) bool {
+	for _, p := range problems {
+		if strings.HasPrefix(p, name+":") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestValidate(t *testing.T) {
+	err := valid().Validate(In, Out)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateMissing(t *testing.T) {
+
+	c := valid()
+	c.JSDURL = ""
+	c.In.Status = ""
+	c.Out.Summary = ""
+
+	got := problems(t, c.Validate(In))
+	if !hasProblem(got, "JSD_URL") || !hasProblem(got, "STATUS_FIELD") {
+		t.Errorf("got %v", got)
+	}
+	// the outbound paths are not read by the inbound function
+	if hasProblem(got, "SUMMARY_FIELD") {
+		t.Errorf("outbound path checked for the inbound direction: %v", got)
+	}
+}
+
+func TestValidateTable(t *testing.T) {
+
+	c := valid()
+	c.Store.Table = ""
+	for _, d := range []string{In, Out} {
+		if got := problems(t, c.Validate(d)); len(got) != 1 || !hasProblem(got, "TABLE_NAME") {
+			t.Errorf("%v: got %v", d, got)
+		}
+	}
+
+	// both directions read the records the other wrote, so there is no table per direction
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := ioutil.WriteFile(path, []byte(`{"store": {"in_table": "snowsync-in"}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Read(path); err == nil {
+		t.Error("table of one direction accepted")
+	}
+}
+
+func TestLinkStoreOptions(t *testing.T) {
+
+	c := valid()
+	if got := c.LinkStoreOptions().Table; got != "snowsync" {
+		t.Errorf("links kept in %q", got)
+	}
+	c.Store.LinkTable = "snowsync-links"
+	if got := c.LinkStoreOptions().Table; got != "snowsync-links" {
+		t.Errorf("links kept in %q", got)
+	}
+	if got := c.StoreOptions().Table; got != "snowsync" {
+		t.Errorf("records kept in %q", got)
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+
+	c := valid()
+	c.Retry.MaxAttempts = "many"
+	c.Retry.BaseDelay = "soon"
+	c.Retry.StatusCodes = "503,teapot"
+	c.Outbox.Type = "file"
+	c.Secrets.TTL = "-1s"
+	c.Secrets.Backend = "vault"
+	c.JSDAuth.Mode = "oauth2"
+	c.SNOWAuth.Mode = "kerberos"
+	c.Webhooks.MaxAge = "forever"
+	c.Webhooks.SNOW = Webhook{User: "snow"}
+	c.In.Status = "state..name"
+
+	got := problems(t, c.Validate(In, Out))
+	for _, name := range []string{
+		"RETRY_MAX_ATTEMPTS",
+		"RETRY_BASE_DELAY",
+		"RETRY_STATUS_CODES",
+		"OUTBOX_PATH",
+		"SECRETS_TTL",
+		"SECRETS_BACKEND",
+		"JSD_TOKEN_URL",
+		"SNOW_AUTH",
+		"WEBHOOK_MAX_AGE",
+		"SNOW_WEBHOOK_PASS",
+		"STATUS_FIELD",
+	} {
+		if !hasProblem(got, name) {
+			t.Errorf("%v not reported in %v", name, got)
+		}
+	}
+}
+
+func TestValidateAuthOfAttachmentSource(t *testing.T) {
+
+	c := valid()
+	c.JSDAuth.Mode = "mtls"
+
+	// the outbound function only calls JSD when it copies attachments
+	if err := c.Validate(Out); err != nil {
+		t.Errorf("got %v", err)
+	}
+	c.Out.Attachments = "issue.fields.attachment"
+	got := problems(t, c.Validate(Out))
+	if !hasProblem(got, "JSD_TLS_CERT") || !hasProblem(got, "JSD_TLS_KEY") {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestOutboxUnderLambda(t *testing.T) {
+
+	c := valid()
+	if o := c.OutboxOptions(); o.Type != "none" {
+		t.Errorf("outbox is %+v outside Lambda", o)
+	}
+
+	// failed deliveries must survive the invocation, so Lambda needs a table or an explicit none
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "snowsync-in")
+	if got := problems(t, c.Validate(In)); len(got) != 1 || !hasProblem(got, "OUTBOX_TABLE") {
+		t.Errorf("got %v", got)
+	}
+	c.Outbox.Table = "outbox"
+	if err := c.Validate(In); err != nil {
+		t.Fatal(err)
+	}
+	if o := c.OutboxOptions(); o.Type != "dynamodb" || o.Table != "outbox" {
+		t.Errorf("outbox is %+v under Lambda", o)
+	}
+
+	c.Outbox = Outbox{Type: "none"}
+	if err := c.Validate(In); err != nil {
+		t.Errorf("outbox turned off rejected: %v", err)
+	}
+	c.Outbox = Outbox{Type: "memory"}
+	if got := problems(t, c.Validate(In)); !hasProblem(got, "OUTBOX_TYPE") {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestValidateObservabilityAndServer(t *testing.T) {
+
+	c := valid()
+	c.Observability = Observability{LogLevel: "loud", MetricsFormat: "statsd", TracesExporter: "jaeger"}
+	c.Server = Server{ShutdownTimeout: "soon", TLSCert: "server.pem", TLSClientCA: "ca.pem"}
+	got := problems(t, c.Validate(In))
+	for _, name := range []string{"LOG_LEVEL", "METRICS_FORMAT", "OTEL_TRACES_EXPORTER", "SHUTDOWN_TIMEOUT", "TLS_KEY_FILE"} {
+		if !hasProblem(got, name) {
+			t.Errorf("%v not reported in %v", name, got)
+		}
+	}
+
+	c = valid()
+	c.Observability = Observability{LogLevel: "debug", MetricsFormat: "none", TracesExporter: "stdout"}
+	c.Server = Server{ShutdownTimeout: "5s", TLSCert: "server.pem", TLSKey: "server.key", TLSClientCA: "ca.pem"}
+	if err := c.Validate(In, Out); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := c.LogLevel(); l != slog.LevelDebug {
+		t.Errorf("log level is %v", l)
+	}
+	if d, _ := c.ShutdownTimeout(); d != 5*time.Second {
+		t.Errorf("shutdown timeout is %v", d)
+	}
+}
+
+func TestObservabilityDefaults(t *testing.T) {
+
+	c, err := Read("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := c.LogLevel(); l != slog.LevelInfo {
+		t.Errorf("log level is %v", l)
+	}
+	if f := c.MetricsFormat(); f != metrics.Prometheus {
+		t.Errorf("metrics format is %v", f)
+	}
+	if d, _ := c.ShutdownTimeout(); d != 20*time.Second || c.Server.ListenAddr != ":8080" {
+		t.Errorf("server listens on %v and waits %v", c.Server.ListenAddr, d)
+	}
+
+	// only the log reaches CloudWatch under Lambda
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "snowsync-in")
+	if f := c.MetricsFormat(); f != metrics.EMF {
+		t.Errorf("metrics format under Lambda is %v", f)
+	}
+}
+
+func TestRead(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := ioutil.WriteFile(path, []byte(`{
+		"jsd_url": "https://file.example.com",
+		"retry": {"max_attempts": "5", "base_delay": "1s"},
+		"outbox": {"type": "dynamodb", "table": "outbox"},
+		"webhooks": {"max_age": "1m"},
+		"in": {"status": "state"}
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("JSD_URL", "https://env.example.com")
+	t.Setenv("RETRY_BASE_DELAY", "2s")
+	t.Setenv("IN_STATUS_FIELD", "incident.state")
+
+	c, err := Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.JSDURL != "https://env.example.com" {
+		t.Errorf("environment did not take precedence: %v", c.JSDURL)
+	}
+	if c.In.Status != "incident.state" {
+		t.Errorf("prefixed path not read: %v", c.In.Status)
+	}
+	if o := c.OutboxOptions(); o.Type != "dynamodb" || o.Table != "outbox" {
+		t.Errorf("outbox is %+v", o)
+	}
+	p, err := c.RetryPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.MaxAttempts != 5 || p.BaseDelay != 2*time.Second {
+		t.Errorf("retry policy is %+v", p)
+	}
+}
+
+func TestReadUnknownField(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := ioutil.WriteFile(path, []byte(`{"jsd_urll": "https://jsd.example.com"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Read(path)
+	if err == nil {
+		t.Error("misspelt setting accepted")
+	}
+}
+
+func TestVerifier(t *testing.T) {
+
+	c := valid()
+	for _, system := range []string{secrets.JSD, secrets.SNOW} {
+		v, err := c.Verifier(system, store.NewMemory())
+		if err != nil || v == nil {
+			t.Errorf("%v: got %v, %v", system, v, err)
+		}
+	}
+
+	c.Webhooks.SNOW.User = "u"
+	got := problems(t, func() error { _, err := c.Verifier(secrets.SNOW, nil); return err }())
+	if !hasProblem(got, "SNOW_WEBHOOK_TOKEN") {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestVerifierSignatureScheme(t *testing.T) {
+
+	ctx := context.Background()
+	c := valid()
+	c.Webhooks.JSD.Secret = "s3cret"
+
+	// by default JSD webhooks are checked as Atlassian signs them, over the body alone and without a timestamp
+	v, err := c.Verifier(secrets.JSD, store.NewMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	jira := &events.APIGatewayProxyRequest{
+		Body:    `{"timestamp":1700000000000,"webhookEvent":"jira:issue_updated","issue":{"key":"ACP-1"}}`,
+		Headers: map[string]string{"X-Hub-Signature": "sha256=01b403545676779c2c8dd0373fa4627c4be1b20cc5be13b07a3caf41fe04382d"},
+	}
+	if err := v.Verify(ctx, jira); err != nil {
+		t.Errorf("Atlassian signature refused: %v", err)
+	}
+
+	c.Webhooks.JSD.TimestampHeader = "X-Sent"
+	if got := problems(t, c.Validate(Out)); !hasProblem(got, "JSD_TIMESTAMP_HEADER") {
+		t.Errorf("got %v", got)
+	}
+
+	// the timestamp scheme signs the headers too, and refuses a delivery without them
+	c.Webhooks.JSD.SignatureScheme = SignatureTimestamp
+	v, err = c.Verifier(secrets.JSD, store.NewMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Verify(ctx, jira); !errors.Is(err, webhook.ErrUnauthenticated) {
+		t.Errorf("got %v", err)
+	}
+
+	c.Webhooks.JSD.SignatureScheme = "jwt"
+	if got := problems(t, c.Validate(Out)); !hasProblem(got, "JSD_SIGNATURE_SCHEME") {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestVerifierFailsClosed(t *testing.T) {
+
+	c := valid()
+	c.Webhooks = Webhooks{}
+
+	// unauthenticated webhooks are refused unless that is asked for
+	got := problems(t, c.Validate(In, Out))
+	if !hasProblem(got, "JSD_WEBHOOK_SECRET") || !hasProblem(got, "SNOW_WEBHOOK_TOKEN") {
+		t.Errorf("got %v", got)
+	}
+
+	c.Webhooks.Auth = "off"
+	if got := problems(t, c.Validate(In, Out)); !hasProblem(got, "WEBHOOK_AUTH") {
+		t.Errorf("got %v", got)
+	}
+
+	c.Webhooks.Auth = WebhookAuthNone
+	if err := c.Validate(In, Out); err != nil {
+		t.Fatal(err)
+	}
+	v, err := c.Verifier(secrets.JSD, nil)
+	if err != nil || v != nil {
+		t.Errorf("got %v, %v with authentication off", v, err)
+	}
+}
+
+func TestCheckPath(t *testing.T) {
+
+	for path, ok := range map[string]bool{
+		"issue.fields.status.name":  true,
+		"comments.0.body":           true,
+		`fields.customfield\.10002`: true,
+		"comments.#.id":             true,
+		"issue|@reverse":            true,
+		" issue.key":                false,
+		"issue..key":                false,
+		"issue.key.":                false,
+		"comments.#(id==1":          false,
+		"comments.#(id==1))":        false,
+		"issue|@nonsense":           false,
+	} {
+		err := checkPath(path)
+		if ok && err != nil {
+			t.Errorf("%q rejected: %v", path, err)
+		}
+		if !ok && err == nil {
+			t.Errorf("%q accepted", path)
+		}
+	}
+}
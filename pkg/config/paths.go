@@ -0,0 +1,66 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// checkPath reports gjson paths that cannot match anything, which gjson itself silently accepts
+func checkPath(path string) error {
+
+	if strings.TrimSpace(path) != path {
+		return fmt.Errorf("path %q has surrounding whitespace", path)
+	}
+
+	var depth int
+	var part strings.Builder
+	for i := 0; i < len(path); i++ {
+		ch := path[i]
+		switch {
+		case ch == '\\' && i+1 < len(path):
+			// an escaped character is part of the key
+			part.WriteByte(path[i+1])
+			i++
+			continue
+		case ch == '(' || ch == '[' || ch == '{':
+			depth++
+		case ch == ')' || ch == ']' || ch == '}':
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("path %q closes a bracket it never opened", path)
+			}
+		case (ch == '.' || ch == '|') && depth == 0:
+			err := checkPart(path, part.String())
+			if err != nil {
+				return err
+			}
+			part.Reset()
+			continue
+		}
+		part.WriteByte(ch)
+	}
+	if depth != 0 {
+		return fmt.Errorf("path %q leaves a bracket open", path)
+	}
+	return checkPart(path, part.String())
+}
+
+// checkPart reports an empty component, or a modifier gjson does not know
+func checkPart(path, part string) error {
+
+	if part == "" {
+		return fmt.Errorf("path %q has an empty component", path)
+	}
+	if strings.HasPrefix(part, "@") {
+		name := strings.TrimPrefix(part, "@")
+		if i := strings.IndexByte(name, ':'); i >= 0 {
+			name = name[:i]
+		}
+		if !gjson.ModifierExists(name, nil) {
+			return fmt.Errorf("path %q uses unknown modifier @%v", path, name)
+		}
+	}
+	return nil
+}
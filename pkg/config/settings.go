@@ -0,0 +1,519 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/UKHomeOffice/snowsync/pkg/attachment"
+	"github.com/UKHomeOffice/snowsync/pkg/caller"
+	"github.com/UKHomeOffice/snowsync/pkg/metrics"
+	"github.com/UKHomeOffice/snowsync/pkg/outbox"
+	"github.com/UKHomeOffice/snowsync/pkg/secrets"
+	"github.com/UKHomeOffice/snowsync/pkg/store"
+	"github.com/UKHomeOffice/snowsync/pkg/tracing"
+	"github.com/UKHomeOffice/snowsync/pkg/webhook"
+)
+
+// StoreOptions returns the options the mapping store is opened with
+// both directions share one table or bolt bucket, as each looks up the records the other wrote
+func (c *Config) StoreOptions() store.Options {
+	return store.Options{
+		Type:   c.Store.Type,
+		Table:  c.Store.Table,
+		Region: c.Store.Region,
+		Path:   c.Store.Path,
+	}
+}
+
+// LinkStoreOptions returns the options the store of comment links is opened with
+// links are kept in LINK_TABLE_NAME, or TABLE_NAME when it is blank
+func (c *Config) LinkStoreOptions() store.Options {
+	return store.Options{
+		Type:      c.Store.Type,
+		Table:     or(c.Store.LinkTable, c.Store.Table),
+		Region:    c.Store.Region,
+		Path:      c.Store.Path,
+		Namespace: "links",
+	}
+}
+
+// OutboxOptions returns the options the outbox is opened with
+// under Lambda the outbox defaults to dynamodb, as failed deliveries would otherwise be lost with the invocation
+func (c *Config) OutboxOptions() outbox.Options {
+	o := outbox.Options{
+		Type:   c.Outbox.Type,
+		Table:  c.Outbox.Table,
+		Region: c.Store.Region,
+		Path:   c.Outbox.Path,
+	}
+	if o.Type == "" {
+		o.Type = outbox.TypeNone
+		if onLambda() {
+			o.Type = outbox.TypeDynamoDB
+		}
+	}
+	return o
+}
+
+// onLambda reports whether the process runs as a Lambda function
+func onLambda() bool {
+	return os.Getenv("AWS_LAMBDA_FUNCTION_NAME") != ""
+}
+
+// outboxProblems checks the outbox can be opened
+func (c *Config) outboxProblems() []string {
+	o := c.OutboxOptions()
+	switch o.Type {
+	case outbox.TypeNone:
+	case outbox.TypeMemory:
+		if onLambda() {
+			return []string{"OUTBOX_TYPE: the memory outbox does not outlive a Lambda invocation, use dynamodb or none"}
+		}
+	case outbox.TypeFile:
+		if o.Path == "" {
+			return []string{"OUTBOX_PATH: missing, needed by the file outbox"}
+		}
+	case outbox.TypeDynamoDB:
+		if o.Table == "" && c.Outbox.Type == "" {
+			return []string{"OUTBOX_TABLE: missing, needed by the dynamodb outbox used under Lambda unless OUTBOX_TYPE is none"}
+		}
+		if o.Table == "" {
+			return []string{"OUTBOX_TABLE: missing, needed by the dynamodb outbox"}
+		}
+	default:
+		return []string{fmt.Sprintf("OUTBOX_TYPE: unknown outbox %q", o.Type)}
+	}
+	return nil
+}
+
+// RetryPolicy returns the policy both clients retry with
+func (c *Config) RetryPolicy() (*caller.RetryPolicy, error) {
+	p, problems := c.retryPolicy()
+	return p, check(problems)
+}
+
+func (c *Config) retryPolicy() (*caller.RetryPolicy, []string) {
+
+	p := caller.DefaultRetryPolicy()
+	var problems []string
+	r := c.Retry
+
+	if r.MaxAttempts != "" {
+		n, err := strconv.Atoi(r.MaxAttempts)
+		if err != nil || n < 1 {
+			problems = append(problems, fmt.Sprintf("RETRY_MAX_ATTEMPTS: invalid count %q", r.MaxAttempts))
+		}
+		p.MaxAttempts = n
+	}
+	if r.BaseDelay != "" {
+		d, err := time.ParseDuration(r.BaseDelay)
+		if err != nil || d < 0 {
+			problems = append(problems, fmt.Sprintf("RETRY_BASE_DELAY: invalid duration %q", r.BaseDelay))
+		}
+		p.BaseDelay = d
+	}
+	if r.MaxDelay != "" {
+		d, err := time.ParseDuration(r.MaxDelay)
+		if err != nil || d < 0 {
+			problems = append(problems, fmt.Sprintf("RETRY_MAX_DELAY: invalid duration %q", r.MaxDelay))
+		}
+		p.MaxDelay = d
+	}
+	if r.Jitter != "" {
+		b, err := strconv.ParseBool(r.Jitter)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("RETRY_JITTER: invalid boolean %q", r.Jitter))
+		}
+		p.Jitter = b
+	}
+	if r.StatusCodes != "" {
+		p.RetryStatus = nil
+		for _, s := range strings.Split(r.StatusCodes, ",") {
+			code, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || code < 100 || code > 599 {
+				problems = append(problems, fmt.Sprintf("RETRY_STATUS_CODES: invalid status %q", s))
+				continue
+			}
+			p.RetryStatus = append(p.RetryStatus, code)
+		}
+	}
+	return p, problems
+}
+
+// auth returns the authentication settings of a system and the prefix of their variables
+func (c *Config) auth(system string) (Auth, string) {
+	if system == secrets.SNOW {
+		return c.SNOWAuth, "SNOW_"
+	}
+	return c.JSDAuth, "JSD_"
+}
+
+// authProblems checks the authentication of a system names a known mode with the settings it needs
+func (c *Config) authProblems(system string) []string {
+
+	a, prefix := c.auth(system)
+	switch a.Mode {
+	case "", caller.AuthBasic, caller.AuthBearer:
+	case caller.AuthOAuth2:
+		if a.TokenURL == "" {
+			return []string{prefix + "TOKEN_URL: missing, needed by oauth2 authentication"}
+		}
+	case caller.AuthMTLS:
+		var problems []string
+		if a.TLSCert == "" {
+			problems = append(problems, prefix+"TLS_CERT: missing, needed by mtls authentication")
+		}
+		if a.TLSKey == "" {
+			problems = append(problems, prefix+"TLS_KEY: missing, needed by mtls authentication")
+		}
+		return problems
+	default:
+		return []string{fmt.Sprintf("%vAUTH: unknown mode %q", prefix, a.Mode)}
+	}
+	return nil
+}
+
+// Authenticator builds the authenticator of a system, whose credentials are loaded from the set of the same name
+func (c *Config) Authenticator(system string, p secrets.Provider) (caller.Authenticator, error) {
+
+	err := check(c.authProblems(system))
+	if err != nil {
+		return nil, err
+	}
+
+	a, _ := c.auth(system)
+	switch a.Mode {
+	case caller.AuthBearer:
+		return &caller.Bearer{Secrets: p, Set: system}, nil
+	case caller.AuthOAuth2:
+		return &caller.ClientCredentials{
+			Secrets:  p,
+			Set:      system,
+			TokenURL: a.TokenURL,
+			Scopes:   strings.Fields(a.Scopes),
+		}, nil
+	case caller.AuthMTLS:
+		return caller.NewMutualTLS(a.TLSCert, a.TLSKey, a.TLSCA)
+	}
+	return &caller.Basic{Secrets: p, Set: system}, nil
+}
+
+// secretsProblems checks the secrets backend can be opened
+func (c *Config) secretsProblems() []string {
+
+	var problems []string
+	s := c.Secrets
+	if s.TTL != "" {
+		d, err := time.ParseDuration(s.TTL)
+		if err != nil || d < 0 {
+			problems = append(problems, fmt.Sprintf("SECRETS_TTL: invalid duration %q", s.TTL))
+		}
+	}
+	switch s.Backend {
+	case "", secrets.BackendEnv, secrets.BackendSSM, secrets.BackendSecretsManager:
+	case secrets.BackendFile:
+		if s.Path == "" {
+			problems = append(problems, "SECRETS_PATH: missing, needed by the file secrets backend")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("SECRETS_BACKEND: unknown backend %q", s.Backend))
+	}
+	return problems
+}
+
+// OpenSecrets opens the secrets backend, env by default, cached for SECRETS_TTL
+func (c *Config) OpenSecrets() (*secrets.Cache, error) {
+
+	err := check(c.secretsProblems())
+	if err != nil {
+		return nil, err
+	}
+
+	s := c.Secrets
+	ttl := secrets.DefaultTTL
+	if s.TTL != "" {
+		ttl, _ = time.ParseDuration(s.TTL)
+	}
+
+	var p secrets.Provider
+	switch s.Backend {
+	case secrets.BackendFile:
+		p = &secrets.File{Dir: s.Path}
+	case secrets.BackendSSM:
+		p = secrets.NewSSM(prefix(s.Prefix, "/snowsync/"), c.Store.Region)
+	case secrets.BackendSecretsManager:
+		p = secrets.NewSecretsManager(prefix(s.Prefix, "snowsync/"), c.Store.Region)
+	default:
+		p = secrets.Env{}
+	}
+	return secrets.NewCache(p, ttl), nil
+}
+
+// prefix places the credential sets in SSM or Secrets Manager
+func prefix(set, def string) string {
+	if set != "" {
+		return set
+	}
+	return def
+}
+
+// webhook authentication modes
+const (
+	WebhookAuthRequired = "required"
+	WebhookAuthNone     = "none"
+)
+
+// JSD signature schemes, body is how Atlassian signs its webhooks
+const (
+	SignatureBody      = "body"
+	SignatureTimestamp = "timestamp"
+)
+
+// Verifier builds the verifier of the webhooks a system sends, keeping the nonces it has seen in nonces
+// it is nil only when WEBHOOK_AUTH is none
+func (c *Config) Verifier(system string, nonces store.MappingStore) (webhook.Verifier, error) {
+	v, problems := c.verifier(system, nonces)
+	return v, check(problems)
+}
+
+func (c *Config) verifier(system string, nonces store.MappingStore) (webhook.Verifier, []string) {
+
+	var problems []string
+
+	switch c.Webhooks.Auth {
+	case "", WebhookAuthRequired:
+	case WebhookAuthNone:
+		return nil, nil
+	default:
+		problems = append(problems, fmt.Sprintf("WEBHOOK_AUTH: unknown mode %q, want %v or %v", c.Webhooks.Auth, WebhookAuthRequired, WebhookAuthNone))
+	}
+
+	maxAge := 5 * time.Minute
+	if c.Webhooks.MaxAge != "" {
+		d, err := time.ParseDuration(c.Webhooks.MaxAge)
+		if err != nil || d <= 0 {
+			problems = append(problems, fmt.Sprintf("WEBHOOK_MAX_AGE: invalid duration %q", c.Webhooks.MaxAge))
+		}
+		maxAge = d
+	}
+
+	var auth webhook.Verifier
+	var w Webhook
+	var ts, nonce string
+	switch system {
+	case secrets.JSD:
+		w = c.Webhooks.JSD
+		if w.Secret == "" {
+			problems = append(problems, "JSD_WEBHOOK_SECRET: missing, needed unless WEBHOOK_AUTH is none")
+		}
+		h := &webhook.HMAC{Secret: []byte(w.Secret), Header: or(w.SignatureHeader, "X-Hub-Signature")}
+		switch w.SignatureScheme {
+		case "", SignatureBody:
+			// Atlassian signs the body alone, headers it sends along could be swapped, so they are not checked
+			if w.TimestampHeader != "" {
+				problems = append(problems, fmt.Sprintf("JSD_TIMESTAMP_HEADER: only read with JSD_SIGNATURE_SCHEME %v", SignatureTimestamp))
+			}
+			if w.NonceHeader != "" {
+				problems = append(problems, fmt.Sprintf("JSD_NONCE_HEADER: only read with JSD_SIGNATURE_SCHEME %v", SignatureTimestamp))
+			}
+		case SignatureTimestamp:
+			ts, nonce = or(w.TimestampHeader, "X-Snowsync-Timestamp"), or(w.NonceHeader, "X-Atlassian-Webhook-Identifier")
+			h.TimestampHeader, h.NonceHeader = ts, nonce
+		default:
+			problems = append(problems, fmt.Sprintf("JSD_SIGNATURE_SCHEME: unknown scheme %q, want %v or %v", w.SignatureScheme, SignatureBody, SignatureTimestamp))
+		}
+		auth = h
+	case secrets.SNOW:
+		w = c.Webhooks.SNOW
+		ts, nonce = or(w.TimestampHeader, "X-Snowsync-Timestamp"), or(w.NonceHeader, "X-Snowsync-Nonce")
+		switch {
+		case w.Token != "" && w.User != "":
+			problems = append(problems, "SNOW_WEBHOOK_TOKEN: set either a token or SNOW_WEBHOOK_USER, not both")
+		case w.Token != "":
+			auth = &webhook.Token{Header: or(w.TokenHeader, "X-Snowsync-Token"), Token: w.Token}
+		case w.User != "" && w.Pass == "":
+			problems = append(problems, "SNOW_WEBHOOK_PASS: missing, needed with SNOW_WEBHOOK_USER")
+		case w.User != "":
+			auth = &webhook.Basic{User: w.User, Pass: w.Pass}
+		default:
+			problems = append(problems, "SNOW_WEBHOOK_TOKEN: missing, or set SNOW_WEBHOOK_USER and SNOW_WEBHOOK_PASS, needed unless WEBHOOK_AUTH is none")
+		}
+	}
+	if len(problems) != 0 {
+		return nil, problems
+	}
+	if ts == "" && nonce == "" {
+		return auth, nil
+	}
+	return webhook.All{auth, webhook.NewReplay(system, ts, nonce, maxAge, nonces)}, nil
+}
+
+// AttachmentPolicy returns the policy deciding which attachments are copied
+func (c *Config) AttachmentPolicy() (*attachment.Policy, error) {
+	p, problems := c.attachmentPolicy()
+	return p, check(problems)
+}
+
+func (c *Config) attachmentPolicy() (*attachment.Policy, []string) {
+
+	p := attachment.DefaultPolicy()
+	var problems []string
+	a := c.Attachments
+
+	if a.MaxSize != "" {
+		n, err := strconv.ParseInt(a.MaxSize, 10, 64)
+		if err != nil || n < 1 {
+			problems = append(problems, fmt.Sprintf("ATTACHMENT_MAX_SIZE: invalid size %q", a.MaxSize))
+		}
+		p.MaxSize = n
+	}
+	if a.Types != "" {
+		p.Types = nil
+		for _, t := range strings.Split(a.Types, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				p.Types = append(p.Types, strings.ToLower(t))
+			}
+		}
+	}
+	return p, problems
+}
+
+// AttachmentTable returns the SNOW table files are attached to, incident by default
+func (c *Config) AttachmentTable() string {
+	return or(c.Attachments.SNOWTable, "incident")
+}
+
+// LogLevel returns the minimum level logged, info unless LOG_LEVEL is set
+func (c *Config) LogLevel() (slog.Level, error) {
+	l, problems := c.logLevel()
+	return l, check(problems)
+}
+
+func (c *Config) logLevel() (slog.Level, []string) {
+	var l slog.Level
+	if v := c.Observability.LogLevel; v != "" {
+		err := l.UnmarshalText([]byte(strings.ToUpper(v)))
+		if err != nil {
+			return l, []string{fmt.Sprintf("LOG_LEVEL: invalid level %q", v)}
+		}
+	}
+	return l, nil
+}
+
+// MetricsFormat returns the format metrics are written in
+// under Lambda it defaults to emf, as only the log reaches CloudWatch, and to prometheus elsewhere
+func (c *Config) MetricsFormat() string {
+	if f := c.Observability.MetricsFormat; f != "" {
+		return f
+	}
+	if onLambda() {
+		return metrics.EMF
+	}
+	return metrics.Prometheus
+}
+
+// observabilityProblems checks the logs, metrics and traces can be written as configured
+func (c *Config) observabilityProblems() []string {
+
+	_, problems := c.logLevel()
+	switch f := c.MetricsFormat(); f {
+	case metrics.EMF, metrics.Prometheus, metrics.None:
+	default:
+		problems = append(problems, fmt.Sprintf("METRICS_FORMAT: unknown format %q", f))
+	}
+	switch e := c.Observability.TracesExporter; e {
+	case "", tracing.None, tracing.OTLP, tracing.Stdout:
+	default:
+		problems = append(problems, fmt.Sprintf("OTEL_TRACES_EXPORTER: unknown exporter %q", e))
+	}
+	return problems
+}
+
+// ShutdownTimeout returns how long snowsync-server lets requests in flight finish once told to stop, 20s unless
+// SHUTDOWN_TIMEOUT is set
+func (c *Config) ShutdownTimeout() (time.Duration, error) {
+	d, problems := c.shutdownTimeout()
+	return d, check(problems)
+}
+
+func (c *Config) shutdownTimeout() (time.Duration, []string) {
+	if c.Server.ShutdownTimeout == "" {
+		return 20 * time.Second, nil
+	}
+	d, err := time.ParseDuration(c.Server.ShutdownTimeout)
+	if err != nil || d < 0 {
+		return d, []string{fmt.Sprintf("SHUTDOWN_TIMEOUT: invalid duration %q", c.Server.ShutdownTimeout)}
+	}
+	return d, nil
+}
+
+// serverProblems checks the settings snowsync-server listens with
+func (c *Config) serverProblems() []string {
+
+	_, problems := c.shutdownTimeout()
+	s := c.Server
+	if s.TLSCert != "" && s.TLSKey == "" {
+		problems = append(problems, "TLS_KEY_FILE: missing, needed with TLS_CERT_FILE")
+	}
+	if s.TLSKey != "" && s.TLSCert == "" {
+		problems = append(problems, "TLS_CERT_FILE: missing, needed with TLS_KEY_FILE")
+	}
+	if s.TLSClientCA != "" && s.TLSCert == "" {
+		problems = append(problems, "TLS_CLIENT_CA_FILE: client certificates are only checked over HTTPS, set TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	return problems
+}
+
+// settingsProblems checks every setting the directions given build their clients and handlers from
+func (c *Config) settingsProblems(directions []string) []string {
+
+	var problems []string
+	problems = append(problems, c.outboxProblems()...)
+	problems = append(problems, c.secretsProblems()...)
+	problems = append(problems, c.observabilityProblems()...)
+	problems = append(problems, c.serverProblems()...)
+
+	_, p := c.retryPolicy()
+	problems = append(problems, p...)
+
+	// each direction calls its target system, and the other one too when copying attachments
+	in, out := validating(In, directions), validating(Out, directions)
+	if in || out && c.Out.Attachments != "" {
+		problems = append(problems, c.authProblems(secrets.JSD)...)
+	}
+	if out || in && c.In.Attachments != "" {
+		problems = append(problems, c.authProblems(secrets.SNOW)...)
+	}
+	if in {
+		_, p = c.verifier(secrets.SNOW, nil)
+		problems = append(problems, p...)
+	}
+	if out {
+		_, p = c.verifier(secrets.JSD, nil)
+		problems = append(problems, p...)
+	}
+	if in && c.In.Attachments != "" || out && c.Out.Attachments != "" {
+		_, p = c.attachmentPolicy()
+		problems = append(problems, p...)
+	}
+	return problems
+}
+
+// check turns the problems found into an error, nil when there are none
+func check(problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return &Error{Problems: problems}
+}
+
+func or(v, fallback string) string {
+	if v != "" {
+		return v
+	}
+	return fallback
+}
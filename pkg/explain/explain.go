@@ -0,0 +1,163 @@
+// Package explain describes how a webhook would be parsed and routed, without syncing anything
+// so a mapping can be debugged against a sample payload instead of a deployment
+package explain
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/UKHomeOffice/snowsync/pkg/logging"
+)
+
+// outcomes of an explained webhook
+const (
+	// Process means the event would be synced
+	Process = "process"
+	// Ignore means the event would be accepted and dropped
+	Ignore = "ignore"
+	// Reject means the event would be refused, with a 400 unless the reason gives another status
+	Reject = "reject"
+)
+
+// Field is a value read from the payload through a configured gjson path
+type Field struct {
+	Name  string `json:"name"`
+	Path  string `json:"path"`
+	Value string `json:"value,omitempty"`
+	Found bool   `json:"found"`
+}
+
+// Translation is a value carried through a mapping table
+type Translation struct {
+	Name   string `json:"name"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Mapped bool   `json:"mapped"`
+}
+
+// Report explains one webhook
+type Report struct {
+	Direction    string        `json:"direction"`
+	Resource     string        `json:"resource"`
+	Fields       []Field       `json:"fields"`
+	Translations []Translation `json:"translations,omitempty"`
+	// Identifier is the ticket the event would be processed under
+	Identifier string `json:"identifier,omitempty"`
+	Outcome    string `json:"outcome"`
+	Reason     string `json:"reason,omitempty"`
+	// Notes are the lines the parser logged
+	Notes []string `json:"notes,omitempty"`
+
+	last string
+}
+
+// Read records the value each named path finds in the payload, a blank path is left out
+func (r *Report) Read(body string, paths [][2]string) {
+	for _, p := range paths {
+		if p[1] == "" {
+			continue
+		}
+		v := gjson.Get(body, p[1])
+		r.Fields = append(r.Fields, Field{Name: p[0], Path: p[1], Value: v.String(), Found: v.Exists()})
+	}
+}
+
+// Translate records a value carried through a mapping table
+func (r *Report) Translate(name, from, to string, mapped bool) {
+	r.Translations = append(r.Translations, Translation{Name: name, From: from, To: to, Mapped: mapped})
+}
+
+// Capture returns a context whose log lines are kept as notes of the report
+func (r *Report) Capture(ctx context.Context) context.Context {
+	return logging.Into(ctx, slog.New(&notes{r: r}))
+}
+
+// Decision returns the message of the last note, which is why the parser stopped when it drops an event
+func (r *Report) Decision() string {
+	return r.last
+}
+
+// notes is a slog handler adding each record to a report
+type notes struct {
+	r     *Report
+	attrs []slog.Attr
+}
+
+func (h *notes) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *notes) Handle(_ context.Context, rec slog.Record) error {
+	var b strings.Builder
+	b.WriteString(rec.Message)
+	add := func(a slog.Attr) bool {
+		fmt.Fprintf(&b, " %v=%q", a.Key, a.Value.String())
+		return true
+	}
+	for _, a := range h.attrs {
+		add(a)
+	}
+	rec.Attrs(add)
+	h.r.Notes = append(h.r.Notes, b.String())
+	h.r.last = rec.Message
+	return nil
+}
+
+func (h *notes) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &notes{r: h.r, attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+func (h *notes) WithGroup(string) slog.Handler {
+	return h
+}
+
+// Write prints the report for a reader
+func (r *Report) Write(w io.Writer) error {
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "direction\t%v\n", r.Direction)
+	fmt.Fprintf(tw, "resource\t%v\n", r.Resource)
+
+	fmt.Fprintln(tw, "\nfields")
+	for _, f := range r.Fields {
+		v := fmt.Sprintf("%q", f.Value)
+		if !f.Found {
+			v = "(not found)"
+		}
+		fmt.Fprintf(tw, "  %v\t%v\t%v\n", f.Name, f.Path, v)
+	}
+
+	if len(r.Translations) != 0 {
+		fmt.Fprintln(tw, "\ntranslations")
+		for _, t := range r.Translations {
+			to := fmt.Sprintf("%q", t.To)
+			if !t.Mapped {
+				to = "(no mapping)"
+			}
+			fmt.Fprintf(tw, "  %v\t%q -> %v\n", t.Name, t.From, to)
+		}
+	}
+
+	fmt.Fprintln(tw)
+	if r.Identifier != "" {
+		fmt.Fprintf(tw, "identifier\t%v\n", r.Identifier)
+	}
+	fmt.Fprintf(tw, "outcome\t%v\n", r.Outcome)
+	if r.Reason != "" {
+		fmt.Fprintf(tw, "reason\t%v\n", r.Reason)
+	}
+
+	if len(r.Notes) != 0 {
+		fmt.Fprintln(tw, "\nnotes")
+		for _, n := range r.Notes {
+			fmt.Fprintf(tw, "  %v\n", n)
+		}
+	}
+	return tw.Flush()
+}
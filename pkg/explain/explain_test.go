@@ -0,0 +1,93 @@
+package explain
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/UKHomeOffice/snowsync/pkg/logging"
+)
+
+func TestRead(t *testing.T) {
+
+	r := &Report{}
+	r.Read(`{"number":"INC0010001","priority":""}`, [][2]string{
+		{"INTID_FIELD", "number"},
+		{"PRIORITY_FIELD", "priority"},
+		{"STATUS_FIELD", "state"},
+		// a blank path is not configured, so it is not reported
+		{"EXTID_FIELD", ""},
+	})
+
+	want := []Field{
+		{Name: "INTID_FIELD", Path: "number", Value: "INC0010001", Found: true},
+		{Name: "PRIORITY_FIELD", Path: "priority", Found: true},
+		{Name: "STATUS_FIELD", Path: "state"},
+	}
+	if len(r.Fields) != len(want) {
+		t.Fatalf("fields are %+v", r.Fields)
+	}
+	for i, f := range want {
+		if r.Fields[i] != f {
+			t.Errorf("field %v is %+v, want %+v", i, r.Fields[i], f)
+		}
+	}
+}
+
+func TestCapture(t *testing.T) {
+
+	r := &Report{}
+	ctx := logging.With(r.Capture(context.Background()), logging.Ticket, "INC0010001")
+
+	logging.From(ctx).Info("creating ticket")
+	logging.From(ctx).Warn("ignoring blank or unexpected priority", "priority", "5")
+
+	if len(r.Notes) != 2 {
+		t.Fatalf("notes are %q", r.Notes)
+	}
+	if r.Notes[1] != `ignoring blank or unexpected priority ticket="INC0010001" priority="5"` {
+		t.Errorf("note is %q", r.Notes[1])
+	}
+	// the parser stops on the line explaining why, so the last message is the decision
+	if r.Decision() != "ignoring blank or unexpected priority" {
+		t.Errorf("decision is %q", r.Decision())
+	}
+}
+
+func TestWrite(t *testing.T) {
+
+	r := &Report{
+		Direction: "in",
+		Resource:  "/v2/in",
+		Fields: []Field{
+			{Name: "INTID_FIELD", Path: "number", Value: "INC0010001", Found: true},
+			{Name: "STATUS_FIELD", Path: "state"},
+		},
+		Identifier: "INC0010001",
+		Outcome:    Ignore,
+		Reason:     "ignoring blank or unexpected priority",
+		Notes:      []string{"ignoring blank or unexpected priority"},
+	}
+	r.Translate("priority", "1", "P1", true)
+	r.Translate("service", "Email", "", false)
+
+	var b bytes.Buffer
+	err := r.Write(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`INTID_FIELD   number  "INC0010001"`,
+		"STATUS_FIELD  state   (not found)",
+		`priority  "1" -> "P1"`,
+		`service   "Email" -> (no mapping)`,
+		"identifier  INC0010001",
+		"outcome     ignore",
+		"reason      ignoring blank or unexpected priority",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("%q missing from\n%v", want, b.String())
+		}
+	}
+}
@@ -1,16 +1,49 @@
 package in
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/tidwall/gjson"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/UKHomeOffice/snowsync/pkg/attachment"
+	"github.com/UKHomeOffice/snowsync/pkg/caller"
+	"github.com/UKHomeOffice/snowsync/pkg/config"
+	"github.com/UKHomeOffice/snowsync/pkg/logging"
+	"github.com/UKHomeOffice/snowsync/pkg/metrics"
+	"github.com/UKHomeOffice/snowsync/pkg/outbox"
+	"github.com/UKHomeOffice/snowsync/pkg/tracing"
+	"github.com/UKHomeOffice/snowsync/pkg/webhook"
+)
+
+// reasons a webhook cannot be parsed, counted in metrics
+var (
+	errMissingConfig      = errors.New("missing field path")
+	errMissingField       = errors.New("missing value in payload")
+	errUnexpectedResource = errors.New("unexpected resource")
 )
 
+// parseReason labels a parse failure for metrics
+func parseReason(err error) string {
+	switch {
+	case errors.Is(err, errMissingConfig):
+		return "missing_config"
+	case errors.Is(err, errMissingField):
+		return "missing_field"
+	case errors.Is(err, errUnexpectedResource):
+		return "unexpected_resource"
+	}
+	return "other"
+}
+
 // Incident is a type of ticket
 type Incident struct {
 	Comment        string `json:"comment,omitempty"`
@@ -28,6 +61,24 @@ type Incident struct {
 	Service        string `json:"business_service,omitempty"`
 	Status         string `json:"status,omitempty"`
 	Summary        string `json:"summary,omitempty"`
+	// CommentHash, RemoteCommentID and CommentDeleted follow a comment in the mapping store after it is synced
+	CommentHash     string `json:"comment_hash,omitempty"`
+	RemoteCommentID string `json:"remote_comment_id,omitempty"`
+	CommentDeleted  bool   `json:"comment_deleted,omitempty"`
+	// UpdatedAt is when the source system last changed the ticket, in unix milliseconds, and orders events
+	UpdatedAt int64 `json:"updated_at,omitempty"`
+	// Version counts writes of the record, guarding it against concurrent changes
+	Version int64 `json:"version,omitempty"`
+	// Event is the webhook event, telling comment edits and deletions apart
+	Event string `json:"-"`
+	// State is the JSD workflow state the ticket was moved to, blank when it was not moved
+	State string `json:"-"`
+	// owner names this event as the holder of the creation lock of the ticket
+	owner string
+	// synced is set once the event created or updated a ticket known on both systems
+	synced bool
+	// Attachments are copied separately and never stored
+	Attachments []attachment.Attachment `json:"-"`
 }
 
 // newIncident initialises an Incident
@@ -35,58 +86,64 @@ func newIncident() *Incident {
 	return &Incident{}
 }
 
-// checkVars checks incoming payload has the required field values
-func checkIncidentVars(input string) error {
+// checkIncidentVars checks incoming payload has the required field values
+func checkIncidentVars(input string, f *config.InFields) error {
 
-	vars := []string{
-		"DESCRIPTION_FIELD",
-		"INTID_FIELD",
-		"PRIORITY_FIELD",
-		"REPORTER_FIELD",
-		"STATUS_FIELD",
-		"SUMMARY_FIELD",
+	vars := []struct{ name, field string }{
+		{"DESCRIPTION_FIELD", f.Description},
+		{"INTID_FIELD", f.IntID},
+		{"PRIORITY_FIELD", f.Priority},
+		{"REPORTER_FIELD", f.Reporter},
+		{"STATUS_FIELD", f.Status},
+		{"SUMMARY_FIELD", f.Summary},
 	}
 
 	for _, v := range vars {
-		field, ok := os.LookupEnv(v)
-		if !ok {
-			return fmt.Errorf("missing environment variable: %v", v)
+		if v.field == "" {
+			return fmt.Errorf("%w: %v", errMissingConfig, v.name)
 		}
-		value := gjson.Get(input, field)
+		value := gjson.Get(input, v.field)
 		if !value.Exists() {
-			return fmt.Errorf("missing value in payload: %v", field)
+			return fmt.Errorf("%w: %v", errMissingField, v.field)
 		}
 	}
 	return nil
 }
 
 // parseIncident gets values from an inbound incident
-func parseIncident(input string) (*Incident, error) {
+func (p *Processor) parseIncident(ctx context.Context, input string) (_ *Incident, err error) {
 
+	ctx, span := tracing.Start(ctx, "in.parseIncident")
+	defer func() { tracing.End(span, err) }()
+
+	f := &p.conf.In
 	i := newIncident()
 
-	i.ExtID = gjson.Get(input, os.Getenv("EXTID_FIELD")).Str
+	i.ExtID = gjson.Get(input, f.ExtID).Str
 
 	// check for required values in new tickets only
 	if i.ExtID == "" {
-		err := checkIncidentVars(input)
+		err := checkIncidentVars(input, f)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	i.Description = gjson.Get(input, os.Getenv("DESCRIPTION_FIELD")).Str
-	i.Comment = gjson.Get(input, os.Getenv("COMMENT_FIELD")).Str
-	i.CommentID = gjson.Get(input, os.Getenv("COMMENT_ID_FIELD")).Str
-	i.IntComment = gjson.Get(input, os.Getenv("INTERNAL_COMMENT_FIELD")).Str
-	i.IntCommentID = gjson.Get(input, os.Getenv("INTERNAL_COMMENT_ID_FIELD")).Str
-	i.IntID = gjson.Get(input, os.Getenv("INTID_FIELD")).Str
-	i.Priority = gjson.Get(input, os.Getenv("PRIORITY_FIELD")).Str
-	i.Reporter = gjson.Get(input, os.Getenv("REPORTER_FIELD")).Str
-	i.Resolution = gjson.Get(input, os.Getenv("RESOLUTION_FIELD")).Str
-	i.Service = gjson.Get(input, os.Getenv("SERVICE_FIELD")).Str
-	i.Status = gjson.Get(input, os.Getenv("STATUS_FIELD")).Str
-	i.Summary = gjson.Get(input, os.Getenv("SUMMARY_FIELD")).Str
+	i.Description = gjson.Get(input, f.Description).Str
+	i.Comment = gjson.Get(input, f.Comment).Str
+	i.CommentID = gjson.Get(input, f.CommentID).Str
+	i.IntComment = gjson.Get(input, f.InternalComment).Str
+	i.IntCommentID = gjson.Get(input, f.InternalCommentID).Str
+	i.IntID = gjson.Get(input, f.IntID).Str
+	i.Priority = gjson.Get(input, f.Priority).Str
+	i.Reporter = gjson.Get(input, f.Reporter).Str
+	i.Resolution = gjson.Get(input, f.Resolution).Str
+	i.Service = gjson.Get(input, f.Service).Str
+	i.Status = gjson.Get(input, f.Status).Str
+	i.Summary = gjson.Get(input, f.Summary).Str
+	i.Attachments = attachment.FromSNOW(input, f.Attachments)
+	i.Event = gjson.Get(input, f.Event).Str
+	i.UpdatedAt = updatedAt(gjson.Get(input, f.Updated))
 
 	// treat both type of comment as customer visible comments on JSD
 	// initialise comment id if nil as it's being used as sort key
@@ -103,34 +160,62 @@ func parseIncident(input string) (*Incident, error) {
 		break
 	}
 
-	// assign to an organisation in JSD
-	switch i.Service {
-	case "CSOC":
-		i.Service = "59"
-	case "Cyclamen IT Platform Local":
-		i.Service = "9"
-	case "PPPT - ILEAP":
-		i.Service = "58"
-	case "Semaphore":
-		i.Service = "45"
-	default:
-		i.Service = "65"
-	}
+	i.CommentHash = commentHash(i.Comment)
 
-	fmt.Printf("parsed incident: %v from %v, status: %v, comment id: %v\n", i.IntID, i.Service, i.Status, i.CommentID)
+	// assign to an organisation in JSD
+	i.Service, _ = p.conf.Mappings.Services.ToJSD(i.Service)
 
 	return i, nil
 }
 
+// Handler serves inbound webhooks for the lifetime of a function instance
+type Handler struct {
+	proc *Processor
+	// Outbox tracks each delivery until the other system has accepted it
+	Outbox *outbox.Outbox
+	// Verifier authenticates webhooks, nil accepts every request
+	Verifier webhook.Verifier
+}
+
+// NewHandler creates a Handler around a Processor
+func NewHandler(p *Processor) *Handler {
+	return &Handler{proc: p}
+}
+
 // Handle sends an incoming request to parser and processor, and returns a http response
-func Handle(request *events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+func (h *Handler) Handle(ctx context.Context, request *events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return h.handle(ctx, request, nil, true)
+}
 
-	inc, err := parseIncident(request.Body)
+// Replay re-drives an outbox entry, keeping its delivery history
+// an entry without an id is treated as a recorded webhook and tracked afresh
+// replays are started by an operator, so they are not authenticated again
+func (h *Handler) Replay(ctx context.Context, e *outbox.Entry) (events.APIGatewayProxyResponse, error) {
+	request := &events.APIGatewayProxyRequest{
+		Resource: e.Resource,
+		Body:     e.Body,
+	}
+	if e.ID == "" {
+		e = nil
+	}
+	return h.handle(ctx, request, e, false)
+}
+
+// Identify returns the identifier a request would be processed under, blank if it would be ignored
+func (h *Handler) Identify(request *events.APIGatewayProxyRequest) (string, error) {
+	inc, err := h.route(context.Background(), request)
+	if err != nil || inc == nil {
+		return "", err
+	}
+	return inc.Identifier, nil
+}
+
+// route parses a request and assigns the identifier for its resource
+func (h *Handler) route(ctx context.Context, request *events.APIGatewayProxyRequest) (*Incident, error) {
+
+	inc, err := h.proc.parseIncident(ctx, request.Body)
 	if err != nil {
-		return events.APIGatewayProxyResponse{
-			StatusCode: http.StatusBadRequest,
-			Body:       err.Error(),
-		}, err
+		return nil, err
 	}
 
 	// assign identifier according to the api endpoint used
@@ -141,18 +226,77 @@ func Handle(request *events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 	case "/v2/in":
 		inc.Identifier = inc.IntID
 	default:
-		return events.APIGatewayProxyResponse{
-			StatusCode: http.StatusBadRequest,
-			Body:       err.Error(),
-		}, err
+		return nil, fmt.Errorf("%w: %v", errUnexpectedResource, request.Resource)
 	}
+	return inc, nil
+}
+
+// handle processes a request, e is the outbox entry of a replayed request
+func (h *Handler) handle(ctx context.Context, request *events.APIGatewayProxyRequest, e *outbox.Entry, verify bool) (resp events.APIGatewayProxyResponse, _ error) {
+
+	start := time.Now()
+
+	ctx, span := tracing.Start(tracing.Extract(ctx, request.Headers), "in.Handle",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("snowsync.resource", request.Resource)),
+	)
+	defer span.End()
 
-	res, err := process(inc)
+	ctx = logging.With(ctx,
+		logging.Direction, "in",
+		logging.Resource, request.Resource,
+		logging.RequestID, request.RequestContext.RequestID,
+	)
+	if id := tracing.TraceID(ctx); id != "" {
+		ctx = logging.With(ctx, logging.TraceID, id)
+	}
+
+	if verify && h.Verifier != nil {
+		err := h.Verifier.Verify(ctx, request)
+		if errors.Is(err, webhook.ErrUnauthenticated) {
+			return errorResponse(ctx, http.StatusUnauthorized, err)
+		}
+		if err != nil {
+			return errorResponse(ctx, http.StatusInternalServerError, fmt.Errorf("could not verify webhook: %w", err))
+		}
+		// a delivery that fails from here on gives up its nonce, so the sender can deliver it again
+		defer func() {
+			if resp.StatusCode != http.StatusOK {
+				h.release(ctx, request)
+			}
+		}()
+	}
+
+	inc, err := h.route(ctx, request)
+	if err != nil {
+		metrics.Inc(metrics.ParseFailures, "direction", "in", "reason", parseReason(err))
+		return errorResponse(ctx, http.StatusBadRequest, err)
+	}
+
+	ctx = logging.With(ctx, logging.Ticket, inc.Identifier, logging.Comment, inc.CommentID)
+	span.SetAttributes(attribute.String("snowsync.ticket", inc.Identifier), attribute.String("snowsync.comment_id", inc.CommentID))
+	logging.From(ctx).Info("parsed incident", "service", inc.Service, "status", inc.Status)
+
+	if e == nil {
+		e = outbox.NewEntry("in", request, inc.Identifier, inc.CommentID)
+	}
+	err = h.Outbox.Pending(ctx, e)
 	if err != nil {
-		return events.APIGatewayProxyResponse{
-			StatusCode: http.StatusInternalServerError,
-			Body:       err.Error(),
-		}, err
+		return errorResponse(ctx, http.StatusInternalServerError, fmt.Errorf("could not record pending delivery: %w", err))
+	}
+
+	res, err := h.proc.process(ctx, inc)
+	if err == nil {
+		err = h.proc.attach(ctx, inc)
+	}
+	if err != nil {
+		h.deadLetter(ctx, e, err)
+		return errorResponse(ctx, caller.GatewayStatus(err), err)
+	}
+
+	err = h.Outbox.Delivered(ctx, e)
+	if err != nil {
+		logging.From(ctx).Error("could not mark delivered", "entry_id", e.ID, logging.Err(err))
 	}
 
 	msg := struct {
@@ -163,14 +307,49 @@ func Handle(request *events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 
 	bmsg, err := json.Marshal(msg)
 	if err != nil {
-		return events.APIGatewayProxyResponse{
-			StatusCode: http.StatusInternalServerError,
-			Body:       err.Error(),
-		}, err
+		return errorResponse(ctx, http.StatusInternalServerError, err)
 	}
 
+	logging.From(ctx).Info("request handled", "status", http.StatusOK, logging.Since(start))
+
 	return events.APIGatewayProxyResponse{
 		StatusCode: http.StatusOK,
 		Body:       string(bmsg),
 	}, nil
 }
+
+// release gives up what the verifier holds for a failed delivery, problems are only logged
+func (h *Handler) release(ctx context.Context, request *events.APIGatewayProxyRequest) {
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+
+	err := webhook.Release(ctx, h.Verifier, request)
+	if err != nil {
+		logging.From(ctx).Error("could not release webhook", logging.Err(err))
+	}
+}
+
+// deadLetter keeps a failed delivery for replay, the webhook has already failed so problems are only logged
+// the request context may have expired, so the write gets its own deadline
+func (h *Handler) deadLetter(ctx context.Context, e *outbox.Entry, cause error) {
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+
+	err := h.Outbox.Failed(ctx, e, cause)
+	if err != nil {
+		logging.From(ctx).Error("could not dead-letter", "entry_id", e.ID, logging.Err(err))
+	}
+}
+
+// errorResponse reports a failure to the webhook sender
+// the error is not returned to Lambda as API Gateway would replace the response with a 502
+func errorResponse(ctx context.Context, code int, err error) (events.APIGatewayProxyResponse, error) {
+	logging.From(ctx).Error("request failed", "status", code, logging.Err(err))
+	tracing.Fail(ctx, err)
+	return events.APIGatewayProxyResponse{
+		StatusCode: code,
+		Body:       err.Error(),
+	}, nil
+}
@@ -0,0 +1,224 @@
+package in
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"path"
+
+	"github.com/UKHomeOffice/snowsync/pkg/attachment"
+	"github.com/UKHomeOffice/snowsync/pkg/caller"
+	"github.com/UKHomeOffice/snowsync/pkg/logging"
+	"github.com/UKHomeOffice/snowsync/pkg/metrics"
+	"github.com/UKHomeOffice/snowsync/pkg/tracing"
+)
+
+// EnableAttachments lets the processor copy attachments from SNOW, downloading them through snow
+// the files copied are chosen by the attachment policy of the configuration
+func (p *Processor) EnableAttachments(snow *caller.Client) error {
+	policy, err := p.conf.AttachmentPolicy()
+	if err != nil {
+		return err
+	}
+	p.snow = snow
+	p.policy = policy
+	return nil
+}
+
+// attach copies the attachments of an incident to its JSD ticket, skipping those copied before
+// files the policy rejects are logged and left behind, any other failure fails the webhook so it can be replayed
+func (p *Processor) attach(ctx context.Context, inc *Incident) (err error) {
+
+	if p.policy == nil || len(inc.Attachments) == 0 {
+		return nil
+	}
+	// files go to a ticket this event created or updated, so both identifiers are known
+	if !inc.synced || inc.ExtID == "" {
+		logging.From(ctx).Info("not copying attachments of an event that did not update a ticket")
+		return nil
+	}
+
+	ctx, span := tracing.Start(ctx, "in.attach")
+	defer func() { tracing.End(span, err) }()
+
+	for i := range inc.Attachments {
+		a := &inc.Attachments[i]
+		log := logging.From(ctx).With("attachment_id", a.ID)
+
+		var rec Incident
+		found, err := p.db.LookupComment(ctx, inc.Identifier, a.Key(), &rec)
+		if err != nil {
+			return fmt.Errorf("could not look up attachment %v: %w", a.ID, err)
+		}
+		if found {
+			metrics.Inc(metrics.Attachments, "direction", "in", "outcome", "duplicate")
+			continue
+		}
+
+		copied, err := p.copyAttachment(ctx, inc, a)
+		if errors.Is(err, attachment.ErrRejected) {
+			log.Warn("attachment not copied", logging.Err(err))
+			metrics.Inc(metrics.Attachments, "direction", "in", "outcome", "rejected")
+			continue
+		}
+		if err != nil {
+			metrics.Inc(metrics.Attachments, "direction", "in", "outcome", "failure")
+			return fmt.Errorf("could not copy attachment %v: %w", a.ID, err)
+		}
+
+		// record the file and its copy so a later webhook listing either does not attach it again, in either direction
+		for _, key := range []string{a.Key(), attachment.Key(copied)} {
+			if key == attachment.Key("") {
+				continue
+			}
+			rec = Incident{Identifier: inc.Identifier, ExtID: inc.ExtID, IntID: inc.IntID, CommentID: key}
+			err = p.db.Put(ctx, inc.Identifier, key, &rec)
+			if err != nil {
+				return fmt.Errorf("could not record attachment %v: %w", a.ID, err)
+			}
+		}
+		metrics.Inc(metrics.Attachments, "direction", "in", "outcome", "success")
+		log.Info("attachment copied to JSD", "file_name", a.Name)
+	}
+	return nil
+}
+
+// copyAttachment downloads a file from SNOW and attaches it to the JSD request, returning the id JSD gave the copy
+// JSD takes attachments in two steps: the file is uploaded as a temporary file, which is then attached
+func (p *Processor) copyAttachment(ctx context.Context, inc *Incident, a *attachment.Attachment) (string, error) {
+
+	err := p.policy.Check(a)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := p.policy.Download(ctx, p.snow, a)
+	if err != nil {
+		return "", err
+	}
+
+	tid, err := p.uploadTemporary(ctx, a, b)
+	if err != nil {
+		return "", err
+	}
+
+	dat := map[string]interface{}{
+		"temporaryAttachmentIds": []string{tid},
+		"public":                 true,
+	}
+	out, err := json.Marshal(dat)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal attachment payload: %w", err)
+	}
+
+	path := "/rest/servicedeskapi/request/" + url.PathEscape(inc.ExtID) + "/attachment"
+	req, err := p.jsd.NewRequest(ctx, path, "POST", out)
+	if err != nil {
+		return "", fmt.Errorf("could not make request: %w", err)
+	}
+	res, err := p.jsd.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not attach file on JSD: %w", err)
+	}
+	defer res.Body.Close()
+
+	// the file is attached by now, so without its id the copy is only recognised by the id of the original
+	rb, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		logging.From(ctx).Warn("could not read JSD response body", logging.Err(err))
+		return "", nil
+	}
+	id, err := attachedID(rb)
+	if err != nil {
+		logging.From(ctx).Warn("could not read the id of the attached file", logging.Err(err))
+		return "", nil
+	}
+	return id, nil
+}
+
+// attachedID reads the id JSD gave an attached file, which the service desk API only gives in the link to the file
+func attachedID(body []byte) (string, error) {
+
+	var dat struct {
+		Attachments struct {
+			Values []struct {
+				Links struct {
+					JiraRest string `json:"jiraRest"`
+				} `json:"_links"`
+			} `json:"values"`
+		} `json:"attachments"`
+	}
+	err := json.Unmarshal(body, &dat)
+	if err != nil {
+		return "", fmt.Errorf("could not decode JSD response: %w", err)
+	}
+	if len(dat.Attachments.Values) == 0 {
+		return "", fmt.Errorf("could not find an attachment in JSD response")
+	}
+	link := dat.Attachments.Values[0].Links.JiraRest
+	id := path.Base(link)
+	if link == "" || id == "/" || id == "." {
+		return "", fmt.Errorf("could not find an attachment id in JSD response")
+	}
+	return id, nil
+}
+
+// uploadTemporary uploads a file to the service desk and returns its temporary attachment id
+func (p *Processor) uploadTemporary(ctx context.Context, a *attachment.Attachment, b []byte) (string, error) {
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, a.Name))
+	h.Set("Content-Type", a.ContentType)
+	part, err := w.CreatePart(h)
+	if err != nil {
+		return "", fmt.Errorf("could not create upload: %w", err)
+	}
+	part.Write(b)
+	err = w.Close()
+	if err != nil {
+		return "", fmt.Errorf("could not create upload: %w", err)
+	}
+
+	path := "/rest/servicedeskapi/servicedesk/" + serviceDeskID + "/attachTemporaryFile"
+	req, err := p.jsd.NewRequest(ctx, path, "POST", body.Bytes())
+	if err != nil {
+		return "", fmt.Errorf("could not make request: %w", err)
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	// JSD refuses multipart uploads without this header
+	req.Header.Set("X-Atlassian-Token", "no-check")
+
+	res, err := p.jsd.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not upload file to JSD: %w", err)
+	}
+	defer res.Body.Close()
+
+	rb, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", fmt.Errorf("could not read JSD response body %w", err)
+	}
+
+	var dat struct {
+		Temporary []struct {
+			ID string `json:"temporaryAttachmentId"`
+		} `json:"temporaryAttachments"`
+	}
+	err = json.Unmarshal(rb, &dat)
+	if err != nil {
+		return "", fmt.Errorf("could not decode JSD response: %w", err)
+	}
+	if len(dat.Temporary) == 0 || dat.Temporary[0].ID == "" {
+		return "", fmt.Errorf("could not find a temporary attachment id in JSD response")
+	}
+	return dat.Temporary[0].ID, nil
+}
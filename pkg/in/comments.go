@@ -0,0 +1,96 @@
+package in
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+
+	"github.com/UKHomeOffice/snowsync/pkg/logging"
+	"github.com/UKHomeOffice/snowsync/pkg/loop"
+)
+
+// comment events named by EVENT_FIELD
+const (
+	eventCommentUpdated = "comment_updated"
+	eventCommentDeleted = "comment_deleted"
+)
+
+// commentHash fingerprints comment text so an edit can be told from a repeated delivery
+func commentHash(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:16])
+}
+
+// edited reports whether a comment already synced as rec has changed since
+// older records carry no hash, so for those only an explicit update event counts
+func edited(rec, inc *Incident) bool {
+	if inc.CommentID == "0" || inc.Comment == "" {
+		return false
+	}
+	if inc.Event == eventCommentUpdated {
+		return true
+	}
+	return rec.CommentHash != "" && rec.CommentHash != inc.CommentHash
+}
+
+// editComment carries an edited SNOW comment over to JSD, returning the id of the JSD comment now holding it
+// the JSD comment is rewritten when its id is known, otherwise the new text is added as a further comment
+func (p *Processor) editComment(ctx context.Context, inc *Incident, rec *Incident) (string, error) {
+	body := fmt.Sprintf("Comment edited on ServiceNow (%v): %v", inc.CommentID, inc.Comment)
+	return p.annotateComment(ctx, inc.ExtID, rec.RemoteCommentID, body)
+}
+
+// deleteComment adds a note about a deleted SNOW comment to JSD
+// the JSD copy is left untouched, so nothing is lost if the comment was deleted by mistake
+func (p *Processor) deleteComment(ctx context.Context, inc *Incident, rec *Incident) error {
+	body := fmt.Sprintf("Comment deleted on ServiceNow (%v)", inc.CommentID)
+	if rec.RemoteCommentID != "" {
+		body += fmt.Sprintf(", its copy (%v) is kept", rec.RemoteCommentID)
+	}
+	_, err := p.annotateComment(ctx, inc.ExtID, "", body)
+	return err
+}
+
+// annotateComment replaces the body of JSD comment rid, or adds a new comment when rid is blank
+// the id of the comment written is returned
+func (p *Processor) annotateComment(ctx context.Context, eid, rid, body string) (string, error) {
+
+	out, err := json.Marshal(map[string]string{"body": loop.Mark(body, p.conf.Marker)})
+	if err != nil {
+		return "", fmt.Errorf("could marshal JSD payload: %w", err)
+	}
+
+	path := "/rest/api/2/issue/" + url.PathEscape(eid) + "/comment"
+	method := "POST"
+	if rid != "" {
+		path += "/" + url.PathEscape(rid)
+		method = "PUT"
+	}
+
+	req, err := p.jsd.NewRequest(ctx, path, method, out)
+	if err != nil {
+		return "", fmt.Errorf("could not make request: %w", err)
+	}
+	res, err := p.jsd.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not call JSD: %w", err)
+	}
+	defer res.Body.Close()
+
+	if rid != "" {
+		return rid, nil
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", fmt.Errorf("could not read JSD response body %w", err)
+	}
+	cid, err := commentID(b)
+	if err != nil {
+		logging.From(ctx).Warn("could not read the id of the new JSD comment", logging.Err(err))
+	}
+	return cid, nil
+}
@@ -1,17 +1,20 @@
 package in
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"net/http"
-	"net/url"
 	"strconv"
-	"time"
 
-	"github.com/UKHomeOffice/snowsync/pkg/caller"
+	"github.com/UKHomeOffice/snowsync/pkg/logging"
+	"github.com/UKHomeOffice/snowsync/pkg/mapping"
 )
 
+// serviceDeskID is the JSD service desk tickets are raised on
+const serviceDeskID = "1"
+
 // Values make up the JSD payload
 type Values struct {
 	Comment     string      `json:"comment,omitempty"`
@@ -44,34 +47,29 @@ type transition struct {
 	ID string `json:"id,omitempty"`
 }
 
-func transformCreate(inc *Incident) (map[string]interface{}, error) {
+// errNotRaisable is returned for incidents JSD cannot raise a ticket for, such as those without a known priority
+var errNotRaisable = errors.New("no ticket raised")
+
+// transformCreate builds the JSD request raising a ticket, nil when the incident has no priority JSD knows
+func transformCreate(ctx context.Context, inc *Incident, m *mapping.Mappings) (map[string]interface{}, error) {
 
 	dat := make(map[string]interface{})
-	dat["serviceDeskId"] = "1"
+	dat["serviceDeskId"] = serviceDeskID
 	dat["requestTypeId"] = "14"
 
 	var pri priority
 
-	switch inc.Priority {
-	case "1":
-		pri.Name = "P1 - Production system down"
-	case "2":
-		pri.Name = "P2 - Production system impaired"
-	case "3":
-		pri.Name = "P3 - Non production system impaired"
-	case "4":
-		pri.Name = "P4 - General request"
-	case "5":
-		pri.Name = "P4 - General request"
-	default:
-		fmt.Printf("ignoring blank or unexpected priority: %v", inc.Priority)
+	name, ok := m.Priorities.ToJSD(inc.Priority)
+	if !ok {
+		logging.From(ctx).Info("ignoring blank or unexpected priority", "priority", inc.Priority)
 		return nil, nil
 	}
+	pri.Name = name
 
 	// convert org code to int slice as that's what JSD expects
 	d, err := strconv.Atoi(inc.Service)
 	if err != nil {
-		return nil, fmt.Errorf("could not convert organisation code: %v", err)
+		return nil, fmt.Errorf("could not convert organisation code: %w", err)
 	}
 	var org []int
 	org = append(org, d)
@@ -90,49 +88,31 @@ func transformCreate(inc *Incident) (map[string]interface{}, error) {
 
 }
 
-func createIncident(b []byte) (string, error) {
-
-	user, pass, base, err := getEnv()
-	if err != nil {
-		return "", fmt.Errorf("environment error: %v", err)
-	}
-
-	surl, err := url.Parse(base)
-	if err != nil {
-		return "", fmt.Errorf("could not form JSD URL: %v", err)
-	}
-
-	// create client and request
-	c := &caller.Client{
-		BaseURL:    surl,
-		HTTPClient: &http.Client{Timeout: 5 * time.Second},
-	}
+func (p *Processor) createIncident(ctx context.Context, b []byte) (string, error) {
 
-	req, err := c.NewRequest("/rest/servicedeskapi/request/", "POST", user, pass, b)
+	req, err := p.jsd.NewRequest(ctx, "/rest/servicedeskapi/request/", "POST", b)
 	if err != nil {
-		return "", fmt.Errorf("could not make request: %v", err)
+		return "", fmt.Errorf("could not make request: %w", err)
 	}
 
 	// make HTTP request to JSD
-	res, err := c.Do(req)
+	res, err := p.jsd.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("could not call JSD: %v", err)
+		return "", fmt.Errorf("could not call JSD: %w", err)
 	}
 	defer res.Body.Close()
 
 	// read HTTP response
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return "", fmt.Errorf("could not read JSD response body %v", err)
+		return "", fmt.Errorf("could not read JSD response body %w", err)
 	}
 
-	fmt.Printf("sent request, JSD replied with: %v", string(body))
-
 	// dynamically decode response and check for JSD assigned identifier
 	var dat map[string]interface{}
 	err = json.Unmarshal(body, &dat)
 	if err != nil {
-		return "", fmt.Errorf("could not decode JSD response: %v", err)
+		return "", fmt.Errorf("could not decode JSD response: %w", err)
 	}
 
 	eid, ok := dat["issueKey"].(string)
@@ -140,26 +120,29 @@ func createIncident(b []byte) (string, error) {
 		return "", fmt.Errorf("could not find an identifier in JSD response")
 	}
 
-	fmt.Printf("JSD returned an identifier: %v", eid)
+	logging.From(ctx).Info("JSD returned an identifier", "external_identifier", eid)
 	return eid, nil
 
 }
 
-func (p *Processor) create(in *Incident) (string, error) {
+func (p *Processor) create(ctx context.Context, in *Incident) (string, error) {
 
-	v, err := transformCreate(in)
+	v, err := transformCreate(ctx, in, p.conf.Mappings)
 	if err != nil {
-		return "", fmt.Errorf("could not transform creator payload: %v", err)
+		return "", fmt.Errorf("could not transform creator payload: %w", err)
+	}
+	if v == nil {
+		return "", errNotRaisable
 	}
 
 	new, err := json.Marshal(v)
 	if err != nil {
-		return "", fmt.Errorf("could not marshal creator payload: %v", err)
+		return "", fmt.Errorf("could not marshal creator payload: %w", err)
 	}
 
-	out, err := createIncident(new)
+	out, err := p.createIncident(ctx, new)
 	if err != nil {
-		return "", fmt.Errorf("could not make a create call: %v", err)
+		return "", fmt.Errorf("could not make a create call: %w", err)
 	}
 
 	return out, nil
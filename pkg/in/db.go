@@ -0,0 +1,217 @@
+package in
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/UKHomeOffice/snowsync/pkg/caller"
+	"github.com/UKHomeOffice/snowsync/pkg/logging"
+	"github.com/UKHomeOffice/snowsync/pkg/metrics"
+	"github.com/UKHomeOffice/snowsync/pkg/store"
+	"github.com/UKHomeOffice/snowsync/pkg/tracing"
+)
+
+func (p *Processor) checkPartial(ctx context.Context, inc *Incident) (_ bool, _ string, err error) {
+
+	ctx, span := tracing.Start(ctx, "in.checkPartial")
+	defer func() { tracing.End(span, err) }()
+
+	start := time.Now()
+	defer metrics.Since(metrics.StoreCalls, start, "direction", "in", "operation", "lookup")
+
+	var pld Incident
+	found, err := p.db.Lookup(ctx, inc.Identifier, &pld)
+	if err != nil {
+		return false, "", fmt.Errorf("could not get item: %w", err)
+	}
+
+	if found {
+		if pld.ExtID != "" {
+			logging.From(ctx).Debug("partial match found", "external_identifier", pld.ExtID, logging.Since(start))
+			return true, pld.ExtID, nil
+		}
+		return false, "", fmt.Errorf("partial entry has no external identifier")
+	}
+	logging.From(ctx).Debug("no partial match found", logging.Since(start))
+	return false, "", nil
+}
+
+// checkExact looks for the record of this comment, which is returned when found
+func (p *Processor) checkExact(ctx context.Context, inc *Incident) (_ bool, _ *Incident, err error) {
+
+	ctx, span := tracing.Start(ctx, "in.checkExact")
+	defer func() { tracing.End(span, err) }()
+
+	start := time.Now()
+	defer metrics.Since(metrics.StoreCalls, start, "direction", "in", "operation", "lookup_comment")
+
+	// look for internal_id and comment match
+	var pld Incident
+	found, err := p.db.LookupComment(ctx, inc.Identifier, inc.CommentID, &pld)
+	if err != nil {
+		return false, nil, fmt.Errorf("could not get item: %w", err)
+	}
+
+	if found {
+		if pld.ExtID != "" {
+			logging.From(ctx).Debug("exact match found", "external_identifier", pld.ExtID, logging.Since(start))
+			return true, &pld, nil
+		}
+		return false, nil, fmt.Errorf("exact entry has no external identifier")
+	}
+	logging.From(ctx).Debug("no exact match found", logging.Since(start))
+	return false, nil, nil
+}
+
+func (p *Processor) writeItem(ctx context.Context, inc *Incident) (err error) {
+
+	ctx, span := tracing.Start(ctx, "in.writeItem")
+	defer func() { tracing.End(span, err) }()
+
+	start := time.Now()
+	defer metrics.Since(metrics.StoreCalls, start, "direction", "in", "operation", "put")
+
+	// the record is written only if it is still at the version it was read at
+	prev := inc.Version
+	inc.Version = prev + 1
+	err = p.db.Put(ctx, inc.Identifier, inc.CommentID, inc, store.IfVersion(prev))
+	if errors.Is(err, store.ErrConditionFailed) {
+		inc.Version = prev
+		logging.From(ctx).Warn("rejecting stale write", "version", prev)
+		metrics.Inc(metrics.Stale, "direction", "in", "reason", "version")
+		return fmt.Errorf("%w: record changed by a concurrent request", caller.ErrConflict)
+	}
+	if err != nil {
+		inc.Version = prev
+		return fmt.Errorf("could not put to db: %w", err)
+	}
+
+	logging.From(ctx).Debug("item written to db", "external_identifier", inc.ExtID, logging.Since(start))
+	return nil
+}
+
+// writeLinked writes the record of a comment copied to JSD along with the link between the two comments
+func (p *Processor) writeLinked(ctx context.Context, inc *Incident) error {
+
+	err := p.writeItem(ctx, inc)
+	if err != nil {
+		return err
+	}
+	if inc.RemoteCommentID == "" {
+		return nil
+	}
+
+	err = store.PutLink(ctx, p.links, &store.Link{
+		System:          store.SystemSNOW,
+		Ticket:          inc.IntID,
+		CommentID:       inc.CommentID,
+		RemoteSystem:    store.SystemJSD,
+		RemoteTicket:    inc.ExtID,
+		RemoteCommentID: inc.RemoteCommentID,
+	})
+	if err != nil {
+		return fmt.Errorf("could not link comments: %w", err)
+	}
+	return nil
+}
+
+// claimCreate makes sure only one invocation creates a ticket on JSD
+// when another invocation creates it first, true is returned with the external identifier it was given
+func (p *Processor) claimCreate(ctx context.Context, inc *Incident) (_ bool, _ string, err error) {
+
+	ctx, span := tracing.Start(ctx, "in.claimCreate")
+	defer func() { tracing.End(span, err) }()
+
+	id, err := p.resumeCreate(ctx, inc)
+	if err != nil {
+		return false, "", err
+	}
+	if id != "" {
+		return true, id, nil
+	}
+
+	inc.owner = store.NewOwner()
+	held, err := store.Claim(ctx, p.db, inc.Identifier, inc.owner, func() (bool, error) {
+		logging.From(ctx).Debug("waiting for a concurrent create")
+		var partial bool
+		var err error
+		partial, id, err = p.checkPartial(ctx, inc)
+		if err != nil || partial {
+			return partial, err
+		}
+		// the concurrent request may have created the ticket but failed to record it
+		id, err = p.resumeCreate(ctx, inc)
+		return id != "", err
+	})
+	if errors.Is(err, store.ErrLockHeld) {
+		return false, "", fmt.Errorf("%w: %v", caller.ErrConflict, err)
+	}
+	if err != nil {
+		return false, "", fmt.Errorf("could not claim ticket creation: %w", err)
+	}
+
+	if held {
+		// a create may have finished between the first lookup and taking the lock
+		partial, id, err := p.checkPartial(ctx, inc)
+		if err != nil {
+			p.releaseCreate(ctx, inc)
+			return false, "", err
+		}
+		if !partial {
+			return false, "", nil
+		}
+		p.releaseCreate(ctx, inc)
+		logging.From(ctx).Info("ticket already created by a concurrent request", "external_identifier", id)
+		return true, id, nil
+	}
+
+	logging.From(ctx).Info("ticket created by a concurrent request", "external_identifier", id)
+	return true, id, nil
+}
+
+// resumeCreate finishes a create whose ticket was raised on JSD but whose record was never written,
+// returning the external identifier the lock kept, or an empty string when there is no such create
+func (p *Processor) resumeCreate(ctx context.Context, inc *Incident) (string, error) {
+
+	l, err := store.CreatedLock(ctx, p.db, inc.Identifier)
+	if err != nil || l == nil {
+		return "", err
+	}
+	logging.From(ctx).Info("recording ticket created by an earlier request", "external_identifier", l.RemoteID)
+
+	// the comment of the event that raised the ticket went with it, a later comment is still to be copied
+	rec := Incident{Identifier: inc.Identifier, ExtID: inc.ExtID, IntID: inc.IntID, CommentID: l.CommentID}
+	if l.CommentID == inc.CommentID {
+		rec = *inc
+	}
+	rec.ExtID = l.RemoteID
+	err = p.writeItem(ctx, &rec)
+	// a concurrent request recording the same create is as good
+	if err != nil && !errors.Is(err, caller.ErrConflict) {
+		return "", fmt.Errorf("could not put DB item: %w", err)
+	}
+	err = store.ReleaseLock(ctx, p.db, inc.Identifier, l.Owner)
+	if err != nil {
+		logging.From(ctx).Warn("could not release creation lock", logging.Err(err))
+	}
+	return l.RemoteID, nil
+}
+
+// markCreated keeps the identifier JSD gave the ticket on the creation lock until the record is written,
+// failing to do so leaves a replay to create the ticket again should the write fail too
+func (p *Processor) markCreated(ctx context.Context, inc *Incident) {
+	err := store.MarkCreated(ctx, p.db, inc.Identifier, inc.owner, inc.ExtID, inc.CommentID)
+	if err != nil {
+		logging.From(ctx).Warn("could not record created ticket on creation lock", logging.Err(err))
+	}
+}
+
+// releaseCreate gives up the creation lock, failing to do so only holds up another create until the lock expires
+func (p *Processor) releaseCreate(ctx context.Context, inc *Incident) {
+	err := store.ReleaseLock(ctx, p.db, inc.Identifier, inc.owner)
+	if err != nil {
+		logging.From(ctx).Warn("could not release creation lock", logging.Err(err))
+	}
+}
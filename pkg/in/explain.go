@@ -0,0 +1,84 @@
+package in
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tidwall/gjson"
+
+	"github.com/UKHomeOffice/snowsync/pkg/config"
+	"github.com/UKHomeOffice/snowsync/pkg/explain"
+	"github.com/UKHomeOffice/snowsync/pkg/loop"
+)
+
+// Explain describes how a ServiceNow webhook would be parsed and routed, without calling JSD or the store
+// checks that need the store, such as stale events and comment links, are left out
+func Explain(conf *config.Config, resource, body string) *explain.Report {
+
+	r := &explain.Report{Direction: "in", Resource: resource}
+	f := &conf.In
+	r.Read(body, [][2]string{
+		{"EXTID_FIELD", f.ExtID},
+		{"INTID_FIELD", f.IntID},
+		{"DESCRIPTION_FIELD", f.Description},
+		{"COMMENT_FIELD", f.Comment},
+		{"COMMENT_ID_FIELD", f.CommentID},
+		{"INTERNAL_COMMENT_FIELD", f.InternalComment},
+		{"INTERNAL_COMMENT_ID_FIELD", f.InternalCommentID},
+		{"PRIORITY_FIELD", f.Priority},
+		{"REPORTER_FIELD", f.Reporter},
+		{"RESOLUTION_FIELD", f.Resolution},
+		{"SERVICE_FIELD", f.Service},
+		{"STATUS_FIELD", f.Status},
+		{"SUMMARY_FIELD", f.Summary},
+		{"ATTACHMENTS_FIELD", f.Attachments},
+		{"EVENT_FIELD", f.Event},
+		{"UPDATED_FIELD", f.Updated},
+	})
+
+	ctx := r.Capture(context.Background())
+	h := NewHandler(&Processor{conf: conf})
+	inc, err := h.route(ctx, &events.APIGatewayProxyRequest{Resource: resource, Body: body})
+	if err != nil {
+		r.Outcome, r.Reason = explain.Reject, fmt.Sprintf("%v (%v)", err, http.StatusBadRequest)
+		if errors.Is(err, errUnexpectedResource) {
+			r.Reason += ", expected /v2/in or /v2/add"
+		}
+		return r
+	}
+
+	m := conf.Mappings
+	r.Identifier = inc.Identifier
+	service := gjson.Get(body, f.Service).String()
+	_, ok := m.Services.ToJSD(service)
+	r.Translate("service", service, inc.Service, ok)
+	priority, ok := m.Priorities.ToJSD(inc.Priority)
+	r.Translate("priority", inc.Priority, priority, ok)
+	if target, ok := m.Targets.ToJSD(inc.Status); ok {
+		r.Translate("status (JSD status)", inc.Status, target, true)
+	} else {
+		t, ok := m.Transitions.ToJSD(inc.Status)
+		r.Translate("status (JSD transition)", inc.Status, t, ok)
+	}
+
+	r.Outcome = explain.Process
+	if loop.Marked(inc.Comment, conf.Marker) {
+		r.Outcome, r.Reason = explain.Ignore, "comment carries the snowsync marker"
+		return r
+	}
+
+	// an event of a ticket not synced yet raises it, unless JSD cannot take it
+	if inc.ExtID == "" {
+		v, err := transformCreate(ctx, inc, m)
+		switch {
+		case err != nil:
+			r.Outcome, r.Reason = explain.Reject, fmt.Sprintf("could not transform creator payload: %v (%v)", err, http.StatusInternalServerError)
+		case v == nil:
+			r.Outcome, r.Reason = explain.Ignore, "no ticket would be raised: "+r.Decision()
+		}
+	}
+	return r
+}
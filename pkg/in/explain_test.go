@@ -0,0 +1,65 @@
+package in
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/UKHomeOffice/snowsync/pkg/config"
+	"github.com/UKHomeOffice/snowsync/pkg/explain"
+	"github.com/UKHomeOffice/snowsync/pkg/mapping"
+)
+
+func TestExplain(t *testing.T) {
+
+	conf := &config.Config{
+		In: config.InFields{
+			ExtID:       "external_identifier",
+			IntID:       "number",
+			Description: "description",
+			Priority:    "priority",
+			Reporter:    "reporter",
+			Service:     "service",
+			Status:      "state",
+			Summary:     "summary",
+		},
+		Mappings: mapping.Default(),
+	}
+	// without a default organisation, a service the table does not list leaves the ticket without one
+	conf.Mappings.Services.Default = nil
+	body := func(extra map[string]string) string {
+		m := map[string]string{
+			"number":      "INC0010001",
+			"description": "disk full",
+			"priority":    "2",
+			"reporter":    "alice",
+			"service":     "CSOC",
+			"state":       "1",
+			"summary":     "database down",
+		}
+		for k, v := range extra {
+			m[k] = v
+		}
+		b, _ := json.Marshal(m)
+		return string(b)
+	}
+
+	for name, c := range map[string]struct {
+		resource string
+		body     string
+		outcome  string
+		reason   string
+	}{
+		"create":            {"/v2/in", body(nil), explain.Process, ""},
+		"unmapped priority": {"/v2/in", body(map[string]string{"priority": "9"}), explain.Ignore, "priority"},
+		"unmapped service":  {"/v2/in", body(map[string]string{"service": "nobody"}), explain.Reject, "organisation code"},
+		// a ticket raised from JSD already exists, so its priority is not needed to raise it
+		"update of a JSD ticket": {"/v2/add", body(map[string]string{"priority": "9", "external_identifier": "ACP-7"}), explain.Process, ""},
+		"unexpected resource":    {"/v2/out", body(nil), explain.Reject, "/v2/in or /v2/add"},
+	} {
+		r := Explain(conf, c.resource, c.body)
+		if r.Outcome != c.outcome || !strings.Contains(r.Reason, c.reason) {
+			t.Errorf("%v: got %v (%v)", name, r.Outcome, r.Reason)
+		}
+	}
+}
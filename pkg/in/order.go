@@ -0,0 +1,38 @@
+package in
+
+import (
+	"context"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/UKHomeOffice/snowsync/pkg/order"
+	"github.com/UKHomeOffice/snowsync/pkg/store"
+)
+
+// layouts SNOW gives update times in, such as sys_updated_on, which the REST API gives in UTC
+var layouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+}
+
+// updatedAt reads the update time of an event in unix milliseconds, 0 when it is missing or unreadable
+func updatedAt(v gjson.Result) int64 {
+	return order.UpdatedAt(v, layouts...)
+}
+
+// checkStale reports whether an event is older than the newest one applied to its ticket
+func (p *Processor) checkStale(ctx context.Context, inc *Incident) (bool, error) {
+	return order.Stale(ctx, p.db, "in", inc.Identifier, inc.UpdatedAt)
+}
+
+// advanceHead records an applied event as the newest of its ticket, along with the state it reports the ticket in and
+// the state it moved the ticket to on the other system
+// a stale event reports a state the ticket has since left
+func (p *Processor) advanceHead(ctx context.Context, inc *Incident, stale bool) {
+	order.Advance(ctx, p.db, "in", inc.Identifier, inc.UpdatedAt)
+	if !stale {
+		order.Record(ctx, p.db, store.SystemSNOW, inc.Identifier, inc.Status)
+	}
+	order.Record(ctx, p.db, store.SystemJSD, inc.Identifier, inc.State)
+}
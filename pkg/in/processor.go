@@ -1,135 +1,246 @@
 package in
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"os"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/UKHomeOffice/snowsync/pkg/attachment"
+	"github.com/UKHomeOffice/snowsync/pkg/caller"
+	"github.com/UKHomeOffice/snowsync/pkg/config"
+	"github.com/UKHomeOffice/snowsync/pkg/logging"
+	"github.com/UKHomeOffice/snowsync/pkg/loop"
+	"github.com/UKHomeOffice/snowsync/pkg/metrics"
+	"github.com/UKHomeOffice/snowsync/pkg/store"
 )
 
-// DB defines client methods
-type DB interface {
-	GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error)
-	PutItem(*dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error)
-	Query(*dynamodb.QueryInput) (*dynamodb.QueryOutput, error)
-}
-
-// Dynamo is a DB client
-type Dynamo struct {
-	DynamoDB dynamodbiface.DynamoDBAPI
-}
-
 // Processor can implement client methods
 type Processor struct {
-	db Dynamo
+	db   store.MappingStore
+	jsd  *caller.Client
+	conf *config.Config
+	// links records which comment was copied to which, by default alongside the mapping records
+	links store.MappingStore
+	// transitions caches the JSD transitions discovered for each status
+	transitions *transitionCache
+	// snow and policy are only set when attachments are copied
+	snow   *caller.Client
+	policy *attachment.Policy
 }
 
-func newProcessor(d Dynamo) *Processor {
-	return &Processor{db: d}
+// NewProcessor creates a Processor with its dependencies
+func NewProcessor(db store.MappingStore, jsd *caller.Client, conf *config.Config) *Processor {
+	return &Processor{db: db, links: db, jsd: jsd, conf: conf, transitions: newTransitionCache()}
 }
 
-func newDBClient() *Dynamo {
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	}))
-	ddb := dynamodb.New(sess, &aws.Config{Region: aws.String(os.Getenv("AWS_REGION"))})
-	return &Dynamo{DynamoDB: ddb}
+// ShareLinks keeps comment links in a store shared with the other direction
+func (p *Processor) ShareLinks(links store.MappingStore) {
+	p.links = links
 }
 
-func getEnv() (string, string, string, error) {
+func (p *Processor) process(ctx context.Context, inc *Incident) (_ string, err error) {
 
-	user, ok := os.LookupEnv("ADMIN_USER")
-	if !ok {
-		return "", "", "", fmt.Errorf("missing username")
-	}
+	branch := "ignored"
+	defer func() {
+		// attachments only follow an event that created or updated the ticket
+		inc.synced = err == nil && (branch == "create" || branch == "update" || branch == "progress" || branch == "edit")
+		metrics.Inc(metrics.Processed, "direction", "in", "branch", branch, "outcome", outcome(err))
+	}()
 
-	pass, ok := os.LookupEnv("ADMIN_PASS")
-	if !ok {
-		return "", "", "", fmt.Errorf("missing password")
+	// comments snowsync wrote to SNOW itself are not copied back, the rest of the event still applies
+	reason, err := loop.Echo(ctx, p.links, p.conf.Marker, store.SystemSNOW, inc.IntID, inc.CommentID, inc.Comment)
+	if err != nil {
+		return "", fmt.Errorf("could not check for echo: %w", err)
 	}
-
-	base, ok := os.LookupEnv("JSD_URL")
-	if !ok {
-		return "", "", "", fmt.Errorf("missing JSD URL")
+	echo := reason != ""
+	if echo {
+		logging.From(ctx).Info("dropping self-originated comment", "reason", reason)
+		if inc.Event == eventCommentDeleted {
+			branch = "echo"
+			return "", nil
+		}
+		inc.Comment = ""
+		inc.CommentHash = commentHash("")
 	}
 
-	return user, pass, base, nil
-}
-
-func process(inc *Incident) (string, error) {
-
-	p := newProcessor(*newDBClient())
+	// an event older than the newest one applied to the ticket still brings its comments, which are deduplicated
+	// by comment id, but its status, priority and fields are left alone so a late event cannot roll the ticket back
+	stale, err := p.checkStale(ctx, inc)
+	if err != nil {
+		return "", fmt.Errorf("could not check for stale event: %w", err)
+	}
+	defer func() {
+		if err == nil {
+			p.advanceHead(ctx, inc, stale)
+		}
+	}()
 
 	// check if internal id exists in DB, expect external identifier in return
-	partial, eid, err := p.db.checkPartial(inc)
+	partial, eid, err := p.checkPartial(ctx, inc)
 	if err != nil {
-		return "", fmt.Errorf("could not check partial item: %v", err)
+		return "", fmt.Errorf("could not check partial item: %w", err)
 	}
 
 	//add external identifier
 	inc.ExtID = eid
 	// check if both internal id and comment id exist in DB, expect external identifier in return
-	exact, err := p.db.checkExact(inc)
+	exact, rec, err := p.checkExact(ctx, inc)
 	if err != nil {
-		return "", fmt.Errorf("could not check exact item: %v", err)
+		return "", fmt.Errorf("could not check exact item: %w", err)
+	}
+
+	// an echo belongs to a ticket snowsync already synced, there is nothing to create
+	if echo && !exact && !partial {
+		branch = "echo"
+		return "", nil
+	}
+
+	// only one invocation creates a ticket, the others carry on as updates once it exists
+	if !exact && !partial && inc.Event != eventCommentDeleted {
+		partial, eid, err = p.claimCreate(ctx, inc)
+		if err != nil {
+			return "", err
+		}
+		if partial {
+			inc.ExtID = eid
+			exact, rec, err = p.checkExact(ctx, inc)
+			if err != nil {
+				return "", fmt.Errorf("could not check exact item: %w", err)
+			}
+		}
 	}
 
 	switch {
+	case !exact && inc.Event == eventCommentDeleted:
+		logging.From(ctx).Info("ignoring deletion of a comment that was never synced")
+		return eid, nil
+	case exact && inc.Event == eventCommentDeleted:
+		branch = "delete"
+		ctx = logging.With(ctx, logging.Branch, "delete")
+		if rec.CommentDeleted {
+			logging.From(ctx).Info("comment deletion already synced")
+			return eid, nil
+		}
+		logging.From(ctx).Info("marking deleted comment")
+		err = p.deleteComment(ctx, inc, rec)
+		if err != nil {
+			return "", fmt.Errorf("could not mark deleted comment: %w", err)
+		}
+		upd := *rec
+		upd.CommentDeleted = true
+		err = p.writeItem(ctx, &upd)
+		if err != nil {
+			return "", fmt.Errorf("could not update DB item: %w", err)
+		}
+		return eid, nil
+	case exact && edited(rec, inc):
+		branch = "edit"
+		ctx = logging.With(ctx, logging.Branch, "edit")
+		logging.From(ctx).Info("updating edited comment")
+		inc.RemoteCommentID, err = p.editComment(ctx, inc, rec)
+		if err != nil {
+			return "", fmt.Errorf("could not update edited comment: %w", err)
+		}
+		inc.Version = rec.Version
+		err = p.writeLinked(ctx, inc)
+		if err != nil {
+			return "", fmt.Errorf("could not update DB item: %w", err)
+		}
+		if stale {
+			return eid, nil
+		}
+		err = p.setStatus(ctx, inc)
+		if err != nil {
+			return "", fmt.Errorf("could not update ticket: %w", err)
+		}
+		return eid, nil
 	case !exact && !partial:
-		fmt.Println("creating new ticket...")
-		// create ticket on JSD
-		eid, err := p.create(inc)
+		branch = "create"
+		ctx = logging.With(ctx, logging.Branch, "create")
+		logging.From(ctx).Info("creating new ticket")
+		// create ticket on JSD, a failed create leaves the ticket to the next attempt
+		eid, err := p.create(ctx, inc)
+		if errors.Is(err, errNotRaisable) {
+			p.releaseCreate(ctx, inc)
+			branch = "ignored"
+			return "", nil
+		}
 		if err != nil {
-			return "", fmt.Errorf("could not create ticket: %v", err)
+			p.releaseCreate(ctx, inc)
+			return "", fmt.Errorf("could not create ticket: %w", err)
 		}
 		// add returned external identifier
 		inc.ExtID = eid
+		// the lock keeps the identifier until the record is written, so a replay after a failed write records it
+		p.markCreated(ctx, inc)
 		// create a new DB record
-		err = p.db.writeItem(inc)
+		err = p.writeItem(ctx, inc)
 		if err != nil {
-			return "", fmt.Errorf("could not put DB item: %v", err)
+			return "", fmt.Errorf("could not put DB item: %w", err)
 		}
+		p.releaseCreate(ctx, inc)
 		return eid, nil
-	case !exact && partial:
-		fmt.Println("updating ticket with new comments...")
+	case !exact && partial && inc.Comment != "":
+		branch = "update"
+		ctx = logging.With(ctx, logging.Branch, "update")
+		logging.From(ctx).Info("updating ticket with new comments")
 		// update ticket on SNOW
-		eid, err = p.update(inc)
+		eid, inc.RemoteCommentID, err = p.update(ctx, inc)
 		if err != nil {
-			return "", fmt.Errorf("could not update ticket: %v", err)
+			return "", fmt.Errorf("could not update ticket: %w", err)
 		}
-		// update DB with existing key
-		err := p.db.writeItem(inc)
+		// record the comment as soon as JSD has it, so it is not posted twice if a later step fails
+		err = p.writeLinked(ctx, inc)
 		if err != nil {
-			return "", fmt.Errorf("could not update DB item: %v", err)
+			return "", fmt.Errorf("could not update DB item: %w", err)
 		}
-		err = p.setPriority(inc)
-		if err != nil {
-			return "", fmt.Errorf("could not set priority: %v", err)
+		if stale {
+			return eid, nil
 		}
-		err = p.setStatus(inc)
+		err = p.setPriority(ctx, inc)
 		if err != nil {
-			return "", fmt.Errorf("could not update ticket: %v", err)
+			return "", fmt.Errorf("could not set priority: %w", err)
 		}
-		return eid, nil
-	case exact:
-		fmt.Println("no new comments, updating status only...")
-		// update DB with existing key
-		err := p.db.writeItem(inc)
+		err = p.setStatus(ctx, inc)
 		if err != nil {
-			return "", fmt.Errorf("could not update DB item: %v", err)
+			return "", fmt.Errorf("could not update ticket: %w", err)
 		}
+		return eid, nil
+	case stale:
+		branch = "stale"
+		logging.From(ctx).Info("no new comments in stale event, nothing to update")
+		return eid, nil
+	case exact || partial:
+		branch = "progress"
+		ctx = logging.With(ctx, logging.Branch, "progress")
+		logging.From(ctx).Info("no new comments, updating status only")
 		// remove comments and update ticket
 		inc.Comment = ""
-		err = p.setStatus(inc)
+		// the comment itself is unchanged, so keep what is known about it
+		if exact {
+			inc.CommentHash, inc.RemoteCommentID, inc.CommentDeleted = rec.CommentHash, rec.RemoteCommentID, rec.CommentDeleted
+			inc.Version = rec.Version
+		}
+		err = p.setStatus(ctx, inc)
 		if err != nil {
-			return "", fmt.Errorf("could not update ticket: %v", err)
+			return "", fmt.Errorf("could not update ticket: %w", err)
+		}
+		// update DB with existing key
+		err = p.writeItem(ctx, inc)
+		if err != nil {
+			return "", fmt.Errorf("could not update DB item: %w", err)
 		}
 		return eid, nil
 	default:
-		fmt.Printf("nothing to update, quitting!\n")
+		logging.From(ctx).Info("nothing to update")
 	}
 	return "", nil
 }
+
+// outcome labels a processing result for metrics
+func outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
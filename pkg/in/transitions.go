@@ -0,0 +1,215 @@
+package in
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/UKHomeOffice/snowsync/pkg/logging"
+	"github.com/UKHomeOffice/snowsync/pkg/mapping"
+)
+
+// transitionTTL bounds how long discovered transitions are trusted, so workflow edits are picked up
+var transitionTTL = time.Hour
+
+// issueState is where a JSD issue stands in its workflow
+type issueState struct {
+	Project   string
+	IssueType string
+	Status    string
+}
+
+// transitionCache holds the transitions discovered from each status of each project and issue type
+type transitionCache struct {
+	mu      sync.Mutex
+	entries map[string]transitionEntry
+}
+
+type transitionEntry struct {
+	// ids maps the name of the status a transition leads to onto the transition id
+	ids     map[string]string
+	fetched time.Time
+}
+
+func newTransitionCache() *transitionCache {
+	return &transitionCache{entries: make(map[string]transitionEntry)}
+}
+
+func transitionKey(s *issueState) string {
+	return s.Project + "/" + s.IssueType + "/" + s.Status
+}
+
+func (c *transitionCache) get(s *issueState) (map[string]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[transitionKey(s)]
+	if !ok || time.Since(e.fetched) > transitionTTL {
+		return nil, false
+	}
+	return e.ids, true
+}
+
+func (c *transitionCache) put(s *issueState, ids map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[transitionKey(s)] = transitionEntry{ids: ids, fetched: time.Now()}
+}
+
+func (c *transitionCache) forget(s *issueState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, transitionKey(s))
+}
+
+// moveTo takes a JSD ticket to the named status, discovering the transitions on the way from JSD
+// the JSD workflow, when configured, plans the steps, otherwise the status is expected to be one step away
+func (p *Processor) moveTo(ctx context.Context, inc *Incident, target string) error {
+
+	s, err := p.issueState(ctx, inc.ExtID)
+	if err != nil {
+		return err
+	}
+	if s.Status == target {
+		logging.From(ctx).Info("ticket already in state", "state", target)
+		return nil
+	}
+
+	path := []mapping.Transition{{From: s.Status, To: target}}
+	wf := &p.conf.Mappings.Workflows.JSD
+	if wf.Constrained() {
+		path, err = wf.Path(s.Status, target)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, step := range path {
+		s.Status = step.From
+		id, err := p.discover(ctx, inc.ExtID, s, step)
+		if err != nil {
+			return err
+		}
+
+		// the resolution comment goes with the last step
+		var body string
+		if i == len(path)-1 {
+			body = inc.Resolution
+		}
+		err = p.transition(ctx, inc.ExtID, id, body)
+		if err != nil {
+			// the workflow may have been edited since the transitions were discovered
+			p.transitions.forget(s)
+			return fmt.Errorf("could not move ticket from %v to %v: %w", step.From, step.To, err)
+		}
+	}
+	return nil
+}
+
+// discover finds the id of the transition taking an issue in state s to the next status of a step
+// the transitions of a status are cached per project and issue type, the configured id is used if JSD cannot be asked
+func (p *Processor) discover(ctx context.Context, eid string, s *issueState, step mapping.Transition) (string, error) {
+
+	ids, ok := p.transitions.get(s)
+	if !ok {
+		var err error
+		ids, err = p.listTransitions(ctx, eid)
+		if err != nil && step.ID != "" {
+			logging.From(ctx).Warn("could not discover JSD transitions, using configured id", "transition", step.ID, logging.Err(err))
+			return step.ID, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		p.transitions.put(s, ids)
+	}
+
+	id, ok := ids[step.To]
+	if !ok {
+		return "", fmt.Errorf("%w: JSD offers no transition from %v to %v for %v issues in %v", mapping.ErrNoPath, step.From, step.To, s.IssueType, s.Project)
+	}
+	return id, nil
+}
+
+// issueState asks JSD for the project, issue type and status of an issue
+func (p *Processor) issueState(ctx context.Context, eid string) (*issueState, error) {
+
+	var issue struct {
+		Fields struct {
+			Status struct {
+				Name string `json:"name"`
+			} `json:"status"`
+			IssueType struct {
+				Name string `json:"name"`
+			} `json:"issuetype"`
+			Project struct {
+				Key string `json:"key"`
+			} `json:"project"`
+		} `json:"fields"`
+	}
+	err := p.getJSD(ctx, "/rest/api/2/issue/"+url.PathEscape(eid)+"?fields=status,issuetype,project", &issue)
+	if err != nil {
+		return nil, fmt.Errorf("could not get ticket status: %w", err)
+	}
+	if issue.Fields.Status.Name == "" {
+		return nil, fmt.Errorf("could not find a status for ticket %v", eid)
+	}
+
+	return &issueState{
+		Project:   issue.Fields.Project.Key,
+		IssueType: issue.Fields.IssueType.Name,
+		Status:    issue.Fields.Status.Name,
+	}, nil
+}
+
+// listTransitions asks JSD for the transitions open to an issue, keyed by the status each leads to
+func (p *Processor) listTransitions(ctx context.Context, eid string) (map[string]string, error) {
+
+	var list struct {
+		Transitions []struct {
+			ID string `json:"id"`
+			To struct {
+				Name string `json:"name"`
+			} `json:"to"`
+		} `json:"transitions"`
+	}
+	err := p.getJSD(ctx, "/rest/api/2/issue/"+url.PathEscape(eid)+"/transitions", &list)
+	if err != nil {
+		return nil, fmt.Errorf("could not list transitions: %w", err)
+	}
+
+	ids := make(map[string]string, len(list.Transitions))
+	for _, t := range list.Transitions {
+		if _, ok := ids[t.To.Name]; !ok {
+			ids[t.To.Name] = t.ID
+		}
+	}
+	return ids, nil
+}
+
+// getJSD decodes the response to a JSD GET request into v
+func (p *Processor) getJSD(ctx context.Context, path string, v interface{}) error {
+
+	req, err := p.jsd.NewRequest(ctx, path, "GET", nil)
+	if err != nil {
+		return fmt.Errorf("could not make request: %w", err)
+	}
+	res, err := p.jsd.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not call JSD: %w", err)
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("could not read JSD response body %w", err)
+	}
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		return fmt.Errorf("could not decode JSD response: %w", err)
+	}
+	return nil
+}
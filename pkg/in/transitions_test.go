@@ -0,0 +1,270 @@
+package in
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/UKHomeOffice/snowsync/pkg/caller"
+	"github.com/UKHomeOffice/snowsync/pkg/config"
+	"github.com/UKHomeOffice/snowsync/pkg/mapping"
+	"github.com/UKHomeOffice/snowsync/pkg/store"
+	"github.com/tidwall/gjson"
+)
+
+// workflowJSD answers the issue and transition endpoints for issues ACP-1 and ACP-2, both of project ACP and
+// issue type Incident, offering every transition from every status
+type workflowJSD struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	status      map[string]string
+	transitions map[string]string
+	// listed counts the transition listings, moves keeps the body of each transition request
+	listed int
+	moves  []string
+	// refuse answers the next listing with a status
+	refuse int
+}
+
+func newWorkflowJSD(t *testing.T) *workflowJSD {
+	j := &workflowJSD{
+		status:      map[string]string{"ACP-1": "Open", "ACP-2": "Open"},
+		transitions: map[string]string{"11": "Investigating", "121": "Resolved"},
+	}
+	j.Server = httptest.NewServer(http.HandlerFunc(j.serve))
+	t.Cleanup(j.Close)
+	return j
+}
+
+func (j *workflowJSD) serve(w http.ResponseWriter, r *http.Request) {
+
+	b, _ := ioutil.ReadAll(r.Body)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	key := parts[len(parts)-1]
+	if parts[len(parts)-1] == "transitions" {
+		key = parts[len(parts)-2]
+	}
+	status, ok := j.status[key]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && !strings.HasSuffix(r.URL.Path, "/transitions"):
+		json.NewEncoder(w).Encode(map[string]interface{}{"fields": map[string]interface{}{
+			"status":    map[string]string{"name": status},
+			"issuetype": map[string]string{"name": "Incident"},
+			"project":   map[string]string{"key": "ACP"},
+		}})
+	case r.Method == "GET":
+		j.listed++
+		if j.refuse != 0 {
+			http.Error(w, "refused", j.refuse)
+			j.refuse = 0
+			return
+		}
+		var list []map[string]interface{}
+		for id, to := range j.transitions {
+			list = append(list, map[string]interface{}{"id": id, "to": map[string]string{"name": to}})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"transitions": list})
+	case r.Method == "POST":
+		j.moves = append(j.moves, string(b))
+		to, ok := j.transitions[gjson.GetBytes(b, "transition.id").String()]
+		if !ok {
+			http.Error(w, "invalid transition", http.StatusBadRequest)
+			return
+		}
+		j.status[key] = to
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// newTransitionTest returns a processor moving the issues of a JSD stub through a workflow
+func newTransitionTest(t *testing.T, wf mapping.Workflow) (*Processor, *workflowJSD) {
+	t.Helper()
+
+	jsd := newWorkflowJSD(t)
+	c, err := caller.NewClient(jsd.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mapping.Default()
+	m.Workflows.JSD = wf
+	return NewProcessor(store.NewMemory(), c, &config.Config{Mappings: m}), jsd
+}
+
+func TestMoveToCachesTransitions(t *testing.T) {
+
+	p, jsd := newTransitionTest(t, mapping.Workflow{})
+	ctx := context.Background()
+
+	err := p.moveTo(ctx, &Incident{ExtID: "ACP-1"}, "Investigating")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// both issues start in the same status of the same project and issue type, so one listing serves both
+	err = p.moveTo(ctx, &Incident{ExtID: "ACP-2"}, "Resolved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jsd.listed != 1 {
+		t.Errorf("transitions listed %v times", jsd.listed)
+	}
+	if got := jsd.status["ACP-2"]; got != "Resolved" {
+		t.Errorf("status is %q", got)
+	}
+
+	// a ticket already in the target status is left alone
+	err = p.moveTo(ctx, &Incident{ExtID: "ACP-1"}, "Investigating")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jsd.moves) != 2 {
+		t.Errorf("moved %v times", len(jsd.moves))
+	}
+}
+
+func TestMoveToFollowsWorkflow(t *testing.T) {
+
+	p, jsd := newTransitionTest(t, mapping.Workflow{
+		Initial: "Open",
+		States:  []string{"Open", "Investigating", "Resolved"},
+		Transitions: []mapping.Transition{
+			{From: "Open", To: "Investigating", ID: "11"},
+			{From: "Investigating", To: "Resolved", ID: "121"},
+		},
+	})
+
+	err := p.moveTo(context.Background(), &Incident{ExtID: "ACP-1", Resolution: "fixed"}, "Resolved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jsd.moves) != 2 {
+		t.Fatalf("moved by %v", jsd.moves)
+	}
+	first, last := jsd.moves[0], jsd.moves[1]
+	if gjson.Get(first, "transition.id").String() != "11" || gjson.Get(last, "transition.id").String() != "121" {
+		t.Errorf("moved by %v then %v", first, last)
+	}
+	// the resolution comment only goes with the last step
+	if gjson.Get(first, "update.comment.0.add.body").Exists() || !strings.Contains(gjson.Get(last, "update.comment.0.add.body").String(), "fixed") {
+		t.Errorf("resolution sent with %v and %v", first, last)
+	}
+
+	if err := p.moveTo(context.Background(), &Incident{ExtID: "ACP-2"}, "Closed"); !errors.Is(err, mapping.ErrUnknownState) {
+		t.Errorf("got %v for a status outside the workflow", err)
+	}
+}
+
+func TestDiscoverFallsBackToConfiguredID(t *testing.T) {
+
+	p, jsd := newTransitionTest(t, mapping.Workflow{
+		Initial:     "Open",
+		States:      []string{"Open", "Resolved"},
+		Transitions: []mapping.Transition{{From: "Open", To: "Resolved", ID: "121"}},
+	})
+
+	jsd.refuse = http.StatusForbidden
+	err := p.moveTo(context.Background(), &Incident{ExtID: "ACP-1"}, "Resolved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jsd.moves) != 1 || gjson.Get(jsd.moves[0], "transition.id").String() != "121" {
+		t.Errorf("moved by %v", jsd.moves)
+	}
+
+	// without a configured id there is nothing to fall back on
+	p, jsd = newTransitionTest(t, mapping.Workflow{})
+	jsd.refuse = http.StatusForbidden
+	if err := p.moveTo(context.Background(), &Incident{ExtID: "ACP-1"}, "Resolved"); err == nil {
+		t.Error("moved without knowing the transition")
+	}
+}
+
+func TestDiscoverNoTransition(t *testing.T) {
+
+	p, _ := newTransitionTest(t, mapping.Workflow{})
+	err := p.moveTo(context.Background(), &Incident{ExtID: "ACP-1"}, "Parked")
+	if !errors.Is(err, mapping.ErrNoPath) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestMoveToForgetsRejectedTransitions(t *testing.T) {
+
+	p, jsd := newTransitionTest(t, mapping.Workflow{})
+	ctx := context.Background()
+
+	err := p.moveTo(ctx, &Incident{ExtID: "ACP-1"}, "Investigating")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the workflow is edited, so the cached id is refused and discovered again on the next attempt
+	jsd.transitions = map[string]string{"12": "Investigating"}
+	err = p.moveTo(ctx, &Incident{ExtID: "ACP-2"}, "Investigating")
+	if err == nil {
+		t.Fatal("stale transition accepted")
+	}
+	err = p.moveTo(ctx, &Incident{ExtID: "ACP-2"}, "Investigating")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jsd.listed != 2 {
+		t.Errorf("transitions listed %v times", jsd.listed)
+	}
+	if got := jsd.status["ACP-2"]; got != "Investigating" {
+		t.Errorf("status is %q", got)
+	}
+}
+
+func TestStatusPathStartsFromJSDState(t *testing.T) {
+
+	p, _ := newTransitionTest(t, mapping.Workflow{
+		Initial: "Open",
+		States:  []string{"Open", "Investigating", "Resolved"},
+		Transitions: []mapping.Transition{
+			{From: "Open", To: "Investigating", ID: "11"},
+			{From: "Investigating", To: "Resolved", ID: "121"},
+		},
+	})
+	ctx := context.Background()
+
+	// the SNOW state belongs to the other workflow and is never a starting point on JSD
+	err := store.PutStatus(ctx, p.db, store.SystemSNOW, "INC0010001", "Resolved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, _, err := p.statusPath(ctx, &Incident{Identifier: "INC0010001"}, "121")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(path) != 2 {
+		t.Errorf("moved from Open by %+v", path)
+	}
+
+	// a move reported by JSD is where the next one starts
+	err = store.PutStatus(ctx, p.db, store.SystemJSD, "INC0010001", "Investigating")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, target, err := p.statusPath(ctx, &Incident{Identifier: "INC0010001"}, "121")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(path) != 1 || path[0].ID != "121" || target != "Resolved" {
+		t.Errorf("moved from Investigating by %+v to %v", path, target)
+	}
+}
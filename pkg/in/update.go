@@ -1,49 +1,38 @@
 package in
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 	"net/url"
-	"time"
+	"strings"
 
-	"github.com/UKHomeOffice/snowsync/pkg/caller"
+	"github.com/UKHomeOffice/snowsync/pkg/logging"
+	"github.com/UKHomeOffice/snowsync/pkg/loop"
+	"github.com/UKHomeOffice/snowsync/pkg/mapping"
+	"github.com/UKHomeOffice/snowsync/pkg/store"
 )
 
-func transformUpdate(inc *Incident) (map[string]interface{}, error) {
+func transformUpdate(inc *Incident, marker string) (map[string]interface{}, error) {
 
 	dat := make(map[string]interface{})
 
 	dat["external_identifier"] = inc.ExtID
-	dat["body"] = fmt.Sprintf("Comment added on ServiceNow (%v): %v", inc.CommentID, inc.Comment)
+	dat["body"] = loop.Mark(fmt.Sprintf("Comment added on ServiceNow (%v): %v", inc.CommentID, inc.Comment), marker)
 
 	return dat, nil
 }
 
-func updateIncident(b []byte) (string, error) {
-
-	user, pass, base, err := getEnv()
-	if err != nil {
-		return "", fmt.Errorf("environment error: %v", err)
-	}
-
-	surl, err := url.Parse(base)
-	if err != nil {
-		return "", fmt.Errorf("could not form JSD URL: %v", err)
-	}
-
-	// create client and request
-	c := &caller.Client{
-		BaseURL:    surl,
-		HTTPClient: &http.Client{Timeout: 5 * time.Second},
-	}
+// updateIncident posts a comment to JSD, returning the ticket and the id JSD gave the comment
+func (p *Processor) updateIncident(ctx context.Context, b []byte) (string, string, error) {
 
 	// remove the need for this switcheroo
 	var dat map[string]interface{}
-	err = json.Unmarshal(b, &dat)
+	err := json.Unmarshal(b, &dat)
 	if err != nil {
-		return "", fmt.Errorf("could not decode payload to get external id: %v", err)
+		return "", "", fmt.Errorf("could not decode payload to get external id: %w", err)
 	}
 
 	eid, ok := dat["external_identifier"].(string)
@@ -51,140 +40,218 @@ func updateIncident(b []byte) (string, error) {
 		delete(dat, "external_identifier")
 		path, err := url.Parse("/rest/api/2/issue/" + eid + "/comment")
 		if err != nil {
-			return "", fmt.Errorf("could not form JSD URL: %v", err)
+			return "", "", fmt.Errorf("could not form JSD URL: %w", err)
 		}
 		out, err := json.Marshal(&dat)
 		if err != nil {
-			return "", fmt.Errorf("could marshal JSD payload: %v", err)
+			return "", "", fmt.Errorf("could marshal JSD payload: %w", err)
 		}
 
-		req, err := c.NewRequest(path.Path, "POST", user, pass, out)
+		req, err := p.jsd.NewRequest(ctx, path.Path, "POST", out)
 		if err != nil {
-			return "", fmt.Errorf("could not make request: %v", err)
+			return "", "", fmt.Errorf("could not make request: %w", err)
 		}
 		// make HTTP request to JSD
-		res, err := c.Do(req)
+		res, err := p.jsd.Do(req)
 		if err != nil {
-			return "", fmt.Errorf("could not call JSD: %v", err)
+			return "", "", fmt.Errorf("could not call JSD: %w", err)
 		}
 		defer res.Body.Close()
 
 		// read HTTP response
-		_, err = ioutil.ReadAll(res.Body)
+		body, err := ioutil.ReadAll(res.Body)
 		if err != nil {
-			return "", fmt.Errorf("could not read JSD response body %v", err)
+			return "", "", fmt.Errorf("could not read JSD response body %w", err)
 		}
 
-		//fmt.Printf("sent request, JSD replied with: %v", string(body))
-		return eid, nil
+		// the comment is on JSD by now, so failing here would only post it again on replay
+		cid, err := commentID(body)
+		if err != nil {
+			logging.From(ctx).Warn("could not read the id of the new JSD comment", logging.Err(err))
+		}
+		return eid, cid, nil
 	}
-	return "", fmt.Errorf("no identifier in payload")
+	return "", "", fmt.Errorf("no identifier in payload")
 }
 
-func (p *Processor) update(inc *Incident) (string, error) {
+// update adds a comment to JSD, returning the ticket and the id of the new comment
+func (p *Processor) update(ctx context.Context, inc *Incident) (string, string, error) {
 
-	v, err := transformUpdate(inc)
+	v, err := transformUpdate(inc, p.conf.Marker)
 	if err != nil {
-		return "", fmt.Errorf("could not transform creator payload: %v", err)
+		return "", "", fmt.Errorf("could not transform creator payload: %w", err)
 	}
 
 	upd, err := json.Marshal(v)
 	if err != nil {
-		return "", fmt.Errorf("could not marshal updater payload: %v", err)
+		return "", "", fmt.Errorf("could not marshal updater payload: %w", err)
 	}
 
-	out, err := updateIncident(upd)
+	eid, cid, err := p.updateIncident(ctx, upd)
 	if err != nil {
-		return "", fmt.Errorf("could not make an update call: %v", err)
+		return "", "", fmt.Errorf("could not make an update call: %w", err)
 	}
 
-	return out, nil
+	return eid, cid, nil
 }
 
-func (p *Processor) setStatus(inc *Incident) error {
+// commentID reads the id JSD gave a new comment
+func commentID(body []byte) (string, error) {
 
-	user, pass, base, err := getEnv()
+	var c struct {
+		ID string `json:"id"`
+	}
+	err := json.Unmarshal(body, &c)
 	if err != nil {
-		return fmt.Errorf("environment error: %v", err)
+		return "", fmt.Errorf("could not decode JSD comment: %w", err)
+	}
+	if c.ID == "" {
+		return "", fmt.Errorf("could not find a comment id in JSD response")
 	}
+	return c.ID, nil
+}
 
-	surl, err := url.Parse(base)
-	if err != nil {
-		return fmt.Errorf("could not form JSD URL: %v", err)
+// setStatus moves the JSD ticket to the state the SNOW status maps to, through as many transitions as the workflow needs
+// statuses without a target fall back to the transition ids of the transitions table
+func (p *Processor) setStatus(ctx context.Context, inc *Incident) error {
+
+	if inc.Status == "" {
+		logging.From(ctx).Info("ignoring blank status")
+		return nil
 	}
 
-	// create client and request
-	c := &caller.Client{
-		BaseURL:    surl,
-		HTTPClient: &http.Client{Timeout: 5 * time.Second},
+	// a target status is resolved to transitions by asking JSD
+	if target, ok := p.conf.Mappings.Targets.ToJSD(inc.Status); ok {
+		if target == "" {
+			logging.From(ctx).Info("ignoring status", "status", inc.Status)
+			return nil
+		}
+		err := p.moveTo(ctx, inc, target)
+		if err != nil && p.conf.Mappings.Workflows.JSD.Ignores() && (errors.Is(err, mapping.ErrNoPath) || errors.Is(err, mapping.ErrUnknownState)) {
+			logging.From(ctx).Info("ignoring status the workflow cannot reach", "status", inc.Status, logging.Err(err))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		inc.State = target
+		return nil
 	}
 
 	// t holds the transition code
-	var t string
-	switch inc.Status {
-	case "":
-		fmt.Printf("\nignoring blank status %v\n", inc.Status)
+	t, ok := p.conf.Mappings.Transitions.ToJSD(inc.Status)
+	if !ok {
+		err := p.conf.Mappings.Workflows.SNOW.Unexpected(inc.Status)
+		if err != nil {
+			return err
+		}
+		logging.From(ctx).Info("ignoring unknown status", "status", inc.Status)
 		return nil
-	case "1":
-		fmt.Printf("\nignoring status %v\n", inc.Status)
+	}
+	if t == "" {
+		logging.From(ctx).Info("ignoring status", "status", inc.Status)
 		return nil
-	case "10100":
-		t = "11"
-	case "3":
-		t = "121"
-	default:
-		return fmt.Errorf("\nunexpected ticket status: %v", inc.Status)
 	}
 
-	// add resolution comments
-	var rc resolution
-	var co comment
+	path, target, err := p.statusPath(ctx, inc, t)
+	if err != nil && p.conf.Mappings.Workflows.JSD.Ignores() {
+		logging.From(ctx).Info("ignoring status the workflow cannot reach", "status", inc.Status, logging.Err(err))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(path) == 0 {
+		logging.From(ctx).Info("ticket already in state", "state", target)
+		inc.State = target
+		return nil
+	}
 
-	co = make(comment, 0)
-	co = append(co, struct {
-		Action add "json:\"add,omitempty\""
-	}{add{Body: inc.Resolution}})
-	rc.Com = co
+	for i, tr := range path {
+		// the resolution comment goes with the last step
+		var body string
+		if i == len(path)-1 {
+			body = inc.Resolution
+		}
+		err = p.transition(ctx, inc.ExtID, tr.ID, body)
+		if err != nil {
+			return fmt.Errorf("could not move ticket from %v to %v: %w", tr.From, tr.To, err)
+		}
+	}
+	inc.State = target
+	return nil
+}
+
+// statusPath works out the transitions taking a JSD ticket to the state transition t leads to, starting from
+// the state it was last known to be in on JSD
+// without a JSD workflow, t is taken on its own as before
+func (p *Processor) statusPath(ctx context.Context, inc *Incident, t string) ([]mapping.Transition, string, error) {
+
+	wf := &p.conf.Mappings.Workflows.JSD
+	if !wf.Constrained() {
+		return []mapping.Transition{{ID: t}}, "", nil
+	}
+
+	target, ok := wf.Target(t)
+	if !ok {
+		return nil, "", fmt.Errorf("%w: transition %v", mapping.ErrNoPath, t)
+	}
+
+	from, err := store.LookupStatus(ctx, p.db, store.SystemJSD, inc.Identifier)
+	if err != nil {
+		return nil, "", err
+	}
+	path, err := wf.Path(from, target)
+	if err != nil {
+		return nil, "", err
+	}
+	return path, target, nil
+}
+
+// transition takes a single JSD transition, adding body as a comment when it is not blank
+func (p *Processor) transition(ctx context.Context, eid, id, body string) error {
 
 	v := Values{
-		Resolution: &rc,
-		Transition: &transition{ID: t},
+		Transition: &transition{ID: id},
+	}
+
+	// add resolution comments
+	if body != "" {
+		var rc resolution
+		var co comment
+
+		co = make(comment, 0)
+		co = append(co, struct {
+			Action add "json:\"add,omitempty\""
+		}{add{Body: loop.Mark(body, p.conf.Marker)}})
+		rc.Com = co
+		v.Resolution = &rc
 	}
 
-	path, err := url.Parse("/rest/api/2/issue/" + inc.ExtID + "/transitions")
+	path, err := url.Parse("/rest/api/2/issue/" + eid + "/transitions")
 	if err != nil {
-		return fmt.Errorf("could not form JSD URL: %v", err)
+		return fmt.Errorf("could not form JSD URL: %w", err)
 	}
 	out, err := json.Marshal(&v)
 	if err != nil {
-		return fmt.Errorf("could marshal JSD payload: %v", err)
+		return fmt.Errorf("could marshal JSD payload: %w", err)
 	}
 
-	req, err := c.NewRequest(path.Path, "POST", user, pass, out)
+	req, err := p.jsd.NewRequest(ctx, path.Path, "POST", out)
 	if err != nil {
-		return fmt.Errorf("could not make request: %v", err)
+		return fmt.Errorf("could not make request: %w", err)
 	}
 	// make HTTP request to JSD
-	res, err := c.Do(req)
+	res, err := p.jsd.Do(req)
 	if err != nil {
-		return fmt.Errorf("could not call JSD: %v", err)
+		return fmt.Errorf("could not call JSD: %w", err)
 	}
 	defer res.Body.Close()
 
 	return nil
 }
 
-func (p *Processor) setPriority(inc *Incident) error {
-
-	user, pass, base, err := getEnv()
-	if err != nil {
-		return fmt.Errorf("environment error: %v", err)
-	}
-
-	surl, err := url.Parse(base)
-	if err != nil {
-		return fmt.Errorf("could not form JSD URL: %v", err)
-	}
+func (p *Processor) setPriority(ctx context.Context, inc *Incident) error {
 
 	// transform priority
 	type set struct {
@@ -199,21 +266,14 @@ func (p *Processor) setPriority(inc *Incident) error {
 		Pri priority `json:"priority,omitempty"`
 	}
 
-	switch inc.Comment {
-	case "ServiceNow updated Priority to 1":
-		inc.Priority = "P1 - Production system down"
-	case "ServiceNow updated Priority to 2":
-		inc.Priority = "P2 - Production system impaired"
-	case "ServiceNow updated Priority to 3":
-		inc.Priority = "P3 - Non production system impaired"
-	case "ServiceNow updated Priority to 4":
-		inc.Priority = "P4 - General request"
-	case "ServiceNow updated Priority to 5":
-		inc.Priority = "P4 - General request"
-	default:
-		fmt.Printf("ignoring blank or unexpected priority: %v", inc.Priority)
+	// SNOW reports priority changes as a comment
+	code := strings.TrimPrefix(inc.Comment, "ServiceNow updated Priority to ")
+	name, ok := p.conf.Mappings.Priorities.ToJSD(code)
+	if code == inc.Comment || !ok {
+		logging.From(ctx).Debug("no priority change in comment")
 		return nil
 	}
+	inc.Priority = name
 
 	var pu priorityUpdate
 	var pa priority
@@ -230,34 +290,26 @@ func (p *Processor) setPriority(inc *Incident) error {
 
 	out, err := json.Marshal(&dat)
 	if err != nil {
-		return fmt.Errorf("could marshal JSD payload: %v", err)
+		return fmt.Errorf("could marshal JSD payload: %w", err)
 	}
 
 	// create HTTP request
-	c := &caller.Client{
-		BaseURL:    surl,
-		HTTPClient: &http.Client{Timeout: 5 * time.Second},
-	}
 	path, err := url.Parse("/rest/api/2/issue/" + inc.ExtID)
 	if err != nil {
-		return fmt.Errorf("could not form JSD URL: %v", err)
+		return fmt.Errorf("could not form JSD URL: %w", err)
 	}
-	req, err := c.NewRequest(path.Path, "PUT", user, pass, out)
+	req, err := p.jsd.NewRequest(ctx, path.Path, "PUT", out)
 	if err != nil {
-		return fmt.Errorf("could not make request: %v", err)
+		return fmt.Errorf("could not make request: %w", err)
 	}
 
 	// make HTTP request to JSD
-	res, err := c.Do(req)
+	res, err := p.jsd.Do(req)
 	if err != nil {
-		return fmt.Errorf("could not call JSD: %v", err)
+		return fmt.Errorf("could not call JSD: %w", err)
 	}
 	defer res.Body.Close()
 
-	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("JSD call failed with status code: %v", res.StatusCode)
-	}
-
-	fmt.Printf("%v updated on JSD", inc.ExtID)
+	logging.From(ctx).Info("priority updated on JSD", "priority", inc.Priority)
 	return nil
 }
@@ -0,0 +1,58 @@
+// Package logging writes structured JSON logs, carrying request fields in a context
+// so every line about one webhook can be found together
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// field names shared by every log line
+const (
+	Direction = "direction"
+	Resource  = "resource"
+	RequestID = "request_id"
+	Ticket    = "ticket"
+	Comment   = "comment_id"
+	Branch    = "branch"
+	Latency   = "latency_ms"
+	TraceID   = "trace_id"
+	Error     = "error"
+)
+
+type key struct{}
+
+// Setup makes a JSON logger writing to w at level the default
+func Setup(w io.Writer, level slog.Level) {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})))
+}
+
+// With returns a context whose logger adds the given key value pairs to every line
+func With(ctx context.Context, args ...any) context.Context {
+	return context.WithValue(ctx, key{}, From(ctx).With(args...))
+}
+
+// Into returns a context carrying l in place of the logger it had
+func Into(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, key{}, l)
+}
+
+// From returns the logger carried by a context, or the default logger
+func From(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(key{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// Since returns a latency attribute in milliseconds
+func Since(start time.Time) slog.Attr {
+	return slog.Float64(Latency, float64(time.Since(start).Microseconds())/1000)
+}
+
+// Err returns an error attribute
+func Err(err error) slog.Attr {
+	return slog.String(Error, err.Error())
+}
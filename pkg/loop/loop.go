@@ -0,0 +1,49 @@
+// Package loop keeps comments snowsync writes from being synced back to the system they came from
+package loop
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/UKHomeOffice/snowsync/pkg/store"
+)
+
+// DefaultMarker is appended to every comment snowsync writes
+// it is made of invisible characters so readers of either system do not see it
+const DefaultMarker = "\u2063\u200b\u2063\u200b\u2063"
+
+// Mark tags comment text as written by snowsync, a blank marker leaves it untouched
+func Mark(text, marker string) string {
+	if text == "" || marker == "" || Marked(text, marker) {
+		return text
+	}
+	return text + marker
+}
+
+// Marked reports whether comment text was written by snowsync
+func Marked(text, marker string) bool {
+	return marker != "" && strings.Contains(text, marker)
+}
+
+// Echo explains why an inbound comment is one snowsync wrote itself, or returns a blank reason if it is not
+// the marker is checked first, then the comment links, which also catch copies whose marker was edited away
+func Echo(ctx context.Context, links store.MappingStore, marker, system, ticket, commentID, text string) (string, error) {
+
+	if Marked(text, marker) {
+		return "comment carries the snowsync marker", nil
+	}
+
+	if links == nil || ticket == "" || commentID == "" || commentID == "0" {
+		return "", nil
+	}
+
+	l, found, err := store.LookupLink(ctx, links, system, ticket, commentID)
+	if err != nil {
+		return "", fmt.Errorf("could not look up comment link: %w", err)
+	}
+	if found && l.Copy {
+		return fmt.Sprintf("comment is the copy of %v comment %v", l.RemoteSystem, l.RemoteCommentID), nil
+	}
+	return "", nil
+}
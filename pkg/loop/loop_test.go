@@ -0,0 +1,72 @@
+package loop
+
+import (
+	"context"
+	"testing"
+
+	"github.com/UKHomeOffice/snowsync/pkg/store"
+)
+
+func TestMark(t *testing.T) {
+
+	marked := Mark("looking into it", DefaultMarker)
+	if !Marked(marked, DefaultMarker) {
+		t.Errorf("%q not marked", marked)
+	}
+	if again := Mark(marked, DefaultMarker); again != marked {
+		t.Errorf("marked twice: %q", again)
+	}
+	if got := Mark("", DefaultMarker); got != "" {
+		t.Errorf("blank text marked: %q", got)
+	}
+	if got := Mark("looking into it", ""); got != "looking into it" {
+		t.Errorf("blank marker changed text: %q", got)
+	}
+	if Marked("looking into it", "") {
+		t.Error("blank marker matched")
+	}
+}
+
+func TestEcho(t *testing.T) {
+
+	ctx := context.Background()
+	links := store.NewMemory()
+	err := store.PutLink(ctx, links, &store.Link{
+		System:          store.SystemJSD,
+		Ticket:          "ACP-1",
+		CommentID:       "10001",
+		RemoteSystem:    store.SystemSNOW,
+		RemoteTicket:    "INC0010001",
+		RemoteCommentID: "c1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name                    string
+		system, ticket, comment string
+		text                    string
+		echo                    bool
+	}{
+		{"marked", store.SystemSNOW, "INC0010001", "c9", Mark("hello", DefaultMarker), true},
+		{"copy", store.SystemSNOW, "INC0010001", "c1", "hello", true},
+		{"original", store.SystemJSD, "ACP-1", "10001", "hello", false},
+		{"unlinked", store.SystemSNOW, "INC0010001", "c2", "hello", false},
+		{"no comment", store.SystemSNOW, "INC0010001", "0", "", false},
+	} {
+		reason, err := Echo(ctx, links, DefaultMarker, tc.system, tc.ticket, tc.comment, tc.text)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		if got := reason != ""; got != tc.echo {
+			t.Errorf("%v: echo is %v (%q), want %v", tc.name, got, reason, tc.echo)
+		}
+	}
+
+	// without a link store only the marker is checked
+	reason, err := Echo(ctx, nil, DefaultMarker, store.SystemSNOW, "INC0010001", "c1", "hello")
+	if err != nil || reason != "" {
+		t.Errorf("got %q, %v without links", reason, err)
+	}
+}
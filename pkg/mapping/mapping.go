@@ -0,0 +1,205 @@
+package mapping
+
+import (
+	_ "embed" // default mapping document
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+//go:embed default.json
+var defaultDocument []byte
+
+// Pair links a JSD value to its ServiceNow equivalent
+type Pair struct {
+	JSD  string `json:"jsd"`
+	SNOW string `json:"snow"`
+}
+
+// Table is a bidirectional set of value mappings
+// the first matching entry wins, so several values on one side can share a value on the other
+type Table struct {
+	Entries []Pair `json:"entries"`
+	Default *Pair  `json:"default,omitempty"`
+}
+
+// ToSNOW translates a JSD value to ServiceNow
+func (t *Table) ToSNOW(jsd string) (string, bool) {
+	for _, e := range t.Entries {
+		if e.JSD == jsd {
+			return e.SNOW, true
+		}
+	}
+	if t.Default != nil {
+		return t.Default.SNOW, true
+	}
+	return "", false
+}
+
+// ToJSD translates a ServiceNow value to JSD
+func (t *Table) ToJSD(snow string) (string, bool) {
+	for _, e := range t.Entries {
+		if e.SNOW == snow {
+			return e.JSD, true
+		}
+	}
+	if t.Default != nil {
+		return t.Default.JSD, true
+	}
+	return "", false
+}
+
+// Mappings holds every value mapping shared by the inbound and outbound functions
+type Mappings struct {
+	// Services maps JSD organisation codes to SNOW business services
+	Services Table `json:"services"`
+	// Priorities maps JSD priority names to SNOW priority codes
+	Priorities Table `json:"priorities"`
+	// Statuses maps JSD status names to SNOW state codes
+	Statuses Table `json:"statuses"`
+	// Transitions maps SNOW state codes to JSD transition ids, a blank id means the state is ignored
+	Transitions Table `json:"transitions"`
+	// Targets maps SNOW state codes to JSD status names, found on JSD at run time and preferred over Transitions
+	// a blank name means the state is ignored
+	Targets Table `json:"targets"`
+	// Workflows describe the states of each system and the moves allowed between them
+	Workflows Workflows `json:"workflows"`
+}
+
+// Default returns the mappings embedded at build time
+func Default() *Mappings {
+	m, err := Parse(defaultDocument)
+	if err != nil {
+		panic(fmt.Sprintf("invalid embedded mapping document: %v", err))
+	}
+	return m
+}
+
+// Load reads and validates a mapping document, falling back to the embedded default when path is blank
+func Load(path string) (*Mappings, error) {
+
+	if path == "" {
+		return Parse(defaultDocument)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read mapping file: %w", err)
+	}
+
+	m, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mapping file %v: %w", path, err)
+	}
+	return m, nil
+}
+
+// Parse decodes and validates a mapping document
+func Parse(b []byte) (*Mappings, error) {
+
+	var m Mappings
+	err := json.Unmarshal(b, &m)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode mapping document: %w", err)
+	}
+
+	err = m.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Validate checks every table and reports all problems found
+func (m *Mappings) Validate() error {
+
+	var problems []string
+
+	problems = append(problems, checkTable("services", &m.Services, true)...)
+	problems = append(problems, checkTable("priorities", &m.Priorities, true)...)
+	problems = append(problems, checkTable("statuses", &m.Statuses, true)...)
+	// either table can move JSD tickets, so only one of them is needed
+	if len(m.Transitions.Entries) != 0 || len(m.Targets.Entries) == 0 {
+		problems = append(problems, checkTable("transitions", &m.Transitions, false)...)
+	}
+	if len(m.Targets.Entries) != 0 {
+		problems = append(problems, checkTable("targets", &m.Targets, false)...)
+	}
+
+	// JSD expects organisation codes as integers
+	for _, e := range m.Services.Entries {
+		if _, err := strconv.Atoi(e.JSD); e.JSD != "" && err != nil {
+			problems = append(problems, fmt.Sprintf("services: organisation code %q is not a number", e.JSD))
+		}
+	}
+	if m.Services.Default == nil {
+		problems = append(problems, "services: missing default")
+	} else if _, err := strconv.Atoi(m.Services.Default.JSD); err != nil {
+		problems = append(problems, fmt.Sprintf("services: default organisation code %q is not a number", m.Services.Default.JSD))
+	}
+
+	problems = append(problems, m.Workflows.JSD.check("workflows.jsd")...)
+	problems = append(problems, m.Workflows.SNOW.check("workflows.snow")...)
+
+	// every mapped state must be one the workflows know
+	for _, e := range m.Statuses.Entries {
+		if !m.Workflows.JSD.Known(e.JSD) {
+			problems = append(problems, fmt.Sprintf("statuses: %q is not a JSD workflow state", e.JSD))
+		}
+		if !m.Workflows.SNOW.Known(e.SNOW) {
+			problems = append(problems, fmt.Sprintf("statuses: %q is not a ServiceNow workflow state", e.SNOW))
+		}
+	}
+	for _, e := range m.Transitions.Entries {
+		if !m.Workflows.SNOW.Known(e.SNOW) {
+			problems = append(problems, fmt.Sprintf("transitions: %q is not a ServiceNow workflow state", e.SNOW))
+		}
+		if _, ok := m.Workflows.JSD.Target(e.JSD); e.JSD != "" && m.Workflows.JSD.Constrained() && !ok {
+			problems = append(problems, fmt.Sprintf("transitions: %q is not a JSD workflow transition", e.JSD))
+		}
+	}
+	for _, e := range m.Targets.Entries {
+		if !m.Workflows.SNOW.Known(e.SNOW) {
+			problems = append(problems, fmt.Sprintf("targets: %q is not a ServiceNow workflow state", e.SNOW))
+		}
+		if e.JSD != "" && !m.Workflows.JSD.Known(e.JSD) {
+			problems = append(problems, fmt.Sprintf("targets: %q is not a JSD workflow state", e.JSD))
+		}
+	}
+
+	if len(problems) != 0 {
+		return fmt.Errorf("invalid mappings: %v", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkTable reports empty tables, blank values and duplicate entries
+func checkTable(name string, t *Table, requireJSD bool) []string {
+
+	var problems []string
+
+	if len(t.Entries) == 0 {
+		problems = append(problems, fmt.Sprintf("%v: no entries", name))
+	}
+
+	seen := make(map[Pair]bool)
+	for i, e := range t.Entries {
+		if e.SNOW == "" {
+			problems = append(problems, fmt.Sprintf("%v: entry %v has a blank ServiceNow value", name, i))
+		}
+		if requireJSD && e.JSD == "" {
+			problems = append(problems, fmt.Sprintf("%v: entry %v has a blank JSD value", name, i))
+		}
+		if seen[e] {
+			problems = append(problems, fmt.Sprintf("%v: duplicate entry %q ↔ %q", name, e.JSD, e.SNOW))
+		}
+		seen[e] = true
+	}
+
+	if t.Default != nil && (t.Default.JSD == "" || t.Default.SNOW == "") {
+		problems = append(problems, fmt.Sprintf("%v: default must set both values", name))
+	}
+	return problems
+}
@@ -0,0 +1,99 @@
+package mapping
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDefault(t *testing.T) {
+
+	m := Default()
+	if got, ok := m.Priorities.ToSNOW("P1 - Production system down"); !ok || got != "1" {
+		t.Errorf("got %q, %v", got, ok)
+	}
+	// several ServiceNow values can share a JSD value
+	for _, code := range []string{"4", "5"} {
+		if got, ok := m.Priorities.ToJSD(code); !ok || got != "P4 - General request" {
+			t.Errorf("%v: got %q, %v", code, got, ok)
+		}
+	}
+	// the first entry wins going the other way
+	if got, _ := m.Priorities.ToSNOW("P4 - General request"); got != "4" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestTableDefault(t *testing.T) {
+
+	tab := Table{Entries: []Pair{{JSD: "59", SNOW: "CSOC"}}, Default: &Pair{JSD: "65", SNOW: "AWS ACP"}}
+	if got, ok := tab.ToJSD("Unlisted"); !ok || got != "65" {
+		t.Errorf("got %q, %v", got, ok)
+	}
+	if got, ok := tab.ToSNOW("1"); !ok || got != "AWS ACP" {
+		t.Errorf("got %q, %v", got, ok)
+	}
+	tab.Default = nil
+	if _, ok := tab.ToSNOW("1"); ok {
+		t.Error("unlisted value mapped without a default")
+	}
+}
+
+func TestLoad(t *testing.T) {
+
+	m, err := Load("")
+	if err != nil || len(m.Services.Entries) == 0 {
+		t.Fatalf("got %v, %v", m, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "mapping.json")
+	err = ioutil.WriteFile(path, []byte(`{
+		"services": {"entries": [{"jsd": "1", "snow": "Platform"}], "default": {"jsd": "1", "snow": "Platform"}},
+		"priorities": {"entries": [{"jsd": "High", "snow": "1"}]},
+		"statuses": {"entries": [{"jsd": "Open", "snow": "2"}]},
+		"transitions": {"entries": [{"jsd": "11", "snow": "2"}]}
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := m.Services.ToSNOW("1"); got != "Platform" {
+		t.Errorf("got %q", got)
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("missing file loaded")
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	_, err := Parse([]byte(`{
+		"services": {"entries": [{"jsd": "CSOC", "snow": "CSOC"}]},
+		"priorities": {"entries": [{"jsd": "High", "snow": "1"}, {"jsd": "High", "snow": "1"}]},
+		"statuses": {"entries": [{"jsd": "Open", "snow": ""}]},
+		"transitions": {"entries": []}
+	}`))
+	if err == nil {
+		t.Fatal("invalid document accepted")
+	}
+	for _, want := range []string{
+		`services: organisation code "CSOC" is not a number`,
+		"services: missing default",
+		`priorities: duplicate entry "High" ↔ "1"`,
+		"statuses: entry 0 has a blank ServiceNow value",
+		"transitions: no entries",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q not reported in %v", want, err)
+		}
+	}
+
+	if _, err := Parse([]byte(`{"services": [}`)); err == nil {
+		t.Error("malformed document accepted")
+	}
+}
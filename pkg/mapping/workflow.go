@@ -0,0 +1,173 @@
+package mapping
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnknownState is returned for a state a workflow does not know and rejects
+var ErrUnknownState = errors.New("unknown ticket status")
+
+// ErrNoPath is returned when a workflow offers no way from the current state to the one asked for
+var ErrNoPath = errors.New("no transition path")
+
+// Any stands for every state in the From of a transition
+const Any = "*"
+
+// what a workflow does with a state it does not know
+const (
+	UnknownReject = "reject"
+	UnknownIgnore = "ignore"
+)
+
+// Transition is an allowed move between two states
+// ID is the JSD transition taking it, needed by the transitions table and otherwise only used when JSD cannot be asked
+type Transition struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	ID   string `json:"id,omitempty"`
+}
+
+// Workflow is the state machine of tickets on one system
+// a workflow without states places no constraints, so mapping documents written before workflows keep working
+type Workflow struct {
+	// Initial is the state of a newly created ticket
+	Initial     string       `json:"initial"`
+	States      []string     `json:"states"`
+	Transitions []Transition `json:"transitions"`
+	// Unknown is reject or ignore, and applies to states the workflow does not know or cannot reach
+	Unknown string `json:"unknown,omitempty"`
+}
+
+// Workflows holds the state machine of each system
+type Workflows struct {
+	JSD  Workflow `json:"jsd"`
+	SNOW Workflow `json:"snow"`
+}
+
+// Constrained reports whether the workflow describes any states
+func (w *Workflow) Constrained() bool {
+	return len(w.States) != 0
+}
+
+// Known reports whether a state is part of the workflow
+func (w *Workflow) Known(state string) bool {
+	if !w.Constrained() {
+		return true
+	}
+	for _, s := range w.States {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// Ignores reports whether unknown states are skipped rather than rejected
+func (w *Workflow) Ignores() bool {
+	return w.Unknown == UnknownIgnore
+}
+
+// Unexpected applies the unknown state policy to a state, returning ErrUnknownState unless unknown states are ignored
+func (w *Workflow) Unexpected(state string) error {
+	if w.Ignores() {
+		return nil
+	}
+	return fmt.Errorf("%w: %v", ErrUnknownState, state)
+}
+
+// Target returns the state a JSD transition id leads to
+func (w *Workflow) Target(id string) (string, bool) {
+	for _, t := range w.Transitions {
+		if t.ID == id {
+			return t.To, true
+		}
+	}
+	return "", false
+}
+
+// Path finds the fewest transitions leading from one state to another, nothing when they are the same
+// a blank from is taken as the initial state
+func (w *Workflow) Path(from, to string) ([]Transition, error) {
+
+	if from == "" {
+		from = w.Initial
+	}
+	if from == to {
+		return nil, nil
+	}
+	if !w.Known(to) {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownState, to)
+	}
+
+	// breadth first, so the first path found is a shortest one
+	prev := map[string]Transition{from: {}}
+	queue := []string{from}
+	for len(queue) != 0 {
+		s := queue[0]
+		queue = queue[1:]
+		for _, t := range w.Transitions {
+			if t.From != s && t.From != Any {
+				continue
+			}
+			if _, seen := prev[t.To]; seen {
+				continue
+			}
+			t.From = s
+			prev[t.To] = t
+			if t.To == to {
+				return walk(prev, from, to), nil
+			}
+			queue = append(queue, t.To)
+		}
+	}
+	return nil, fmt.Errorf("%w from %v to %v", ErrNoPath, from, to)
+}
+
+// walk follows the transitions recorded by Path back from the end state
+func walk(prev map[string]Transition, from, to string) []Transition {
+	var path []Transition
+	for s := to; s != from; s = prev[s].From {
+		path = append([]Transition{prev[s]}, path...)
+	}
+	return path
+}
+
+// check reports problems with a workflow
+func (w *Workflow) check(name string) []string {
+
+	if !w.Constrained() {
+		if len(w.Transitions) != 0 {
+			return []string{fmt.Sprintf("%v: transitions without states", name)}
+		}
+		return nil
+	}
+
+	var problems []string
+	states := make(map[string]bool)
+	for _, s := range w.States {
+		if s == "" || s == Any {
+			problems = append(problems, fmt.Sprintf("%v: invalid state %q", name, s))
+		}
+		if states[s] {
+			problems = append(problems, fmt.Sprintf("%v: duplicate state %q", name, s))
+		}
+		states[s] = true
+	}
+
+	if !states[w.Initial] {
+		problems = append(problems, fmt.Sprintf("%v: initial state %q is not a state", name, w.Initial))
+	}
+	for i, t := range w.Transitions {
+		if t.From != Any && !states[t.From] {
+			problems = append(problems, fmt.Sprintf("%v: transition %v starts from unknown state %q", name, i, t.From))
+		}
+		if !states[t.To] {
+			problems = append(problems, fmt.Sprintf("%v: transition %v leads to unknown state %q", name, i, t.To))
+		}
+	}
+	if w.Unknown != "" && w.Unknown != UnknownReject && w.Unknown != UnknownIgnore {
+		problems = append(problems, fmt.Sprintf("%v: unknown must be %v or %v", name, UnknownReject, UnknownIgnore))
+	}
+	return problems
+}
@@ -0,0 +1,135 @@
+package mapping
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// ladder is a workflow whose tickets only move one step at a time, and can be reopened from anywhere
+func ladder() *Workflow {
+	return &Workflow{
+		Initial: "Open",
+		States:  []string{"Open", "Investigating", "Monitoring", "Resolved", "Parked"},
+		Transitions: []Transition{
+			{From: "Open", To: "Investigating", ID: "11"},
+			{From: "Investigating", To: "Monitoring", ID: "21"},
+			{From: "Monitoring", To: "Resolved", ID: "31"},
+			{From: Any, To: "Open", ID: "41"},
+		},
+	}
+}
+
+// ids lists the transition ids of a path
+func ids(path []Transition) string {
+	var s []string
+	for _, t := range path {
+		s = append(s, t.From+">"+t.ID+">"+t.To)
+	}
+	return strings.Join(s, " ")
+}
+
+func TestPath(t *testing.T) {
+
+	w := ladder()
+	for _, c := range []struct {
+		from, to, want string
+	}{
+		{from: "Open", to: "Resolved", want: "Open>11>Investigating Investigating>21>Monitoring Monitoring>31>Resolved"},
+		// a blank state is the initial one
+		{from: "", to: "Investigating", want: "Open>11>Investigating"},
+		// a move from any state is taken from the actual one
+		{from: "Resolved", to: "Investigating", want: "Resolved>41>Open Open>11>Investigating"},
+		{from: "Monitoring", to: "Monitoring", want: ""},
+	} {
+		path, err := w.Path(c.from, c.to)
+		if err != nil {
+			t.Errorf("%v to %v: %v", c.from, c.to, err)
+			continue
+		}
+		if got := ids(path); got != c.want {
+			t.Errorf("%v to %v: got %v, want %v", c.from, c.to, got, c.want)
+		}
+	}
+
+	if _, err := w.Path("Open", "Parked"); !errors.Is(err, ErrNoPath) {
+		t.Errorf("unreachable state got %v", err)
+	}
+	if _, err := w.Path("Open", "Closed"); !errors.Is(err, ErrUnknownState) {
+		t.Errorf("unknown state got %v", err)
+	}
+}
+
+func TestUnconstrained(t *testing.T) {
+
+	var w Workflow
+	if !w.Known("anything") {
+		t.Error("a workflow without states rejected a state")
+	}
+	if err := w.Unexpected("anything"); !errors.Is(err, ErrUnknownState) {
+		t.Errorf("got %v", err)
+	}
+	w.Unknown = UnknownIgnore
+	if err := w.Unexpected("anything"); err != nil {
+		t.Errorf("ignored state got %v", err)
+	}
+	if problems := w.check("workflows.jsd"); len(problems) != 0 {
+		t.Errorf("got %v", problems)
+	}
+}
+
+func TestTarget(t *testing.T) {
+
+	w := ladder()
+	if to, ok := w.Target("31"); !ok || to != "Resolved" {
+		t.Errorf("got %q, %v", to, ok)
+	}
+	if _, ok := w.Target("99"); ok {
+		t.Error("unknown transition found")
+	}
+}
+
+func TestCheckWorkflow(t *testing.T) {
+
+	w := &Workflow{
+		Initial: "New",
+		States:  []string{"Open", "Open", Any},
+		Transitions: []Transition{
+			{From: "Closed", To: "Open"},
+			{From: Any, To: "Done", ID: "21"},
+		},
+		Unknown: "drop",
+	}
+	problems := strings.Join(w.check("workflows.jsd"), "; ")
+	for _, want := range []string{
+		`duplicate state "Open"`,
+		`invalid state "*"`,
+		`initial state "New" is not a state`,
+		`transition 0 starts from unknown state "Closed"`,
+		`transition 1 leads to unknown state "Done"`,
+		"unknown must be reject or ignore",
+	} {
+		if !strings.Contains(problems, want) {
+			t.Errorf("%q not reported in %v", want, problems)
+		}
+	}
+
+	w = &Workflow{Transitions: []Transition{{From: Any, To: "Open"}}}
+	if problems := w.check("workflows.snow"); len(problems) != 1 {
+		t.Errorf("transitions without states got %v", problems)
+	}
+}
+
+func TestValidateWorkflowStates(t *testing.T) {
+
+	_, err := Parse([]byte(`{
+		"services": {"entries": [{"jsd": "1", "snow": "Platform"}], "default": {"jsd": "1", "snow": "Platform"}},
+		"priorities": {"entries": [{"jsd": "High", "snow": "1"}]},
+		"statuses": {"entries": [{"jsd": "Open", "snow": "2"}, {"jsd": "Parked", "snow": "2"}]},
+		"transitions": {"entries": [{"jsd": "11", "snow": "2"}]},
+		"workflows": {"jsd": {"initial": "Open", "states": ["Open"]}}
+	}`))
+	if err == nil || !strings.Contains(err.Error(), `statuses: "Parked" is not a JSD workflow state`) {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// writeEMF writes one observation as an Embedded Metric Format line, the caller holds the lock
+// see https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch_Embedded_Metric_Format_Specification.html
+func (r *Registry) writeEMF(name, unit string, value float64, labels []string) {
+
+	if r.emf == nil {
+		return
+	}
+
+	// EMF metric names read better without the Prometheus suffixes
+	metric := strings.TrimSuffix(strings.TrimSuffix(name, "_total"), "_seconds")
+
+	dims := make([]string, 0, len(labels)/2)
+	line := map[string]interface{}{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		dims = append(dims, labels[i])
+		line[labels[i]] = labels[i+1]
+	}
+	line[metric] = value
+	line["_aws"] = map[string]interface{}{
+		"Timestamp": time.Now().UnixNano() / int64(time.Millisecond),
+		"CloudWatchMetrics": []interface{}{
+			map[string]interface{}{
+				"Namespace":  r.namespace,
+				"Dimensions": [][]string{dims},
+				"Metrics": []interface{}{
+					map[string]string{"Name": metric, "Unit": unit},
+				},
+			},
+		},
+	}
+
+	b, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(r.emf, "%s\n", b)
+}
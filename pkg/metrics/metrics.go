@@ -0,0 +1,179 @@
+// Package metrics counts sync outcomes and times downstream calls
+// observations are kept for a Prometheus /metrics endpoint and, under Lambda, written as
+// CloudWatch Embedded Metric Format lines that CloudWatch turns into metrics without an agent
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metric names
+const (
+	// Processed counts processed webhooks by direction, branch and outcome
+	Processed = "snowsync_processed_total"
+	// ParseFailures counts webhooks that could not be parsed by direction and reason
+	ParseFailures = "snowsync_parse_failures_total"
+	// RemoteCalls times calls to SNOW and JSD by system, method and status
+	RemoteCalls = "snowsync_remote_call_seconds"
+	// StoreCalls times mapping store operations by direction and operation
+	StoreCalls = "snowsync_store_seconds"
+	// Attachments counts attachments by direction and outcome
+	Attachments = "snowsync_attachments_total"
+	// Stale counts rejected stale events and writes by direction and reason
+	Stale = "snowsync_stale_total"
+)
+
+// Formats metrics can be written in
+const (
+	EMF        = "emf"
+	Prometheus = "prometheus"
+	None       = "none"
+)
+
+// buckets are the upper bounds of histogram buckets in seconds
+var buckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// series is one metric with one set of label values
+type series struct {
+	labels []string
+	count  float64
+	sum    float64
+	// bucket counts, only for histograms
+	bucket []uint64
+}
+
+// Registry aggregates observations
+type Registry struct {
+	mu     sync.Mutex
+	series map[string]map[string]*series
+	kinds  map[string]string
+	// emf receives an EMF line per observation, nil disables EMF
+	emf       io.Writer
+	namespace string
+	// disabled drops every observation
+	disabled bool
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		series:    make(map[string]map[string]*series),
+		kinds:     make(map[string]string),
+		namespace: "snowsync",
+	}
+}
+
+// Default receives the observations made through the package functions
+var Default = NewRegistry()
+
+// Setup configures the default registry to write in format, emf, prometheus or none, EMF lines are written to w
+// a blank namespace keeps the default
+func Setup(w io.Writer, format, namespace string) error {
+
+	Default.mu.Lock()
+	defer Default.mu.Unlock()
+
+	switch format {
+	case EMF:
+		Default.emf = w
+	case Prometheus:
+		Default.emf = nil
+	case None:
+		Default.disabled = true
+	default:
+		return fmt.Errorf("invalid metrics format: %v", format)
+	}
+
+	if namespace != "" {
+		Default.namespace = namespace
+	}
+	return nil
+}
+
+// Inc adds one to a counter, labels are given as name value pairs
+func Inc(name string, labels ...string) {
+	Default.Add(name, 1, labels...)
+}
+
+// Since records the time elapsed since start in a histogram, labels are given as name value pairs
+func Since(name string, start time.Time, labels ...string) {
+	Default.Observe(name, time.Since(start), labels...)
+}
+
+// Add adds n to a counter
+func (r *Registry) Add(name string, n float64, labels ...string) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.disabled {
+		return
+	}
+
+	s := r.get(name, "counter", labels)
+	s.count += n
+	r.writeEMF(name, "Count", n, labels)
+}
+
+// Observe records a duration in a histogram
+func (r *Registry) Observe(name string, d time.Duration, labels ...string) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.disabled {
+		return
+	}
+
+	s := r.get(name, "histogram", labels)
+	v := d.Seconds()
+	s.count++
+	s.sum += v
+	for i, b := range buckets {
+		if v <= b {
+			s.bucket[i]++
+		}
+	}
+	r.writeEMF(name, "Milliseconds", float64(d.Microseconds())/1000, labels)
+}
+
+// get finds or creates a series, the caller holds the lock
+func (r *Registry) get(name, kind string, labels []string) *series {
+
+	if len(labels)%2 != 0 {
+		labels = append(labels, "")
+	}
+
+	m, ok := r.series[name]
+	if !ok {
+		m = make(map[string]*series)
+		r.series[name] = m
+		r.kinds[name] = kind
+	}
+
+	key := strings.Join(labels, "\x00")
+	s, ok := m[key]
+	if !ok {
+		s = &series{labels: labels}
+		if kind == "histogram" {
+			s.bucket = make([]uint64, len(buckets))
+		}
+		m[key] = s
+	}
+	return s
+}
+
+// names returns the metric names in a stable order, the caller holds the lock
+func (r *Registry) names() []string {
+	var names []string
+	for n := range r.series {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheus(t *testing.T) {
+
+	r := NewRegistry()
+	r.Add(Processed, 1, "direction", "in", "branch", "create", "outcome", "success")
+	r.Add(Processed, 1, "direction", "in", "branch", "create", "outcome", "success")
+	r.Add(Processed, 1, "direction", "out", "branch", "update", "outcome", "failure")
+	r.Observe(RemoteCalls, 30*time.Millisecond, "system", "jsd", "method", "POST", "status", "201")
+
+	var b bytes.Buffer
+	r.WritePrometheus(&b)
+	out := b.String()
+	for _, want := range []string{
+		"# TYPE snowsync_processed_total counter\n",
+		`snowsync_processed_total{direction="in",branch="create",outcome="success"} 2` + "\n",
+		`snowsync_processed_total{direction="out",branch="update",outcome="failure"} 1` + "\n",
+		"# TYPE snowsync_remote_call_seconds histogram\n",
+		`snowsync_remote_call_seconds_bucket{system="jsd",method="POST",status="201",le="0.025"} 0` + "\n",
+		`snowsync_remote_call_seconds_bucket{system="jsd",method="POST",status="201",le="0.05"} 1` + "\n",
+		`snowsync_remote_call_seconds_bucket{system="jsd",method="POST",status="201",le="+Inf"} 1` + "\n",
+		`snowsync_remote_call_seconds_count{system="jsd",method="POST",status="201"} 1` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%v", want, out)
+		}
+	}
+}
+
+func TestEMF(t *testing.T) {
+
+	var b bytes.Buffer
+	r := NewRegistry()
+	r.emf = &b
+	r.namespace = "snowsync-test"
+	r.Add(Processed, 1, "direction", "out", "outcome", "rejected")
+
+	var line struct {
+		Direction string  `json:"direction"`
+		Outcome   string  `json:"outcome"`
+		Processed float64 `json:"snowsync_processed"`
+		AWS       struct {
+			CloudWatchMetrics []struct {
+				Namespace  string
+				Dimensions [][]string
+				Metrics    []struct{ Name, Unit string }
+			}
+		} `json:"_aws"`
+	}
+	err := json.Unmarshal(b.Bytes(), &line)
+	if err != nil {
+		t.Fatalf("%v: %s", err, b.Bytes())
+	}
+	if line.Direction != "out" || line.Outcome != "rejected" || line.Processed != 1 {
+		t.Errorf("got %s", b.Bytes())
+	}
+	m := line.AWS.CloudWatchMetrics
+	if len(m) != 1 || m[0].Namespace != "snowsync-test" || len(m[0].Metrics) != 1 || m[0].Metrics[0].Name != "snowsync_processed" {
+		t.Errorf("got %s", b.Bytes())
+	}
+	if len(m) == 1 && strings.Join(m[0].Dimensions[0], ",") != "direction,outcome" {
+		t.Errorf("dimensions are %v", m[0].Dimensions)
+	}
+}
+
+func TestSetup(t *testing.T) {
+
+	defer func() { Default = NewRegistry() }()
+
+	var b bytes.Buffer
+	Default = NewRegistry()
+	if err := Setup(&b, EMF, "acp"); err != nil {
+		t.Fatal(err)
+	}
+	Inc(Processed, "direction", "in", "branch", "progress", "outcome", "success")
+	if !strings.Contains(b.String(), `"Namespace":"acp"`) {
+		t.Errorf("EMF line is %q", b.String())
+	}
+
+	Default = NewRegistry()
+	if err := Setup(&b, None, ""); err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+	Inc(Processed, "direction", "in", "branch", "progress", "outcome", "success")
+	var p bytes.Buffer
+	Default.WritePrometheus(&p)
+	if b.Len() != 0 || p.Len() != 0 {
+		t.Errorf("observation kept with metrics turned off: %q, %q", b.String(), p.String())
+	}
+
+	if err := Setup(&b, "statsd", ""); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Handler serves the default registry in the Prometheus text format
+func Handler() http.Handler {
+	return Default
+}
+
+// ServeHTTP serves the registry in the Prometheus text format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WritePrometheus(w)
+}
+
+// WritePrometheus writes every series in the Prometheus text format
+func (r *Registry) WritePrometheus(w io.Writer) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, name := range r.names() {
+
+		kind := r.kinds[name]
+		fmt.Fprintf(w, "# TYPE %v %v\n", name, kind)
+
+		m := r.series[name]
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			s := m[k]
+			if kind == "counter" {
+				fmt.Fprintf(w, "%v%v %v\n", name, format(s.labels), number(s.count))
+				continue
+			}
+			for i, b := range buckets {
+				fmt.Fprintf(w, "%v_bucket%v %v\n", name, format(s.labels, "le", number(b)), s.bucket[i])
+			}
+			fmt.Fprintf(w, "%v_bucket%v %v\n", name, format(s.labels, "le", "+Inf"), number(s.count))
+			fmt.Fprintf(w, "%v_sum%v %v\n", name, format(s.labels), number(s.sum))
+			fmt.Fprintf(w, "%v_count%v %v\n", name, format(s.labels), number(s.count))
+		}
+	}
+}
+
+// format renders label pairs as {name="value",...}
+func format(labels []string, extra ...string) string {
+
+	labels = append(append([]string{}, labels...), extra...)
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%v=%q", labels[i], labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func number(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,90 @@
+// Package order keeps events that arrive late from rolling a ticket back
+package order
+
+import (
+	"context"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/UKHomeOffice/snowsync/pkg/logging"
+	"github.com/UKHomeOffice/snowsync/pkg/metrics"
+	"github.com/UKHomeOffice/snowsync/pkg/store"
+	"github.com/UKHomeOffice/snowsync/pkg/tracing"
+)
+
+// UpdatedAt reads the update time of an event in unix milliseconds, 0 when it is missing or unreadable
+// strings are read with the first of layouts that fits
+func UpdatedAt(v gjson.Result, layouts ...string) int64 {
+	switch v.Type {
+	case gjson.Number:
+		n := v.Int()
+		// epoch seconds are told apart from milliseconds by size
+		if n < 1e11 {
+			return n * 1000
+		}
+		return n
+	case gjson.String:
+		for _, l := range layouts {
+			t, err := time.Parse(l, v.Str)
+			if err == nil {
+				return t.UnixMilli()
+			}
+		}
+	}
+	return 0
+}
+
+// Stale reports whether an event updated at the given time is older than the newest one applied to its ticket in the same
+// direction
+// a stale event still brings its comments, only its status, priority and field changes are skipped
+// events without an update time are never stale
+func Stale(ctx context.Context, s store.MappingStore, direction, ticket string, updatedAt int64) (_ bool, err error) {
+
+	if updatedAt == 0 {
+		return false, nil
+	}
+
+	ctx, span := tracing.Start(ctx, direction+".checkStale")
+	defer func() { tracing.End(span, err) }()
+
+	start := time.Now()
+	defer metrics.Since(metrics.StoreCalls, start, "direction", direction, "operation", "lookup_head")
+
+	h, err := store.LookupHead(ctx, s, direction, ticket)
+	if err != nil {
+		return false, err
+	}
+	if updatedAt < h.UpdatedAt {
+		logging.From(ctx).Info("skipping status and field changes of stale event", "updated_at", updatedAt, "applied_updated_at", h.UpdatedAt)
+		metrics.Inc(metrics.Stale, "direction", direction, "reason", "older_event")
+		return true, nil
+	}
+	return false, nil
+}
+
+// Advance records an applied event as the newest of its ticket in a direction
+// failing to do so only weakens ordering
+func Advance(ctx context.Context, s store.MappingStore, direction, ticket string, updatedAt int64) {
+
+	if updatedAt == 0 {
+		return
+	}
+	err := store.AdvanceHead(ctx, s, direction, ticket, store.Head{UpdatedAt: updatedAt})
+	if err != nil {
+		logging.From(ctx).Warn("could not record the newest applied event", logging.Err(err))
+	}
+}
+
+// Record keeps the state a ticket is now in on a system, for the workflow of that system to start from
+// a blank state keeps the one recorded, and failing to record it only weakens the workflow checks
+func Record(ctx context.Context, s store.MappingStore, system, ticket, status string) {
+
+	if status == "" {
+		return
+	}
+	err := store.PutStatus(ctx, s, system, ticket, status)
+	if err != nil {
+		logging.From(ctx).Warn("could not record the state of the ticket", "system", system, logging.Err(err))
+	}
+}
@@ -0,0 +1,132 @@
+package order
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/UKHomeOffice/snowsync/pkg/store"
+)
+
+func TestUpdatedAt(t *testing.T) {
+
+	layouts := []string{time.RFC3339Nano, "2006-01-02 15:04:05"}
+	for body, want := range map[string]int64{
+		`{"t": 1700000000}`:               1700000000000,
+		`{"t": 1700000000123}`:            1700000000123,
+		`{"t": "2023-11-14T22:13:20.5Z"}`: 1700000000500,
+		`{"t": "2023-11-14 22:13:20"}`:    1700000000000,
+		`{"t": "yesterday"}`:              0,
+		`{"t": true}`:                     0,
+		`{}`:                              0,
+	} {
+		if got := UpdatedAt(gjson.Get(body, "t"), layouts...); got != want {
+			t.Errorf("%v read as %v, want %v", body, got, want)
+		}
+	}
+}
+
+func TestStale(t *testing.T) {
+
+	ctx := context.Background()
+	s := store.NewMemory()
+
+	stale, err := Stale(ctx, s, "in", "INC0010001", 2000)
+	if err != nil || stale {
+		t.Fatalf("got %v, %v before any event was applied", stale, err)
+	}
+	Advance(ctx, s, "in", "INC0010001", 2000)
+
+	for at, want := range map[int64]bool{
+		1000: true,
+		2000: false,
+		3000: false,
+		// events without an update time are never stale
+		0: false,
+	} {
+		stale, err := Stale(ctx, s, "in", "INC0010001", at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stale != want {
+			t.Errorf("event at %v stale is %v, want %v", at, stale, want)
+		}
+	}
+
+	// an older event or one without an update time does not move the head back
+	Advance(ctx, s, "in", "INC0010001", 1000)
+	Advance(ctx, s, "in", "INC0010001", 0)
+	h, err := store.LookupHead(ctx, s, "in", "INC0010001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.UpdatedAt != 2000 {
+		t.Errorf("head is %+v", h)
+	}
+	Advance(ctx, s, "in", "INC0010001", 3000)
+	h, err = store.LookupHead(ctx, s, "in", "INC0010001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.UpdatedAt != 3000 {
+		t.Errorf("head is %+v after a newer event", h)
+	}
+}
+
+func TestStaleInterleaved(t *testing.T) {
+
+	ctx := context.Background()
+	s := store.NewMemory()
+
+	// a JSD-created ticket is updated from JSD through /v2/out and from SNOW through /v2/add, both keyed by its JSD key,
+	// and the clocks of the two systems are not comparable
+	Advance(ctx, s, "out", "ACP-1", 5000)
+	stale, err := Stale(ctx, s, "in", "ACP-1", 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale {
+		t.Error("SNOW event judged against a JSD update time")
+	}
+	Advance(ctx, s, "in", "ACP-1", 3000)
+
+	stale, err = Stale(ctx, s, "out", "ACP-1", 4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stale {
+		t.Error("older JSD event not stale")
+	}
+	stale, err = Stale(ctx, s, "in", "ACP-1", 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stale {
+		t.Error("older SNOW event not stale")
+	}
+}
+
+func TestRecord(t *testing.T) {
+
+	ctx := context.Background()
+	s := store.NewMemory()
+
+	// an event from SNOW reports the SNOW state and moves JSD, an event from JSD does the reverse, and each system
+	// keeps its own state whichever direction recorded it
+	Record(ctx, s, store.SystemSNOW, "ACP-1", "In Progress")
+	Record(ctx, s, store.SystemJSD, "ACP-1", "Investigating")
+	Record(ctx, s, store.SystemJSD, "ACP-1", "Resolved")
+	Record(ctx, s, store.SystemSNOW, "ACP-1", "")
+
+	for system, want := range map[string]string{store.SystemSNOW: "In Progress", store.SystemJSD: "Resolved"} {
+		got, err := store.LookupStatus(ctx, s, system, "ACP-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%v status is %q, want %q", system, got, want)
+		}
+	}
+}
@@ -1,14 +1,50 @@
 package out
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/tidwall/gjson"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/UKHomeOffice/snowsync/pkg/attachment"
+	"github.com/UKHomeOffice/snowsync/pkg/caller"
+	"github.com/UKHomeOffice/snowsync/pkg/config"
+	"github.com/UKHomeOffice/snowsync/pkg/logging"
+	"github.com/UKHomeOffice/snowsync/pkg/metrics"
+	"github.com/UKHomeOffice/snowsync/pkg/outbox"
+	"github.com/UKHomeOffice/snowsync/pkg/tracing"
+	"github.com/UKHomeOffice/snowsync/pkg/webhook"
+)
+
+// reasons a webhook cannot be parsed, counted in metrics
+var (
+	errMissingConfig      = errors.New("missing field path")
+	errMissingField       = errors.New("missing value in payload")
+	errInvalidStatus      = errors.New("invalid ticket status")
+	errUnexpectedResource = errors.New("unexpected resource")
 )
 
+// parseReason labels a parse failure for metrics
+func parseReason(err error) string {
+	switch {
+	case errors.Is(err, errMissingConfig):
+		return "missing_config"
+	case errors.Is(err, errMissingField):
+		return "missing_field"
+	case errors.Is(err, errInvalidStatus):
+		return "invalid_status"
+	case errors.Is(err, errUnexpectedResource):
+		return "unexpected_resource"
+	}
+	return "other"
+}
+
 // Incident is a type of ticket
 type Incident struct {
 	Comment     string `json:"comments,omitempty"`
@@ -22,6 +58,26 @@ type Incident struct {
 	Status      string `json:"state,omitempty"`
 	Service     string `json:"business_service,omitempty"`
 	Summary     string `json:"title,omitempty"`
+	// CommentHash, RemoteCommentID and CommentDeleted follow a comment in the mapping store after it is synced
+	CommentHash     string `json:"comment_hash,omitempty"`
+	RemoteCommentID string `json:"remote_comment_id,omitempty"`
+	CommentDeleted  bool   `json:"comment_deleted,omitempty"`
+	// UpdatedAt is when the source system last changed the ticket, in unix milliseconds, and orders events
+	UpdatedAt int64 `json:"updated_at,omitempty"`
+	// Version counts writes of the record, guarding it against concurrent changes
+	Version int64 `json:"version,omitempty"`
+	// Event is the webhook event, telling comment edits and deletions apart
+	Event string `json:"-"`
+	// Reported is the JSD status the webhook gave, before it is mapped to a SNOW state
+	Reported string `json:"-"`
+	// State is the SNOW workflow state the ticket was moved to, blank when it was not moved
+	State string `json:"-"`
+	// owner names this event as the holder of the creation lock of the ticket
+	owner string
+	// synced is set once the event created or updated a ticket known on both systems
+	synced bool
+	// Attachments are copied separately and never sent in the payload or stored
+	Attachments []attachment.Attachment `json:"-"`
 }
 
 // newIncident initialises an Incident
@@ -29,63 +85,58 @@ func newIncident() *Incident {
 	return &Incident{}
 }
 
-// checkVars checks incoming payload has the required field values
-func checkIncidentVars(input string) error {
+// checkIncidentVars checks incoming payload has the required field values
+func checkIncidentVars(input string, f *config.OutFields) error {
 
-	vars := []string{
-		"DESCRIPTION_FIELD",
-		"ISSUE_ID_FIELD",
-		"PRIORITY_FIELD",
-		"STATUS_FIELD",
-		"SUMMARY_FIELD",
+	vars := []struct{ name, field string }{
+		{"DESCRIPTION_FIELD", f.Description},
+		{"ISSUE_ID_FIELD", f.IssueID},
+		{"PRIORITY_FIELD", f.Priority},
+		{"STATUS_FIELD", f.Status},
+		{"SUMMARY_FIELD", f.Summary},
 	}
 
 	for _, v := range vars {
-		field, ok := os.LookupEnv(v)
-		if !ok {
-			return fmt.Errorf("missing environment variable: %v", v)
+		if v.field == "" {
+			return fmt.Errorf("%w: %v", errMissingConfig, v.name)
 		}
-		value := gjson.Get(input, field)
+		value := gjson.Get(input, v.field)
 		if !value.Exists() {
-			return fmt.Errorf("missing value in payload: %v", field)
+			return fmt.Errorf("%w: %v", errMissingField, v.field)
 		}
 	}
 	return nil
 }
 
 // parseIncident gets values from an inbound incident
-func parseIncident(input string) (*Incident, error) {
+func (p *Processor) parseIncident(ctx context.Context, input string) (_ *Incident, err error) {
+
+	ctx, span := tracing.Start(ctx, "out.parseIncident")
+	defer func() { tracing.End(span, err) }()
 
-	err := checkIncidentVars(input)
+	f := &p.conf.Out
+	err = checkIncidentVars(input, f)
 	if err != nil {
 		return nil, err
 	}
 
 	i := newIncident()
 
-	i.Comment = gjson.Get(input, os.Getenv("COMMENT_FIELD")).Str
-	i.CommentID = gjson.Get(input, os.Getenv("COMMENT_ID_FIELD")).Str
-	i.Description = gjson.Get(input, os.Getenv("DESCRIPTION_FIELD")).Str
-	i.ExtID = gjson.Get(input, os.Getenv("ISSUE_ID_FIELD")).Str
-	i.IntID = gjson.Get(input, os.Getenv("SNOW_ID_FIELD")).Str
-	i.Priority = gjson.Get(input, os.Getenv("PRIORITY_FIELD")).Str
-	i.Service = gjson.Get(input, os.Getenv("SERVICE_FIELD")).Str
-	i.Status = gjson.Get(input, os.Getenv("STATUS_FIELD")).Str
-	i.Summary = gjson.Get(input, os.Getenv("SUMMARY_FIELD")).Str
+	i.Comment = gjson.Get(input, f.Comment).Str
+	i.CommentID = gjson.Get(input, f.CommentID).Str
+	i.Description = gjson.Get(input, f.Description).Str
+	i.ExtID = gjson.Get(input, f.IssueID).Str
+	i.IntID = gjson.Get(input, f.SNOWID).Str
+	i.Priority = gjson.Get(input, f.Priority).Str
+	i.Service = gjson.Get(input, f.Service).Str
+	i.Status = gjson.Get(input, f.Status).Str
+	i.Summary = gjson.Get(input, f.Summary).Str
+	i.Attachments = attachment.FromJSD(input, f.Attachments)
+	i.Event = gjson.Get(input, f.Event).Str
+	i.UpdatedAt = updatedAt(gjson.Get(input, f.Updated))
 
 	// assign to an organisation in SNOW
-	switch i.Service {
-	case "59":
-		i.Service = "CSOC"
-	case "9":
-		i.Service = "Cyclamen IT Platform Local"
-	case "58":
-		i.Service = "PPPT - ILEAP"
-	case "45":
-		i.Service = "Semaphore"
-	default:
-		i.Service = "AWS ACP"
-	}
+	i.Service, _ = p.conf.Mappings.Services.ToSNOW(i.Service)
 
 	// initialise comment id if nil as it will be used as sort key & transform
 	if i.CommentID == "" {
@@ -93,56 +144,91 @@ func parseIncident(input string) (*Incident, error) {
 	}
 
 	// transform comments to fit target schema
-	commentAuthor := gjson.Get(input, os.Getenv("COMMENT_AUTHOR_FIELD")).Str
+	commentAuthor := gjson.Get(input, f.CommentAuthor).Str
 	if commentAuthor == "ServiceNow" {
-		fmt.Println("ignoring comment left on JSD by ServiceNow service account")
+		logging.From(ctx).Info("ignoring comment left on JSD by ServiceNow service account")
 		return i, nil
 	}
 
-	commentBody := gjson.Get(input, os.Getenv("COMMENT_BODY_FIELD")).Str
+	commentBody := gjson.Get(input, f.CommentBody).Str
 	i.Comment = fmt.Sprintf("%v %v", commentAuthor, commentBody)
+	i.CommentHash = commentHash(i.Comment)
 
 	// transform status
-	switch i.Status {
-	case "Open":
-		i.Status = "2"
-	case "Investigating", "Identified", "Monitoring", "Escalated", "Escalated to Appvia":
-		i.Status = "22"
-	case "Resolved", "Closed":
-		i.Status = "6"
-	default:
-		return nil, fmt.Errorf("invalid ticket status %v", i.Status)
+	i.Reported = i.Status
+	status, ok := p.conf.Mappings.Statuses.ToSNOW(i.Status)
+	if !ok && !p.conf.Mappings.Workflows.JSD.Ignores() {
+		return nil, fmt.Errorf("%w: %v", errInvalidStatus, i.Status)
+	}
+	if !ok {
+		logging.From(ctx).Info("ignoring unknown status", "status", i.Status)
 	}
+	i.Status = status
 
 	// transform priority
-	switch i.Priority {
-	case "P1 - Production system down":
-		i.Priority = "1"
-	case "P2 - Production system impaired":
-		i.Priority = "2"
-	case "P3 - Non production system impaired":
-		i.Priority = "3"
-	case "P4 - General request":
-		i.Priority = "4"
-	default:
-		fmt.Printf("ignoring blank or unexpected priority: %v", i.Priority)
+	priority, ok := p.conf.Mappings.Priorities.ToSNOW(i.Priority)
+	if !ok {
+		logging.From(ctx).Info("ignoring blank or unexpected priority", "priority", i.Priority)
 		return nil, nil
 	}
-
-	fmt.Printf("parsed incident: %v from %v, status: %v, comment id: %v\n", i.ExtID, i.Service, i.Status, i.CommentID)
+	i.Priority = priority
 
 	return i, nil
 }
 
+// Handler serves outbound webhooks for the lifetime of a function instance
+type Handler struct {
+	proc *Processor
+	// Outbox tracks each delivery until the other system has accepted it
+	Outbox *outbox.Outbox
+	// Verifier authenticates webhooks, nil accepts every request
+	Verifier webhook.Verifier
+}
+
+// NewHandler creates a Handler around a Processor
+func NewHandler(p *Processor) *Handler {
+	return &Handler{proc: p}
+}
+
 // Handle sends an incoming request to parser and processor, and returns a http response
-func Handle(request *events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+func (h *Handler) Handle(ctx context.Context, request *events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return h.handle(ctx, request, nil, true)
+}
 
-	inc, err := parseIncident(request.Body)
+// Replay re-drives an outbox entry, keeping its delivery history
+// an entry without an id is treated as a recorded webhook and tracked afresh
+// replays are started by an operator, so they are not authenticated again
+func (h *Handler) Replay(ctx context.Context, e *outbox.Entry) (events.APIGatewayProxyResponse, error) {
+	request := &events.APIGatewayProxyRequest{
+		Resource: e.Resource,
+		Body:     e.Body,
+	}
+	if e.ID == "" {
+		e = nil
+	}
+	return h.handle(ctx, request, e, false)
+}
+
+// Identify returns the identifier a request would be processed under, blank if it would be ignored
+func (h *Handler) Identify(request *events.APIGatewayProxyRequest) (string, error) {
+	inc, err := h.route(context.Background(), request)
+	if err != nil || inc == nil {
+		return "", err
+	}
+	return inc.Identifier, nil
+}
+
+// route parses a request and assigns the identifier for its resource
+func (h *Handler) route(ctx context.Context, request *events.APIGatewayProxyRequest) (*Incident, error) {
+
+	inc, err := h.proc.parseIncident(ctx, request.Body)
 	if err != nil {
-		return events.APIGatewayProxyResponse{
-			StatusCode: http.StatusBadRequest,
-			Body:       err.Error(),
-		}, err
+		return nil, err
+	}
+
+	// nothing to sync, e.g. a blank priority
+	if inc == nil {
+		return nil, nil
 	}
 
 	// assign identifier according to the api endpoint used
@@ -157,21 +243,126 @@ func Handle(request *events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 			inc.Identifier = inc.ExtID
 		}
 	default:
-		return events.APIGatewayProxyResponse{
-			StatusCode: http.StatusBadRequest,
-			Body:       err.Error(),
-		}, err
+		return nil, fmt.Errorf("%w: %v", errUnexpectedResource, request.Resource)
+	}
+	return inc, nil
+}
+
+// handle processes a request, e is the outbox entry of a replayed request
+func (h *Handler) handle(ctx context.Context, request *events.APIGatewayProxyRequest, e *outbox.Entry, verify bool) (resp events.APIGatewayProxyResponse, _ error) {
+
+	start := time.Now()
+
+	ctx, span := tracing.Start(tracing.Extract(ctx, request.Headers), "out.Handle",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("snowsync.resource", request.Resource)),
+	)
+	defer span.End()
+
+	ctx = logging.With(ctx,
+		logging.Direction, "out",
+		logging.Resource, request.Resource,
+		logging.RequestID, request.RequestContext.RequestID,
+	)
+	if id := tracing.TraceID(ctx); id != "" {
+		ctx = logging.With(ctx, logging.TraceID, id)
 	}
 
-	err = process(inc)
+	if verify && h.Verifier != nil {
+		err := h.Verifier.Verify(ctx, request)
+		if errors.Is(err, webhook.ErrUnauthenticated) {
+			return errorResponse(ctx, http.StatusUnauthorized, err)
+		}
+		if err != nil {
+			return errorResponse(ctx, http.StatusInternalServerError, fmt.Errorf("could not verify webhook: %w", err))
+		}
+		// a delivery that fails from here on gives up its nonce, so the sender can deliver it again
+		defer func() {
+			if resp.StatusCode != http.StatusOK {
+				h.release(ctx, request)
+			}
+		}()
+	}
+
+	inc, err := h.route(ctx, request)
 	if err != nil {
+		metrics.Inc(metrics.ParseFailures, "direction", "out", "reason", parseReason(err))
+		return errorResponse(ctx, http.StatusBadRequest, err)
+	}
+
+	// nothing to sync, e.g. a blank priority
+	if inc == nil {
+		metrics.Inc(metrics.Processed, "direction", "out", "branch", "ignored", "outcome", "success")
+		logging.From(ctx).Info("request handled", "status", http.StatusOK, logging.Since(start))
 		return events.APIGatewayProxyResponse{
-			StatusCode: http.StatusInternalServerError,
-			Body:       err.Error(),
-		}, err
+			StatusCode: http.StatusOK,
+		}, nil
+	}
+
+	ctx = logging.With(ctx, logging.Ticket, inc.Identifier, logging.Comment, inc.CommentID)
+	span.SetAttributes(attribute.String("snowsync.ticket", inc.Identifier), attribute.String("snowsync.comment_id", inc.CommentID))
+	logging.From(ctx).Info("parsed incident", "service", inc.Service, "status", inc.Status)
+
+	if e == nil {
+		e = outbox.NewEntry("out", request, inc.Identifier, inc.CommentID)
+	}
+	err = h.Outbox.Pending(ctx, e)
+	if err != nil {
+		return errorResponse(ctx, http.StatusInternalServerError, fmt.Errorf("could not record pending delivery: %w", err))
+	}
+
+	err = h.proc.process(ctx, inc)
+	if err == nil {
+		err = h.proc.attach(ctx, inc)
+	}
+	if err != nil {
+		h.deadLetter(ctx, e, err)
+		return errorResponse(ctx, caller.GatewayStatus(err), err)
+	}
+
+	err = h.Outbox.Delivered(ctx, e)
+	if err != nil {
+		logging.From(ctx).Error("could not mark delivered", "entry_id", e.ID, logging.Err(err))
 	}
 
+	logging.From(ctx).Info("request handled", "status", http.StatusOK, logging.Since(start))
 	return events.APIGatewayProxyResponse{
 		StatusCode: http.StatusOK,
 	}, nil
 }
+
+// release gives up what the verifier holds for a failed delivery, problems are only logged
+func (h *Handler) release(ctx context.Context, request *events.APIGatewayProxyRequest) {
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+
+	err := webhook.Release(ctx, h.Verifier, request)
+	if err != nil {
+		logging.From(ctx).Error("could not release webhook", logging.Err(err))
+	}
+}
+
+// deadLetter keeps a failed delivery for replay, the webhook has already failed so problems are only logged
+// the request context may have expired, so the write gets its own deadline
+func (h *Handler) deadLetter(ctx context.Context, e *outbox.Entry, cause error) {
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+
+	err := h.Outbox.Failed(ctx, e, cause)
+	if err != nil {
+		logging.From(ctx).Error("could not dead-letter", "entry_id", e.ID, logging.Err(err))
+	}
+}
+
+// errorResponse reports a failure to the webhook sender
+// the error is not returned to Lambda as API Gateway would replace the response with a 502
+func errorResponse(ctx context.Context, code int, err error) (events.APIGatewayProxyResponse, error) {
+	logging.From(ctx).Error("request failed", "status", code, logging.Err(err))
+	tracing.Fail(ctx, err)
+	return events.APIGatewayProxyResponse{
+		StatusCode: code,
+		Body:       err.Error(),
+	}, nil
+}
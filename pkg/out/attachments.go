@@ -0,0 +1,185 @@
+package out
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+
+	"github.com/UKHomeOffice/snowsync/pkg/attachment"
+	"github.com/UKHomeOffice/snowsync/pkg/caller"
+	"github.com/UKHomeOffice/snowsync/pkg/logging"
+	"github.com/UKHomeOffice/snowsync/pkg/metrics"
+	"github.com/UKHomeOffice/snowsync/pkg/tracing"
+)
+
+// EnableAttachments lets the processor copy attachments from JSD, downloading them through jsd
+// the files copied and the SNOW table they are attached to are read from the configuration
+func (p *Processor) EnableAttachments(jsd *caller.Client) error {
+	policy, err := p.conf.AttachmentPolicy()
+	if err != nil {
+		return err
+	}
+	p.jsd = jsd
+	p.policy = policy
+	p.table = p.conf.AttachmentTable()
+	return nil
+}
+
+// attach copies the attachments of an incident to its SNOW record, skipping those copied before
+// files the policy rejects are logged and left behind, any other failure fails the webhook so it can be replayed
+func (p *Processor) attach(ctx context.Context, inc *Incident) (err error) {
+
+	if p.policy == nil || len(inc.Attachments) == 0 {
+		return nil
+	}
+	// files go to a ticket this event created or updated, so both identifiers are known
+	if !inc.synced || inc.IntID == "" {
+		logging.From(ctx).Info("not copying attachments of an event that did not update a ticket")
+		return nil
+	}
+
+	ctx, span := tracing.Start(ctx, "out.attach")
+	defer func() { tracing.End(span, err) }()
+
+	// the record is looked up once, and only when a file is copied
+	var sysID string
+	for i := range inc.Attachments {
+		a := &inc.Attachments[i]
+		log := logging.From(ctx).With("attachment_id", a.ID)
+
+		var rec Incident
+		found, err := p.db.LookupComment(ctx, inc.Identifier, a.Key(), &rec)
+		if err != nil {
+			return fmt.Errorf("could not look up attachment %v: %w", a.ID, err)
+		}
+		if found {
+			metrics.Inc(metrics.Attachments, "direction", "out", "outcome", "duplicate")
+			continue
+		}
+
+		var copied string
+		err = p.policy.Check(a)
+		if err == nil && sysID == "" {
+			sysID, err = p.lookupSysID(ctx, inc.IntID)
+			if err != nil {
+				return fmt.Errorf("could not find the SNOW record to attach to: %w", err)
+			}
+		}
+		if err == nil {
+			copied, err = p.copyAttachment(ctx, sysID, a)
+		}
+		if errors.Is(err, attachment.ErrRejected) {
+			log.Warn("attachment not copied", logging.Err(err))
+			metrics.Inc(metrics.Attachments, "direction", "out", "outcome", "rejected")
+			continue
+		}
+		if err != nil {
+			metrics.Inc(metrics.Attachments, "direction", "out", "outcome", "failure")
+			return fmt.Errorf("could not copy attachment %v: %w", a.ID, err)
+		}
+
+		// record the file and its copy so a later webhook listing either does not attach it again, in either direction
+		for _, key := range []string{a.Key(), attachment.Key(copied)} {
+			if key == attachment.Key("") {
+				continue
+			}
+			rec = Incident{Identifier: inc.Identifier, ExtID: inc.ExtID, IntID: inc.IntID, CommentID: key}
+			err = p.db.Put(ctx, inc.Identifier, key, &rec)
+			if err != nil {
+				return fmt.Errorf("could not record attachment %v: %w", a.ID, err)
+			}
+		}
+		metrics.Inc(metrics.Attachments, "direction", "out", "outcome", "success")
+		log.Info("attachment copied to SNOW", "file_name", a.Name)
+	}
+	return nil
+}
+
+// lookupSysID finds the sys_id of the record the internal identifier numbers, which the attachment API needs
+func (p *Processor) lookupSysID(ctx context.Context, number string) (string, error) {
+
+	q := url.Values{}
+	q.Set("sysparm_query", "number="+number)
+	q.Set("sysparm_fields", "sys_id")
+	q.Set("sysparm_limit", "1")
+
+	req, err := p.snow.NewRequest(ctx, "/api/now/table/"+url.PathEscape(p.table)+"?"+q.Encode(), "GET", nil)
+	if err != nil {
+		return "", fmt.Errorf("could not make request: %w", err)
+	}
+	res, err := p.snow.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not call SNOW: %w", err)
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", fmt.Errorf("could not read SNOW response body %w", err)
+	}
+	var dat struct {
+		Result []struct {
+			SysID string `json:"sys_id"`
+		} `json:"result"`
+	}
+	err = json.Unmarshal(b, &dat)
+	if err != nil {
+		return "", fmt.Errorf("could not decode SNOW response: %w", err)
+	}
+	if len(dat.Result) == 0 || dat.Result[0].SysID == "" {
+		return "", fmt.Errorf("no %v record numbered %v", p.table, number)
+	}
+	return dat.Result[0].SysID, nil
+}
+
+// copyAttachment downloads a file from JSD and uploads it through the SNOW attachment API to the record sysID,
+// returning the sys_id SNOW gave the copy
+func (p *Processor) copyAttachment(ctx context.Context, sysID string, a *attachment.Attachment) (string, error) {
+
+	b, err := p.policy.Download(ctx, p.jsd, a)
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{}
+	q.Set("table_name", p.table)
+	q.Set("table_sys_id", sysID)
+	q.Set("file_name", a.Name)
+
+	req, err := p.snow.NewRequest(ctx, "/api/now/attachment/file?"+q.Encode(), "POST", b)
+	if err != nil {
+		return "", fmt.Errorf("could not make request: %w", err)
+	}
+	// SNOW stores the file with the content type it was sent with
+	req.Header.Set("Content-Type", a.ContentType)
+
+	res, err := p.snow.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not upload file to SNOW: %w", err)
+	}
+	defer res.Body.Close()
+
+	// the file is attached by now, so without its sys_id the copy is only recognised by the id of the original
+	rb, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		logging.From(ctx).Warn("could not read SNOW response body", logging.Err(err))
+		return "", nil
+	}
+	var dat struct {
+		Result struct {
+			SysID string `json:"sys_id"`
+		} `json:"result"`
+	}
+	err = json.Unmarshal(rb, &dat)
+	if err != nil {
+		logging.From(ctx).Warn("could not decode SNOW response", logging.Err(err))
+		return "", nil
+	}
+	if dat.Result.SysID == "" {
+		logging.From(ctx).Warn("could not find the sys_id of the attached file in SNOW response")
+	}
+	return dat.Result.SysID, nil
+}
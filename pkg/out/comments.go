@@ -0,0 +1,58 @@
+package out
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// comment events named by EVENT_FIELD
+const (
+	eventCommentUpdated = "comment_updated"
+	eventCommentDeleted = "comment_deleted"
+)
+
+// commentHash fingerprints comment text so an edit can be told from a repeated delivery
+func commentHash(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:16])
+}
+
+// edited reports whether a comment already synced as rec has changed since
+// older records carry no hash, so for those only an explicit update event counts
+func edited(rec, inc *Incident) bool {
+	if inc.CommentID == "0" || inc.Comment == "" {
+		return false
+	}
+	if inc.Event == eventCommentUpdated {
+		return true
+	}
+	return rec.CommentHash != "" && rec.CommentHash != inc.CommentHash
+}
+
+// annotateComment adds a note about a synced comment to the SNOW ticket
+// SNOW journal entries cannot be changed through the integration, so edits and deletions are added as comments
+func (p *Processor) annotateComment(ctx context.Context, inc *Incident, note string) error {
+
+	upd := *inc
+	upd.Priority = ""
+	upd.Description = ""
+	upd.Comment = note
+
+	_, err := p.update(ctx, &upd)
+	if err != nil {
+		return fmt.Errorf("could not annotate comment: %w", err)
+	}
+	return nil
+}
+
+// payload strips the fields only kept in the mapping store from an incident sent to SNOW
+func (i Incident) payload() Incident {
+	i.CommentHash = ""
+	i.RemoteCommentID = ""
+	i.CommentDeleted = false
+	i.UpdatedAt = 0
+	i.Version = 0
+	return i
+}
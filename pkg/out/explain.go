@@ -0,0 +1,79 @@
+package out
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tidwall/gjson"
+
+	"github.com/UKHomeOffice/snowsync/pkg/config"
+	"github.com/UKHomeOffice/snowsync/pkg/explain"
+	"github.com/UKHomeOffice/snowsync/pkg/loop"
+	"github.com/UKHomeOffice/snowsync/pkg/store"
+)
+
+// Explain describes how a JSD webhook would be parsed and routed, without calling SNOW or the store
+// checks that need the store, such as stale events and comment links, are left out
+func Explain(conf *config.Config, resource, body string) *explain.Report {
+
+	r := &explain.Report{Direction: "out", Resource: resource}
+	f := &conf.Out
+	r.Read(body, [][2]string{
+		{"ISSUE_ID_FIELD", f.IssueID},
+		{"SNOW_ID_FIELD", f.SNOWID},
+		{"DESCRIPTION_FIELD", f.Description},
+		{"COMMENT_FIELD", f.Comment},
+		{"COMMENT_ID_FIELD", f.CommentID},
+		{"COMMENT_AUTHOR_FIELD", f.CommentAuthor},
+		{"COMMENT_BODY_FIELD", f.CommentBody},
+		{"PRIORITY_FIELD", f.Priority},
+		{"SERVICE_FIELD", f.Service},
+		{"STATUS_FIELD", f.Status},
+		{"SUMMARY_FIELD", f.Summary},
+		{"ATTACHMENTS_FIELD", f.Attachments},
+		{"EVENT_FIELD", f.Event},
+		{"UPDATED_FIELD", f.Updated},
+	})
+
+	// a fresh store has no record of the ticket, so workflow moves are checked from the initial state
+	p := &Processor{db: store.NewMemory(), conf: conf}
+	ctx := r.Capture(context.Background())
+	inc, err := NewHandler(p).route(ctx, &events.APIGatewayProxyRequest{Resource: resource, Body: body})
+	if err == nil && inc != nil {
+		err = p.checkStatus(ctx, inc)
+	}
+	if err != nil {
+		r.Outcome, r.Reason = explain.Reject, fmt.Sprintf("%v (%v)", err, http.StatusBadRequest)
+		if errors.Is(err, errUnexpectedResource) {
+			r.Reason += ", expected /v2/out or /v2/reverse"
+		}
+		return r
+	}
+
+	m := conf.Mappings
+	service := gjson.Get(body, f.Service).String()
+	to, ok := m.Services.ToSNOW(service)
+	r.Translate("service", service, to, ok)
+	status := gjson.Get(body, f.Status).String()
+	to, ok = m.Statuses.ToSNOW(status)
+	r.Translate("status", status, to, ok)
+	priority := gjson.Get(body, f.Priority).String()
+	to, ok = m.Priorities.ToSNOW(priority)
+	r.Translate("priority", priority, to, ok)
+
+	if inc == nil {
+		r.Outcome = explain.Ignore
+		r.Reason = r.Decision()
+		return r
+	}
+
+	r.Identifier = inc.Identifier
+	r.Outcome = explain.Process
+	if loop.Marked(inc.Comment, conf.Marker) {
+		r.Outcome, r.Reason = explain.Ignore, "comment carries the snowsync marker"
+	}
+	return r
+}
@@ -1,43 +1,43 @@
 package out
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"net/http"
-	"net/url"
-	"os"
-	"time"
 
 	"github.com/UKHomeOffice/snowsync/pkg/caller"
+	"github.com/UKHomeOffice/snowsync/pkg/logging"
+	"github.com/UKHomeOffice/snowsync/pkg/loop"
 )
 
-func create(inc *Incident) (string, error) {
+func (p *Processor) create(ctx context.Context, inc *Incident) (string, error) {
 
 	// construct payload with SNOW required headers
 	dat := make(map[string]interface{})
 	dat["messageid"] = "HO_SIAM_IN_REST_INC_POST_JSON_ACP_Incident_Create"
 	dat["external_identifier"] = inc.Identifier
-	dat["payload"] = inc
+	payload := inc.payload()
+	payload.Comment = loop.Mark(payload.Comment, p.conf.Marker)
+	dat["payload"] = payload
 
 	new, err := json.Marshal(dat)
 	if err != nil {
-		return "", fmt.Errorf("could not marshal creator payload: %v", err)
+		return "", fmt.Errorf("could not marshal creator payload: %w", err)
 	}
 
-	iid, err := callSNOW(new)
+	// creates are never retried as SNOW would raise a duplicate incident
+	res, err := p.callSNOW(ctx, new, "")
 	if err != nil {
-		return "", fmt.Errorf("could not invoke a create call: %v", err)
+		return "", fmt.Errorf("could not invoke a create call: %w", err)
 	}
-
-	// check for and return internal identifier
-	if iid != "" {
-		return iid, nil
-	}
-	return "", fmt.Errorf("no identifier in SNOW response")
+	return res.IntID, nil
 }
 
-func update(inc *Incident) error {
+// update adds a comment to SNOW, returning the sys_id SNOW gave the comment if it reports one
+func (p *Processor) update(ctx context.Context, inc *Incident) (string, error) {
 
 	// construct payload with SNOW required headers
 	dat := make(map[string]interface{})
@@ -50,23 +50,26 @@ func update(inc *Incident) error {
 	}
 
 	dat["internal_identifier"] = inc.IntID
-	// avoid repeating internal identifier in payload
-	inc.IntID = ""
-	dat["payload"] = inc
+	// avoid repeating internal identifier in payload, the record written afterwards still needs it
+	payload := inc.payload()
+	payload.IntID = ""
+	payload.Comment = loop.Mark(payload.Comment, p.conf.Marker)
+	dat["payload"] = payload
 
 	update, err := json.Marshal(dat)
 	if err != nil {
-		return fmt.Errorf("could not marshal updater payload: %v", err)
+		return "", fmt.Errorf("could not marshal updater payload: %w", err)
 	}
 
-	_, err = callSNOW(update)
+	// the key covers the comment id and text so SNOW can discard a repeated delivery but not a later edit
+	res, err := p.callSNOW(ctx, update, idempotencyKey(dat["internal_identifier"], inc.CommentID, "comment", commentHash(inc.Comment)))
 	if err != nil {
-		return fmt.Errorf("could not invoke caller: %v", err)
+		return "", fmt.Errorf("could not invoke caller: %w", err)
 	}
-	return nil
+	return res.CommentID, nil
 }
 
-func progress(inc *Incident) error {
+func (p *Processor) progress(ctx context.Context, inc *Incident) error {
 
 	// construct payload with SNOW required headers
 	dat := make(map[string]interface{})
@@ -80,98 +83,85 @@ func progress(inc *Incident) error {
 
 	dat["internal_identifier"] = inc.IntID
 	// remove irrelevant keys from payload
-	inc.IntID = ""
-	inc.Comment = ""
-	inc.Priority = ""
+	payload := inc.payload()
+	payload.IntID = ""
+	payload.Comment = ""
+	payload.Priority = ""
 
-	if inc.Status == "6" {
-		inc.Resolution = "done"
+	if payload.Status == "6" {
+		payload.Resolution = "done"
 	}
 
-	dat["payload"] = inc
+	dat["payload"] = payload
 
 	progress, err := json.Marshal(dat)
 	if err != nil {
-		return fmt.Errorf("could not marshal updater payload: %v", err)
+		return fmt.Errorf("could not marshal updater payload: %w", err)
 	}
 
-	_, err = callSNOW(progress)
+	// setting a state twice has no further effect
+	_, err = p.callSNOW(ctx, progress, idempotencyKey(dat["internal_identifier"], inc.CommentID, inc.Status))
 	if err != nil {
-		return fmt.Errorf("could not invoke caller: %v", err)
+		return fmt.Errorf("could not invoke caller: %w", err)
 	}
 
 	return nil
 }
 
-func callSNOW(ms []byte) (string, error) {
-
-	// check environment
-	base, ok := os.LookupEnv("SNOW_URL")
-	if !ok {
-		return "", fmt.Errorf("missing SNOW URL")
-	}
-
-	surl, err := url.Parse(base)
-	if err != nil {
-		return "", fmt.Errorf("could not parse SNOW URL: %v", err)
-	}
-
-	user, ok := os.LookupEnv("ADMIN_USER")
-	if !ok {
-		return "", fmt.Errorf("missing username")
-	}
+// idempotencyKey identifies a SNOW message so that retries of it can be recognised
+func idempotencyKey(parts ...interface{}) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%v", parts)))
+	return hex.EncodeToString(h[:16])
+}
 
-	pass, ok := os.LookupEnv("ADMIN_PASS")
-	if !ok {
-		return "", fmt.Errorf("missing password")
-	}
+// result is what SNOW reports back for a message
+type result struct {
+	IntID string `json:"internal_identifier"`
+	// CommentID is the sys_id of the journal entry a comment became, blank for other messages
+	CommentID string `json:"comment_sysid"`
+}
 
-	// create client and request
-	c := &caller.Client{
-		BaseURL:    surl,
-		HTTPClient: &http.Client{Timeout: 5 * time.Second},
-	}
+// callSNOW posts a message to SNOW, a non-blank key marks it safe to retry
+func (p *Processor) callSNOW(ctx context.Context, ms []byte, key string) (*result, error) {
 
-	req, err := c.NewRequest("", "POST", user, pass, ms)
+	req, err := p.snow.NewRequest(ctx, "", "POST", ms)
 	if err != nil {
-		return "", fmt.Errorf("could not make request: %v", err)
+		return nil, fmt.Errorf("could not make request: %w", err)
+	}
+	if key != "" {
+		caller.SetIdempotencyKey(req, key)
 	}
 
 	// make HTTP request to SNOW
-	res, err := c.Do(req)
+	res, err := p.snow.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("could not call SNOW: %v", err)
+		return nil, fmt.Errorf("could not call SNOW: %w", err)
 	}
 	defer res.Body.Close()
 
 	// read HTTP response
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return "", fmt.Errorf("could not read SNOW response body %v", err)
+		return nil, fmt.Errorf("could not read SNOW response body %w", err)
 	}
 
-	fmt.Printf("sent request, SNOW replied with: %v", string(body))
-
-	// dynamically decode response and check for SNOW assigned identifier
-	var dat map[string]interface{}
+	// decode response and check for SNOW assigned identifier
+	var dat struct {
+		Result *result `json:"result"`
+	}
 	err = json.Unmarshal(body, &dat)
 	if err != nil {
-		return "", fmt.Errorf("could not decode SNOW response: %v", err)
-	}
-	rts, ok := dat["result"].(map[string]interface{})
-	if !ok {
-		return "", fmt.Errorf("could not find a result in SNOW response")
+		return nil, fmt.Errorf("could not decode SNOW response: %w", err)
 	}
-	ini, ok := rts["internal_identifier"].(string)
-	if !ok {
-		return "", fmt.Errorf("could not find an identifier in SNOW response")
+	if dat.Result == nil {
+		return nil, fmt.Errorf("could not find a result in SNOW response")
 	}
 
 	// return internal identifier
-	if ini != "" {
-		fmt.Printf("SNOW returned an identifier: %v", ini)
-		return ini, nil
+	if dat.Result.IntID != "" {
+		logging.From(ctx).Info("SNOW returned an identifier", "internal_identifier", dat.Result.IntID)
+		return dat.Result, nil
 	}
-	return "", fmt.Errorf("request failed, SNOW did not return an identifier")
+	return nil, fmt.Errorf("request failed, SNOW did not return an identifier")
 
 }
@@ -0,0 +1,38 @@
+package out
+
+import (
+	"context"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/UKHomeOffice/snowsync/pkg/order"
+	"github.com/UKHomeOffice/snowsync/pkg/store"
+)
+
+// layouts JSD gives update times in, such as the webhook timestamp or the issue updated field
+var layouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.000-0700",
+}
+
+// updatedAt reads the update time of an event in unix milliseconds, 0 when it is missing or unreadable
+func updatedAt(v gjson.Result) int64 {
+	return order.UpdatedAt(v, layouts...)
+}
+
+// checkStale reports whether an event is older than the newest one applied to its ticket
+func (p *Processor) checkStale(ctx context.Context, inc *Incident) (bool, error) {
+	return order.Stale(ctx, p.db, "out", inc.Identifier, inc.UpdatedAt)
+}
+
+// advanceHead records an applied event as the newest of its ticket, along with the state it reports the ticket in and
+// the state it moved the ticket to on the other system
+// a stale event reports a state the ticket has since left
+func (p *Processor) advanceHead(ctx context.Context, inc *Incident, stale bool) {
+	order.Advance(ctx, p.db, "out", inc.Identifier, inc.UpdatedAt)
+	if !stale {
+		order.Record(ctx, p.db, store.SystemJSD, inc.Identifier, inc.Reported)
+	}
+	order.Record(ctx, p.db, store.SystemSNOW, inc.Identifier, inc.State)
+}
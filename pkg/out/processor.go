@@ -1,109 +1,236 @@
 package out
 
 import (
+	"context"
 	"fmt"
-	"os"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/UKHomeOffice/snowsync/pkg/attachment"
+	"github.com/UKHomeOffice/snowsync/pkg/caller"
+	"github.com/UKHomeOffice/snowsync/pkg/config"
+	"github.com/UKHomeOffice/snowsync/pkg/logging"
+	"github.com/UKHomeOffice/snowsync/pkg/loop"
+	"github.com/UKHomeOffice/snowsync/pkg/metrics"
+	"github.com/UKHomeOffice/snowsync/pkg/store"
 )
 
-// DB implements db client methods
-type DB interface {
-	GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error)
-	PutItem(*dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error)
-	Query(*dynamodb.QueryInput) (*dynamodb.QueryOutput, error)
-}
-
-// Dynamo is a DB client
-type Dynamo struct {
-	DynamoDB dynamodbiface.DynamoDBAPI
-}
-
 // Processor represents clients
 type Processor struct {
-	db Dynamo
+	db   store.MappingStore
+	snow *caller.Client
+	conf *config.Config
+	// links records which comment was copied to which, by default alongside the mapping records
+	links store.MappingStore
+	// jsd, policy and table are only set when attachments are copied
+	jsd    *caller.Client
+	policy *attachment.Policy
+	table  string
 }
 
-func newProcessor(d Dynamo) *Processor {
-	return &Processor{db: d}
+// NewProcessor creates a Processor with its dependencies
+func NewProcessor(db store.MappingStore, snow *caller.Client, conf *config.Config) *Processor {
+	return &Processor{db: db, links: db, snow: snow, conf: conf}
 }
 
-func newDBClient() *Dynamo {
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	}))
-	ddb := dynamodb.New(sess, &aws.Config{Region: aws.String(os.Getenv("AWS_REGION"))})
-	return &Dynamo{DynamoDB: ddb}
+// ShareLinks keeps comment links in a store shared with the other direction
+func (p *Processor) ShareLinks(links store.MappingStore) {
+	p.links = links
 }
 
-func process(inc *Incident) error {
+func (p *Processor) process(ctx context.Context, inc *Incident) (err error) {
 
-	p := newProcessor(*newDBClient())
+	branch := "ignored"
+	defer func() {
+		// attachments only follow an event that created or updated the ticket
+		inc.synced = err == nil && (branch == "create" || branch == "update" || branch == "progress" || branch == "edit")
+		metrics.Inc(metrics.Processed, "direction", "out", "branch", branch, "outcome", outcome(err))
+	}()
+
+	// comments snowsync wrote to JSD itself are not copied back, the rest of the event still applies
+	reason, err := loop.Echo(ctx, p.links, p.conf.Marker, store.SystemJSD, inc.ExtID, inc.CommentID, inc.Comment)
+	if err != nil {
+		return fmt.Errorf("could not check for echo: %w", err)
+	}
+	echo := reason != ""
+	if echo {
+		logging.From(ctx).Info("dropping self-originated comment", "reason", reason)
+		if inc.Event == eventCommentDeleted {
+			branch = "echo"
+			return nil
+		}
+		inc.Comment = ""
+		inc.CommentHash = commentHash("")
+	}
+
+	// an event older than the newest one applied to the ticket still brings its comments, which are deduplicated
+	// by comment id, but its status, priority and fields are left alone so a late event cannot roll the ticket back
+	stale, err := p.checkStale(ctx, inc)
+	if err != nil {
+		return fmt.Errorf("could not check for stale event: %w", err)
+	}
+	defer func() {
+		if err == nil {
+			p.advanceHead(ctx, inc, stale)
+		}
+	}()
+
+	err = p.checkStatus(ctx, inc)
+	if err != nil {
+		return fmt.Errorf("could not check status: %w", err)
+	}
 
 	// check if external id exists in DB, expect internal identifier in return
-	partial, iid, err := p.db.checkPartial(inc)
+	partial, iid, err := p.checkPartial(ctx, inc)
 	if err != nil {
-		return fmt.Errorf("could not check partial item: %v", err)
+		return fmt.Errorf("could not check partial item: %w", err)
 	}
 
 	// add internal identifier
 	inc.IntID = iid
 
 	// check if both external id and comment exist, expect internal identifier in return
-	exact, err := p.db.checkExact(inc)
+	exact, rec, err := p.checkExact(ctx, inc)
 	if err != nil {
-		return fmt.Errorf("could not check exact item: %v", err)
+		return fmt.Errorf("could not check exact item: %w", err)
+	}
+
+	// an echo belongs to a ticket snowsync already synced, there is nothing to create
+	if echo && !exact && !partial {
+		branch = "echo"
+		return nil
+	}
+
+	// only one invocation creates a ticket, the others carry on as updates once it exists
+	if !exact && !partial && inc.Event != eventCommentDeleted {
+		partial, iid, err = p.claimCreate(ctx, inc)
+		if err != nil {
+			return err
+		}
+		if partial {
+			inc.IntID = iid
+			exact, rec, err = p.checkExact(ctx, inc)
+			if err != nil {
+				return fmt.Errorf("could not check exact item: %w", err)
+			}
+		}
 	}
 
 	switch {
+	case !exact && inc.Event == eventCommentDeleted:
+		logging.From(ctx).Info("ignoring deletion of a comment that was never synced")
+		return nil
+	case exact && inc.Event == eventCommentDeleted:
+		branch = "delete"
+		ctx = logging.With(ctx, logging.Branch, "delete")
+		if rec.CommentDeleted {
+			logging.From(ctx).Info("comment deletion already synced")
+			return nil
+		}
+		logging.From(ctx).Info("annotating deleted comment")
+		err = p.annotateComment(ctx, inc, fmt.Sprintf("Comment deleted on JSD (%v)", inc.CommentID))
+		if err != nil {
+			return err
+		}
+		upd := *rec
+		upd.CommentDeleted = true
+		err = p.writeItem(ctx, &upd)
+		if err != nil {
+			return fmt.Errorf("could not update DB item: %w", err)
+		}
+		return nil
+	case exact && edited(rec, inc):
+		branch = "edit"
+		ctx = logging.With(ctx, logging.Branch, "edit")
+		logging.From(ctx).Info("annotating edited comment")
+		err = p.annotateComment(ctx, inc, fmt.Sprintf("Comment edited on JSD (%v): %v", inc.CommentID, inc.Comment))
+		if err != nil {
+			return err
+		}
+		// keep the link to the SNOW comment alongside the new hash
+		inc.RemoteCommentID = rec.RemoteCommentID
+		inc.Version = rec.Version
+		err = p.writeItem(ctx, inc)
+		if err != nil {
+			return fmt.Errorf("could not update DB item: %w", err)
+		}
+		return nil
 	case !exact && !partial:
-		fmt.Println("creating new ticket...")
-		// create ticket on SNOW
-		iid, err := create(inc)
+		branch = "create"
+		ctx = logging.With(ctx, logging.Branch, "create")
+		logging.From(ctx).Info("creating new ticket")
+		// create ticket on SNOW, a failed create leaves the ticket to the next attempt
+		iid, err := p.create(ctx, inc)
 		if err != nil {
-			return fmt.Errorf("could not create ticket: %v", err)
+			p.releaseCreate(ctx, inc)
+			return fmt.Errorf("could not create ticket: %w", err)
 		}
 		// add returned internal identifier
-		inc.IntID = iid
+		inc.IntID, inc.State = iid, inc.Status
+		// the lock keeps the identifier until the record is written, so a replay after a failed write records it
+		p.markCreated(ctx, inc)
 		// create a new DB record
-		err = p.db.writeItem(inc)
+		err = p.writeItem(ctx, inc)
 		if err != nil {
-			return fmt.Errorf("could not put DB item: %v", err)
+			return fmt.Errorf("could not put DB item: %w", err)
 		}
+		p.releaseCreate(ctx, inc)
 		return nil
-	case !exact && partial:
-		fmt.Println("updating ticket with new comments...")
-		// update DB with existing key
-		err := p.db.writeItem(inc)
+	case !exact && partial && inc.Comment != "":
+		branch = "update"
+		ctx = logging.With(ctx, logging.Branch, "update")
+		logging.From(ctx).Info("updating ticket with new comments")
+		// remove irrelevant keys and update ticket on SNOW
+		upd := *inc
+		upd.Priority = ""
+		upd.Description = ""
+		if stale {
+			upd.Status, upd.Resolution, upd.Summary = "", "", ""
+		}
+		cid, err := p.update(ctx, &upd)
 		if err != nil {
-			return fmt.Errorf("could not update DB item: %v", err)
+			return fmt.Errorf("could not update ticket: %w", err)
 		}
-		// remove irrelevant keys and update ticket on SNOW
-		inc.Priority = ""
-		inc.Description = ""
-		err = update(inc)
+		// record the comment only once SNOW has it, so a failed update is not mistaken for a delivered one
+		inc.RemoteCommentID, inc.State = cid, upd.Status
+		err = p.writeLinked(ctx, inc)
 		if err != nil {
-			return fmt.Errorf("could not update ticket: %v", err)
+			return fmt.Errorf("could not update DB item: %w", err)
 		}
 		return nil
-	case exact:
-		fmt.Println("no new comments, updating status only...")
-		// update DB with existing key
-		err := p.db.writeItem(inc)
-		if err != nil {
-			return fmt.Errorf("could not update DB item: %v", err)
+	case stale:
+		branch = "stale"
+		logging.From(ctx).Info("no new comments in stale event, nothing to update")
+		return nil
+	case exact || partial:
+		branch = "progress"
+		ctx = logging.With(ctx, logging.Branch, "progress")
+		logging.From(ctx).Info("no new comments, updating status only")
+		// the comment itself is unchanged, so keep what is known about it
+		if exact {
+			inc.CommentHash, inc.RemoteCommentID, inc.CommentDeleted = rec.CommentHash, rec.RemoteCommentID, rec.CommentDeleted
+			inc.Version = rec.Version
 		}
 		// progress ticket on SNOW
-		err = progress(inc)
+		err := p.progress(ctx, inc)
+		if err != nil {
+			return fmt.Errorf("could not update ticket: %w", err)
+		}
+		inc.State = inc.Status
+		// update DB with existing key
+		err = p.writeItem(ctx, inc)
 		if err != nil {
-			return fmt.Errorf("could not update ticket: %v", err)
+			return fmt.Errorf("could not update DB item: %w", err)
 		}
 		return nil
 	default:
-		fmt.Printf("nothing to update, quitting!\n")
+		logging.From(ctx).Info("nothing to update")
 	}
 	return nil
 }
+
+// outcome labels a processing result for metrics
+func outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
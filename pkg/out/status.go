@@ -0,0 +1,34 @@
+package out
+
+import (
+	"context"
+
+	"github.com/UKHomeOffice/snowsync/pkg/logging"
+	"github.com/UKHomeOffice/snowsync/pkg/store"
+)
+
+// checkStatus makes sure the SNOW workflow allows moving the ticket to its new state from the one it was last known to be
+// in on SNOW
+// a move it does not allow is rejected, or left out of the event when the workflow ignores such states
+func (p *Processor) checkStatus(ctx context.Context, inc *Incident) error {
+
+	wf := &p.conf.Mappings.Workflows.SNOW
+	if inc.Status == "" || !wf.Constrained() {
+		return nil
+	}
+
+	from, err := store.LookupStatus(ctx, p.db, store.SystemSNOW, inc.Identifier)
+	if err != nil {
+		return err
+	}
+	_, err = wf.Path(from, inc.Status)
+	if err == nil {
+		return nil
+	}
+	if wf.Ignores() {
+		logging.From(ctx).Info("ignoring status the workflow cannot reach", "status", inc.Status, logging.Err(err))
+		inc.Status = ""
+		return nil
+	}
+	return err
+}
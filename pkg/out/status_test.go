@@ -0,0 +1,120 @@
+package out
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/UKHomeOffice/snowsync/pkg/config"
+	"github.com/UKHomeOffice/snowsync/pkg/mapping"
+	"github.com/UKHomeOffice/snowsync/pkg/store"
+)
+
+// newStatusTest returns a processor checking moves against a SNOW workflow
+func newStatusTest(unknown string) *Processor {
+	m := mapping.Default()
+	m.Workflows.SNOW = mapping.Workflow{
+		Initial: "New",
+		States:  []string{"New", "In Progress", "Resolved"},
+		Transitions: []mapping.Transition{
+			{From: "New", To: "In Progress"},
+			{From: "In Progress", To: "Resolved"},
+		},
+		Unknown: unknown,
+	}
+	return NewProcessor(store.NewMemory(), nil, &config.Config{Mappings: m})
+}
+
+func TestCheckStatus(t *testing.T) {
+
+	p := newStatusTest(mapping.UnknownReject)
+	ctx := context.Background()
+
+	// a new ticket starts in the initial state, from which Resolved is reached through In Progress
+	err := p.checkStatus(ctx, &Incident{Identifier: "ACP-1", Status: "Resolved"})
+	if err != nil {
+		t.Errorf("move from New refused: %v", err)
+	}
+	err = p.checkStatus(ctx, &Incident{Identifier: "ACP-1", Status: "Closed"})
+	if !errors.Is(err, mapping.ErrUnknownState) {
+		t.Errorf("got %v for a state outside the workflow", err)
+	}
+
+	// the JSD state belongs to the other workflow and is not where the SNOW move starts
+	err = store.PutStatus(ctx, p.db, store.SystemJSD, "ACP-1", "Resolved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.checkStatus(ctx, &Incident{Identifier: "ACP-1", Status: "In Progress"}); err != nil {
+		t.Errorf("moved from the JSD state: %v", err)
+	}
+
+	// nothing leads out of Resolved
+	err = store.PutStatus(ctx, p.db, store.SystemSNOW, "ACP-1", "Resolved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.checkStatus(ctx, &Incident{Identifier: "ACP-1", Status: "In Progress"})
+	if !errors.Is(err, mapping.ErrNoPath) {
+		t.Errorf("got %v moving from Resolved", err)
+	}
+
+	// an event without a status has nothing to check
+	if err := p.checkStatus(ctx, &Incident{Identifier: "ACP-2"}); err != nil {
+		t.Errorf("got %v without a status", err)
+	}
+}
+
+func TestCheckStatusIgnores(t *testing.T) {
+
+	p := newStatusTest(mapping.UnknownIgnore)
+	ctx := context.Background()
+
+	err := store.PutStatus(ctx, p.db, store.SystemSNOW, "ACP-1", "Resolved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inc := &Incident{Identifier: "ACP-1", Status: "New", Comment: "done"}
+	err = p.checkStatus(ctx, inc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rest of the event is still synced
+	if inc.Status != "" || inc.Comment != "done" {
+		t.Errorf("incident is %+v", inc)
+	}
+}
+
+func TestCheckStatusUnconstrained(t *testing.T) {
+
+	p := NewProcessor(store.NewMemory(), nil, &config.Config{Mappings: mapping.Default()})
+	p.conf.Mappings.Workflows.SNOW = mapping.Workflow{}
+
+	err := p.checkStatus(context.Background(), &Incident{Identifier: "ACP-1", Status: "Anything"})
+	if err != nil {
+		t.Errorf("workflow without states refused a move: %v", err)
+	}
+}
+
+func TestCheckIncidentVars(t *testing.T) {
+
+	f := &config.OutFields{
+		IssueID:     "issue.key",
+		Description: "issue.fields.description",
+		Priority:    "issue.fields.priority.name",
+		Status:      "issue.fields.status.name",
+		Summary:     "issue.fields.summary",
+	}
+	body := `{"issue":{"key":"ACP-1","fields":{"description":"d","priority":{"name":"P1"},"status":{"name":"Open"},"summary":"s"}}}`
+
+	if err := checkIncidentVars(body, f); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkIncidentVars(`{"issue":{"key":"ACP-1"}}`, f); !errors.Is(err, errMissingField) {
+		t.Errorf("got %v for a body without fields", err)
+	}
+	f.Status = ""
+	if err := checkIncidentVars(body, f); !errors.Is(err, errMissingConfig) {
+		t.Errorf("got %v without STATUS_FIELD", err)
+	}
+}
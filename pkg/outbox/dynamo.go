@@ -0,0 +1,103 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// Dynamo keeps entries in a DynamoDB table with a hash key named entry_id
+type Dynamo struct {
+	DynamoDB dynamodbiface.DynamoDBAPI
+	Table    string
+}
+
+// NewDynamo creates a DynamoDB client for a table
+func NewDynamo(table, region string) *Dynamo {
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+	ddb := dynamodb.New(sess, &aws.Config{Region: aws.String(region)})
+	return &Dynamo{DynamoDB: ddb, Table: table}
+}
+
+// Put writes an entry
+func (d *Dynamo) Put(ctx context.Context, e *Entry) error {
+
+	item, err := dynamodbattribute.MarshalMap(e)
+	if err != nil {
+		return fmt.Errorf("could not marshal entry: %w", err)
+	}
+
+	_, err = d.DynamoDB.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.Table),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("could not put entry: %w", err)
+	}
+	return nil
+}
+
+// Delete removes an entry
+func (d *Dynamo) Delete(ctx context.Context, id string) error {
+
+	_, err := d.DynamoDB.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.Table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"entry_id": {
+				S: aws.String(id),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("could not delete entry: %w", err)
+	}
+	return nil
+}
+
+// List scans for entries in a state, oldest first
+// the table only holds undelivered entries so a scan stays small
+func (d *Dynamo) List(ctx context.Context, state State) ([]*Entry, error) {
+
+	input := &dynamodb.ScanInput{
+		TableName:        aws.String(d.Table),
+		FilterExpression: aws.String("#state = :state"),
+		ExpressionAttributeNames: map[string]*string{
+			"#state": aws.String("state"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":state": {
+				S: aws.String(string(state)),
+			},
+		},
+	}
+
+	var out []*Entry
+	var uerr error
+	err := d.DynamoDB.ScanPagesWithContext(ctx, input, func(page *dynamodb.ScanOutput, last bool) bool {
+		for _, item := range page.Items {
+			var e Entry
+			uerr = dynamodbattribute.UnmarshalMap(item, &e)
+			if uerr != nil {
+				return false
+			}
+			out = append(out, &e)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not scan entries: %w", err)
+	}
+	if uerr != nil {
+		return nil, fmt.Errorf("could not unmarshal entry: %w", uerr)
+	}
+
+	sortEntries(out)
+	return out, nil
+}
@@ -0,0 +1,100 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// File is a queue of entries kept as one JSON file each in a local directory
+type File struct {
+	dir string
+}
+
+// NewFile creates the queue directory if needed
+func NewFile(dir string) (*File, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("could not create outbox directory: %w", err)
+	}
+	return &File{dir: dir}, nil
+}
+
+func (f *File) path(id string) string {
+	return filepath.Join(f.dir, id+".json")
+}
+
+// Put writes an entry to a temporary file and renames it into place, so readers never see a partial entry
+func (f *File) Put(ctx context.Context, e *Entry) error {
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("could not marshal entry: %w", err)
+	}
+
+	tmp, err := ioutil.TempFile(f.dir, ".entry-")
+	if err != nil {
+		return fmt.Errorf("could not create entry file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write entry file: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), f.path(e.ID))
+	if err != nil {
+		return fmt.Errorf("could not move entry file: %w", err)
+	}
+	return nil
+}
+
+// Delete removes an entry file
+func (f *File) Delete(ctx context.Context, id string) error {
+	err := os.Remove(f.path(id))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove entry file: %w", err)
+	}
+	return nil
+}
+
+// List reads the entries in a state, oldest first
+func (f *File) List(ctx context.Context, state State) ([]*Entry, error) {
+
+	files, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read outbox directory: %w", err)
+	}
+
+	var out []*Entry
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".json") || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(f.dir, fi.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("could not read entry file: %w", err)
+		}
+		var e Entry
+		err = json.Unmarshal(b, &e)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode entry file %v: %w", fi.Name(), err)
+		}
+		if e.State == state {
+			out = append(out, &e)
+		}
+	}
+	sortEntries(out)
+	return out, nil
+}
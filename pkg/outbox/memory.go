@@ -0,0 +1,56 @@
+package outbox
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Memory keeps entries in process memory, they are lost on exit
+type Memory struct {
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+// NewMemory creates an empty in-memory store
+func NewMemory() *Memory {
+	return &Memory{entries: make(map[string]Entry)}
+}
+
+// Put stores a copy of an entry
+func (m *Memory) Put(ctx context.Context, e *Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[e.ID] = *e
+	return nil
+}
+
+// Delete removes an entry
+func (m *Memory) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, id)
+	return nil
+}
+
+// List returns copies of the entries in a state, oldest first
+func (m *Memory) List(ctx context.Context, state State) ([]*Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var out []*Entry
+	for _, e := range m.entries {
+		if e.State == state {
+			e := e
+			out = append(out, &e)
+		}
+	}
+	sortEntries(out)
+	return out, nil
+}
+
+func sortEntries(es []*Entry) {
+	sort.Slice(es, func(i, j int) bool {
+		return es[i].Received.Before(es[j].Received)
+	})
+}
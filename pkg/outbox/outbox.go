@@ -0,0 +1,186 @@
+package outbox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// State is the delivery state of an entry
+type State string
+
+// Entry states
+const (
+	StatePending    State = "pending"
+	StateDeadLetter State = "dead_letter"
+)
+
+// Entry is a webhook whose delivery to the other system is being tracked
+// it keeps the raw request so that it can be replayed
+type Entry struct {
+	ID         string    `json:"entry_id"`
+	Direction  string    `json:"direction"`
+	Resource   string    `json:"resource"`
+	Body       string    `json:"body"`
+	Identifier string    `json:"identifier,omitempty"`
+	CommentID  string    `json:"comment_sysid,omitempty"`
+	State      State     `json:"state"`
+	Error      string    `json:"error,omitempty"`
+	Attempts   int       `json:"attempts"`
+	Received   time.Time `json:"received"`
+	Updated    time.Time `json:"updated"`
+}
+
+// NewEntry creates an entry for a webhook request
+func NewEntry(direction string, req *events.APIGatewayProxyRequest, id, commentID string) *Entry {
+
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+
+	return &Entry{
+		ID:         hex.EncodeToString(b),
+		Direction:  direction,
+		Resource:   req.Resource,
+		Body:       req.Body,
+		Identifier: id,
+		CommentID:  commentID,
+		Received:   time.Now().UTC(),
+	}
+}
+
+// Store persists outbox entries
+type Store interface {
+	// Put creates or replaces an entry
+	Put(ctx context.Context, e *Entry) error
+	// Delete removes an entry, removing a missing entry is not an error
+	Delete(ctx context.Context, id string) error
+	// List returns the entries in a state, oldest first
+	List(ctx context.Context, state State) ([]*Entry, error)
+}
+
+// Outbox records every delivery as pending before the remote call is made
+// deliveries that fail are kept as dead letters until they are replayed
+// a nil Outbox records nothing
+type Outbox struct {
+	store Store
+}
+
+// New creates an Outbox on a store
+func New(s Store) *Outbox {
+	return &Outbox{store: s}
+}
+
+// Pending records that a delivery is about to be attempted
+func (o *Outbox) Pending(ctx context.Context, e *Entry) error {
+	if o == nil {
+		return nil
+	}
+	e.State = StatePending
+	e.Attempts++
+	e.Updated = time.Now().UTC()
+	return o.store.Put(ctx, e)
+}
+
+// Delivered removes an entry once the remote system has accepted it
+func (o *Outbox) Delivered(ctx context.Context, e *Entry) error {
+	if o == nil {
+		return nil
+	}
+	return o.store.Delete(ctx, e.ID)
+}
+
+// Failed moves an entry to the dead-letter state with the cause of the failure
+func (o *Outbox) Failed(ctx context.Context, e *Entry, cause error) error {
+	if o == nil {
+		return nil
+	}
+	e.State = StateDeadLetter
+	e.Error = cause.Error()
+	e.Updated = time.Now().UTC()
+	return o.store.Put(ctx, e)
+}
+
+// DeadLetters lists failed deliveries along with pending ones older than age
+// a pending entry that old was most likely interrupted by a timeout or crash
+func (o *Outbox) DeadLetters(ctx context.Context, age time.Duration) ([]*Entry, error) {
+	if o == nil {
+		return nil, nil
+	}
+
+	dead, err := o.store.List(ctx, StateDeadLetter)
+	if err != nil {
+		return nil, fmt.Errorf("could not list dead letters: %w", err)
+	}
+
+	pending, err := o.store.List(ctx, StatePending)
+	if err != nil {
+		return nil, fmt.Errorf("could not list pending entries: %w", err)
+	}
+
+	cutoff := time.Now().Add(-age)
+	for _, e := range pending {
+		if e.Updated.Before(cutoff) {
+			dead = append(dead, e)
+		}
+	}
+	return dead, nil
+}
+
+// Remove deletes an entry, e.g. once it has been replayed
+func (o *Outbox) Remove(ctx context.Context, id string) error {
+	if o == nil {
+		return nil
+	}
+	return o.store.Delete(ctx, id)
+}
+
+// Store types
+const (
+	TypeNone     = "none"
+	TypeMemory   = "memory"
+	TypeFile     = "file"
+	TypeDynamoDB = "dynamodb"
+)
+
+// Options select and configure an outbox store
+type Options struct {
+	// Type is one of none, memory, file or dynamodb
+	Type string
+	// Table is the DynamoDB table name
+	Table string
+	// Region is the AWS region of the DynamoDB table
+	Region string
+	// Path is the directory of the file queue
+	Path string
+}
+
+// Open creates the Outbox selected by options, none gives a nil Outbox
+func Open(o Options) (*Outbox, error) {
+
+	switch o.Type {
+	case TypeNone:
+		return nil, nil
+	case TypeMemory:
+		return New(NewMemory()), nil
+	case TypeFile:
+		if o.Path == "" {
+			return nil, fmt.Errorf("missing outbox directory")
+		}
+		s, err := NewFile(o.Path)
+		if err != nil {
+			return nil, err
+		}
+		return New(s), nil
+	case TypeDynamoDB:
+		if o.Table == "" {
+			return nil, fmt.Errorf("missing outbox table name")
+		}
+		return New(NewDynamo(o.Table, o.Region)), nil
+	default:
+		return nil, fmt.Errorf("unknown outbox type: %v", o.Type)
+	}
+}
@@ -0,0 +1,147 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/UKHomeOffice/snowsync/pkg/testing/fakes"
+)
+
+// stores returns every store kind, emptied for one test
+func stores(t *testing.T) map[string]Store {
+
+	f, err := NewFile(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := fakes.NewDynamoDB()
+	db.AddTable("outbox", "entry_id", "")
+
+	return map[string]Store{
+		"memory":   NewMemory(),
+		"file":     f,
+		"dynamodb": &Dynamo{DynamoDB: db, Table: "outbox"},
+	}
+}
+
+func entry(id string) *Entry {
+	return NewEntry("in", &events.APIGatewayProxyRequest{Resource: "/v2/in", Body: `{"number":"` + id + `"}`}, id, "0")
+}
+
+func TestDelivered(t *testing.T) {
+
+	ctx := context.Background()
+	for name, s := range stores(t) {
+
+		o := New(s)
+		e := entry("INC1")
+		err := o.Pending(ctx, e)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		pending, err := s.List(ctx, StatePending)
+		if err != nil || len(pending) != 1 || pending[0].Body != e.Body || pending[0].Attempts != 1 {
+			t.Errorf("%v: pending entries are %+v, %v", name, pending, err)
+		}
+
+		err = o.Delivered(ctx, e)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		pending, err = s.List(ctx, StatePending)
+		if err != nil || len(pending) != 0 {
+			t.Errorf("%v: delivered entry kept: %+v, %v", name, pending, err)
+		}
+		// removing an entry twice is not an error
+		if err := o.Remove(ctx, e.ID); err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+
+	ctx := context.Background()
+	for name, s := range stores(t) {
+
+		o := New(s)
+		failed, stuck, recent := entry("INC1"), entry("INC2"), entry("INC3")
+		for _, e := range []*Entry{failed, stuck, recent} {
+			err := o.Pending(ctx, e)
+			if err != nil {
+				t.Fatalf("%v: %v", name, err)
+			}
+		}
+		err := o.Failed(ctx, failed, errors.New("JSD answered 503"))
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		// a pending entry last touched long ago was interrupted
+		stuck.Updated = time.Now().Add(-time.Hour).UTC()
+		err = s.Put(ctx, stuck)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dead, err := o.DeadLetters(ctx, 10*time.Minute)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		got := map[string]*Entry{}
+		for _, e := range dead {
+			got[e.Identifier] = e
+		}
+		if len(got) != 2 || got["INC1"] == nil || got["INC2"] == nil {
+			t.Fatalf("%v: dead letters are %+v", name, dead)
+		}
+		if got["INC1"].State != StateDeadLetter || got["INC1"].Error != "JSD answered 503" {
+			t.Errorf("%v: failed entry is %+v", name, got["INC1"])
+		}
+
+		// a replayed entry counts its attempts
+		err = o.Pending(ctx, got["INC1"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got["INC1"].Attempts != 2 {
+			t.Errorf("%v: %v attempts after a replay", name, got["INC1"].Attempts)
+		}
+	}
+}
+
+func TestNil(t *testing.T) {
+
+	var o *Outbox
+	ctx := context.Background()
+	e := entry("INC1")
+	if err := o.Pending(ctx, e); err != nil {
+		t.Error(err)
+	}
+	if err := o.Failed(ctx, e, errors.New("failed")); err != nil {
+		t.Error(err)
+	}
+	if dead, err := o.DeadLetters(ctx, 0); err != nil || dead != nil {
+		t.Errorf("got %v, %v", dead, err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+
+	o, err := Open(Options{Type: TypeNone})
+	if err != nil || o != nil {
+		t.Errorf("none opened %v, %v", o, err)
+	}
+	for _, opts := range []Options{
+		{Type: TypeFile},
+		{Type: TypeDynamoDB},
+		{Type: "queue"},
+	} {
+		if _, err := Open(opts); err == nil {
+			t.Errorf("%+v opened", opts)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package secrets
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/UKHomeOffice/snowsync/pkg/logging"
+)
+
+// Cache keeps credential sets loaded from a provider for TTL
+// when a reload fails the last credentials are kept in use, so an outage of the backend does not stop syncing
+type Cache struct {
+	provider Provider
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]entry
+}
+
+type entry struct {
+	creds  *Credentials
+	loaded time.Time
+}
+
+// NewCache caches a provider, a TTL of 0 loads credentials on every use
+func NewCache(p Provider, ttl time.Duration) *Cache {
+	return &Cache{provider: p, ttl: ttl, entries: make(map[string]entry)}
+}
+
+// Get returns a credential set, loading it again once it is older than the TTL
+func (c *Cache) Get(ctx context.Context, name string) (*Credentials, error) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[name]
+	if ok && time.Since(e.loaded) < c.ttl {
+		return e.creds, nil
+	}
+
+	creds, err := c.provider.Get(ctx, name)
+	if err != nil && ok {
+		logging.From(ctx).Warn("could not reload credentials, using the last ones loaded", "credentials", name, logging.Err(err))
+		return e.creds, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.entries[name] = entry{creds: creds, loaded: time.Now()}
+	return creds, nil
+}
+
+// Invalidate makes the next Get of a credential set load it again, such as after a remote system rejected it
+func (c *Cache) Invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[name]; ok {
+		e.loaded = time.Time{}
+		c.entries[name] = e
+	}
+}
@@ -0,0 +1,30 @@
+package secrets
+
+import (
+	"context"
+	"os"
+	"strings"
+)
+
+// Env reads a credential set from <NAME>_USER and <NAME>_PASS, such as JSD_USER and SNOW_PASS
+// ADMIN_USER and ADMIN_PASS are used for sets that are not configured, as both systems once shared them
+type Env struct{}
+
+// Get reads a credential set from the environment
+func (Env) Get(ctx context.Context, name string) (*Credentials, error) {
+	n := strings.ToUpper(name)
+	return complete(name, &Credentials{
+		User: lookup(n+"_USER", "ADMIN_USER"),
+		Pass: lookup(n+"_PASS", "ADMIN_PASS"),
+	})
+}
+
+// lookup returns the first variable set
+func lookup(keys ...string) string {
+	for _, k := range keys {
+		if v, ok := os.LookupEnv(k); ok {
+			return v
+		}
+	}
+	return ""
+}
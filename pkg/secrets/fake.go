@@ -0,0 +1,39 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Fake is an in-memory provider for tests and local runs
+type Fake struct {
+	mu    sync.Mutex
+	creds map[string]Credentials
+	// Gets counts loads, so tests can tell cached credentials from reloaded ones
+	Gets int
+}
+
+// NewFake creates an empty fake provider
+func NewFake() *Fake {
+	return &Fake{creds: make(map[string]Credentials)}
+}
+
+// Set stores or rotates a credential set
+func (f *Fake) Set(name, user, pass string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.creds[name] = Credentials{User: user, Pass: pass}
+}
+
+// Get returns a copy of a stored credential set
+func (f *Fake) Get(ctx context.Context, name string) (*Credentials, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Gets++
+	c, ok := f.creds[name]
+	if !ok {
+		return nil, fmt.Errorf("no credentials for %v", name)
+	}
+	return &c, nil
+}
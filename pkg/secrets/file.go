@@ -0,0 +1,39 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// File reads a credential set from the username and password files of a directory named after it
+// this is how a Kubernetes secret mounted under Dir/<name> appears, a set holding a bearer token may have no username file
+type File struct {
+	Dir string
+}
+
+// Get reads a credential set from its files, every read sees a rotated secret
+func (f *File) Get(ctx context.Context, name string) (*Credentials, error) {
+
+	user, err := f.read(name, "username")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	pass, err := f.read(name, "password")
+	if err != nil {
+		return nil, err
+	}
+	return complete(name, &Credentials{User: user, Pass: pass})
+}
+
+func (f *File) read(name, key string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(f.Dir, name, key))
+	if err != nil {
+		return "", fmt.Errorf("could not read %v %v: %w", name, key, err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
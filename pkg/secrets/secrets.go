@@ -0,0 +1,47 @@
+// Package secrets loads the credentials used to call JSD and ServiceNow
+// credentials come from the environment, mounted files, SSM Parameter Store or Secrets Manager and are
+// cached for a while, so a rotated password is picked up without a redeploy
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// credential sets
+const (
+	JSD  = "jsd"
+	SNOW = "snow"
+)
+
+// Backends credentials can be loaded from
+const (
+	BackendEnv            = "env"
+	BackendFile           = "file"
+	BackendSSM            = "ssm"
+	BackendSecretsManager = "secretsmanager"
+)
+
+// DefaultTTL is how long credentials are used before they are loaded again
+const DefaultTTL = 5 * time.Minute
+
+// Credentials are a username and password for one system
+type Credentials struct {
+	User string
+	Pass string
+}
+
+// Provider loads a named credential set
+type Provider interface {
+	Get(ctx context.Context, name string) (*Credentials, error)
+}
+
+// complete checks the password of a credential set was found
+// the username is left to the authentication modes that send one, a bearer token has none
+func complete(name string, c *Credentials) (*Credentials, error) {
+	if c.Pass == "" {
+		return nil, fmt.Errorf("missing password for %v", name)
+	}
+	return c, nil
+}
@@ -0,0 +1,181 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+func TestEnv(t *testing.T) {
+
+	t.Setenv("ADMIN_USER", "admin")
+	t.Setenv("ADMIN_PASS", "admin-pass")
+	t.Setenv("JSD_USER", "jsd")
+	t.Setenv("JSD_PASS", "jsd-pass")
+
+	c, err := Env{}.Get(context.Background(), JSD)
+	if err != nil || c.User != "jsd" || c.Pass != "jsd-pass" {
+		t.Errorf("got %+v, %v", c, err)
+	}
+	// a set that is not configured falls back to the shared admin credentials
+	c, err = Env{}.Get(context.Background(), SNOW)
+	if err != nil || c.User != "admin" || c.Pass != "admin-pass" {
+		t.Errorf("got %+v, %v", c, err)
+	}
+}
+
+func TestFile(t *testing.T) {
+
+	dir := t.TempDir()
+	write := func(name, key, value string) {
+		t.Helper()
+		err := os.MkdirAll(filepath.Join(dir, name), 0700)
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(dir, name, key), []byte(value), 0600)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(SNOW, "username", "snow\n")
+	write(SNOW, "password", "snow-pass\n")
+	// a bearer token needs no username
+	write(JSD, "password", "personal-access-token")
+
+	f := &File{Dir: dir}
+	c, err := f.Get(context.Background(), SNOW)
+	if err != nil || c.User != "snow" || c.Pass != "snow-pass" {
+		t.Errorf("got %+v, %v", c, err)
+	}
+	c, err = f.Get(context.Background(), JSD)
+	if err != nil || c.User != "" || c.Pass != "personal-access-token" {
+		t.Errorf("got %+v, %v", c, err)
+	}
+	if _, err := f.Get(context.Background(), "admin"); err == nil {
+		t.Error("missing set loaded")
+	}
+}
+
+type fakeSSM struct {
+	ssmiface.SSMAPI
+	params map[string]string
+}
+
+func (f *fakeSSM) GetParametersWithContext(_ aws.Context, in *ssm.GetParametersInput, _ ...request.Option) (*ssm.GetParametersOutput, error) {
+	out := &ssm.GetParametersOutput{}
+	for _, n := range in.Names {
+		if v, ok := f.params[aws.StringValue(n)]; ok {
+			out.Parameters = append(out.Parameters, &ssm.Parameter{Name: n, Value: aws.String(v)})
+		}
+	}
+	return out, nil
+}
+
+func TestSSM(t *testing.T) {
+
+	s := &SSM{Prefix: "/snowsync/", SSM: &fakeSSM{params: map[string]string{
+		"/snowsync/snow/username": "snow",
+		"/snowsync/snow/password": "snow-pass",
+		"/snowsync/jsd/username":  "jsd",
+	}}}
+	c, err := s.Get(context.Background(), SNOW)
+	if err != nil || c.User != "snow" || c.Pass != "snow-pass" {
+		t.Errorf("got %+v, %v", c, err)
+	}
+	if _, err := s.Get(context.Background(), JSD); err == nil {
+		t.Error("set without a password loaded")
+	}
+}
+
+type fakeSecretsManager struct {
+	secretsmanageriface.SecretsManagerAPI
+	secrets map[string]string
+}
+
+func (f *fakeSecretsManager) GetSecretValueWithContext(_ aws.Context, in *secretsmanager.GetSecretValueInput, _ ...request.Option) (*secretsmanager.GetSecretValueOutput, error) {
+	v, ok := f.secrets[aws.StringValue(in.SecretId)]
+	if !ok {
+		return nil, errors.New("ResourceNotFoundException")
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(v)}, nil
+}
+
+func TestSecretsManager(t *testing.T) {
+
+	s := &SecretsManager{Prefix: "snowsync/", SecretsManager: &fakeSecretsManager{secrets: map[string]string{
+		"snowsync/snow": `{"username":"snow","password":"snow-pass"}`,
+		"snowsync/jsd":  `{"password":"personal-access-token"}`,
+	}}}
+	c, err := s.Get(context.Background(), SNOW)
+	if err != nil || c.User != "snow" || c.Pass != "snow-pass" {
+		t.Errorf("got %+v, %v", c, err)
+	}
+	c, err = s.Get(context.Background(), JSD)
+	if err != nil || c.Pass != "personal-access-token" {
+		t.Errorf("got %+v, %v", c, err)
+	}
+}
+
+func TestCache(t *testing.T) {
+
+	f := NewFake()
+	f.Set(JSD, "jsd", "first")
+	c := NewCache(f, time.Hour)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		creds, err := c.Get(ctx, JSD)
+		if err != nil || creds.Pass != "first" {
+			t.Fatalf("got %+v, %v", creds, err)
+		}
+	}
+	if f.Gets != 1 {
+		t.Errorf("%v loads, want the first cached", f.Gets)
+	}
+
+	// a rotated password is picked up once the set is invalidated
+	f.Set(JSD, "jsd", "second")
+	c.Invalidate(JSD)
+	if creds, err := c.Get(ctx, JSD); err != nil || creds.Pass != "second" {
+		t.Errorf("got %+v, %v after a rotation", creds, err)
+	}
+}
+
+// failing is a provider whose backend is down
+type failing struct{ Provider }
+
+func (failing) Get(context.Context, string) (*Credentials, error) {
+	return nil, errors.New("backend unavailable")
+}
+
+func TestCacheKeepsLastCredentials(t *testing.T) {
+
+	f := NewFake()
+	f.Set(SNOW, "snow", "pass")
+	c := NewCache(f, 0)
+	ctx := context.Background()
+	if _, err := c.Get(ctx, SNOW); err != nil {
+		t.Fatal(err)
+	}
+
+	// an outage of the backend does not stop syncing
+	c.provider = failing{}
+	creds, err := c.Get(ctx, SNOW)
+	if err != nil || creds.Pass != "pass" {
+		t.Errorf("got %+v, %v during an outage", creds, err)
+	}
+	if _, err := c.Get(ctx, JSD); err == nil {
+		t.Error("set never loaded reported as found")
+	}
+}
@@ -0,0 +1,47 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+)
+
+// SecretsManager reads a credential set from the secret <Prefix><name>, a JSON object with username and password
+type SecretsManager struct {
+	SecretsManager secretsmanageriface.SecretsManagerAPI
+	Prefix         string
+}
+
+// NewSecretsManager creates a Secrets Manager client
+func NewSecretsManager(prefix, region string) *SecretsManager {
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+	return &SecretsManager{SecretsManager: secretsmanager.New(sess, &aws.Config{Region: aws.String(region)}), Prefix: prefix}
+}
+
+// Get reads the current version of a credential set
+func (s *SecretsManager) Get(ctx context.Context, name string) (*Credentials, error) {
+
+	resp, err := s.SecretsManager.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(s.Prefix + name),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not get secret: %w", err)
+	}
+
+	var v struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	err = json.Unmarshal([]byte(aws.StringValue(resp.SecretString)), &v)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode secret %v: %w", name, err)
+	}
+	return complete(name, &Credentials{User: v.Username, Pass: v.Password})
+}
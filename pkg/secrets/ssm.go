@@ -0,0 +1,49 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// SSM reads a credential set from the SecureString parameters <Prefix><name>/username and <Prefix><name>/password
+type SSM struct {
+	SSM    ssmiface.SSMAPI
+	Prefix string
+}
+
+// NewSSM creates a Parameter Store client
+func NewSSM(prefix, region string) *SSM {
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+	return &SSM{SSM: ssm.New(sess, &aws.Config{Region: aws.String(region)}), Prefix: prefix}
+}
+
+// Get reads and decrypts both parameters of a credential set
+func (s *SSM) Get(ctx context.Context, name string) (*Credentials, error) {
+
+	user, pass := s.Prefix+name+"/username", s.Prefix+name+"/password"
+	resp, err := s.SSM.GetParametersWithContext(ctx, &ssm.GetParametersInput{
+		Names:          aws.StringSlice([]string{user, pass}),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not get parameters: %w", err)
+	}
+
+	var c Credentials
+	for _, p := range resp.Parameters {
+		switch aws.StringValue(p.Name) {
+		case user:
+			c.User = aws.StringValue(p.Value)
+		case pass:
+			c.Pass = aws.StringValue(p.Value)
+		}
+	}
+	return complete(name, &c)
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// maxBody matches the API Gateway payload limit
+const maxBody = 10 << 20
+
+// Handler handles webhooks the way API Gateway delivers them
+type Handler interface {
+	Handle(context.Context, *events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
+}
+
+// Server serves the webhook resources over plain net/http
+type Server struct {
+	mux   *http.ServeMux
+	ready int32
+}
+
+// New creates a Server routing the inbound and outbound resources to their handlers
+func New(in, out Handler) *Server {
+
+	s := &Server{mux: http.NewServeMux()}
+
+	for _, r := range []string{"/v2/in", "/v2/add"} {
+		s.mux.Handle(r, adapt(r, in))
+	}
+	for _, r := range []string{"/v2/out", "/v2/reverse"} {
+		s.mux.Handle(r, adapt(r, out))
+	}
+
+	s.mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+	})
+	s.mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&s.ready) == 0 {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return s
+}
+
+// Handle registers an extra handler, e.g. for metrics
+func (s *Server) Handle(pattern string, h http.Handler) {
+	s.mux.Handle(pattern, h)
+}
+
+// SetReady changes the readiness reported to the orchestrator, cleared when shutting down so traffic drains
+func (s *Server) SetReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&s.ready, v)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// adapt turns a HTTP request into an API Gateway proxy request for resource
+func adapt(resource string, h Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+		if err != nil {
+			http.Error(w, "could not read request body", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		req := &events.APIGatewayProxyRequest{
+			Resource:                        resource,
+			Path:                            r.URL.Path,
+			HTTPMethod:                      r.Method,
+			Headers:                         make(map[string]string),
+			MultiValueHeaders:               make(map[string][]string),
+			QueryStringParameters:           make(map[string]string),
+			MultiValueQueryStringParameters: r.URL.Query(),
+			Body:                            string(body),
+			RequestContext: events.APIGatewayProxyRequestContext{
+				RequestID:        requestID(r),
+				ResourcePath:     resource,
+				HTTPMethod:       r.Method,
+				RequestTimeEpoch: time.Now().UnixNano() / int64(time.Millisecond),
+				Identity: events.APIGatewayRequestIdentity{
+					SourceIP:  sourceIP(r),
+					UserAgent: r.UserAgent(),
+				},
+			},
+		}
+		for k, v := range r.Header {
+			req.Headers[k] = strings.Join(v, ",")
+			req.MultiValueHeaders[k] = v
+		}
+		for k, v := range r.URL.Query() {
+			req.QueryStringParameters[k] = v[len(v)-1]
+		}
+
+		res, err := h.Handle(r.Context(), req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		write(w, res)
+	})
+}
+
+// write copies an API Gateway proxy response to w
+func write(w http.ResponseWriter, res events.APIGatewayProxyResponse) {
+
+	for k, v := range res.Headers {
+		w.Header().Set(k, v)
+	}
+	for k, vs := range res.MultiValueHeaders {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+
+	body := []byte(res.Body)
+	if res.IsBase64Encoded {
+		b, err := base64.StdEncoding.DecodeString(res.Body)
+		if err != nil {
+			http.Error(w, "could not decode response body", http.StatusInternalServerError)
+			return
+		}
+		body = b
+	}
+
+	if res.StatusCode == 0 {
+		res.StatusCode = http.StatusOK
+	}
+	w.WriteHeader(res.StatusCode)
+	w.Write(body)
+}
+
+// requestID keeps an identifier set by a proxy in front of the server, or makes one up
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
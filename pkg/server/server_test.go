@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// recorder keeps the last request it handled and answers with res or err
+type recorder struct {
+	req *events.APIGatewayProxyRequest
+	res events.APIGatewayProxyResponse
+	err error
+}
+
+func (h *recorder) Handle(_ context.Context, req *events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	h.req = req
+	return h.res, h.err
+}
+
+func TestAdapt(t *testing.T) {
+
+	in := &recorder{res: events.APIGatewayProxyResponse{StatusCode: http.StatusCreated, Body: "created", Headers: map[string]string{"X-Ticket": "ACP-1"}}}
+	out := &recorder{}
+	s := httptest.NewServer(New(in, out))
+	defer s.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, s.URL+"/v2/add?source=snow", strings.NewReader(`{"number":"INC0010001"}`))
+	req.Header.Set("X-Request-Id", "req-1")
+	req.Header.Add("X-Forwarded-For", "10.0.0.1")
+	req.Header.Add("X-Forwarded-For", "10.0.0.2")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, _ := ioutil.ReadAll(res.Body)
+
+	if res.StatusCode != http.StatusCreated || string(b) != "created" || res.Header.Get("X-Ticket") != "ACP-1" {
+		t.Errorf("got %v %q with headers %v", res.StatusCode, b, res.Header)
+	}
+	if out.req != nil {
+		t.Error("/v2/add routed to the outbound handler")
+	}
+	got := in.req
+	if got == nil {
+		t.Fatal("/v2/add not routed to the inbound handler")
+	}
+	if got.Resource != "/v2/add" || got.Body != `{"number":"INC0010001"}` || got.QueryStringParameters["source"] != "snow" {
+		t.Errorf("request is %+v", got)
+	}
+	if got.RequestContext.RequestID != "req-1" || got.RequestContext.Identity.SourceIP != "127.0.0.1" {
+		t.Errorf("request context is %+v", got.RequestContext)
+	}
+	if got.Headers["X-Forwarded-For"] != "10.0.0.1,10.0.0.2" || len(got.MultiValueHeaders["X-Forwarded-For"]) != 2 {
+		t.Errorf("headers are %v and %v", got.Headers, got.MultiValueHeaders)
+	}
+
+	for _, r := range []string{"/v2/out", "/v2/reverse"} {
+		out.req = nil
+		res, err := http.Post(s.URL+r, "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if out.req == nil || out.req.Resource != r {
+			t.Errorf("%v routed as %+v", r, out.req)
+		}
+	}
+}
+
+func TestAdaptRefuses(t *testing.T) {
+
+	h := &recorder{err: errors.New("store unavailable")}
+	srv := New(h, h)
+	s := httptest.NewServer(srv)
+	defer s.Close()
+
+	res, err := http.Get(s.URL + "/v2/in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed || res.Header.Get("Allow") != http.MethodPost {
+		t.Errorf("GET got %v with Allow %q", res.StatusCode, res.Header.Get("Allow"))
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v2/in", strings.NewReader(strings.Repeat("a", maxBody+1))))
+	if w.Code != http.StatusRequestEntityTooLarge || h.req != nil {
+		t.Errorf("oversized body got %v", w.Code)
+	}
+
+	// a handler error is not a response API Gateway would have sent on
+	res, err = http.Post(s.URL+"/v2/in", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("handler error got %v", res.StatusCode)
+	}
+}
+
+func TestWriteBase64(t *testing.T) {
+
+	w := httptest.NewRecorder()
+	write(w, events.APIGatewayProxyResponse{Body: base64.StdEncoding.EncodeToString([]byte("file")), IsBase64Encoded: true})
+	if w.Code != http.StatusOK || w.Body.String() != "file" {
+		t.Errorf("got %v %q", w.Code, w.Body.String())
+	}
+}
+
+func TestReadiness(t *testing.T) {
+
+	s := New(&recorder{}, &recorder{})
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	if get("/healthz") != http.StatusOK {
+		t.Error("not live")
+	}
+	if get("/readyz") != http.StatusServiceUnavailable {
+		t.Error("ready before SetReady")
+	}
+	s.SetReady(true)
+	if get("/readyz") != http.StatusOK {
+		t.Error("not ready after SetReady")
+	}
+	// shutting down drains traffic while the process is still live
+	s.SetReady(false)
+	if get("/readyz") != http.StatusServiceUnavailable || get("/healthz") != http.StatusOK {
+		t.Error("still ready after shutdown started")
+	}
+}
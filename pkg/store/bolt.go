@@ -0,0 +1,185 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// a bolt file can only be opened once, so stores sharing a file share its handle
+var (
+	boltMu    sync.Mutex
+	boltFiles = make(map[string]*bolt.DB)
+)
+
+// Bolt is a MappingStore kept in a bucket of a local bolt database file
+type Bolt struct {
+	db     *bolt.DB
+	bucket []byte
+
+	mu sync.Mutex
+	// pruned is when expired records were last removed
+	pruned time.Time
+}
+
+// NewBolt opens or creates a bolt database, namespace names the bucket and defaults to mappings
+func NewBolt(path, namespace string) (*Bolt, error) {
+
+	if namespace == "" {
+		namespace = "mappings"
+	}
+
+	boltMu.Lock()
+	defer boltMu.Unlock()
+
+	db, ok := boltFiles[path]
+	if !ok {
+		var err error
+		db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+		if err != nil {
+			return nil, fmt.Errorf("could not open bolt database: %w", err)
+		}
+		boltFiles[path] = db
+	}
+
+	b := &Bolt{db: db, bucket: []byte(namespace)}
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(b.bucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create bucket: %w", err)
+	}
+	return b, nil
+}
+
+// boltKey joins both identifiers so records of a ticket sort together by comment identifier
+func boltKey(id, commentID string) []byte {
+	return []byte(id + "\x00" + commentID)
+}
+
+// Lookup decodes the record with the lowest comment identifier, matching DynamoDB range key order
+func (b *Bolt) Lookup(ctx context.Context, id string, v interface{}) (bool, error) {
+
+	var found bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		prefix := boltKey(id, "")
+		k, val := tx.Bucket(b.bucket).Cursor().Seek(prefix)
+		if k == nil || !bytes.HasPrefix(k, prefix) {
+			return nil
+		}
+		found = true
+		return decode(val, v)
+	})
+	return found, err
+}
+
+// LookupComment decodes the record for a ticket comment
+func (b *Bolt) LookupComment(ctx context.Context, id, commentID string, v interface{}) (bool, error) {
+
+	var found bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(b.bucket).Get(boltKey(id, commentID))
+		if val == nil {
+			return nil
+		}
+		found = true
+		return decode(val, v)
+	})
+	return found, err
+}
+
+// Put writes v as JSON
+func (b *Bolt) Put(ctx context.Context, id, commentID string, v interface{}, opts ...PutOption) error {
+
+	o := newPutOptions(opts)
+
+	val, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("could not marshal record: %w", err)
+	}
+
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(b.bucket)
+		ok, err := o.allows(bk.Get(boltKey(id, commentID)))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrConditionFailed
+		}
+		return bk.Put(boltKey(id, commentID), val)
+	})
+	if errors.Is(err, ErrConditionFailed) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("could not put record: %w", err)
+	}
+	return nil
+}
+
+// Delete removes the record for a ticket comment
+func (b *Bolt) Delete(ctx context.Context, id, commentID string, opts ...PutOption) error {
+
+	o := newPutOptions(opts)
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(b.bucket)
+		ok, err := o.allows(bk.Get(boltKey(id, commentID)))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrConditionFailed
+		}
+		return bk.Delete(boltKey(id, commentID))
+	})
+	if errors.Is(err, ErrConditionFailed) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("could not delete record: %w", err)
+	}
+	return nil
+}
+
+// prune removes expired records under ids starting with prefix, at most once every pruneInterval
+func (b *Bolt) prune(ctx context.Context, prefix string, now time.Time) error {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.Sub(b.pruned) < pruneInterval {
+		return nil
+	}
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(b.bucket)
+		var keys [][]byte
+		c := bk.Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			if expired(v, now) {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+		}
+		for _, k := range keys {
+			err := bk.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not prune records: %w", err)
+	}
+	b.pruned = now
+	return nil
+}
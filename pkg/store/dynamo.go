@@ -0,0 +1,171 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// Dynamo is a MappingStore backed by a DynamoDB table
+// the table has a hash key named id and a range key named comment_sysid
+type Dynamo struct {
+	DynamoDB dynamodbiface.DynamoDBAPI
+	Table    string
+}
+
+// NewDynamo creates a DynamoDB client for a table
+func NewDynamo(table, region string) *Dynamo {
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+	ddb := dynamodb.New(sess, &aws.Config{Region: aws.String(region)})
+	return &Dynamo{DynamoDB: ddb, Table: table}
+}
+
+// Lookup queries the first item with a matching hash key
+func (d *Dynamo) Lookup(ctx context.Context, id string, v interface{}) (bool, error) {
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(d.Table),
+		KeyConditionExpression: aws.String("id = :id"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":id": {
+				S: aws.String(id),
+			},
+		},
+	}
+
+	resp, err := d.DynamoDB.QueryWithContext(ctx, input)
+	if err != nil {
+		return false, fmt.Errorf("could not query items: %w", err)
+	}
+
+	if len(resp.Items) == 0 {
+		return false, nil
+	}
+
+	err = dynamodbattribute.UnmarshalMap(resp.Items[0], v)
+	if err != nil {
+		return false, fmt.Errorf("could not unmarshal item: %w", err)
+	}
+	return true, nil
+}
+
+// LookupComment gets the item with matching hash and range keys
+func (d *Dynamo) LookupComment(ctx context.Context, id, commentID string, v interface{}) (bool, error) {
+
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String(d.Table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(id),
+			},
+			"comment_sysid": {
+				S: aws.String(commentID),
+			},
+		},
+	}
+
+	resp, err := d.DynamoDB.GetItemWithContext(ctx, input)
+	if err != nil {
+		return false, fmt.Errorf("could not get item: %w", err)
+	}
+
+	if resp.Item == nil {
+		return false, nil
+	}
+
+	err = dynamodbattribute.UnmarshalMap(resp.Item, v)
+	if err != nil {
+		return false, fmt.Errorf("could not unmarshal item: %w", err)
+	}
+	return true, nil
+}
+
+// Put writes an item, replacing any item with the same keys unless an option forbids it
+func (d *Dynamo) Put(ctx context.Context, id, commentID string, v interface{}, opts ...PutOption) error {
+
+	o := newPutOptions(opts)
+
+	item, err := dynamodbattribute.MarshalMap(v)
+	if err != nil {
+		return fmt.Errorf("could not marshal item: %w", err)
+	}
+	item["id"] = &dynamodb.AttributeValue{S: aws.String(id)}
+	item["comment_sysid"] = &dynamodb.AttributeValue{S: aws.String(commentID)}
+
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(d.Table),
+		Item:      item,
+	}
+	input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues = o.condition()
+
+	_, err = d.DynamoDB.PutItemWithContext(ctx, input)
+	if conditionFailed(err) {
+		return ErrConditionFailed
+	}
+	if err != nil {
+		return fmt.Errorf("could not put item: %w", err)
+	}
+	return nil
+}
+
+// Delete removes the item with matching hash and range keys, unless an option forbids it
+func (d *Dynamo) Delete(ctx context.Context, id, commentID string, opts ...PutOption) error {
+
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.Table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(id),
+			},
+			"comment_sysid": {
+				S: aws.String(commentID),
+			},
+		},
+	}
+	input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues = newPutOptions(opts).condition()
+
+	_, err := d.DynamoDB.DeleteItemWithContext(ctx, input)
+	if conditionFailed(err) {
+		return ErrConditionFailed
+	}
+	if err != nil {
+		return fmt.Errorf("could not delete item: %w", err)
+	}
+	return nil
+}
+
+// condition expresses the options as a DynamoDB condition, nil when the write is unconditional
+func (o putOptions) condition() (*string, map[string]*string, map[string]*dynamodb.AttributeValue) {
+	switch {
+	case o.ifAbsent:
+		return aws.String("attribute_not_exists(id)"), nil, nil
+	case o.ifVersion && o.version == 0:
+		return aws.String("attribute_not_exists(id) OR attribute_not_exists(#version)"),
+			map[string]*string{"#version": aws.String("version")}, nil
+	case o.ifVersion:
+		return aws.String("#version = :version"),
+			map[string]*string{"#version": aws.String("version")},
+			map[string]*dynamodb.AttributeValue{
+				":version": {
+					N: aws.String(strconv.FormatInt(o.version, 10)),
+				},
+			}
+	}
+	return nil, nil, nil
+}
+
+// conditionFailed reports whether DynamoDB refused a write because its condition did not hold
+func conditionFailed(err error) bool {
+	var ae awserr.Error
+	return errors.As(err, &ae) && ae.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
@@ -0,0 +1,60 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Head records the newest source update applied to a ticket in one direction, so that older events arriving late can be
+// dropped
+type Head struct {
+	// UpdatedAt is the update time the source system gave the event, in unix milliseconds
+	UpdatedAt int64 `json:"updated_at"`
+	Version   int64 `json:"version,omitempty"`
+}
+
+// headID keys the head of a ticket apart from its mapping records, and apart from the head of the other direction, as
+// each direction compares update times given by its own source system
+func headID(direction, ticket string) string {
+	return "head:" + direction + ":" + ticket
+}
+
+// LookupHead returns the head of a ticket in a direction, which is zero until an event is applied to it
+func LookupHead(ctx context.Context, s MappingStore, direction, ticket string) (*Head, error) {
+
+	var h Head
+	_, err := s.LookupComment(ctx, headID(direction, ticket), "0", &h)
+	if err != nil {
+		return nil, fmt.Errorf("could not get head: %w", err)
+	}
+	return &h, nil
+}
+
+// AdvanceHead moves the head of a ticket in a direction on to next, a newer head is left in place
+func AdvanceHead(ctx context.Context, s MappingStore, direction, ticket string, next Head) error {
+
+	// a concurrent event may move the head between the lookup and the write, in which case it is read again
+	for attempt := 0; attempt < 3; attempt++ {
+		h, err := LookupHead(ctx, s, direction, ticket)
+		if err != nil {
+			return err
+		}
+
+		n := next
+		if n.UpdatedAt <= h.UpdatedAt {
+			return nil
+		}
+		n.Version = h.Version + 1
+
+		err = s.Put(ctx, headID(direction, ticket), "0", &n, IfVersion(h.Version))
+		if errors.Is(err, ErrConditionFailed) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not put head: %w", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("could not advance head: %w", ErrConditionFailed)
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"context"
+	"fmt"
+)
+
+// systems a comment can live on
+const (
+	SystemJSD  = "jsd"
+	SystemSNOW = "snow"
+)
+
+// Link ties a comment on one system to the copy snowsync made on the other
+type Link struct {
+	System          string `json:"system"`
+	Ticket          string `json:"ticket"`
+	CommentID       string `json:"comment_id"`
+	RemoteSystem    string `json:"remote_system"`
+	RemoteTicket    string `json:"remote_ticket"`
+	RemoteCommentID string `json:"remote_comment_id"`
+	// Copy is set when this side holds the comment snowsync wrote rather than the original
+	Copy bool `json:"copy,omitempty"`
+}
+
+// reverse returns the link as seen from the other system
+func (l *Link) reverse() *Link {
+	return &Link{
+		System:          l.RemoteSystem,
+		Ticket:          l.RemoteTicket,
+		CommentID:       l.RemoteCommentID,
+		RemoteSystem:    l.System,
+		RemoteTicket:    l.Ticket,
+		RemoteCommentID: l.CommentID,
+		Copy:            !l.Copy,
+	}
+}
+
+// linkID keys the links of a ticket apart from its mapping records
+func linkID(system, ticket string) string {
+	return "link:" + system + ":" + ticket
+}
+
+// PutLink records a link in both directions, so either comment leads to the other
+// l is given from the side of the original comment
+func PutLink(ctx context.Context, s MappingStore, l *Link) error {
+
+	if l.CommentID == "" || l.RemoteCommentID == "" {
+		return fmt.Errorf("incomplete comment link")
+	}
+
+	orig := *l
+	orig.Copy = false
+	for _, v := range []*Link{&orig, orig.reverse()} {
+		err := s.Put(ctx, linkID(v.System, v.Ticket), v.CommentID, v)
+		if err != nil {
+			return fmt.Errorf("could not put comment link: %w", err)
+		}
+	}
+	return nil
+}
+
+// LookupLink finds the link of a comment on a system
+func LookupLink(ctx context.Context, s MappingStore, system, ticket, commentID string) (*Link, bool, error) {
+
+	var l Link
+	found, err := s.LookupComment(ctx, linkID(system, ticket), commentID, &l)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	return &l, true, nil
+}
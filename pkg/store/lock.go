@@ -0,0 +1,182 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrLockHeld is returned when a ticket is still being created by another owner once the wait is over
+var ErrLockHeld = errors.New("ticket is being created by another request")
+
+// lock states
+const (
+	// LockPending is the state of a ticket whose creation on the other system has started but not finished
+	LockPending = "pending"
+	// LockCreated is the state of a ticket created on the other system whose mapping record is not yet written,
+	// the lock keeps the identifier it was given so a replay records it instead of creating the ticket again
+	LockCreated = "created"
+)
+
+// lock intervals, a lock outlives a function timeout so only a crashed owner leaves it to expire
+var (
+	LockTTL  = 60 * time.Second
+	LockWait = 10 * time.Second
+	LockPoll = 250 * time.Millisecond
+)
+
+// Lock is held while a ticket is created on the other system
+type Lock struct {
+	State string `json:"state"`
+	Owner string `json:"owner"`
+	// ExpiresAt is in unix seconds, so it can double as a DynamoDB TTL attribute
+	ExpiresAt int64 `json:"expires_at"`
+	// Version changes with every owner, so a takeover or release only succeeds against the lock it observed
+	Version int64 `json:"version,omitempty"`
+	// RemoteID is the identifier the other system gave a created ticket, and CommentID the comment its event carried
+	RemoteID  string `json:"remote_id,omitempty"`
+	CommentID string `json:"created_comment_id,omitempty"`
+}
+
+// lockID keys the lock of a ticket apart from its mapping records
+func lockID(ticket string) string {
+	return "lock:" + ticket
+}
+
+// NewOwner returns a random name for the holder of a lock
+func NewOwner() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// AcquireLock takes the creation lock of a ticket, reporting false while another owner holds it
+// a lock left behind by a crashed owner is taken over once it has expired
+func AcquireLock(ctx context.Context, s MappingStore, ticket, owner string) (bool, error) {
+
+	l := &Lock{State: LockPending, Owner: owner, ExpiresAt: time.Now().Add(LockTTL).Unix(), Version: 1}
+
+	err := s.Put(ctx, lockID(ticket), "0", l, IfAbsent())
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, ErrConditionFailed) {
+		return false, fmt.Errorf("could not put lock: %w", err)
+	}
+
+	var held Lock
+	found, err := s.LookupComment(ctx, lockID(ticket), "0", &held)
+	if err != nil {
+		return false, fmt.Errorf("could not get lock: %w", err)
+	}
+	// a created ticket is never created again, however old its lock
+	if found && (held.State == LockCreated || time.Now().Unix() < held.ExpiresAt) {
+		return false, nil
+	}
+
+	// the lock was released or has expired since, it is replaced only if it is still the one observed,
+	// so of several requests taking it over at once exactly one succeeds
+	l.Version = held.Version + 1
+	err = s.Put(ctx, lockID(ticket), "0", l, IfVersion(held.Version))
+	if errors.Is(err, ErrConditionFailed) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not take over lock: %w", err)
+	}
+	return true, nil
+}
+
+// MarkCreated records on the lock of owner the identifier the other system gave the ticket and the comment its event carried
+// the lock no longer expires, and is released once the mapping record is written
+func MarkCreated(ctx context.Context, s MappingStore, ticket, owner, remoteID, commentID string) error {
+
+	var held Lock
+	found, err := s.LookupComment(ctx, lockID(ticket), "0", &held)
+	if err != nil {
+		return fmt.Errorf("could not get lock: %w", err)
+	}
+	if !found || held.Owner != owner {
+		return fmt.Errorf("lock of %v no longer held by %v", ticket, owner)
+	}
+
+	// an expires_at of zero is far enough in the past for DynamoDB TTL to leave the item alone
+	l := &Lock{State: LockCreated, Owner: owner, Version: held.Version + 1, RemoteID: remoteID, CommentID: commentID}
+	err = s.Put(ctx, lockID(ticket), "0", l, IfVersion(held.Version))
+	if err != nil {
+		return fmt.Errorf("could not mark lock created: %w", err)
+	}
+	return nil
+}
+
+// CreatedLock returns the lock of a ticket created on the other system whose mapping record was never written,
+// or nil when there is none
+func CreatedLock(ctx context.Context, s MappingStore, ticket string) (*Lock, error) {
+
+	var held Lock
+	found, err := s.LookupComment(ctx, lockID(ticket), "0", &held)
+	if err != nil {
+		return nil, fmt.Errorf("could not get lock: %w", err)
+	}
+	if !found || held.State != LockCreated {
+		return nil, nil
+	}
+	return &held, nil
+}
+
+// ReleaseLock gives up the creation lock of a ticket held by owner
+// a lock that has since been taken over by another owner is left alone
+func ReleaseLock(ctx context.Context, s MappingStore, ticket, owner string) error {
+
+	var held Lock
+	found, err := s.LookupComment(ctx, lockID(ticket), "0", &held)
+	if err != nil {
+		return fmt.Errorf("could not get lock: %w", err)
+	}
+	if !found || held.Owner != owner {
+		return nil
+	}
+
+	err = s.Delete(ctx, lockID(ticket), "0", IfVersion(held.Version))
+	if errors.Is(err, ErrConditionFailed) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not release lock: %w", err)
+	}
+	return nil
+}
+
+// Claim takes the creation lock of a ticket, or waits for as long as another owner holds it
+// created is polled while waiting, it returns false with no error once created reports the ticket exists
+// and ErrLockHeld if neither happens within LockWait
+func Claim(ctx context.Context, s MappingStore, ticket, owner string, created func() (bool, error)) (bool, error) {
+
+	deadline := time.Now().Add(LockWait)
+	for {
+		ok, err := AcquireLock(ctx, s, ticket, owner)
+		if err != nil || ok {
+			return ok, err
+		}
+
+		if time.Now().After(deadline) {
+			return false, ErrLockHeld
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(LockPoll):
+		}
+
+		done, err := created()
+		if err != nil {
+			return false, err
+		}
+		if done {
+			return false, nil
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// expire leaves behind the lock of a crashed owner
+func expire(t *testing.T, s MappingStore, ticket string) {
+	t.Helper()
+	l := &Lock{State: LockPending, Owner: "crashed", ExpiresAt: time.Now().Add(-time.Second).Unix(), Version: 3}
+	err := s.Put(context.Background(), lockID(ticket), "0", l)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcquireLock(t *testing.T) {
+
+	ctx := context.Background()
+	for name, s := range stores(t) {
+
+		ok, err := AcquireLock(ctx, s, "INC1", "a")
+		if err != nil || !ok {
+			t.Fatalf("%v: got %v, %v", name, ok, err)
+		}
+		ok, err = AcquireLock(ctx, s, "INC1", "b")
+		if err != nil || ok {
+			t.Errorf("%v: lock taken while held: %v, %v", name, ok, err)
+		}
+
+		expire(t, s, "INC2")
+		ok, err = AcquireLock(ctx, s, "INC2", "b")
+		if err != nil || !ok {
+			t.Errorf("%v: expired lock not taken over: %v, %v", name, ok, err)
+		}
+	}
+}
+
+// frozen answers lookups of a lock with what it held before, as seen by a request that read it just before
+// another one took it over
+type frozen struct {
+	MappingStore
+	lock Lock
+}
+
+func (f frozen) LookupComment(_ context.Context, _, _ string, v interface{}) (bool, error) {
+	*v.(*Lock) = f.lock
+	return true, nil
+}
+
+func TestTakeoverRace(t *testing.T) {
+
+	ctx := context.Background()
+	for name, s := range stores(t) {
+
+		expire(t, s, "INC1")
+		var observed Lock
+		_, err := s.LookupComment(ctx, lockID("INC1"), "0", &observed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ok, err := AcquireLock(ctx, s, "INC1", "a")
+		if err != nil || !ok {
+			t.Fatalf("%v: got %v, %v", name, ok, err)
+		}
+		// b read the expired lock before a replaced it, so its takeover must fail
+		ok, err = AcquireLock(ctx, frozen{MappingStore: s, lock: observed}, "INC1", "b")
+		if err != nil || ok {
+			t.Errorf("%v: two owners took over the lock: %v, %v", name, ok, err)
+		}
+	}
+}
+
+func TestTakeoverConcurrent(t *testing.T) {
+
+	ctx := context.Background()
+	s := NewMemory()
+	expire(t, s, "INC1")
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	winners := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := AcquireLock(ctx, s, "INC1", NewOwner())
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				mu.Lock()
+				winners++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if winners != 1 {
+		t.Errorf("%v owners took over the lock", winners)
+	}
+}
+
+func TestReleaseLock(t *testing.T) {
+
+	ctx := context.Background()
+	for name, s := range stores(t) {
+
+		_, err := AcquireLock(ctx, s, "INC1", "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// only the owner releases the lock
+		err = ReleaseLock(ctx, s, "INC1", "b")
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if ok, _ := AcquireLock(ctx, s, "INC1", "b"); ok {
+			t.Errorf("%v: lock released by another owner", name)
+		}
+		err = ReleaseLock(ctx, s, "INC1", "a")
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if ok, _ := AcquireLock(ctx, s, "INC1", "b"); !ok {
+			t.Errorf("%v: lock not released by its owner", name)
+		}
+
+		// an owner whose lock expired and was taken over leaves the new one alone
+		expire(t, s, "INC2")
+		if ok, _ := AcquireLock(ctx, s, "INC2", "b"); !ok {
+			t.Fatalf("%v: expired lock not taken over", name)
+		}
+		err = ReleaseLock(ctx, s, "INC2", "crashed")
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		var l Lock
+		found, _ := s.LookupComment(ctx, lockID("INC2"), "0", &l)
+		if !found || l.Owner != "b" {
+			t.Errorf("%v: lock of the new owner released, left %+v", name, l)
+		}
+	}
+}
+
+func TestMarkCreated(t *testing.T) {
+
+	ctx := context.Background()
+	for name, s := range stores(t) {
+
+		_, err := AcquireLock(ctx, s, "INC1", "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := MarkCreated(ctx, s, "INC1", "b", "ACP-1", "c1"); err == nil {
+			t.Errorf("%v: lock of another owner marked created", name)
+		}
+		err = MarkCreated(ctx, s, "INC1", "a", "ACP-1", "c1")
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+
+		l, err := CreatedLock(ctx, s, "INC1")
+		if err != nil || l == nil || l.RemoteID != "ACP-1" || l.CommentID != "c1" {
+			t.Fatalf("%v: got %+v, %v", name, l, err)
+		}
+		// a created ticket is never created again, even once the lock would have expired
+		l.ExpiresAt = time.Now().Add(-time.Hour).Unix()
+		err = s.Put(ctx, lockID("INC1"), "0", l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := AcquireLock(ctx, s, "INC1", "b")
+		if err != nil || ok {
+			t.Errorf("%v: created lock taken over: %v, %v", name, ok, err)
+		}
+
+		err = ReleaseLock(ctx, s, "INC1", l.Owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l, err := CreatedLock(ctx, s, "INC1"); err != nil || l != nil {
+			t.Errorf("%v: got %+v, %v after release", name, l, err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is a MappingStore held in process memory, records are lost on exit
+type Memory struct {
+	mu    sync.RWMutex
+	items map[string]map[string][]byte
+	// pruned is when expired records were last removed
+	pruned time.Time
+}
+
+// NewMemory creates an empty in-memory store
+func NewMemory() *Memory {
+	return &Memory{items: make(map[string]map[string][]byte)}
+}
+
+// Lookup decodes the record with the lowest comment identifier, matching DynamoDB range key order
+func (m *Memory) Lookup(ctx context.Context, id string, v interface{}) (bool, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	comments := m.items[id]
+	if len(comments) == 0 {
+		return false, nil
+	}
+
+	keys := make([]string, 0, len(comments))
+	for k := range comments {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return true, decode(comments[keys[0]], v)
+}
+
+// LookupComment decodes the record for a ticket comment
+func (m *Memory) LookupComment(ctx context.Context, id, commentID string, v interface{}) (bool, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	b, ok := m.items[id][commentID]
+	if !ok {
+		return false, nil
+	}
+	return true, decode(b, v)
+}
+
+// Put stores a copy of v
+func (m *Memory) Put(ctx context.Context, id, commentID string, v interface{}, opts ...PutOption) error {
+
+	o := newPutOptions(opts)
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("could not marshal record: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ok, err := o.allows(m.items[id][commentID])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrConditionFailed
+	}
+	if m.items[id] == nil {
+		m.items[id] = make(map[string][]byte)
+	}
+	m.items[id][commentID] = b
+	return nil
+}
+
+// Delete removes the record for a ticket comment
+func (m *Memory) Delete(ctx context.Context, id, commentID string, opts ...PutOption) error {
+
+	o := newPutOptions(opts)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ok, err := o.allows(m.items[id][commentID])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrConditionFailed
+	}
+	delete(m.items[id], commentID)
+	if len(m.items[id]) == 0 {
+		delete(m.items, id)
+	}
+	return nil
+}
+
+// prune removes expired records under ids starting with prefix, at most once every pruneInterval
+func (m *Memory) prune(ctx context.Context, prefix string, now time.Time) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.Sub(m.pruned) < pruneInterval {
+		return nil
+	}
+	m.pruned = now
+
+	for id, comments := range m.items {
+		if !strings.HasPrefix(id, prefix) {
+			continue
+		}
+		for commentID, b := range comments {
+			if expired(b, now) {
+				delete(comments, commentID)
+			}
+		}
+		if len(comments) == 0 {
+			delete(m.items, id)
+		}
+	}
+	return nil
+}
+
+func decode(b []byte, v interface{}) error {
+	err := json.Unmarshal(b, v)
+	if err != nil {
+		return fmt.Errorf("could not unmarshal record: %w", err)
+	}
+	return nil
+}
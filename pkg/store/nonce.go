@@ -0,0 +1,67 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// pruneInterval bounds how often the memory and bolt stores look for expired nonces
+var pruneInterval = time.Minute
+
+// Nonce records that a webhook delivery id was seen, so a replay of the delivery can be refused
+type Nonce struct {
+	// ExpiresAt is in unix seconds, so it can double as a DynamoDB TTL attribute
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// noncePrefix starts the id of every nonce record
+const noncePrefix = "nonce:"
+
+// nonceID keys the delivery ids of a system apart from its mapping records
+func nonceID(system, nonce string) string {
+	return noncePrefix + system + ":" + nonce
+}
+
+// pruner is a store that removes expired records itself, DynamoDB leaves that to the TTL of the table
+type pruner interface {
+	// prune removes the records under ids starting with prefix whose expires_at has passed
+	prune(ctx context.Context, prefix string, now time.Time) error
+}
+
+// expired reports whether a stored record carries an expires_at before now
+func expired(b []byte, now time.Time) bool {
+	var n Nonce
+	return decode(b, &n) == nil && n.ExpiresAt != 0 && n.ExpiresAt <= now.Unix()
+}
+
+// UseNonce records a delivery id of a system, reporting false when it was recorded before
+// the write is conditional, so only one of the functions sharing a store accepts a delivery
+func UseNonce(ctx context.Context, s MappingStore, system, nonce string, expires time.Time) (bool, error) {
+
+	if p, ok := s.(pruner); ok {
+		err := p.prune(ctx, noncePrefix, time.Now())
+		if err != nil {
+			return false, fmt.Errorf("could not prune nonces: %w", err)
+		}
+	}
+
+	err := s.Put(ctx, nonceID(system, nonce), "0", &Nonce{ExpiresAt: expires.Unix()}, IfAbsent())
+	if errors.Is(err, ErrConditionFailed) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not put nonce: %w", err)
+	}
+	return true, nil
+}
+
+// ReleaseNonce forgets a delivery id, so the sender can deliver it again after it failed
+func ReleaseNonce(ctx context.Context, s MappingStore, system, nonce string) error {
+	err := s.Delete(ctx, nonceID(system, nonce), "0")
+	if err != nil {
+		return fmt.Errorf("could not delete nonce: %w", err)
+	}
+	return nil
+}
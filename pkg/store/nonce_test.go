@@ -0,0 +1,86 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUseNonce(t *testing.T) {
+
+	ctx := context.Background()
+	for name, s := range stores(t) {
+
+		fresh, err := UseNonce(ctx, s, "jsd", "n1", time.Now().Add(time.Minute))
+		if err != nil || !fresh {
+			t.Fatalf("%v: got %v, %v", name, fresh, err)
+		}
+		fresh, err = UseNonce(ctx, s, "jsd", "n1", time.Now().Add(time.Minute))
+		if err != nil || fresh {
+			t.Errorf("%v: replay got %v, %v", name, fresh, err)
+		}
+
+		// a released nonce can be used again
+		err = ReleaseNonce(ctx, s, "jsd", "n1")
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		fresh, err = UseNonce(ctx, s, "jsd", "n1", time.Now().Add(time.Minute))
+		if err != nil || !fresh {
+			t.Errorf("%v: released nonce got %v, %v", name, fresh, err)
+		}
+	}
+}
+
+func TestPruneNonces(t *testing.T) {
+
+	ctx := context.Background()
+	for name, s := range stores(t) {
+		p, ok := s.(pruner)
+		if !ok {
+			continue
+		}
+
+		err := s.Put(ctx, nonceID("jsd", "old"), "0", &Nonce{ExpiresAt: time.Now().Add(-time.Second).Unix()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Put(ctx, "INC1", "c1", &record{Text: "kept"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = UseNonce(ctx, s, "jsd", "new", time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if found, _ := s.LookupComment(ctx, nonceID("jsd", "old"), "0", &Nonce{}); found {
+			t.Errorf("%v: expired nonce kept", name)
+		}
+		for id, commentID := range map[string]string{nonceID("jsd", "new"): "0", "INC1": "c1"} {
+			if found, _ := s.LookupComment(ctx, id, commentID, &record{}); !found {
+				t.Errorf("%v: %v pruned", name, id)
+			}
+		}
+
+		// pruning waits for the interval to pass again
+		err = s.Put(ctx, nonceID("jsd", "older"), "0", &Nonce{ExpiresAt: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.prune(ctx, noncePrefix, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found, _ := s.LookupComment(ctx, nonceID("jsd", "older"), "0", &Nonce{}); !found {
+			t.Errorf("%v: pruned again within the interval", name)
+		}
+		err = p.prune(ctx, noncePrefix, time.Now().Add(pruneInterval))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found, _ := s.LookupComment(ctx, nonceID("jsd", "older"), "0", &Nonce{}); found {
+			t.Errorf("%v: expired nonce kept after the interval", name)
+		}
+	}
+}
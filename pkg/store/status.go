@@ -0,0 +1,38 @@
+package store
+
+import (
+	"context"
+	"fmt"
+)
+
+// Status records the workflow state a ticket was last known to be in on one system, either because snowsync moved it
+// there or because the system reported it
+type Status struct {
+	Name string `json:"status"`
+}
+
+// statusID keys the status of a ticket on a system apart from its mapping records and heads
+func statusID(system, ticket string) string {
+	return "status:" + system + ":" + ticket
+}
+
+// LookupStatus returns the state a ticket was last known to be in on a system, blank when it is not known
+func LookupStatus(ctx context.Context, s MappingStore, system, ticket string) (string, error) {
+
+	var st Status
+	_, err := s.LookupComment(ctx, statusID(system, ticket), "0", &st)
+	if err != nil {
+		return "", fmt.Errorf("could not get status: %w", err)
+	}
+	return st.Name, nil
+}
+
+// PutStatus records the state a ticket is in on a system
+func PutStatus(ctx context.Context, s MappingStore, system, ticket, status string) error {
+
+	err := s.Put(ctx, statusID(system, ticket), "0", &Status{Name: status})
+	if err != nil {
+		return fmt.Errorf("could not put status: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrConditionFailed is returned when a conditional write finds the record in another state than expected
+var ErrConditionFailed = errors.New("condition failed")
+
+// MappingStore persists the link between a ticket and its counterpart on the other system
+// records are keyed by ticket identifier and comment identifier
+type MappingStore interface {
+	// Lookup decodes the first record held for a ticket into v
+	Lookup(ctx context.Context, id string, v interface{}) (bool, error)
+	// LookupComment decodes the record held for a ticket comment into v
+	LookupComment(ctx context.Context, id, commentID string, v interface{}) (bool, error)
+	// Put writes v as the record for a ticket comment, options make the write conditional
+	Put(ctx context.Context, id, commentID string, v interface{}, opts ...PutOption) error
+	// Delete removes the record for a ticket comment, if there is one, options make the removal conditional
+	Delete(ctx context.Context, id, commentID string, opts ...PutOption) error
+}
+
+// PutOption sets a condition on a write or a removal
+type PutOption func(*putOptions)
+
+type putOptions struct {
+	ifAbsent bool
+	// version is checked when ifVersion is set
+	ifVersion bool
+	version   int64
+}
+
+// IfAbsent only writes when no record is held for the ticket comment, ErrConditionFailed is returned otherwise
+func IfAbsent() PutOption {
+	return func(o *putOptions) {
+		o.ifAbsent = true
+	}
+}
+
+// IfVersion only writes when the record held for the ticket comment is at version v, ErrConditionFailed is returned otherwise
+// version 0 stands for no record, or a record written before records were versioned
+func IfVersion(v int64) PutOption {
+	return func(o *putOptions) {
+		o.ifVersion = true
+		o.version = v
+	}
+}
+
+// versioned reads the version attribute of a stored record
+type versioned struct {
+	Version int64 `json:"version"`
+}
+
+// allows reports whether a record held as b, nil when there is none, may be replaced
+func (o putOptions) allows(b []byte) (bool, error) {
+	switch {
+	case b == nil:
+		return !o.ifVersion || o.version == 0, nil
+	case o.ifAbsent:
+		return false, nil
+	case o.ifVersion:
+		var v versioned
+		err := decode(b, &v)
+		if err != nil {
+			return false, err
+		}
+		return v.Version == o.version, nil
+	}
+	return true, nil
+}
+
+func newPutOptions(opts []PutOption) putOptions {
+	var o putOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Store types
+const (
+	TypeDynamoDB = "dynamodb"
+	TypeMemory   = "memory"
+	TypeBolt     = "bolt"
+)
+
+// Options select and configure a store implementation
+type Options struct {
+	// Type is one of dynamodb, memory or bolt
+	Type string
+	// Table is the DynamoDB table name
+	Table string
+	// Region is the AWS region of the DynamoDB table
+	Region string
+	// Path is the bolt database file
+	Path string
+	// Namespace separates the records of several stores kept in one bolt file
+	Namespace string
+}
+
+// New opens the store selected by options
+func New(o Options) (MappingStore, error) {
+
+	switch o.Type {
+	case TypeDynamoDB:
+		if o.Table == "" {
+			return nil, fmt.Errorf("missing table name")
+		}
+		return NewDynamo(o.Table, o.Region), nil
+	case TypeMemory:
+		return NewMemory(), nil
+	case TypeBolt:
+		if o.Path == "" {
+			return nil, fmt.Errorf("missing bolt database path")
+		}
+		return NewBolt(o.Path, o.Namespace)
+	default:
+		return nil, fmt.Errorf("unknown store type: %v", o.Type)
+	}
+}
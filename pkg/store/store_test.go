@@ -0,0 +1,99 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/UKHomeOffice/snowsync/pkg/testing/fakes"
+)
+
+// stores returns an empty store of each type, the DynamoDB one backed by a fake
+func stores(t *testing.T) map[string]MappingStore {
+
+	b, err := NewBolt(filepath.Join(t.TempDir(), "snowsync.db"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := fakes.NewDynamoDB()
+	db.AddTable("snowsync", "id", "comment_sysid")
+
+	return map[string]MappingStore{
+		TypeMemory:   NewMemory(),
+		TypeBolt:     b,
+		TypeDynamoDB: &Dynamo{DynamoDB: db, Table: "snowsync"},
+	}
+}
+
+type record struct {
+	Text    string `json:"text"`
+	Version int64  `json:"version,omitempty"`
+}
+
+func TestPutConditions(t *testing.T) {
+
+	ctx := context.Background()
+	for name, s := range stores(t) {
+
+		err := s.Put(ctx, "INC1", "c1", &record{Text: "first", Version: 1}, IfAbsent())
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		err = s.Put(ctx, "INC1", "c1", &record{Text: "again"}, IfAbsent())
+		if !errors.Is(err, ErrConditionFailed) {
+			t.Errorf("%v: second IfAbsent write got %v", name, err)
+		}
+
+		err = s.Put(ctx, "INC1", "c1", &record{Text: "stale", Version: 1}, IfVersion(0))
+		if !errors.Is(err, ErrConditionFailed) {
+			t.Errorf("%v: write at the wrong version got %v", name, err)
+		}
+		err = s.Put(ctx, "INC1", "c1", &record{Text: "second", Version: 2}, IfVersion(1))
+		if err != nil {
+			t.Errorf("%v: write at the right version got %v", name, err)
+		}
+
+		// version 0 stands for no record
+		err = s.Put(ctx, "INC1", "c2", &record{Text: "new", Version: 1}, IfVersion(0))
+		if err != nil {
+			t.Errorf("%v: first versioned write got %v", name, err)
+		}
+
+		var r record
+		found, err := s.LookupComment(ctx, "INC1", "c1", &r)
+		if err != nil || !found || r.Text != "second" {
+			t.Errorf("%v: got %+v, %v, %v", name, r, found, err)
+		}
+	}
+}
+
+func TestDeleteConditions(t *testing.T) {
+
+	ctx := context.Background()
+	for name, s := range stores(t) {
+
+		err := s.Put(ctx, "INC1", "c1", &record{Text: "first", Version: 2})
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		err = s.Delete(ctx, "INC1", "c1", IfVersion(1))
+		if !errors.Is(err, ErrConditionFailed) {
+			t.Errorf("%v: delete at the wrong version got %v", name, err)
+		}
+		err = s.Delete(ctx, "INC1", "c1", IfVersion(2))
+		if err != nil {
+			t.Errorf("%v: delete at the right version got %v", name, err)
+		}
+		found, err := s.LookupComment(ctx, "INC1", "c1", &record{})
+		if err != nil || found {
+			t.Errorf("%v: record left behind: %v, %v", name, found, err)
+		}
+
+		// an unconditional delete of nothing is not an error
+		err = s.Delete(ctx, "INC1", "c1")
+		if err != nil {
+			t.Errorf("%v: got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,874 @@
+// Package e2e runs both directions against fake JSD, ServiceNow and DynamoDB
+package e2e
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/tidwall/gjson"
+
+	"github.com/UKHomeOffice/snowsync/pkg/caller"
+	"github.com/UKHomeOffice/snowsync/pkg/config"
+	"github.com/UKHomeOffice/snowsync/pkg/in"
+	"github.com/UKHomeOffice/snowsync/pkg/loop"
+	"github.com/UKHomeOffice/snowsync/pkg/mapping"
+	"github.com/UKHomeOffice/snowsync/pkg/out"
+	"github.com/UKHomeOffice/snowsync/pkg/secrets"
+	"github.com/UKHomeOffice/snowsync/pkg/store"
+	"github.com/UKHomeOffice/snowsync/pkg/testing/fakes"
+	"github.com/UKHomeOffice/snowsync/pkg/webhook"
+)
+
+// table holds the records of both directions, which share it as they do when deployed
+const table = "snowsync"
+
+// env holds the fakes and handlers of one test
+type env struct {
+	jsd  *fakes.JSD
+	snow *fakes.SNOW
+	db   *fakes.DynamoDB
+	in   *in.Handler
+	out  *out.Handler
+	// shared is the store both directions keep their records and comment links in
+	shared store.MappingStore
+}
+
+func newEnv(t *testing.T) *env {
+
+	e := &env{jsd: fakes.NewJSD(), snow: fakes.NewSNOW(), db: fakes.NewDynamoDB()}
+	t.Cleanup(e.jsd.Close)
+	t.Cleanup(e.snow.Close)
+
+	e.db.AddTable(table, "id", "comment_sysid")
+	e.shared = &store.Dynamo{DynamoDB: e.db, Table: table}
+
+	conf := &config.Config{
+		JSDURL:  e.jsd.URL,
+		SNOWURL: e.snow.URL,
+		Marker:  loop.DefaultMarker,
+		In: config.InFields{
+			IntID:       "number",
+			ExtID:       "external_identifier",
+			Attachments: "attachments",
+			Description: "description",
+			Comment:     "comment",
+			CommentID:   "comment_id",
+			Event:       "event",
+			Priority:    "priority",
+			Reporter:    "reporter",
+			Resolution:  "resolution",
+			Service:     "service",
+			Status:      "state",
+			Summary:     "summary",
+			Updated:     "sys_updated_on",
+		},
+		Out: config.OutFields{
+			IssueID:       "issue.key",
+			SNOWID:        "issue.fields.customfield_11824",
+			Attachments:   "issue.fields.attachment",
+			Description:   "issue.fields.description",
+			CommentID:     "comment.id",
+			CommentAuthor: "comment.author.displayName",
+			CommentBody:   "comment.body",
+			Priority:      "issue.fields.priority.name",
+			Service:       "issue.fields.customfield_10002.0.id",
+			Status:        "issue.fields.status.name",
+			Summary:       "issue.fields.summary",
+			Event:         "webhookEvent",
+			Updated:       "timestamp",
+		},
+		Mappings: mapping.Default(),
+	}
+
+	sec := secrets.NewFake()
+	sec.Set(secrets.JSD, "jsd-user", "jsd-pass")
+	sec.Set(secrets.SNOW, "snow-user", "snow-pass")
+
+	jsd, err := caller.NewClient(e.jsd.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsd.SetAuthenticator(&caller.Basic{Secrets: sec, Set: secrets.JSD})
+	snow, err := caller.NewClient(e.snow.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snow.SetAuthenticator(&caller.Basic{Secrets: sec, Set: secrets.SNOW})
+
+	inp := in.NewProcessor(e.shared, jsd, conf)
+	err = inp.EnableAttachments(snow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outp := out.NewProcessor(e.shared, snow, conf)
+	err = outp.EnableAttachments(jsd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.in = in.NewHandler(inp)
+	e.out = out.NewHandler(outp)
+	return e
+}
+
+// send delivers a webhook to a handler and fails the test unless it is accepted
+func send(t *testing.T, h interface {
+	Handle(context.Context, *events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
+}, resource string, body interface{}) events.APIGatewayProxyResponse {
+
+	t.Helper()
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := h.Handle(context.Background(), &events.APIGatewayProxyRequest{Resource: resource, Body: string(b)})
+	if err != nil {
+		t.Fatalf("%v: %v", resource, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("%v answered %v: %v", resource, res.StatusCode, res.Body)
+	}
+	return res
+}
+
+// incident is a ServiceNow webhook
+func incident(state string, extra map[string]string) map[string]string {
+	m := map[string]string{
+		"number":      "INC0010001",
+		"description": "disk full",
+		"priority":    "2",
+		"reporter":    "alice",
+		"service":     "CSOC",
+		"state":       state,
+		"summary":     "database down",
+	}
+	for k, v := range extra {
+		m[k] = v
+	}
+	return m
+}
+
+// issue is a JSD webhook
+func issue(key, status string, comment map[string]interface{}) map[string]interface{} {
+	m := map[string]interface{}{
+		"webhookEvent": "jira:issue_updated",
+		"issue": map[string]interface{}{
+			"key": key,
+			"fields": map[string]interface{}{
+				"description":       "queue backing up",
+				"summary":           "ingest stalled",
+				"priority":          map[string]string{"name": "P1 - Production system down"},
+				"status":            map[string]string{"name": status},
+				"customfield_10002": []map[string]string{{"id": "59"}},
+			},
+		},
+	}
+	if comment != nil {
+		m["webhookEvent"] = "comment_created"
+		m["comment"] = comment
+	}
+	return m
+}
+
+func TestInboundLifecycle(t *testing.T) {
+
+	e := newEnv(t)
+
+	// create
+	send(t, e.in, "/v2/in", incident("1", nil))
+	create := e.jsd.AssertCalled(t, "POST", "/rest/servicedeskapi/request/")
+	if got := create.Get("requestFieldValues.priority.name"); got != "P2 - Production system impaired" {
+		t.Errorf("created with priority %q", got)
+	}
+	if got := create.Get("requestFieldValues.customfield_11824"); got != "INC0010001" {
+		t.Errorf("created with ServiceNow id %q", got)
+	}
+	if got := create.Header.Get("Authorization"); !strings.HasPrefix(got, "Basic ") {
+		t.Errorf("created with authorization %q", got)
+	}
+	i := e.jsd.Issue("ACP-1")
+	if i == nil {
+		t.Fatal("no ticket raised on JSD")
+	}
+	if len(e.db.Items(table)) == 0 {
+		t.Error("no mapping written to the store")
+	}
+
+	// a repeated create is recognised rather than raising a second ticket
+	send(t, e.in, "/v2/in", incident("1", nil))
+	e.jsd.AssertCount(t, 1, "POST", "/rest/servicedeskapi/request/")
+
+	// comment
+	send(t, e.in, "/v2/in", incident("1", map[string]string{"comment": "rebooted the primary", "comment_id": "c1"}))
+	e.jsd.AssertCount(t, 1, "POST", "/rest/api/2/issue/ACP-1/comment")
+	if i = e.jsd.Issue("ACP-1"); !hasComment(i, "rebooted the primary") {
+		t.Errorf("comment not added, comments are %v", i.Comments)
+	}
+
+	// the same comment delivered again is not copied twice
+	send(t, e.in, "/v2/in", incident("1", map[string]string{"comment": "rebooted the primary", "comment_id": "c1"}))
+	e.jsd.AssertCount(t, 1, "POST", "/rest/api/2/issue/ACP-1/comment")
+
+	// status
+	send(t, e.in, "/v2/in", incident("10100", map[string]string{"comment_id": "c2"}))
+	tr := e.jsd.AssertCalled(t, "POST", "/rest/api/2/issue/ACP-1/transitions")
+	if got := tr.Get("transition.id"); got != "11" {
+		t.Errorf("transitioned with id %q", got)
+	}
+	if got := e.jsd.Issue("ACP-1").Status; got != "Investigating" {
+		t.Errorf("status is %q after progress", got)
+	}
+
+	// resolve
+	send(t, e.in, "/v2/in", incident("3", map[string]string{"comment_id": "c3", "resolution": "restored from backup"}))
+	tr = e.jsd.AssertCalled(t, "POST", "/rest/api/2/issue/ACP-1/transitions")
+	if got := tr.Get("transition.id"); got != "121" {
+		t.Errorf("resolved with transition id %q", got)
+	}
+	if got := e.jsd.Issue("ACP-1").Status; got != "Resolved" {
+		t.Errorf("status is %q after resolve", got)
+	}
+}
+
+func TestOutboundLifecycle(t *testing.T) {
+
+	e := newEnv(t)
+
+	// create
+	send(t, e.out, "/v2/out", issue("ACP-7", "Open", nil))
+	create := e.snow.AssertCalled(t, "POST", "/")
+	if got := create.Get("messageid"); !strings.Contains(got, "Create") {
+		t.Errorf("created with message %q", got)
+	}
+	if got := create.Get("external_identifier"); got != "ACP-7" {
+		t.Errorf("created with key %q", got)
+	}
+	if got := create.Get("payload.priority"); got != "1" {
+		t.Errorf("created with priority %q", got)
+	}
+	id, ok := e.snow.Incident("ACP-7")
+	if !ok {
+		t.Fatal("no incident raised on ServiceNow")
+	}
+
+	// comment
+	send(t, e.out, "/v2/out", issue("ACP-7", "Open", map[string]interface{}{
+		"id": "10001", "body": "looking into it", "author": map[string]string{"displayName": "bob"},
+	}))
+	update := e.snow.AssertCalled(t, "POST", "/")
+	if got := update.Get("internal_identifier"); got != id {
+		t.Errorf("commented on %q, want %q", got, id)
+	}
+	if got := update.Get("payload.comments"); !strings.Contains(got, "looking into it") {
+		t.Errorf("commented %q", got)
+	}
+	e.snow.AssertCount(t, 2, "POST", "/")
+
+	// status
+	send(t, e.out, "/v2/out", issue("ACP-7", "Investigating", nil))
+	progress := e.snow.AssertCalled(t, "POST", "/")
+	if got := progress.Get("payload.state"); got != "22" {
+		t.Errorf("progressed to state %q", got)
+	}
+
+	// resolve
+	send(t, e.out, "/v2/out", issue("ACP-7", "Resolved", nil))
+	resolve := e.snow.AssertCalled(t, "POST", "/")
+	if got := resolve.Get("payload.state"); got != "6" {
+		t.Errorf("resolved to state %q", got)
+	}
+	if got := resolve.Get("payload.resolution_code"); got == "" {
+		t.Error("resolved without a resolution code")
+	}
+	if got := resolve.Get("internal_identifier"); got != id {
+		t.Errorf("resolved %q, want %q", got, id)
+	}
+}
+
+// assertNoEmptyComments fails the test if a blank comment was posted to either system
+func assertNoEmptyComments(t *testing.T, e *env) {
+	t.Helper()
+	for _, r := range e.jsd.Find("POST", "/rest/api/2/issue/*") {
+		if strings.HasSuffix(r.Path, "/comment") && strings.TrimSpace(r.Get("body")) == "" {
+			t.Errorf("empty comment posted to %v", r.Path)
+		}
+	}
+	for _, r := range e.snow.Find("POST", "/") {
+		if c := gjson.Get(r.Body, "payload.comments"); c.Exists() && strings.TrimSpace(c.String()) == "" {
+			t.Errorf("empty comment sent to ServiceNow: %v", r.Body)
+		}
+	}
+}
+
+func TestInboundRepeatedCommentWithStatus(t *testing.T) {
+
+	e := newEnv(t)
+	send(t, e.in, "/v2/in", incident("1", nil))
+	send(t, e.in, "/v2/in", incident("1", map[string]string{"comment": "rebooted the primary", "comment_id": "c1"}))
+
+	// ServiceNow repeats the last comment on every event, the status change applies without copying it again
+	send(t, e.in, "/v2/in", incident("10100", map[string]string{"comment": "rebooted the primary", "comment_id": "c1"}))
+	e.jsd.AssertCount(t, 1, "POST", "/rest/api/2/issue/ACP-1/comment")
+	if got := e.jsd.Issue("ACP-1").Status; got != "Investigating" {
+		t.Errorf("status is %q", got)
+	}
+
+	send(t, e.in, "/v2/in", incident("3", map[string]string{"comment": "rebooted the primary", "comment_id": "c1", "resolution": "restored"}))
+	e.jsd.AssertCount(t, 1, "POST", "/rest/api/2/issue/ACP-1/comment")
+	if got := e.jsd.Issue("ACP-1").Status; got != "Resolved" {
+		t.Errorf("status is %q", got)
+	}
+	copies := 0
+	for _, c := range e.jsd.Issue("ACP-1").Comments {
+		if strings.Contains(c, "rebooted the primary") {
+			copies++
+		}
+	}
+	if copies != 1 {
+		t.Errorf("comment copied %v times", copies)
+	}
+	assertNoEmptyComments(t, e)
+}
+
+func TestOutboundRepeatedCommentWithStatus(t *testing.T) {
+
+	e := newEnv(t)
+	comment := map[string]interface{}{"id": "10001", "body": "looking into it", "author": map[string]string{"displayName": "bob"}}
+	send(t, e.out, "/v2/out", issue("ACP-7", "Open", nil))
+	send(t, e.out, "/v2/out", issue("ACP-7", "Open", comment))
+	e.snow.AssertCount(t, 2, "POST", "/")
+
+	// the same comment id arrives with the next status change, only the status is sent
+	send(t, e.out, "/v2/out", issue("ACP-7", "Investigating", comment))
+	progress := e.snow.AssertCalled(t, "POST", "/")
+	if got := progress.Get("payload.state"); got != "22" {
+		t.Errorf("progressed to state %q", got)
+	}
+	if got := progress.Get("payload.comments"); got != "" {
+		t.Errorf("comment copied again: %q", got)
+	}
+
+	send(t, e.out, "/v2/out", issue("ACP-7", "Resolved", comment))
+	resolve := e.snow.AssertCalled(t, "POST", "/")
+	if got := resolve.Get("payload.state"); got != "6" {
+		t.Errorf("resolved to state %q", got)
+	}
+	commented := 0
+	for _, r := range e.snow.Find("POST", "/") {
+		if strings.Contains(r.Get("payload.comments"), "looking into it") {
+			commented++
+		}
+	}
+	if commented != 1 {
+		t.Errorf("comment sent %v times", commented)
+	}
+	assertNoEmptyComments(t, e)
+}
+
+func TestInboundDeletedComment(t *testing.T) {
+
+	e := newEnv(t)
+	send(t, e.in, "/v2/in", incident("1", nil))
+	send(t, e.in, "/v2/in", incident("1", map[string]string{"comment": "restart the primary", "comment_id": "c1"}))
+
+	send(t, e.in, "/v2/in", incident("1", map[string]string{"comment_id": "c1", "event": "comment_deleted"}))
+	e.jsd.AssertNotCalled(t, "PUT", "/rest/api/2/issue/ACP-1/comment/*")
+	i := e.jsd.Issue("ACP-1")
+	if !hasComment(i, "restart the primary") {
+		t.Errorf("copy of the deleted comment lost, comments are %v", i.Comments)
+	}
+	if !hasComment(i, "Comment deleted on ServiceNow (c1)") {
+		t.Errorf("deletion not noted, comments are %v", i.Comments)
+	}
+
+	// the deletion is only noted once
+	send(t, e.in, "/v2/in", incident("1", map[string]string{"comment_id": "c1", "event": "comment_deleted"}))
+	e.jsd.AssertCount(t, 2, "POST", "/rest/api/2/issue/ACP-1/comment")
+}
+
+func TestInboundEchoWithStatus(t *testing.T) {
+
+	e := newEnv(t)
+	send(t, e.in, "/v2/in", incident("1", nil))
+
+	// c9 is the copy of a JSD comment, its marker edited away on ServiceNow
+	err := store.PutLink(context.Background(), e.shared, &store.Link{
+		System:          store.SystemJSD,
+		Ticket:          "ACP-1",
+		CommentID:       "10005",
+		RemoteSystem:    store.SystemSNOW,
+		RemoteTicket:    "INC0010001",
+		RemoteCommentID: "c9",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the comment is not copied back, the status change still applies
+	send(t, e.in, "/v2/in", incident("10100", map[string]string{"comment": "Comment added on JSD: on it", "comment_id": "c9"}))
+	e.jsd.AssertNotCalled(t, "POST", "/rest/api/2/issue/ACP-1/comment")
+	if got := e.jsd.Issue("ACP-1").Status; got != "Investigating" {
+		t.Errorf("status is %q after an echoed comment", got)
+	}
+
+	// a marked comment is recognised without a link
+	send(t, e.in, "/v2/in", incident("3", map[string]string{"comment": "done" + loop.DefaultMarker, "comment_id": "c10", "resolution": "restored"}))
+	e.jsd.AssertNotCalled(t, "POST", "/rest/api/2/issue/ACP-1/comment")
+	if got := e.jsd.Issue("ACP-1").Status; got != "Resolved" {
+		t.Errorf("status is %q after a marked comment", got)
+	}
+	assertNoEmptyComments(t, e)
+}
+
+func TestOutboundEchoWithStatus(t *testing.T) {
+
+	e := newEnv(t)
+	send(t, e.out, "/v2/out", issue("ACP-7", "Open", nil))
+
+	// the comment is not copied back, the status change still applies
+	send(t, e.out, "/v2/out", issue("ACP-7", "Investigating", map[string]interface{}{
+		"id": "10002", "body": "Comment added on ServiceNow (c1): on it" + loop.DefaultMarker, "author": map[string]string{"displayName": "snowsync"},
+	}))
+	e.snow.AssertCount(t, 2, "POST", "/")
+	progress := e.snow.AssertCalled(t, "POST", "/")
+	if got := progress.Get("payload.state"); got != "22" {
+		t.Errorf("progressed to state %q", got)
+	}
+	if got := progress.Get("payload.comments"); got != "" {
+		t.Errorf("echoed comment copied back: %q", got)
+	}
+	assertNoEmptyComments(t, e)
+}
+
+func TestInboundStaleComment(t *testing.T) {
+
+	e := newEnv(t)
+	send(t, e.in, "/v2/in", incident("1", map[string]string{"sys_updated_on": "2026-01-01 10:00:00"}))
+	send(t, e.in, "/v2/in", incident("10100", map[string]string{"sys_updated_on": "2026-01-01 10:05:00"}))
+	e.jsd.AssertCount(t, 1, "POST", "/rest/api/2/issue/ACP-1/transitions")
+
+	// a late event brings its comment but cannot move the ticket back
+	send(t, e.in, "/v2/in", incident("1", map[string]string{"sys_updated_on": "2026-01-01 10:02:00", "comment": "paged the DBA", "comment_id": "c4"}))
+	e.jsd.AssertCount(t, 1, "POST", "/rest/api/2/issue/ACP-1/comment")
+	e.jsd.AssertCount(t, 1, "POST", "/rest/api/2/issue/ACP-1/transitions")
+	i := e.jsd.Issue("ACP-1")
+	if !hasComment(i, "paged the DBA") {
+		t.Errorf("stale comment lost, comments are %v", i.Comments)
+	}
+	if i.Status != "Investigating" {
+		t.Errorf("status rolled back to %q", i.Status)
+	}
+
+	// delivered again, the comment is not copied twice
+	send(t, e.in, "/v2/in", incident("1", map[string]string{"sys_updated_on": "2026-01-01 10:02:00", "comment": "paged the DBA", "comment_id": "c4"}))
+	e.jsd.AssertCount(t, 1, "POST", "/rest/api/2/issue/ACP-1/comment")
+	assertNoEmptyComments(t, e)
+}
+
+func TestOutboundStaleComment(t *testing.T) {
+
+	e := newEnv(t)
+	at := func(m map[string]interface{}, ts int64) map[string]interface{} {
+		m["timestamp"] = ts
+		return m
+	}
+	send(t, e.out, "/v2/out", at(issue("ACP-7", "Open", nil), 1767261600000))
+	send(t, e.out, "/v2/out", at(issue("ACP-7", "Investigating", nil), 1767261900000))
+	e.snow.AssertCount(t, 2, "POST", "/")
+
+	// a late event brings its comment but not its status
+	send(t, e.out, "/v2/out", at(issue("ACP-7", "Open", map[string]interface{}{
+		"id": "10003", "body": "paged the DBA", "author": map[string]string{"displayName": "bob"},
+	}), 1767261720000))
+	update := e.snow.AssertCalled(t, "POST", "/")
+	if got := update.Get("payload.comments"); !strings.Contains(got, "paged the DBA") {
+		t.Errorf("stale comment lost, commented %q", got)
+	}
+	if got := update.Get("payload.state"); got != "" {
+		t.Errorf("stale event set state %q", got)
+	}
+
+	// a late event without a comment has nothing left to apply
+	send(t, e.out, "/v2/out", at(issue("ACP-7", "Open", nil), 1767261720000))
+	e.snow.AssertCount(t, 3, "POST", "/")
+	assertNoEmptyComments(t, e)
+}
+
+// deliver hands a webhook to a handler and returns its status
+func deliver(t *testing.T, h interface {
+	Handle(context.Context, *events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
+}, resource string, body interface{}) int {
+
+	t.Helper()
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := h.Handle(context.Background(), &events.APIGatewayProxyRequest{Resource: resource, Body: string(b)})
+	if err != nil {
+		t.Fatalf("%v: %v", resource, err)
+	}
+	return res.StatusCode
+}
+
+func TestInboundUnrecordedCreate(t *testing.T) {
+
+	e := newEnv(t)
+
+	// JSD raises the ticket but its mapping record cannot be written
+	e.db.FailPut(table, "INC0010001")
+	if code := deliver(t, e.in, "/v2/in", incident("1", nil)); code == http.StatusOK {
+		t.Fatal("failed record write answered 200")
+	}
+	e.jsd.AssertCount(t, 1, "POST", "/rest/servicedeskapi/request/")
+
+	// the redelivery records the ticket already raised rather than raising another
+	send(t, e.in, "/v2/in", incident("1", map[string]string{"comment": "any news?", "comment_id": "c1"}))
+	e.jsd.AssertCount(t, 1, "POST", "/rest/servicedeskapi/request/")
+	e.jsd.AssertCount(t, 1, "POST", "/rest/api/2/issue/ACP-1/comment")
+	assertNoLocks(t, e.db)
+}
+
+// assertNoLocks fails the test if a creation lock is left in the table
+func assertNoLocks(t *testing.T, db *fakes.DynamoDB) {
+	t.Helper()
+	for _, item := range db.Items(table) {
+		if strings.HasPrefix(aws.StringValue(item["id"].S), "lock:") {
+			t.Errorf("creation lock left behind: %v", item)
+		}
+	}
+}
+
+func TestOutboundUnrecordedCreate(t *testing.T) {
+
+	e := newEnv(t)
+
+	e.db.FailPut(table, "ACP-7")
+	if code := deliver(t, e.out, "/v2/out", issue("ACP-7", "Open", nil)); code == http.StatusOK {
+		t.Fatal("failed record write answered 200")
+	}
+	e.snow.AssertCount(t, 1, "POST", "/")
+	id, _ := e.snow.Incident("ACP-7")
+
+	send(t, e.out, "/v2/out", issue("ACP-7", "Investigating", nil))
+	progress := e.snow.AssertCalled(t, "POST", "/")
+	if got := progress.Get("internal_identifier"); got != id {
+		t.Errorf("redelivery sent %q, want the incident raised before, %v", got, id)
+	}
+	e.snow.AssertCount(t, 2, "POST", "/")
+	assertNoLocks(t, e.db)
+}
+
+// withFile adds an attachment to a ServiceNow webhook
+func withFile(m map[string]string) map[string]interface{} {
+	out := map[string]interface{}{
+		"attachments": []map[string]interface{}{{"sys_id": "att9", "file_name": "trace.txt", "content_type": "text/plain", "size_bytes": 12}},
+	}
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+func TestInboundAttachments(t *testing.T) {
+
+	e := newEnv(t)
+
+	// an echo of a ticket snowsync never raised is dropped along with its files
+	send(t, e.in, "/v2/in", withFile(incident("1", map[string]string{"number": "INC0010002", "comment": "hello" + loop.DefaultMarker, "comment_id": "c1"})))
+	e.jsd.AssertNotCalled(t, "POST", "/rest/servicedeskapi/servicedesk/*")
+	e.jsd.AssertNotCalled(t, "POST", "/rest/servicedeskapi/request/*")
+
+	send(t, e.in, "/v2/in", withFile(incident("1", nil)))
+	e.jsd.AssertCount(t, 1, "POST", "/rest/servicedeskapi/request/ACP-1/attachment")
+	if got := e.jsd.Issue("ACP-1").Attachments; len(got) != 1 {
+		t.Errorf("attachments are %v", got)
+	}
+
+	// a file listed again is not copied twice
+	send(t, e.in, "/v2/in", withFile(incident("10100", nil)))
+	e.jsd.AssertCount(t, 1, "POST", "/rest/servicedeskapi/request/ACP-1/attachment")
+}
+
+func TestOutboundAttachments(t *testing.T) {
+
+	e := newEnv(t)
+	withFile := func(m map[string]interface{}) map[string]interface{} {
+		fields := m["issue"].(map[string]interface{})["fields"].(map[string]interface{})
+		fields["attachment"] = []map[string]interface{}{{
+			"id": "10200", "filename": "trace.txt", "mimeType": "text/plain", "size": 12, "content": e.jsd.URL + "/secure/attachment/10200/trace.txt",
+		}}
+		return m
+	}
+
+	// an echo of an issue snowsync never raised is dropped along with its files
+	send(t, e.out, "/v2/out", withFile(issue("ACP-8", "Open", map[string]interface{}{
+		"id": "10001", "body": "hello" + loop.DefaultMarker, "author": map[string]string{"displayName": "snowsync"},
+	})))
+	e.snow.AssertNotCalled(t, "GET", "/api/now/table/*")
+	e.snow.AssertNotCalled(t, "POST", "/api/now/attachment/file")
+
+	send(t, e.out, "/v2/out", withFile(issue("ACP-7", "Open", nil)))
+	id, ok := e.snow.Incident("ACP-7")
+	if !ok {
+		t.Fatal("no incident raised on ServiceNow")
+	}
+	upload := e.snow.AssertCalled(t, "POST", "/api/now/attachment/file")
+	q, err := url.ParseQuery(upload.Query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// files are attached to the record by sys_id, not by its number
+	if got := q.Get("table_sys_id"); got != fakes.SysID(id) {
+		t.Errorf("attached to %q, want the sys_id of %v", got, id)
+	}
+	if got := q.Get("table_name"); got != "incident" {
+		t.Errorf("attached to table %q", got)
+	}
+
+	send(t, e.out, "/v2/out", withFile(issue("ACP-7", "Investigating", nil)))
+	e.snow.AssertCount(t, 1, "POST", "/api/now/attachment/file")
+}
+
+func TestFailedCalls(t *testing.T) {
+
+	e := newEnv(t)
+	send(t, e.in, "/v2/in", incident("1", nil))
+
+	// a comment is not retried by the caller, the failure is reported so ServiceNow redelivers it
+	e.jsd.Fail("POST", "/rest/api/2/issue/ACP-1/comment", http.StatusServiceUnavailable)
+	b, _ := json.Marshal(incident("1", map[string]string{"comment": "still there?", "comment_id": "c1"}))
+	res, err := e.in.Handle(context.Background(), &events.APIGatewayProxyRequest{Resource: "/v2/in", Body: string(b)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("failed comment answered %v", res.StatusCode)
+	}
+	send(t, e.in, "/v2/in", incident("1", map[string]string{"comment": "still there?", "comment_id": "c1"}))
+	e.jsd.AssertCount(t, 2, "POST", "/rest/api/2/issue/ACP-1/comment")
+	if i := e.jsd.Issue("ACP-1"); len(i.Comments) != 1 {
+		t.Errorf("got comments %v after redelivery", i.Comments)
+	}
+
+	// reads are retried by the caller
+	e.jsd.Fail("GET", "/rest/api/2/issue/ACP-1/transitions", http.StatusServiceUnavailable)
+	send(t, e.in, "/v2/in", incident("10100", map[string]string{"comment_id": "c2"}))
+	e.jsd.AssertCount(t, 2, "GET", "/rest/api/2/issue/ACP-1/transitions")
+	if got := e.jsd.Issue("ACP-1").Status; got != "Investigating" {
+		t.Errorf("status is %q after a retried read", got)
+	}
+}
+
+func hasComment(i *fakes.Issue, text string) bool {
+	if i == nil {
+		return false
+	}
+	for _, c := range i.Comments {
+		if strings.Contains(c, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRedeliveryAfterFailure(t *testing.T) {
+
+	e := newEnv(t)
+	e.in.Verifier = webhook.All{
+		&webhook.Token{Header: "X-Snowsync-Token", Token: "t0ken"},
+		webhook.NewReplay(secrets.SNOW, "", "X-Snowsync-Nonce", time.Minute, e.shared),
+	}
+	b, err := json.Marshal(incident("1", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliver := func() int {
+		res, err := e.in.Handle(context.Background(), &events.APIGatewayProxyRequest{
+			Resource: "/v2/in",
+			Body:     string(b),
+			Headers:  map[string]string{"X-Snowsync-Token": "t0ken", "X-Snowsync-Nonce": "d1"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode
+	}
+
+	// the sender delivers a failed webhook again with the same delivery id
+	e.jsd.Fail("POST", "/rest/servicedeskapi/request/", http.StatusInternalServerError)
+	if code := deliver(); code == http.StatusOK {
+		t.Fatal("failed delivery accepted")
+	}
+	if code := deliver(); code != http.StatusOK {
+		t.Fatalf("redelivery answered %v", code)
+	}
+	if e.jsd.Issue("ACP-1") == nil || e.jsd.Issue("ACP-2") != nil {
+		t.Error("redelivery did not raise exactly one ticket")
+	}
+	// once delivered, the id is refused
+	if code := deliver(); code != http.StatusUnauthorized {
+		t.Errorf("replay answered %v", code)
+	}
+}
+
+func TestJSDCreatedUpdatedFromSNOW(t *testing.T) {
+
+	e := newEnv(t)
+	e.jsd.Raise("ACP-7")
+	at := func(m map[string]interface{}, ts int64) map[string]interface{} {
+		m["timestamp"] = ts
+		return m
+	}
+	send(t, e.out, "/v2/out", at(issue("ACP-7", "Open", nil), 1767261900000))
+	id, ok := e.snow.Incident("ACP-7")
+	if !ok {
+		t.Fatal("no incident raised on ServiceNow")
+	}
+
+	// ServiceNow reports on the incident through /v2/add, keyed by the JSD issue, with its own clock behind the one
+	// of JSD, so its changes are applied rather than judged stale against JSD events
+	send(t, e.in, "/v2/add", incident("10100", map[string]string{
+		"number": id, "external_identifier": "ACP-7", "sys_updated_on": "2026-01-01 10:02:00", "comment": "on it", "comment_id": "c1",
+	}))
+	e.jsd.AssertNotCalled(t, "POST", "/rest/servicedeskapi/request/")
+	i := e.jsd.Issue("ACP-7")
+	if !hasComment(i, "on it") {
+		t.Errorf("comment not added, comments are %v", i.Comments)
+	}
+	if i.Status != "Investigating" {
+		t.Errorf("status is %q after progress", i.Status)
+	}
+
+	// a late ServiceNow event cannot move the issue back
+	send(t, e.in, "/v2/add", incident("1", map[string]string{
+		"number": id, "external_identifier": "ACP-7", "sys_updated_on": "2026-01-01 10:01:00",
+	}))
+	if got := e.jsd.Issue("ACP-7").Status; got != "Investigating" {
+		t.Errorf("status rolled back to %q", got)
+	}
+	send(t, e.in, "/v2/add", incident("3", map[string]string{
+		"number": id, "external_identifier": "ACP-7", "sys_updated_on": "2026-01-01 10:03:00", "comment_id": "c2", "resolution": "restored",
+	}))
+	if got := e.jsd.Issue("ACP-7").Status; got != "Resolved" {
+		t.Errorf("status is %q after resolve", got)
+	}
+
+	// a later JSD event still reaches ServiceNow
+	send(t, e.out, "/v2/out", at(issue("ACP-7", "Investigating", nil), 1767262000000))
+	progress := e.snow.AssertCalled(t, "POST", "/")
+	if got := progress.Get("internal_identifier"); got != id {
+		t.Errorf("progressed %q, want %q", got, id)
+	}
+	e.snow.AssertCount(t, 2, "POST", "/")
+	if got := progress.Get("messageid"); strings.Contains(got, "Create") {
+		t.Errorf("raised a second incident with %q", got)
+	}
+	assertNoLocks(t, e.db)
+}
+
+func TestSNOWCreatedUpdatedFromJSD(t *testing.T) {
+
+	e := newEnv(t)
+	send(t, e.in, "/v2/in", incident("1", map[string]string{"sys_updated_on": "2026-01-01 10:05:00"}))
+	if e.jsd.Issue("ACP-1") == nil {
+		t.Fatal("no ticket raised on JSD")
+	}
+	reverse := func(status string, ts int64, comment map[string]interface{}) map[string]interface{} {
+		m := issue("ACP-1", status, comment)
+		m["issue"].(map[string]interface{})["fields"].(map[string]interface{})["customfield_11824"] = "INC0010001"
+		m["timestamp"] = ts
+		return m
+	}
+
+	// JSD reports on the issue through /v2/reverse, keyed by the incident, with its own clock behind the one of
+	// ServiceNow, so its changes are applied rather than judged stale against ServiceNow events
+	send(t, e.out, "/v2/reverse", reverse("Investigating", 1767261720000, map[string]interface{}{
+		"id": "10005", "body": "looking into it", "author": map[string]string{"displayName": "bob"},
+	}))
+	update := e.snow.AssertCalled(t, "POST", "/")
+	if got := update.Get("internal_identifier"); got != "INC0010001" {
+		t.Errorf("updated %q", got)
+	}
+	if got := update.Get("payload.state"); got != "22" {
+		t.Errorf("updated to state %q", got)
+	}
+	if got := update.Get("payload.comments"); !strings.Contains(got, "looking into it") {
+		t.Errorf("commented %q", got)
+	}
+
+	// a late JSD event cannot move the incident back
+	send(t, e.out, "/v2/reverse", reverse("Open", 1767261660000, nil))
+	e.snow.AssertCount(t, 1, "POST", "/")
+	send(t, e.out, "/v2/reverse", reverse("Resolved", 1767261780000, nil))
+	resolve := e.snow.AssertCalled(t, "POST", "/")
+	if got := resolve.Get("payload.state"); got != "6" {
+		t.Errorf("resolved to state %q", got)
+	}
+
+	for _, r := range e.snow.Find("POST", "/") {
+		if got := r.Get("messageid"); strings.Contains(got, "Create") {
+			t.Errorf("raised an incident for a ServiceNow ticket with %q", got)
+		}
+	}
+	e.jsd.AssertCount(t, 1, "POST", "/rest/servicedeskapi/request/")
+	assertNoLocks(t, e.db)
+}
+
+func TestAttachmentsNotCopiedBack(t *testing.T) {
+
+	e := newEnv(t)
+	jsdFile := func(m map[string]interface{}, id, snowID string) map[string]interface{} {
+		fields := m["issue"].(map[string]interface{})["fields"].(map[string]interface{})
+		fields["attachment"] = []map[string]interface{}{{
+			"id": id, "filename": "trace.txt", "mimeType": "text/plain", "size": 12, "content": e.jsd.URL + "/secure/attachment/" + id + "/trace.txt",
+		}}
+		if snowID != "" {
+			fields["customfield_11824"] = snowID
+		}
+		return m
+	}
+	snowFile := func(m map[string]string, sysID string) map[string]interface{} {
+		out := withFile(m)
+		out["attachments"] = []map[string]interface{}{{"sys_id": sysID, "file_name": "trace.txt", "content_type": "text/plain", "size_bytes": 12}}
+		return out
+	}
+
+	// a ServiceNow file copied to JSD comes back listed under the id JSD gave it
+	send(t, e.in, "/v2/in", snowFile(incident("1", nil), "att9"))
+	e.jsd.AssertCount(t, 1, "POST", "/rest/servicedeskapi/request/ACP-1/attachment")
+	send(t, e.out, "/v2/reverse", jsdFile(issue("ACP-1", "Investigating", nil), "20001", "INC0010001"))
+	e.snow.AssertNotCalled(t, "POST", "/api/now/attachment/file")
+
+	// a JSD file copied to ServiceNow comes back listed under the sys_id ServiceNow gave it
+	e.jsd.Raise("ACP-7")
+	send(t, e.out, "/v2/out", jsdFile(issue("ACP-7", "Open", nil), "10200", ""))
+	e.snow.AssertCount(t, 1, "POST", "/api/now/attachment/file")
+	id, _ := e.snow.Incident("ACP-7")
+	send(t, e.in, "/v2/add", snowFile(incident("10100", map[string]string{"number": id, "external_identifier": "ACP-7"}), "att1"))
+	e.jsd.AssertNotCalled(t, "POST", "/rest/servicedeskapi/request/ACP-7/attachment")
+
+	// a new file on either side is still copied
+	send(t, e.in, "/v2/add", snowFile(incident("10100", map[string]string{"number": id, "external_identifier": "ACP-7"}), "att10"))
+	e.jsd.AssertCount(t, 1, "POST", "/rest/servicedeskapi/request/ACP-7/attachment")
+}
+
+func TestInboundUnmappedPriority(t *testing.T) {
+
+	e := newEnv(t)
+
+	// JSD cannot raise a ticket without a priority it knows, so the event is dropped rather than failed
+	send(t, e.in, "/v2/in", incident("1", map[string]string{"priority": "9"}))
+	e.jsd.AssertNotCalled(t, "POST", "/rest/servicedeskapi/request/")
+	assertNoLocks(t, e.db)
+
+	// a later event with a known priority raises it
+	send(t, e.in, "/v2/in", incident("1", nil))
+	e.jsd.AssertCount(t, 1, "POST", "/rest/servicedeskapi/request/")
+}
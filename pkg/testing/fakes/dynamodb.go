@@ -0,0 +1,409 @@
+package fakes
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// DynamoDB is an in-memory DynamoDB holding the tables the mapping store and outbox use
+// it understands the calls and expressions they make, any other call fails with an UnsupportedOperation error
+type DynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+
+	mu     sync.Mutex
+	tables map[string]*table
+	// failures are the hash keys whose next put fails, by table
+	failures map[string]map[string]bool
+}
+
+type table struct {
+	hash, rng string
+	items     map[string]map[string]*dynamodb.AttributeValue
+}
+
+// NewDynamoDB returns an empty in-memory DynamoDB
+func NewDynamoDB() *DynamoDB {
+	return &DynamoDB{
+		DynamoDBAPI: unsupported(),
+		tables:      make(map[string]*table),
+		failures:    make(map[string]map[string]bool),
+	}
+}
+
+// unsupported returns a client failing every call before it is sent, so a call the fake does not
+// implement reports an error instead of reaching AWS or panicking
+func unsupported() *dynamodb.DynamoDB {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("eu-west-2"),
+		Credentials: credentials.AnonymousCredentials,
+	}))
+	c := dynamodb.New(sess)
+	c.Handlers.Validate.PushFront(func(r *request.Request) {
+		r.Error = awserr.New("UnsupportedOperation", "fakes.DynamoDB does not implement "+r.Operation.Name, nil)
+	})
+	return c
+}
+
+// AddTable creates a table keyed by a hash key and an optional range key
+func (d *DynamoDB) AddTable(name, hash, rng string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tables[name] = &table{hash: hash, rng: rng, items: make(map[string]map[string]*dynamodb.AttributeValue)}
+}
+
+// Items returns a copy of every item in a table, ordered by key
+func (d *DynamoDB) Items(name string) []map[string]*dynamodb.AttributeValue {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, ok := d.tables[name]
+	if !ok {
+		return nil
+	}
+	keys := make([]string, 0, len(t.items))
+	for k := range t.items {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]map[string]*dynamodb.AttributeValue, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, copyItem(t.items[k]))
+	}
+	return out
+}
+
+// FailPut fails the next write of an item with a hash key to a table, such as a mapping record after a create
+func (d *DynamoDB) FailPut(name, hash string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.failures[name] == nil {
+		d.failures[name] = make(map[string]bool)
+	}
+	d.failures[name][hash] = true
+}
+
+func (d *DynamoDB) table(name *string) (*table, error) {
+	t, ok := d.tables[aws.StringValue(name)]
+	if !ok {
+		return nil, awserr.New(dynamodb.ErrCodeResourceNotFoundException, "table not found: "+aws.StringValue(name), nil)
+	}
+	return t, nil
+}
+
+// key forms the storage key of an item, failing when a key attribute is missing
+func (t *table) key(item map[string]*dynamodb.AttributeValue) (string, error) {
+	h, ok := item[t.hash]
+	if !ok {
+		return "", awserr.New("ValidationException", "missing hash key "+t.hash, nil)
+	}
+	k := render(h)
+	if t.rng != "" {
+		r, ok := item[t.rng]
+		if !ok {
+			return "", awserr.New("ValidationException", "missing range key "+t.rng, nil)
+		}
+		k += "\x00" + render(r)
+	}
+	return k, nil
+}
+
+// GetItemWithContext returns an item by its key
+func (d *DynamoDB) GetItemWithContext(_ aws.Context, in *dynamodb.GetItemInput, _ ...request.Option) (*dynamodb.GetItemOutput, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, err := d.table(in.TableName)
+	if err != nil {
+		return nil, err
+	}
+	k, err := t.key(in.Key)
+	if err != nil {
+		return nil, err
+	}
+	out := &dynamodb.GetItemOutput{}
+	if item, ok := t.items[k]; ok {
+		out.Item = copyItem(item)
+	}
+	return out, nil
+}
+
+// PutItemWithContext writes an item if its condition holds
+func (d *DynamoDB) PutItemWithContext(_ aws.Context, in *dynamodb.PutItemInput, _ ...request.Option) (*dynamodb.PutItemOutput, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, err := d.table(in.TableName)
+	if err != nil {
+		return nil, err
+	}
+	k, err := t.key(in.Item)
+	if err != nil {
+		return nil, err
+	}
+	if h := aws.StringValue(in.Item[t.hash].S); d.failures[aws.StringValue(in.TableName)][h] {
+		delete(d.failures[aws.StringValue(in.TableName)], h)
+		return nil, awserr.New(dynamodb.ErrCodeInternalServerError, "injected failure", nil)
+	}
+	e := expr{names: in.ExpressionAttributeNames, values: in.ExpressionAttributeValues}
+	err = e.check(in.ConditionExpression, t.items[k])
+	if err != nil {
+		return nil, err
+	}
+	t.items[k] = copyItem(in.Item)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+// DeleteItemWithContext removes an item if its condition holds
+func (d *DynamoDB) DeleteItemWithContext(_ aws.Context, in *dynamodb.DeleteItemInput, _ ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, err := d.table(in.TableName)
+	if err != nil {
+		return nil, err
+	}
+	k, err := t.key(in.Key)
+	if err != nil {
+		return nil, err
+	}
+	e := expr{names: in.ExpressionAttributeNames, values: in.ExpressionAttributeValues}
+	err = e.check(in.ConditionExpression, t.items[k])
+	if err != nil {
+		return nil, err
+	}
+	delete(t.items, k)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// QueryWithContext returns the items matching a key condition and filter, in key order
+func (d *DynamoDB) QueryWithContext(_ aws.Context, in *dynamodb.QueryInput, _ ...request.Option) (*dynamodb.QueryOutput, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, err := d.table(in.TableName)
+	if err != nil {
+		return nil, err
+	}
+	e := expr{names: in.ExpressionAttributeNames, values: in.ExpressionAttributeValues}
+	items, err := t.match(e, in.KeyConditionExpression, in.FilterExpression)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.QueryOutput{Items: items, Count: aws.Int64(int64(len(items)))}, nil
+}
+
+// ScanWithContext returns the items matching a filter, in key order
+func (d *DynamoDB) ScanWithContext(_ aws.Context, in *dynamodb.ScanInput, _ ...request.Option) (*dynamodb.ScanOutput, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, err := d.table(in.TableName)
+	if err != nil {
+		return nil, err
+	}
+	e := expr{names: in.ExpressionAttributeNames, values: in.ExpressionAttributeValues}
+	items, err := t.match(e, nil, in.FilterExpression)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.ScanOutput{Items: items, Count: aws.Int64(int64(len(items)))}, nil
+}
+
+// ScanPagesWithContext scans a table as a single page
+func (d *DynamoDB) ScanPagesWithContext(ctx aws.Context, in *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	out, err := d.ScanWithContext(ctx, in, opts...)
+	if err != nil {
+		return err
+	}
+	fn(out, true)
+	return nil
+}
+
+// match returns copies of the items satisfying every given expression
+func (t *table) match(e expr, conds ...*string) ([]map[string]*dynamodb.AttributeValue, error) {
+
+	keys := make([]string, 0, len(t.items))
+	for k := range t.items {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var out []map[string]*dynamodb.AttributeValue
+	for _, k := range keys {
+		ok := true
+		for _, c := range conds {
+			if aws.StringValue(c) == "" {
+				continue
+			}
+			m, err := e.eval(aws.StringValue(c), t.items[k])
+			if err != nil {
+				return nil, err
+			}
+			ok = ok && m
+		}
+		if ok {
+			out = append(out, copyItem(t.items[k]))
+		}
+	}
+	return out, nil
+}
+
+// expr evaluates the subset of condition expressions snowsync writes:
+// comparisons with = and <>, attribute_exists, attribute_not_exists and begins_with, joined by AND or OR
+type expr struct {
+	names  map[string]*string
+	values map[string]*dynamodb.AttributeValue
+}
+
+// check returns a ConditionalCheckFailedException when a condition does not hold for an item
+func (e expr) check(cond *string, item map[string]*dynamodb.AttributeValue) error {
+	if aws.StringValue(cond) == "" {
+		return nil
+	}
+	ok, err := e.eval(aws.StringValue(cond), item)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+	}
+	return nil
+}
+
+func (e expr) eval(s string, item map[string]*dynamodb.AttributeValue) (bool, error) {
+
+	// OR binds looser than AND
+	if parts := splitWord(s, "OR"); len(parts) > 1 {
+		for _, p := range parts {
+			ok, err := e.eval(p, item)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	}
+	if parts := splitWord(s, "AND"); len(parts) > 1 {
+		for _, p := range parts {
+			ok, err := e.eval(p, item)
+			if err != nil || !ok {
+				return ok, err
+			}
+		}
+		return true, nil
+	}
+
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		return e.eval(s[1:len(s)-1], item)
+	}
+
+	for _, fn := range []string{"attribute_not_exists", "attribute_exists", "begins_with"} {
+		if !strings.HasPrefix(s, fn+"(") || !strings.HasSuffix(s, ")") {
+			continue
+		}
+		args := strings.Split(s[len(fn)+1:len(s)-1], ",")
+		v, found := item[e.name(args[0])]
+		switch fn {
+		case "attribute_not_exists":
+			return !found, nil
+		case "attribute_exists":
+			return found, nil
+		}
+		if len(args) != 2 {
+			return false, awserr.New("ValidationException", "begins_with takes two arguments: "+s, nil)
+		}
+		prefix, err := e.value(args[1])
+		if err != nil {
+			return false, err
+		}
+		return found && strings.HasPrefix(aws.StringValue(v.S), aws.StringValue(prefix.S)), nil
+	}
+
+	for _, op := range []string{"<>", "="} {
+		i := strings.Index(s, op)
+		if i < 0 {
+			continue
+		}
+		v, found := item[e.name(s[:i])]
+		want, err := e.value(s[i+len(op):])
+		if err != nil {
+			return false, err
+		}
+		equal := found && render(v) == render(want)
+		if op == "<>" {
+			return found && !equal, nil
+		}
+		return equal, nil
+	}
+	return false, awserr.New("ValidationException", "unsupported expression: "+s, nil)
+}
+
+// name resolves an attribute name placeholder
+func (e expr) name(s string) string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "#") {
+		return aws.StringValue(e.names[s])
+	}
+	return s
+}
+
+// value resolves an attribute value placeholder
+func (e expr) value(s string) (*dynamodb.AttributeValue, error) {
+	s = strings.TrimSpace(s)
+	v, ok := e.values[s]
+	if !ok {
+		return nil, awserr.New("ValidationException", "missing expression attribute value "+s, nil)
+	}
+	return v, nil
+}
+
+// splitWord splits an expression on a keyword outside brackets
+func splitWord(s, word string) []string {
+	var parts []string
+	var depth, start int
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ' ':
+			if depth == 0 && strings.HasPrefix(s[i+1:], word+" ") {
+				parts = append(parts, s[start:i])
+				start = i + len(word) + 2
+				i = start - 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// render gives an attribute value a canonical form for comparison
+func render(v *dynamodb.AttributeValue) string {
+	if v == nil {
+		return ""
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func copyItem(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	if item == nil {
+		return nil
+	}
+	b, err := json.Marshal(item)
+	if err != nil {
+		panic(fmt.Sprintf("could not copy item: %v", err))
+	}
+	var out map[string]*dynamodb.AttributeValue
+	err = json.Unmarshal(b, &out)
+	if err != nil {
+		panic(fmt.Sprintf("could not copy item: %v", err))
+	}
+	return out
+}
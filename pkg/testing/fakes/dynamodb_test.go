@@ -0,0 +1,72 @@
+package fakes
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestDynamoDBUnsupported(t *testing.T) {
+
+	d := NewDynamoDB()
+	d.AddTable("snowsync", "id", "comment_sysid")
+
+	// calls the fake does not implement fail instead of panicking
+	_, err := d.UpdateItemWithContext(context.Background(), &dynamodb.UpdateItemInput{TableName: aws.String("snowsync")})
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) || aerr.Code() != "UnsupportedOperation" || !strings.Contains(aerr.Message(), "UpdateItem") {
+		t.Errorf("got %v", err)
+	}
+	_, err = d.BatchWriteItem(&dynamodb.BatchWriteItemInput{})
+	if err == nil {
+		t.Error("unimplemented call succeeded")
+	}
+}
+
+func TestDynamoDBConditions(t *testing.T) {
+
+	d := NewDynamoDB()
+	d.AddTable("snowsync", "id", "comment_sysid")
+	ctx := context.Background()
+	item := map[string]*dynamodb.AttributeValue{
+		"id":            {S: aws.String("INC1")},
+		"comment_sysid": {S: aws.String("0")},
+		"version":       {N: aws.String("1")},
+	}
+
+	put := func(cond string, values map[string]*dynamodb.AttributeValue) error {
+		in := &dynamodb.PutItemInput{TableName: aws.String("snowsync"), Item: item, ExpressionAttributeValues: values}
+		if cond != "" {
+			in.ConditionExpression = aws.String(cond)
+		}
+		_, err := d.PutItemWithContext(ctx, in)
+		return err
+	}
+	if err := put("attribute_not_exists(id)", nil); err != nil {
+		t.Fatal(err)
+	}
+	err := put("attribute_not_exists(id)", nil)
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+		t.Errorf("second put got %v", err)
+	}
+	if err := put("version = :v", map[string]*dynamodb.AttributeValue{":v": {N: aws.String("1")}}); err != nil {
+		t.Errorf("put at the version read got %v", err)
+	}
+	if err := put("version = :v", nil); err == nil {
+		t.Error("missing expression value accepted")
+	}
+
+	d.FailPut("snowsync", "INC1")
+	if err := put("", nil); err == nil {
+		t.Error("injected failure not returned")
+	}
+	if err := put("", nil); err != nil {
+		t.Errorf("failure injected twice: %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+package fakes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+)
+
+// DefaultTransitions are the transitions of the embedded JSD workflow, by id, open from every status
+var DefaultTransitions = map[string]string{
+	"11":  "Investigating",
+	"121": "Resolved",
+}
+
+// Issue is a ticket held by the fake JSD
+type Issue struct {
+	Key      string
+	Status   string
+	Priority string
+	// Fields are the request field values the ticket was raised with
+	Fields map[string]interface{}
+	// Comments are keyed by id
+	Comments map[string]string
+	// Attachments are the temporary file ids attached to the ticket
+	Attachments []string
+}
+
+// JSD is a fake JSD serving the service desk request, issue, comment and transition endpoints it is called on,
+// the two step attachment upload and downloads of attachment content under /secure/attachment/
+type JSD struct {
+	*httptest.Server
+	recorder
+
+	// Project and IssueType are reported for every issue
+	Project   string
+	IssueType string
+	// Initial is the status of new issues
+	Initial string
+	// Transitions are offered from every status, by id to the name of the status each leads to
+	Transitions map[string]string
+
+	mu       sync.Mutex
+	issues   map[string]*Issue
+	next     int
+	comments int
+	files    int
+	attached int
+	// failures are statuses to answer with, by method and path, consumed once each
+	failures map[string][]int
+}
+
+// NewJSD starts a fake JSD, close it when done
+func NewJSD() *JSD {
+	j := &JSD{
+		Project:     "ACP",
+		IssueType:   "Incident",
+		Initial:     "Open",
+		Transitions: DefaultTransitions,
+		issues:      make(map[string]*Issue),
+		failures:    make(map[string][]int),
+	}
+	j.Server = httptest.NewServer(http.HandlerFunc(j.serve))
+	return j
+}
+
+// Issue returns a copy of an issue, or nil when there is none
+func (j *JSD) Issue(key string) *Issue {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	i, ok := j.issues[key]
+	if !ok {
+		return nil
+	}
+	c := *i
+	c.Comments = make(map[string]string, len(i.Comments))
+	for k, v := range i.Comments {
+		c.Comments[k] = v
+	}
+	c.Attachments = append([]string(nil), i.Attachments...)
+	return &c
+}
+
+// Raise adds an issue in the initial status, as if a customer raised it on JSD
+func (j *JSD) Raise(key string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.issues[key] = &Issue{Key: key, Status: j.Initial, Comments: make(map[string]string)}
+}
+
+// Fail answers the next request with a method and path with a status, such as 503 to test retries
+func (j *JSD) Fail(method, path string, status int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	k := method + " " + path
+	j.failures[k] = append(j.failures[k], status)
+}
+
+func (j *JSD) serve(w http.ResponseWriter, r *http.Request) {
+
+	req := j.record(r)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if codes := j.failures[req.Method+" "+req.Path]; len(codes) != 0 {
+		j.failures[req.Method+" "+req.Path] = codes[1:]
+		http.Error(w, "injected failure", codes[0])
+		return
+	}
+
+	parts := strings.Split(strings.Trim(req.Path, "/"), "/")
+	switch {
+	case req.Method == "POST" && req.Path == "/rest/servicedeskapi/request/":
+		j.createRequest(w, req)
+	case req.Method == "POST" && len(parts) == 5 && parts[2] == "servicedesk" && parts[4] == "attachTemporaryFile":
+		j.files++
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"temporaryAttachments": []map[string]string{{"temporaryAttachmentId": fmt.Sprintf("tmp%v", j.files)}},
+		})
+	case req.Method == "POST" && len(parts) == 5 && parts[2] == "request" && parts[4] == "attachment":
+		i, ok := j.issues[parts[3]]
+		if !ok {
+			http.Error(w, `{"errorMessage":"Request does not exist"}`, http.StatusNotFound)
+			return
+		}
+		// like JSD, the id of each attached file is only given in the links to it
+		values := []map[string]interface{}{}
+		for _, id := range gjson.Get(req.Body, "temporaryAttachmentIds").Array() {
+			i.Attachments = append(i.Attachments, id.String())
+			j.attached++
+			values = append(values, map[string]interface{}{"_links": map[string]string{
+				"jiraRest": fmt.Sprintf("%v/rest/api/2/attachment/%v", j.URL, 20000+j.attached),
+				"content":  fmt.Sprintf("%v/secure/attachment/%v/file", j.URL, 20000+j.attached),
+			}})
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"attachments": map[string]interface{}{"size": len(values), "values": values}})
+	case req.Method == "GET" && strings.HasPrefix(req.Path, "/secure/attachment/"):
+		w.Write([]byte("file content"))
+	case len(parts) >= 5 && parts[0] == "rest" && parts[1] == "api" && parts[3] == "issue":
+		i, ok := j.issues[parts[4]]
+		if !ok {
+			http.Error(w, `{"errorMessages":["Issue does not exist"]}`, http.StatusNotFound)
+			return
+		}
+		j.serveIssue(w, req, i, parts[5:])
+	default:
+		http.Error(w, "no such endpoint", http.StatusNotFound)
+	}
+}
+
+func (j *JSD) createRequest(w http.ResponseWriter, req Request) {
+
+	var body struct {
+		Fields map[string]interface{} `json:"requestFieldValues"`
+	}
+	err := json.Unmarshal([]byte(req.Body), &body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	j.next++
+	i := &Issue{
+		Key:      fmt.Sprintf("%v-%v", j.Project, j.next),
+		Status:   j.Initial,
+		Priority: gjson.Get(req.Body, "requestFieldValues.priority.name").String(),
+		Fields:   body.Fields,
+		Comments: make(map[string]string),
+	}
+	j.issues[i.Key] = i
+	writeJSON(w, http.StatusCreated, map[string]string{"issueKey": i.Key})
+}
+
+func (j *JSD) serveIssue(w http.ResponseWriter, req Request, i *Issue, rest []string) {
+
+	switch {
+	case len(rest) == 0 && req.Method == "GET":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"key": i.Key,
+			"fields": map[string]interface{}{
+				"status":    map[string]string{"name": i.Status},
+				"issuetype": map[string]string{"name": j.IssueType},
+				"project":   map[string]string{"key": j.Project},
+				"priority":  map[string]string{"name": i.Priority},
+			},
+		})
+	case len(rest) == 0 && req.Method == "PUT":
+		if p := gjson.Get(req.Body, "update.priority.0.set.name"); p.Exists() {
+			i.Priority = p.String()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(rest) == 1 && rest[0] == "comment" && req.Method == "POST":
+		j.comments++
+		id := fmt.Sprint(10000 + j.comments)
+		i.Comments[id] = gjson.Get(req.Body, "body").String()
+		writeJSON(w, http.StatusCreated, map[string]string{"id": id})
+	case len(rest) == 2 && rest[0] == "comment" && req.Method == "PUT":
+		if _, ok := i.Comments[rest[1]]; !ok {
+			http.Error(w, "no such comment", http.StatusNotFound)
+			return
+		}
+		i.Comments[rest[1]] = gjson.Get(req.Body, "body").String()
+		writeJSON(w, http.StatusOK, map[string]string{"id": rest[1]})
+	case len(rest) == 1 && rest[0] == "transitions" && req.Method == "GET":
+		type to struct {
+			Name string `json:"name"`
+		}
+		type transition struct {
+			ID string `json:"id"`
+			To to     `json:"to"`
+		}
+		list := []transition{}
+		for id, name := range j.Transitions {
+			list = append(list, transition{ID: id, To: to{Name: name}})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"transitions": list})
+	case len(rest) == 1 && rest[0] == "transitions" && req.Method == "POST":
+		name, ok := j.Transitions[gjson.Get(req.Body, "transition.id").String()]
+		if !ok {
+			http.Error(w, `{"errorMessages":["It seems that you have tried to perform a workflow operation that is not valid"]}`, http.StatusBadRequest)
+			return
+		}
+		i.Status = name
+		if c := gjson.Get(req.Body, "update.comment.0.add.body"); c.Exists() {
+			j.comments++
+			i.Comments[fmt.Sprint(10000+j.comments)] = c.String()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "no such endpoint", http.StatusNotFound)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
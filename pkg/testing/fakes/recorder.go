@@ -0,0 +1,121 @@
+// Package fakes provides stand-ins for JSD, ServiceNow and DynamoDB, so both directions can be run end to end
+// in tests and local runs without any remote system
+package fakes
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// Request is a request received by a fake server
+type Request struct {
+	Method string
+	// Path is the escaped path, without the query
+	Path   string
+	Query  string
+	Header http.Header
+	Body   string
+}
+
+// Get reads a value from the JSON body with a gjson path
+func (r Request) Get(path string) string {
+	return gjson.Get(r.Body, path).String()
+}
+
+// recorder keeps the requests a fake server received
+type recorder struct {
+	mu   sync.Mutex
+	reqs []Request
+}
+
+// record reads and keeps a request, returning its body
+func (rec *recorder) record(r *http.Request) Request {
+	b, _ := ioutil.ReadAll(r.Body)
+	req := Request{
+		Method: r.Method,
+		Path:   r.URL.EscapedPath(),
+		Query:  r.URL.RawQuery,
+		Header: r.Header.Clone(),
+		Body:   string(b),
+	}
+	rec.mu.Lock()
+	rec.reqs = append(rec.reqs, req)
+	rec.mu.Unlock()
+	return req
+}
+
+// Requests returns every request received so far
+func (rec *recorder) Requests() []Request {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]Request(nil), rec.reqs...)
+}
+
+// Find returns the requests with a method and path, a path ending in * matches by prefix
+func (rec *recorder) Find(method, path string) []Request {
+	var out []Request
+	for _, r := range rec.Requests() {
+		if r.Method == method && matchPath(path, r.Path) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// Reset forgets the requests received so far
+func (rec *recorder) Reset() {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.reqs = nil
+}
+
+// AssertCount fails the test unless n requests with a method and path were received
+func (rec *recorder) AssertCount(t testing.TB, n int, method, path string) []Request {
+	t.Helper()
+	got := rec.Find(method, path)
+	if len(got) != n {
+		t.Errorf("got %v %v %v requests, want %v\n%v", len(got), method, path, n, rec.summary())
+	}
+	return got
+}
+
+// AssertCalled fails the test unless a request with a method and path was received, returning the last one
+func (rec *recorder) AssertCalled(t testing.TB, method, path string) Request {
+	t.Helper()
+	got := rec.Find(method, path)
+	if len(got) == 0 {
+		t.Errorf("no %v %v request\n%v", method, path, rec.summary())
+		return Request{}
+	}
+	return got[len(got)-1]
+}
+
+// AssertNotCalled fails the test if a request with a method and path was received
+func (rec *recorder) AssertNotCalled(t testing.TB, method, path string) {
+	t.Helper()
+	if got := rec.Find(method, path); len(got) != 0 {
+		t.Errorf("unexpected %v %v request\n%v", method, path, rec.summary())
+	}
+}
+
+// summary lists the requests received, for failure messages
+func (rec *recorder) summary() string {
+	var b strings.Builder
+	b.WriteString("requests received:")
+	for _, r := range rec.Requests() {
+		b.WriteString("\n  " + r.Method + " " + r.Path)
+	}
+	return b.String()
+}
+
+func matchPath(pattern, path string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(path, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == path
+}
@@ -0,0 +1,135 @@
+package fakes
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+)
+
+// SNOW is a fake ServiceNow serving the inbound REST message endpoint at its root, the table API to look up incidents
+// and the attachment API, which only accepts files for a known incident sys_id
+type SNOW struct {
+	*httptest.Server
+	recorder
+
+	mu        sync.Mutex
+	incidents map[string]string
+	next      int
+	comments  int
+	files     int
+	failures  []int
+}
+
+// NewSNOW starts a fake ServiceNow, close it when done
+func NewSNOW() *SNOW {
+	s := &SNOW{incidents: make(map[string]string)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Incident returns the internal identifier ServiceNow gave the ticket raised for a JSD key
+func (s *SNOW) Incident(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.incidents[key]
+	return id, ok
+}
+
+// SysID returns the sys_id of the record with an internal identifier
+func SysID(number string) string {
+	return fmt.Sprintf("%032x", number)
+}
+
+// Fail answers the next message with a status, such as 503 to test dead-lettering
+func (s *SNOW) Fail(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, status)
+}
+
+func (s *SNOW) serve(w http.ResponseWriter, r *http.Request) {
+
+	req := s.record(r)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.failures) != 0 {
+		code := s.failures[0]
+		s.failures = s.failures[1:]
+		http.Error(w, "injected failure", code)
+		return
+	}
+
+	switch {
+	case req.Method == "GET" && strings.HasPrefix(req.Path, "/api/now/table/"):
+		s.lookup(w, req)
+	case req.Method == "GET" && strings.HasPrefix(req.Path, "/api/now/attachment/") && strings.HasSuffix(req.Path, "/file"):
+		w.Write([]byte("file content"))
+	case req.Method == "POST" && req.Path == "/api/now/attachment/file":
+		q, _ := url.ParseQuery(req.Query)
+		if !s.known(q.Get("table_sys_id")) {
+			http.Error(w, "no such record", http.StatusNotFound)
+			return
+		}
+		s.files++
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"result": map[string]string{"sys_id": fmt.Sprintf("att%v", s.files)}})
+	case req.Method == "POST" && (req.Path == "" || req.Path == "/"):
+		s.message(w, req)
+	default:
+		http.Error(w, "no such endpoint", http.StatusNotFound)
+	}
+}
+
+// lookup answers a table query for a record by number
+func (s *SNOW) lookup(w http.ResponseWriter, req Request) {
+	q, _ := url.ParseQuery(req.Query)
+	result := []map[string]string{}
+	number := strings.TrimPrefix(q.Get("sysparm_query"), "number=")
+	for _, id := range s.incidents {
+		if id == number {
+			result = append(result, map[string]string{"sys_id": SysID(id)})
+			break
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"result": result})
+}
+
+// known reports whether a sys_id belongs to a raised incident
+func (s *SNOW) known(sysID string) bool {
+	for _, id := range s.incidents {
+		if SysID(id) == sysID {
+			return true
+		}
+	}
+	return false
+}
+
+// message answers a REST message, raising an incident the first time a JSD key is seen
+func (s *SNOW) message(w http.ResponseWriter, req Request) {
+
+	key := gjson.Get(req.Body, "external_identifier").String()
+	id := gjson.Get(req.Body, "internal_identifier").String()
+	if id == "" {
+		id = s.incidents[key]
+	}
+	if id == "" {
+		s.next++
+		id = fmt.Sprintf("INC%07d", s.next)
+	}
+	if key != "" {
+		s.incidents[key] = id
+	}
+
+	result := map[string]string{"internal_identifier": id}
+	if gjson.Get(req.Body, "payload.comments").String() != "" {
+		s.comments++
+		result["comment_sysid"] = fmt.Sprintf("snowc%v", s.comments)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"result": result})
+}
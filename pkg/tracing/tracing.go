@@ -0,0 +1,126 @@
+// Package tracing sets up OpenTelemetry so one webhook can be followed through the mapping store
+// and the calls made to SNOW and JSD, with W3C trace context passed on to both
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentation = "github.com/UKHomeOffice/snowsync"
+
+// Exporters spans can be sent to
+const (
+	OTLP   = "otlp"
+	Stdout = "stdout"
+	None   = "none"
+)
+
+// provider is kept so Lambda functions can flush before being frozen
+var provider *sdktrace.TracerProvider
+
+// Setup installs a tracer provider sending spans to exporter, otlp, stdout or none (the default when blank)
+// the OTLP exporter is configured by the standard OTEL_EXPORTER_OTLP_ variables, stdout spans are written to w
+// the returned function flushes and stops the provider
+func Setup(ctx context.Context, service, exporter string, w io.Writer) (func(context.Context) error, error) {
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exp sdktrace.SpanExporter
+	var err error
+
+	switch exporter {
+	case "", None:
+		return func(context.Context) error { return nil }, nil
+	case OTLP:
+		exp, err = otlptracehttp.New(ctx)
+	case Stdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(w))
+	default:
+		return nil, fmt.Errorf("invalid traces exporter: %v", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not create %v exporter: %w", exporter, err)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence over the default name
+	res, err := resource.Merge(
+		resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(service)),
+		resource.Environment(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not describe trace resource: %w", err)
+	}
+
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Flush exports finished spans, a Lambda function calls it before returning as it may be frozen afterwards
+func Flush(ctx context.Context) {
+	if provider != nil {
+		provider.ForceFlush(ctx)
+	}
+}
+
+// Start starts a span as a child of any span in ctx
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, opts...)
+}
+
+// End records a failure on a span, if there was one, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Extract continues a trace from the headers of an incoming webhook
+func Extract(ctx context.Context, headers map[string]string) context.Context {
+
+	// header names are matched without regard to case
+	c := make(propagation.MapCarrier, len(headers))
+	for k, v := range headers {
+		c[strings.ToLower(k)] = v
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, c)
+}
+
+// Inject adds the trace context in ctx to outgoing headers
+func Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+}
+
+// TraceID returns the id of the trace in ctx, blank when not tracing
+func TraceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+// Fail marks the span in ctx as failed without ending it, for failures reported in a response rather than returned
+func Fail(ctx context.Context, err error) {
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,103 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/UKHomeOffice/snowsync/pkg/store"
+)
+
+// Replay rejects webhooks that are too old or have been delivered before
+// place it after the signature or token check so only authentic nonces are remembered
+// nonces are kept in a store shared by every instance, so a replay is refused whichever instance it reaches
+type Replay struct {
+	// System names the sender, keeping its nonces apart from those of the other system
+	System string
+	// TimestampHeader holds the time the webhook was sent, as unix seconds, unix milliseconds or RFC 3339
+	TimestampHeader string
+	// NonceHeader holds an identifier unique to each webhook
+	NonceHeader string
+	// MaxAge is how far a timestamp may be from now, and how long a nonce is remembered at least
+	MaxAge time.Duration
+	// Nonces holds the nonces seen
+	Nonces store.MappingStore
+}
+
+// NewReplay creates a Replay guard, a blank header disables that check
+func NewReplay(system, timestampHeader, nonceHeader string, maxAge time.Duration, nonces store.MappingStore) *Replay {
+	return &Replay{
+		System:          system,
+		TimestampHeader: timestampHeader,
+		NonceHeader:     nonceHeader,
+		MaxAge:          maxAge,
+		Nonces:          nonces,
+	}
+}
+
+// Verify checks the timestamp and records the nonce
+// the nonce is held until it expires, unless the delivery fails and is released so the sender can deliver it again
+func (r *Replay) Verify(ctx context.Context, req *events.APIGatewayProxyRequest) error {
+
+	now := time.Now()
+
+	if r.TimestampHeader != "" {
+		ts, ok := parseTimestamp(header(req, r.TimestampHeader))
+		if !ok {
+			return fail("missing or malformed timestamp")
+		}
+		if now.Sub(ts) > r.MaxAge || ts.Sub(now) > r.MaxAge {
+			return fail("timestamp outside allowed window")
+		}
+	}
+
+	if r.NonceHeader == "" {
+		return nil
+	}
+	nonce := header(req, r.NonceHeader)
+	if nonce == "" {
+		return fail("missing nonce")
+	}
+
+	// the window is doubled so a nonce outlives any timestamp it could be sent with
+	fresh, err := store.UseNonce(ctx, r.Nonces, r.System, nonce, now.Add(2*r.MaxAge))
+	if err != nil {
+		return fmt.Errorf("could not record nonce: %w", err)
+	}
+	if !fresh {
+		return fail("nonce already used")
+	}
+	return nil
+}
+
+func parseTimestamp(v string) (time.Time, bool) {
+	if v == "" {
+		return time.Time{}, false
+	}
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		// values this large can only be milliseconds
+		if n > 1e12 {
+			return time.Unix(0, n*int64(time.Millisecond)), true
+		}
+		return time.Unix(n, 0), true
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// Release forgets the nonce of a delivery that failed, so the sender's retry of it is accepted
+func (r *Replay) Release(ctx context.Context, req *events.APIGatewayProxyRequest) error {
+	if r.NonceHeader == "" {
+		return nil
+	}
+	nonce := header(req, r.NonceHeader)
+	if nonce == "" {
+		return nil
+	}
+	return store.ReleaseNonce(ctx, r.Nonces, r.System, nonce)
+}
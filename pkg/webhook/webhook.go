@@ -0,0 +1,201 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// ErrUnauthenticated is wrapped by every verification failure
+var ErrUnauthenticated = errors.New("unauthenticated webhook")
+
+// Verifier checks that a webhook came from the expected sender
+// failures to authenticate wrap ErrUnauthenticated, other errors are failures to check
+type Verifier interface {
+	Verify(ctx context.Context, req *events.APIGatewayProxyRequest) error
+}
+
+// Releaser is a Verifier that holds on to something for each webhook it passes, such as a nonce, which must be
+// given up when the webhook then fails
+type Releaser interface {
+	Release(ctx context.Context, req *events.APIGatewayProxyRequest) error
+}
+
+// Release gives up what v holds for a webhook that failed after passing it
+func Release(ctx context.Context, v Verifier, req *events.APIGatewayProxyRequest) error {
+	if r, ok := v.(Releaser); ok {
+		return r.Release(ctx, req)
+	}
+	return nil
+}
+
+func fail(reason string) error {
+	return fmt.Errorf("%w: %v", ErrUnauthenticated, reason)
+}
+
+// header looks up a header case-insensitively, API Gateway may pass them on lower-cased
+func header(req *events.APIGatewayProxyRequest, name string) string {
+	if v, ok := req.Headers[name]; ok {
+		return v
+	}
+	for k, v := range req.Headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	for k, v := range req.MultiValueHeaders {
+		if strings.EqualFold(k, name) && len(v) != 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+// HMAC verifies a HMAC-SHA256 signature, as sent by JSD webhooks configured with a secret
+// by default the signature covers the body alone, as Atlassian signs it; with a timestamp or nonce header it covers
+// the timestamp, the nonce and the body joined by dots, so neither header can be swapped for that of another delivery
+// the signature header holds the hex digest, optionally prefixed with sha256=
+type HMAC struct {
+	Secret []byte
+	Header string
+	// TimestampHeader and NonceHeader name the headers signed along with the body, both blank sign the body alone
+	TimestampHeader string
+	NonceHeader     string
+}
+
+// Signed returns the string a webhook signature covers when the timestamp and nonce are signed
+func Signed(timestamp, nonce string, body []byte) []byte {
+	return []byte(timestamp + "." + nonce + "." + string(body))
+}
+
+// Verify compares the signature in constant time
+func (h *HMAC) Verify(_ context.Context, req *events.APIGatewayProxyRequest) error {
+
+	var ts, nonce string
+	if h.TimestampHeader != "" {
+		ts = header(req, h.TimestampHeader)
+		if ts == "" {
+			return fail("missing timestamp")
+		}
+	}
+	if h.NonceHeader != "" {
+		nonce = header(req, h.NonceHeader)
+		if nonce == "" {
+			return fail("missing nonce")
+		}
+	}
+
+	sig := header(req, h.Header)
+	if sig == "" {
+		return fail("missing signature")
+	}
+	sig = strings.TrimPrefix(sig, "sha256=")
+
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return fail("malformed signature")
+	}
+
+	body := []byte(req.Body)
+	if req.IsBase64Encoded {
+		body, err = base64.StdEncoding.DecodeString(req.Body)
+		if err != nil {
+			return fail("malformed body")
+		}
+	}
+
+	if h.TimestampHeader != "" || h.NonceHeader != "" {
+		body = Signed(ts, nonce, body)
+	}
+	mac := hmac.New(sha256.New, h.Secret)
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return fail("signature mismatch")
+	}
+	return nil
+}
+
+// Token verifies a shared secret sent in a header
+type Token struct {
+	Header string
+	Token  string
+}
+
+// Verify compares the token in constant time
+func (t *Token) Verify(_ context.Context, req *events.APIGatewayProxyRequest) error {
+
+	got := header(req, t.Header)
+	if got == "" {
+		return fail("missing token")
+	}
+	if subtle.ConstantTimeCompare([]byte(got), []byte(t.Token)) != 1 {
+		return fail("token mismatch")
+	}
+	return nil
+}
+
+// Basic verifies HTTP basic authentication credentials
+type Basic struct {
+	User string
+	Pass string
+}
+
+// Verify compares both credentials in constant time
+func (b *Basic) Verify(_ context.Context, req *events.APIGatewayProxyRequest) error {
+
+	auth := header(req, "Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return fail("missing basic credentials")
+	}
+
+	dec, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+	if err != nil {
+		return fail("malformed basic credentials")
+	}
+	creds := strings.SplitN(string(dec), ":", 2)
+	if len(creds) != 2 {
+		return fail("malformed basic credentials")
+	}
+	user, pass := creds[0], creds[1]
+
+	// evaluate both comparisons so timing does not reveal which one failed
+	u := subtle.ConstantTimeCompare([]byte(user), []byte(b.User))
+	p := subtle.ConstantTimeCompare([]byte(pass), []byte(b.Pass))
+	if u&p != 1 {
+		return fail("credentials mismatch")
+	}
+	return nil
+}
+
+// All passes only if every verifier passes, in order
+type All []Verifier
+
+// Verify runs each verifier
+func (a All) Verify(ctx context.Context, req *events.APIGatewayProxyRequest) error {
+	for _, v := range a {
+		err := v.Verify(ctx, req)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Release gives up what each verifier holds, in order
+func (a All) Release(ctx context.Context, req *events.APIGatewayProxyRequest) error {
+	for _, v := range a {
+		err := Release(ctx, v, req)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/UKHomeOffice/snowsync/pkg/store"
+)
+
+const body = `{"issue":{"key":"ACP-1"}}`
+
+// sign returns the signature of a delivery signed along with its timestamp and nonce
+func sign(secret, ts, nonce, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(Signed(ts, nonce, []byte(body)))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newHMAC() *HMAC {
+	return &HMAC{Secret: []byte("s3cret"), Header: "X-Hub-Signature", TimestampHeader: "X-Timestamp", NonceHeader: "X-Nonce"}
+}
+
+// signed returns a delivery signed with the secret of newHMAC
+func signed(ts, nonce string) *events.APIGatewayProxyRequest {
+	return &events.APIGatewayProxyRequest{
+		Body: body,
+		Headers: map[string]string{
+			"x-hub-signature": sign("s3cret", ts, nonce, body),
+			"X-Timestamp":     ts,
+			"X-Nonce":         nonce,
+		},
+	}
+}
+
+func assertUnauthenticated(t *testing.T, name string, err error) {
+	t.Helper()
+	if !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("%v: got %v, want an unauthenticated error", name, err)
+	}
+}
+
+func TestHMAC(t *testing.T) {
+
+	ctx := context.Background()
+	h := newHMAC()
+
+	err := h.Verify(ctx, signed("1700000000", "n1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a signature without the sha256= prefix is accepted too
+	req := signed("1700000000", "n1")
+	req.Headers["x-hub-signature"] = req.Headers["x-hub-signature"][len("sha256="):]
+	if err := h.Verify(ctx, req); err != nil {
+		t.Errorf("unprefixed signature: %v", err)
+	}
+
+	req = signed("1700000000", "n1")
+	req.Body = base64.StdEncoding.EncodeToString([]byte(body))
+	req.IsBase64Encoded = true
+	if err := h.Verify(ctx, req); err != nil {
+		t.Errorf("encoded body: %v", err)
+	}
+
+	// the timestamp and nonce are signed, so neither can be changed to pass another check
+	req = signed("1700000000", "n1")
+	req.Headers["X-Timestamp"] = "1700000300"
+	assertUnauthenticated(t, "changed timestamp", h.Verify(ctx, req))
+	req = signed("1700000000", "n1")
+	req.Headers["X-Nonce"] = "n2"
+	assertUnauthenticated(t, "changed nonce", h.Verify(ctx, req))
+	req = signed("1700000000", "n1")
+	req.Body = `{"issue":{"key":"ACP-2"}}`
+	assertUnauthenticated(t, "changed body", h.Verify(ctx, req))
+
+	for name, change := range map[string]func(*events.APIGatewayProxyRequest){
+		"missing signature":   func(r *events.APIGatewayProxyRequest) { delete(r.Headers, "x-hub-signature") },
+		"malformed signature": func(r *events.APIGatewayProxyRequest) { r.Headers["x-hub-signature"] = "sha256=zz" },
+		"missing timestamp":   func(r *events.APIGatewayProxyRequest) { delete(r.Headers, "X-Timestamp") },
+		"missing nonce":       func(r *events.APIGatewayProxyRequest) { delete(r.Headers, "X-Nonce") },
+		"wrong secret": func(r *events.APIGatewayProxyRequest) {
+			r.Headers["x-hub-signature"] = sign("guess", "1700000000", "n1", body)
+		},
+	} {
+		req := signed("1700000000", "n1")
+		change(req)
+		assertUnauthenticated(t, name, h.Verify(ctx, req))
+	}
+}
+
+func TestHMACBody(t *testing.T) {
+
+	ctx := context.Background()
+	h := &HMAC{Secret: []byte("s3cret"), Header: "X-Hub-Signature"}
+
+	// a delivery as Jira Cloud sends it, the digest computed with openssl dgst -sha256 -hmac
+	jira := func() *events.APIGatewayProxyRequest {
+		return &events.APIGatewayProxyRequest{
+			Body: `{"timestamp":1700000000000,"webhookEvent":"jira:issue_updated","issue":{"key":"ACP-1"}}`,
+			Headers: map[string]string{
+				"X-Hub-Signature":                "sha256=01b403545676779c2c8dd0373fa4627c4be1b20cc5be13b07a3caf41fe04382d",
+				"X-Atlassian-Webhook-Identifier": "a1b2c3",
+			},
+		}
+	}
+	if err := h.Verify(ctx, jira()); err != nil {
+		t.Fatal(err)
+	}
+	// the WebSub example signature, which Atlassian follows
+	websub := &HMAC{Secret: []byte("It's a Secret to Everybody"), Header: "X-Hub-Signature"}
+	err := websub.Verify(ctx, &events.APIGatewayProxyRequest{
+		Body:    "Hello, World!",
+		Headers: map[string]string{"X-Hub-Signature": "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"},
+	})
+	if err != nil {
+		t.Errorf("example signature: %v", err)
+	}
+
+	req := jira()
+	req.Body = strings.Replace(req.Body, "ACP-1", "ACP-2", 1)
+	assertUnauthenticated(t, "changed body", h.Verify(ctx, req))
+	// a signature over the dotted form is not accepted for the body alone
+	req = jira()
+	req.Headers["X-Hub-Signature"] = sign("s3cret", "", "", req.Body)
+	assertUnauthenticated(t, "dotted signature", h.Verify(ctx, req))
+}
+
+func TestToken(t *testing.T) {
+
+	ctx := context.Background()
+	v := &Token{Header: "X-Snowsync-Token", Token: "t0ken"}
+
+	req := &events.APIGatewayProxyRequest{MultiValueHeaders: map[string][]string{"x-snowsync-token": {"t0ken"}}}
+	if err := v.Verify(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	assertUnauthenticated(t, "wrong token", v.Verify(ctx, &events.APIGatewayProxyRequest{Headers: map[string]string{"X-Snowsync-Token": "t0ke"}}))
+	assertUnauthenticated(t, "missing token", v.Verify(ctx, &events.APIGatewayProxyRequest{}))
+}
+
+func TestBasic(t *testing.T) {
+
+	ctx := context.Background()
+	v := &Basic{User: "snow", Pass: "p:ss"}
+	basic := func(creds string) *events.APIGatewayProxyRequest {
+		return &events.APIGatewayProxyRequest{Headers: map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(creds))}}
+	}
+
+	// the password may itself hold a colon
+	if err := v.Verify(ctx, basic("snow:p:ss")); err != nil {
+		t.Fatal(err)
+	}
+	assertUnauthenticated(t, "wrong password", v.Verify(ctx, basic("snow:pass")))
+	assertUnauthenticated(t, "wrong user", v.Verify(ctx, basic("jsd:p:ss")))
+	assertUnauthenticated(t, "no colon", v.Verify(ctx, basic("snow")))
+	assertUnauthenticated(t, "bearer", v.Verify(ctx, &events.APIGatewayProxyRequest{Headers: map[string]string{"Authorization": "Bearer x"}}))
+	assertUnauthenticated(t, "malformed", v.Verify(ctx, &events.APIGatewayProxyRequest{Headers: map[string]string{"Authorization": "Basic %%%"}}))
+}
+
+func TestReplayWindow(t *testing.T) {
+
+	ctx := context.Background()
+	r := NewReplay("jsd", "X-Timestamp", "", 5*time.Minute, store.NewMemory())
+	at := func(v string) *events.APIGatewayProxyRequest {
+		return &events.APIGatewayProxyRequest{Headers: map[string]string{"X-Timestamp": v}}
+	}
+	now := time.Now()
+
+	for name, ts := range map[string]string{
+		"seconds":      strconv.FormatInt(now.Unix(), 10),
+		"milliseconds": strconv.FormatInt(now.UnixMilli(), 10),
+		"RFC 3339":     now.UTC().Format(time.RFC3339),
+		"a little old": strconv.FormatInt(now.Add(-4*time.Minute).Unix(), 10),
+	} {
+		if err := r.Verify(ctx, at(ts)); err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+	}
+	for name, ts := range map[string]string{
+		"too old":   strconv.FormatInt(now.Add(-6*time.Minute).Unix(), 10),
+		"in future": strconv.FormatInt(now.Add(6*time.Minute).Unix(), 10),
+		"malformed": "yesterday",
+		"missing":   "",
+	} {
+		assertUnauthenticated(t, name, r.Verify(ctx, at(ts)))
+	}
+}
+
+func TestReplayNonce(t *testing.T) {
+
+	ctx := context.Background()
+	nonces := store.NewMemory()
+	with := func(nonce string) *events.APIGatewayProxyRequest {
+		return &events.APIGatewayProxyRequest{Headers: map[string]string{"X-Nonce": nonce}}
+	}
+
+	// two instances sharing a store both refuse a delivery the other has seen
+	a := NewReplay("jsd", "", "X-Nonce", time.Minute, nonces)
+	b := NewReplay("jsd", "", "X-Nonce", time.Minute, nonces)
+	if err := a.Verify(ctx, with("n1")); err != nil {
+		t.Fatal(err)
+	}
+	assertUnauthenticated(t, "replay to the same instance", a.Verify(ctx, with("n1")))
+	assertUnauthenticated(t, "replay to another instance", b.Verify(ctx, with("n1")))
+	if err := b.Verify(ctx, with("n2")); err != nil {
+		t.Errorf("fresh nonce: %v", err)
+	}
+	assertUnauthenticated(t, "missing nonce", a.Verify(ctx, with("")))
+
+	// the nonces of the other system are kept apart
+	snow := NewReplay("snow", "", "X-Nonce", time.Minute, nonces)
+	if err := snow.Verify(ctx, with("n1")); err != nil {
+		t.Errorf("nonce of the other system: %v", err)
+	}
+}
+
+// failing is a store that cannot be written
+type failing struct{ store.MappingStore }
+
+func (failing) Put(context.Context, string, string, interface{}, ...store.PutOption) error {
+	return errors.New("table unavailable")
+}
+
+func TestReplayRelease(t *testing.T) {
+
+	ctx := context.Background()
+	r := NewReplay("jsd", "", "X-Nonce", time.Minute, store.NewMemory())
+	req := &events.APIGatewayProxyRequest{Headers: map[string]string{"X-Nonce": "n1"}}
+
+	if err := r.Verify(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	// the sender delivers a failed webhook again with the same id
+	if err := Release(ctx, All{&Token{}, r}, req); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Verify(ctx, req); err != nil {
+		t.Errorf("redelivery after release: %v", err)
+	}
+	assertUnauthenticated(t, "replay after success", r.Verify(ctx, req))
+}
+
+func TestReplayStoreFailure(t *testing.T) {
+
+	r := NewReplay("jsd", "", "X-Nonce", time.Minute, failing{})
+	err := r.Verify(context.Background(), &events.APIGatewayProxyRequest{Headers: map[string]string{"X-Nonce": "n1"}})
+	if err == nil || errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("got %v, want a store error", err)
+	}
+}
+
+func TestAll(t *testing.T) {
+
+	ctx := context.Background()
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	v := All{newHMAC(), NewReplay("jsd", "X-Timestamp", "X-Nonce", time.Minute, store.NewMemory())}
+
+	// a forged delivery is refused before its nonce is remembered
+	forged := signed(ts, "n1")
+	forged.Headers["x-hub-signature"] = sign("guess", ts, "n1", body)
+	assertUnauthenticated(t, "forged", v.Verify(ctx, forged))
+
+	if err := v.Verify(ctx, signed(ts, "n1")); err != nil {
+		t.Fatal(err)
+	}
+	assertUnauthenticated(t, "replayed", v.Verify(ctx, signed(ts, "n1")))
+}